@@ -485,8 +485,11 @@ func (n *Node) extractMeta() (*nodeMeta, error) {
 }
 
 // Ready sets the Node status in the metadata and broadcasts a change
-// notification to the cluster.
+// notification to the cluster. It locks the cluster, because
+// readyNodes() reads the metadata (under the lock) as it is updated.
 func (c *Cluster) Ready(status bool) error {
+	c.Lock()
+	defer c.Unlock()
 	md, err := c.extractMeta()
 	if err != nil {
 		return err
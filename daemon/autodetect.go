@@ -0,0 +1,127 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/tgres/tgres/graceful"
+	"github.com/tgres/tgres/transceiver"
+	"net"
+	"os"
+	"time"
+)
+
+// graphiteAutoServiceManager accepts both graphite text and pickle
+// connections on the same port (graphite-auto-listen-spec), e.g. to
+// simplify firewall rules. Which one a connection is is told from its
+// first byte, see isPickleFirstByte().
+type graphiteAutoServiceManager struct {
+	streamListeners
+	t *transceiver.Transceiver
+}
+
+func (g *graphiteAutoServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	var err error
+
+	if cfg.GraphiteAutoListenSpec != "" {
+		err = g.listen("graphiteAutoServiceManager", files, cfg.GraphiteAutoListenSpec)
+	} else {
+		logFields{"proto": "graphite-auto"}.Printf("Not starting Graphite auto-detecting protocol because graphite-auto-listen-spec is blank")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error starting Graphite auto-detecting Protocol serviceManager: %v", err)
+	}
+
+	fmt.Println("Graphite text and pickle protocol Listening on " + displayListenSpecs(cfg.GraphiteAutoListenSpec))
+
+	for _, l := range g.listeners {
+		go g.graphiteAutoServer(l)
+	}
+
+	return nil
+}
+
+func (g *graphiteAutoServiceManager) graphiteAutoServer(listener *graceful.Listener) error {
+
+	for {
+		conn, err := acceptRetrying("graphiteAutoServer()", "graphite-auto", listener)
+		if err != nil {
+			return err
+		}
+
+		if !g.admit("graphiteAutoServer()", conn) {
+			continue
+		}
+		logConnAccepted("graphiteAutoServer()", conn)
+		go func() {
+			defer g.release()
+			handleGraphiteAutoProtocol(g.t, conn)
+		}()
+	}
+}
+
+// The first bytes of a pickle connection by default: a zero (the
+// first byte of a 4-byte length header, see graphite-pickle-framing),
+// 0x80 (the PROTO opcode with which pickle protocol 2 and up begins),
+// '(' or ']' (how protocol 0 and 1 lists begin) or 0x1f (gzip, see
+// graphite-pickle-allow-gzip). A graphite text line begins with the
+// metric name, i.e. none of these.
+var dftAutoPickleBytes = []int{0x00, 0x80, '(', ']', 0x1f}
+
+// isPickleFirstByte is whether a connection beginning with b is a
+// pickle one, as per graphite-auto-pickle-bytes.
+func isPickleFirstByte(b byte) bool {
+	for _, pb := range currentCfg().GraphiteAutoPickleBytes {
+		if int(b) == pb {
+			return true
+		}
+	}
+	return false
+}
+
+// peekedConn is a conn with a buffered reader, so that peeking at its
+// first bytes consumes nothing the protocol handler reads.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// handleGraphiteAutoProtocol waits (for up to graphite-text-timeout)
+// for the first byte of conn, and hands it to the pickle or the text
+// protocol accordingly.
+func handleGraphiteAutoProtocol(t *transceiver.Transceiver, conn net.Conn) {
+	cfg := currentCfg()
+	if cfg.GraphiteTextTimeout != 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(cfg.GraphiteTextTimeout) * time.Second))
+	}
+	pc := &peekedConn{Conn: conn, r: bufio.NewReader(conn)}
+	first, err := pc.r.Peek(1)
+	if err != nil {
+		conn.Close() // decrements graceful.TcpWg
+		return
+	}
+	if isPickleFirstByte(first[0]) {
+		handleGraphitePickleProtocol(t, pc, cfg.GraphitePickleTimeout)
+	} else {
+		handleGraphiteTextProtocol(t, pc, cfg.GraphiteTextTimeout)
+	}
+}
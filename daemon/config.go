@@ -16,40 +16,180 @@
 package daemon
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	h "github.com/tgres/tgres/http"
 	"github.com/tgres/tgres/misc"
 	"github.com/tgres/tgres/rrd"
+	x "github.com/tgres/tgres/transceiver"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-var Cfg *Config
+// Cfg is the config, which a reload() replaces (but never modifies).
+// Only Init() and the signal handling, which does the reload(), read
+// it directly, everything else (handlers and such) with currentCfg().
+var (
+	Cfg   *Config
+	cfgLk sync.RWMutex
+)
+
+func currentCfg() *Config {
+	cfgLk.RLock()
+	defer cfgLk.RUnlock()
+	return Cfg
+}
 
 type Config struct {
-	PidPath                  string   `toml:"pid-file"`
-	LogPath                  string   `toml:"log-file"`
-	LogCycle                 duration `toml:"log-cycle-interval"`
-	DbConnectString          string   `toml:"db-connect-string"`
-	MaxCachedPoints          int      `toml:"max-cached-points"`
-	MaxCache                 duration `toml:"max-cache-duration"`
-	MinCache                 duration `toml:"min-cache-duration"`
-	GraphiteTextListenSpec   string   `toml:"graphite-text-listen-spec"`
-	GraphiteUdpListenSpec    string   `toml:"graphite-udp-listen-spec"`
-	GraphitePickleListenSpec string   `toml:"graphite-pickle-listen-spec"`
-	StatsdTextListenSpec     string   `toml:"statsd-text-listen-spec"`
-	StatsdUdpListenSpec      string   `toml:"statsd-udp-listen-spec"`
-	HttpListenSpec           string   `toml:"http-listen-spec"`
-	Workers                  int
-	DSs                      []DSSpec `toml:"ds"`
-	StatFlush                duration `toml:"stat-flush-interval"`
-	StatsNamePrefix          string   `toml:"stats-name-prefix"`
+	PidPath                     string                     `toml:"pid-file"`
+	LogPath                     string                     `toml:"log-file"`
+	LogCycle                    duration                   `toml:"log-cycle-interval"`
+	LogFormat                   logFormat                  `toml:"log-format"`
+	LogLevel                    logLevel                   `toml:"log-level"`
+	DbConnectString             string                     `toml:"db-connect-string"`
+	DbDriver                    string                     `toml:"db-driver"`
+	DbDSN                       string                     `toml:"db-dsn"`
+	DbMaxOpenConns              int                        `toml:"db-max-open-conns"`
+	DbMaxIdleConns              int                        `toml:"db-max-idle-conns"`
+	DbConnMaxLifetime           duration                   `toml:"db-conn-max-lifetime"`
+	DbConnectRetries            int                        `toml:"db-connect-retries"`
+	DbConnectTimeout            duration                   `toml:"db-connect-timeout"`
+	MaxCachedPoints             int                        `toml:"max-cached-points"`
+	MaxCache                    duration                   `toml:"max-cache-duration"`
+	MinCache                    duration                   `toml:"min-cache-duration"`
+	GraphiteTextListenSpec      string                     `toml:"graphite-text-listen-spec"`
+	GraphiteTextUnixListenSpec  string                     `toml:"graphite-text-unix-listen-spec"`
+	UnixSocketMode              fileMode                   `toml:"unix-socket-mode"`
+	GraphiteUdpListenSpec       string                     `toml:"graphite-udp-listen-spec"`
+	GraphitePickleListenSpec    string                     `toml:"graphite-pickle-listen-spec"`
+	GraphiteTextProxyProtocol   bool                       `toml:"graphite-text-proxy-protocol"`
+	GraphitePickleProxyProtocol bool                       `toml:"graphite-pickle-proxy-protocol"`
+	GraphiteTextTimeout         int                        `toml:"graphite-text-timeout"`
+	GraphitePickleTimeout       int                        `toml:"graphite-pickle-timeout"`
+	GraphitePickleAllowGzip     bool                       `toml:"graphite-pickle-allow-gzip"`
+	GraphitePickleFraming       pickleFraming              `toml:"graphite-pickle-framing"`
+	GraphiteAllowTimestampless  bool                       `toml:"graphite-allow-timestampless"`
+	DefaultTimestampToNow       bool                       `toml:"default-timestamp-to-now"`
+	GraphiteTextStrict          bool                       `toml:"graphite-text-strict"`
+	GraphiteTextTLSListenSpec   string                     `toml:"graphite-text-tls-listen-spec"`
+	GraphitePickleTLSListenSpec string                     `toml:"graphite-pickle-tls-listen-spec"`
+	GraphiteAutoListenSpec      string                     `toml:"graphite-auto-listen-spec"`
+	GraphiteAutoPickleBytes     []int                      `toml:"graphite-auto-pickle-bytes"`
+	TLSCertFile                 string                     `toml:"tls-cert-file"`
+	TLSMinVersion               tlsVersion                 `toml:"tls-min-version"`
+	TLSKeyFile                  string                     `toml:"tls-key-file"`
+	GraphiteTlsSniPrefixes      map[string]string          `toml:"graphite-tls-sni-prefixes"`
+	GraphiteTlsDefaultPrefix    string                     `toml:"graphite-tls-default-prefix"`
+	StatsdTextListenSpec        string                     `toml:"statsd-text-listen-spec"`
+	StatsdUdpListenSpec         string                     `toml:"statsd-udp-listen-spec"`
+	InfluxLineListenSpec        string                     `toml:"influx-line-listen-spec"`
+	OpenTSDBListenSpec          string                     `toml:"opentsdb-listen-spec"`
+	ProtobufListenSpec          string                     `toml:"protobuf-listen-spec"`
+	InfluxLineTimeout           int                        `toml:"influx-line-timeout"`
+	OpenTSDBTimeout             int                        `toml:"opentsdb-timeout"`
+	ProtobufTimeout             int                        `toml:"protobuf-timeout"`
+	MsgpackListenSpec           string                     `toml:"msgpack-listen-spec"`
+	HttpListenSpec              string                     `toml:"http-listen-spec"`
+	MonitoringListenSpec        string                     `toml:"monitoring-listen-spec"`
+	GraphiteTextEnabled         *bool                      `toml:"graphite-text-enabled"` // see serviceDisabled
+	GraphiteTextTLSEnabled      *bool                      `toml:"graphite-text-tls-enabled"`
+	GraphiteTextUnixEnabled     *bool                      `toml:"graphite-text-unix-enabled"`
+	GraphiteUdpEnabled          *bool                      `toml:"graphite-udp-enabled"`
+	GraphitePickleEnabled       *bool                      `toml:"graphite-pickle-enabled"`
+	GraphitePickleTLSEnabled    *bool                      `toml:"graphite-pickle-tls-enabled"`
+	GraphiteAutoEnabled         *bool                      `toml:"graphite-auto-enabled"`
+	StatsdUdpEnabled            *bool                      `toml:"statsd-udp-enabled"`
+	InfluxLineEnabled           *bool                      `toml:"influx-line-enabled"`
+	OpenTSDBEnabled             *bool                      `toml:"opentsdb-enabled"`
+	ProtobufEnabled             *bool                      `toml:"protobuf-enabled"`
+	MsgpackEnabled              *bool                      `toml:"msgpack-enabled"`
+	MaxConcurrentConnections    int                        `toml:"max-concurrent-connections"`
+	AcceptBackoffInitial        duration                   `toml:"accept-backoff-initial"`
+	AcceptBackoffMax            duration                   `toml:"accept-backoff-max"`
+	QueueHighWaterMark          float64                    `toml:"queue-high-water-mark"`
+	QueueFullPolicy             map[string]queueFullPolicy `toml:"queue-full-policy"`
+	RateLimitPerIP              float64                    `toml:"rate-limit-per-ip"`
+	RateLimitExempt             []string                   `toml:"rate-limit-exempt"`
+	RateLimitExemptNets         []*net.IPNet               `toml:"-"` // from RateLimitExempt
+	ClusterPeers                []string                   `toml:"cluster-peers"`
+	ClusterSelf                 string                     `toml:"cluster-self"`
+	ClusterPeerIPs              map[string]bool            `toml:"-"` // from ClusterPeers
+	Workers                     int
+	DSs                         []DSSpec               `toml:"ds"`
+	StorageSchemasFile          string                 `toml:"storage-schemas-file"`
+	StorageSchemas              []DSSpec               `toml:"-"` // from StorageSchemasFile
+	StorageAggregationFile      string                 `toml:"storage-aggregation-file"`
+	StorageAggregations         []storageAggregation   `toml:"-"` // from StorageAggregationFile
+	CatchAllDataSourceSpec      *DSSpec                `toml:"catch-all-ds"`
+	StatFlush                   duration               `toml:"stat-flush-interval"`
+	StatsNamePrefix             string                 `toml:"stats-name-prefix"`
+	InternalStatsEnabled        bool                   `toml:"internal-stats-enabled"`
+	InternalStatsInterval       duration               `toml:"internal-stats-interval"`
+	InternalStatsPrefix         string                 `toml:"internal-stats-prefix"`
+	ShutdownDrainTimeout        duration               `toml:"shutdown-drain-timeout"`
+	ConnectionLogLevel          connLogLevel           `toml:"connection-log-level"`
+	BackfillMode                bool                   `toml:"backfill-mode"`
+	MaxSeries                   int                    `toml:"max-series"`
+	MaxSeriesNameLength         int                    `toml:"max-series-name-length"`
+	TimestampSource             x.TimestampSource      `toml:"timestamp-source"`
+	EmptyRenderPolicy           h.EmptyRenderPolicy    `toml:"empty-render-policy"`
+	RenderMaxSeries             int                    `toml:"render-max-series"`
+	QueryTimeout                duration               `toml:"query-timeout"`
+	HttpCorsAllowOrigin         string                 `toml:"http-cors-allow-origin"`
+	HttpGzipMinSize             int                    `toml:"http-gzip-min-size"`
+	HttpBasicAuthUser           string                 `toml:"http-basic-auth-user"`
+	HttpBasicAuthPassword       string                 `toml:"http-basic-auth-password"`
+	HttpBasicAuthFile           string                 `toml:"http-basic-auth-file"`
+	HttpBasicAuthExempt         []string               `toml:"http-basic-auth-exempt"`
+	HttpBasicAuthUsers          h.BasicAuthUsers       `toml:"-"` // from the above
+	DeleteEnabled               bool                   `toml:"delete-enabled"`
+	RenameExisting              x.RenameExisting       `toml:"rename-existing"`
+	PprofEnabled                bool                   `toml:"pprof-enabled"`
+	FindCacheTTL                duration               `toml:"find-cache-ttl"`
+	SourceIdleExpiry            duration               `toml:"source-idle-expiry"`
+	StdinIngest                 bool                   `toml:"stdin-ingest"`
+	FileTailFiles               []string               `toml:"file-tail-files"`
+	FileTailFromStart           bool                   `toml:"file-tail-from-start"`
+	FileTailStateFile           string                 `toml:"file-tail-state-file"`
+	IngestMaxBodySize           int64                  `toml:"ingest-max-body-size"`
+	DerivedMetricsFile          string                 `toml:"derived-metrics-file"`
+	DerivedMetrics              []*x.DerivedMetric     `toml:"-"` // from DerivedMetricsFile
+	FlushPriorityRulesFile      string                 `toml:"flush-priority-rules-file"`
+	FlushPriorityRules          []*x.FlushPriorityRule `toml:"-"` // from FlushPriorityRulesFile
+	AggregationRulesFile        string                 `toml:"aggregation-rules-file"`
+	AggregationRules            []*x.AggregationRule   `toml:"-"` // from AggregationRulesFile
+	NameRewriteScript           string                 `toml:"name-rewrite-script"`
+	NameRewriter                *x.NameRewriter        `toml:"-"` // from NameRewriteScript
+	SeriesAliasRules            []*x.SeriesAliasRule   `toml:"series-alias-rules"`
+	NameReplaceRules            []*x.NameReplaceRule   `toml:"name-replace-rules"`
+	SanitizeNames               bool                   `toml:"sanitize-names"`
+	AllowNames                  []*x.NamePattern       `toml:"allow-names"`
+	DenyNames                   []*x.NamePattern       `toml:"deny-names"`
+	FlushMaxRetries             int                    `toml:"flush-max-retries"`
+	FlushRetryDelay             duration               `toml:"flush-retry-delay"`
+	FlushBatchSize              int                    `toml:"flush-batch-size"`
+	FlushBatchInterval          duration               `toml:"flush-batch-interval"`
+	FlushInterval               duration               `toml:"flush-interval"`
+	DeadLetterSize              int                    `toml:"dead-letter-size"`
+	SpoolDir                    string                 `toml:"spool-dir"`
+	SpoolMaxSize                int64                  `toml:"spool-max-size"`
+	PreAggWindow                duration               `toml:"pre-agg-window"`
+	SecondaryStoreSpec          string                 `toml:"secondary-store-spec"`
+	SecondaryStoreRetention     duration               `toml:"secondary-store-retention"`
+	MaxRrasPerDs                int                    `toml:"max-rras-per-ds"`
+	DropNonFinite               bool                   `toml:"drop-non-finite"`
+	DedupeSameTimestamp         bool                   `toml:"dedupe-same-timestamp"`
+	MaxFutureSkew               duration               `toml:"max-future-skew"`
 }
 
 type regex struct{ *regexp.Regexp }
@@ -59,6 +199,37 @@ func (r *regex) UnmarshalText(text []byte) (err error) {
 	return err
 }
 
+// A TLS protocol version, e.g. "1.2".
+type tlsVersion uint16
+
+func (v *tlsVersion) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "1.0":
+		*v = tls.VersionTLS10
+	case "1.1":
+		*v = tls.VersionTLS11
+	case "", "1.2":
+		*v = tls.VersionTLS12
+	case "1.3":
+		*v = tls.VersionTLS13
+	default:
+		return fmt.Errorf("invalid TLS version %q, must be one of 1.0, 1.1, 1.2 or 1.3", string(text))
+	}
+	return nil
+}
+
+// File permissions in octal, e.g. "0660".
+type fileMode os.FileMode
+
+func (m *fileMode) UnmarshalText(text []byte) error {
+	n, err := strconv.ParseUint(string(text), 8, 32)
+	if err != nil || n > 0777 {
+		return fmt.Errorf("invalid file mode %q, must be octal, e.g. 0660", string(text))
+	}
+	*m = fileMode(n)
+	return nil
+}
+
 type duration struct{ time.Duration }
 
 func (d *duration) UnmarshalText(text []byte) (err error) {
@@ -66,12 +237,142 @@ func (d *duration) UnmarshalText(text []byte) (err error) {
 	return err
 }
 
+// Verbosity of per-connection logging: "none" (default), "close"
+// (one line when a connection is closed) or "all" (accept and close).
+type connLogLevel int
+
+const (
+	connLogNone connLogLevel = iota
+	connLogClose
+	connLogAll
+)
+
+func (l *connLogLevel) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "", "none":
+		*l = connLogNone
+	case "close":
+		*l = connLogClose
+	case "all":
+		*l = connLogAll
+	default:
+		return fmt.Errorf("invalid connection-log-level %q, must be one of none, close or all", string(text))
+	}
+	return nil
+}
+
+// What is logged of bad lines, pickles etc. (see log-level): each
+// one at debug, a summary by address at info and warn, nothing at
+// error. The zero value is info, the default.
+type logLevel int
+
+const (
+	logLevelInfo logLevel = iota
+	logLevelDebug
+	logLevelWarn
+	logLevelError
+)
+
+func (l *logLevel) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "debug":
+		*l = logLevelDebug
+	case "info":
+		*l = logLevelInfo
+	case "warn":
+		*l = logLevelWarn
+	case "error":
+		*l = logLevelError
+	default:
+		return fmt.Errorf("invalid log-level %q, must be one of debug, info, warn or error", string(text))
+	}
+	return nil
+}
+
+// How the log lines are written (see log-format).
+type logFormat int
+
+const (
+	logFormatText logFormat = iota // free-form, as log.Printf writes them
+	logFormatJSON                  // one JSON object per line
+)
+
+func (f *logFormat) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "text":
+		*f = logFormatText
+	case "json":
+		*f = logFormatJSON
+	default:
+		return fmt.Errorf("invalid log-format %q, must be text or json", string(text))
+	}
+	return nil
+}
+
+// Whether pickles are prefixed with their length (see
+// graphite-pickle-framing).
+type pickleFraming int
+
+const (
+	pickleFramingAuto   pickleFraming = iota // detected per connection
+	pickleFramingLength                      // a 4-byte big-endian length, as carbon sends
+	pickleFramingNone                        // bare pickles
+)
+
+func (f *pickleFraming) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "auto":
+		*f = pickleFramingAuto
+	case "length":
+		*f = pickleFramingLength
+	case "none":
+		*f = pickleFramingNone
+	default:
+		return fmt.Errorf("invalid graphite-pickle-framing %q, must be auto, length or none", string(text))
+	}
+	return nil
+}
+
+// What an ingestion protocol does with data points while the
+// transceiver queue is full (see queue-full-policy).
+type queueFullPolicy int
+
+const (
+	queueBlock queueFullPolicy = iota // wait for room, i.e. push back on the client
+	queueDrop                         // drop (and count) them
+)
+
+func (p *queueFullPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "block":
+		*p = queueBlock
+	case "drop":
+		*p = queueDrop
+	default:
+		return fmt.Errorf("invalid queue-full-policy %q, must be block or drop", string(text))
+	}
+	return nil
+}
+
 type DSSpec struct {
 	Regexp    regex
 	Step      duration
 	Heartbeat duration
 	RRAs      []RRASpec
+	Secondary bool // also write the coarsest RRA to the secondary-store-spec db
+	Align     rrd.TimestampAlign
+	Min       *float64
+	Max       *float64
 }
+
+// label is the regexp of the spec, or catch-all-ds, which has none.
+func (ds *DSSpec) label() string {
+	if ds.Regexp.Regexp == nil {
+		return "catch-all-ds"
+	}
+	return ds.Regexp.String()
+}
+
 type RRASpec struct {
 	Function string
 	Step     time.Duration
@@ -93,8 +394,8 @@ func (r *RRASpec) UnmarshalText(text []byte) error {
 	}
 
 	r.Function = strings.ToUpper(parts[0])
-	if r.Function != "AVERAGE" && r.Function != "MIN" && r.Function != "MAX" && r.Function != "LAST" {
-		return fmt.Errorf("Invalid function: %q (valid funcs: average, min, max, last)", r.Function)
+	if !validRRAFunction(r.Function) {
+		return fmt.Errorf("Invalid function: %q (valid funcs: average, sum, min, max, last)", r.Function)
 	}
 
 	var err error
@@ -121,16 +422,34 @@ func (r *RRASpec) UnmarshalText(text []byte) error {
 	return nil
 }
 
-func ReadConfig(cfgPath string) error {
-	Cfg = &Config{}
-	_, err := toml.DecodeFile(cfgPath, Cfg)
+func validRRAFunction(f string) bool {
+	switch f {
+	case "AVERAGE", "SUM", "MIN", "MAX", "LAST":
+		return true
+	}
+	return false
+}
+
+func ReadConfig(cfgPath string) (err error) {
+	Cfg, err = readConfig(cfgPath)
+	return err
+}
+
+// Seconds a TCP ingest connection may be idle, unless configured.
+const dftConnTimeout = 10
+
+func readConfig(cfgPath string) (*Config, error) {
+	cfg := &Config{GraphiteTextTimeout: dftConnTimeout, GraphitePickleTimeout: dftConnTimeout,
+		InfluxLineTimeout: dftConnTimeout, OpenTSDBTimeout: dftConnTimeout, ProtobufTimeout: dftConnTimeout,
+		DbConnectRetries: dftDbConnectRetries, GraphitePickleAllowGzip: true, DropNonFinite: true}
+	_, err := toml.DecodeFile(cfgPath, cfg)
 	if err != nil {
 		log.Printf("Unable to read config: %s.", err)
-		return err
+		return nil, err
 	} else {
 		log.Printf("Read config file: '%s'.", cfgPath)
 	}
-	return nil
+	return cfg, nil
 }
 
 func (c *Config) processConfigPidFile(wd string) error {
@@ -174,6 +493,11 @@ func (c *Config) processConfigLogCycleInterval() error {
 
 	logDir, _ := filepath.Split(c.LogPath)
 	log.Printf("All further status messages will be written to log file(s) in '%s'.", logDir)
+	if c.LogFormat == logFormatJSON {
+		// the time and the pid are fields, see jsonLogWriter
+		log.SetFlags(0)
+		log.SetPrefix("")
+	}
 	logFileCycler()
 	log.Print("Server starting.")
 
@@ -184,8 +508,22 @@ func (c *Config) processDbConnectString() error {
 	if os.Getenv("TGRES_DB_CONNECT") != "" {
 		c.DbConnectString = os.Getenv("TGRES_DB_CONNECT")
 	}
-	if c.DbConnectString == "" {
-		return fmt.Errorf("db-connect-string empty")
+	if c.DbDSN == "" {
+		c.DbDSN = c.DbConnectString
+	}
+	if c.DbDSN == "" {
+		return fmt.Errorf("db-connect-string (or db-dsn) empty")
+	}
+	switch c.DbDriver {
+	case "":
+		c.DbDriver = "postgres"
+	case "postgres":
+	case "sqlite3":
+		if len(c.ClusterPeers) > 0 {
+			return fmt.Errorf("cluster-peers require the postgres db-driver")
+		}
+	default:
+		return fmt.Errorf("invalid db-driver %q, must be postgres or sqlite3", c.DbDriver)
 	}
 	return nil
 }
@@ -236,6 +574,24 @@ func (c *Config) processStatsNamePrefix() error {
 	return nil
 }
 
+const dftInternalStatsInterval = 10 * time.Second
+
+func (c *Config) processInternalStats() error {
+	if !c.InternalStatsEnabled {
+		return nil
+	}
+	if c.InternalStatsInterval.Duration < 0 {
+		return fmt.Errorf("internal-stats-interval must not be negative")
+	} else if c.InternalStatsInterval.Duration == 0 {
+		c.InternalStatsInterval.Duration = dftInternalStatsInterval
+	}
+	if c.InternalStatsPrefix == "" {
+		c.InternalStatsPrefix = "tgres"
+	}
+	log.Printf("Internal stats will be stored as %s.* every %v (internal-stats-enabled).", c.InternalStatsPrefix, c.InternalStatsInterval.Duration)
+	return nil
+}
+
 func (c *Config) processWorkers() error {
 	if c.Workers == 0 {
 		return fmt.Errorf("workers missing, must be an integer")
@@ -244,15 +600,352 @@ func (c *Config) processWorkers() error {
 	return nil
 }
 
+// Unlike the transceiver, 0 is not "no limit" but this default.
+const dftMaxRrasPerDs = 8
+
+func (c *Config) processMaxRrasPerDs() error {
+	if c.MaxRrasPerDs < 0 {
+		return fmt.Errorf("max-rras-per-ds must not be negative")
+	} else if c.MaxRrasPerDs == 0 {
+		c.MaxRrasPerDs = dftMaxRrasPerDs
+	}
+	log.Printf("A Data Source can have at most %d RRAs (max-rras-per-ds).", c.MaxRrasPerDs)
+	return nil
+}
+
+// processGraphiteTlsSniPrefixes lowercases the server names, which
+// are case insensitive and lowercased by graphiteTLSHandshake.
+func (c *Config) processGraphiteTlsSniPrefixes() error {
+	prefixes := make(map[string]string, len(c.GraphiteTlsSniPrefixes))
+	for sni, prefix := range c.GraphiteTlsSniPrefixes {
+		sni = strings.ToLower(sni)
+		if _, ok := prefixes[sni]; ok {
+			return fmt.Errorf("graphite-tls-sni-prefixes: %q is listed more than once", sni)
+		}
+		prefixes[sni] = prefix
+	}
+	c.GraphiteTlsSniPrefixes = prefixes
+	return nil
+}
+
+func (c *Config) processConnTimeouts() error {
+	for name, timeout := range map[string]int{
+		"graphite-text-timeout":   c.GraphiteTextTimeout,
+		"graphite-pickle-timeout": c.GraphitePickleTimeout,
+		"influx-line-timeout":     c.InfluxLineTimeout,
+		"opentsdb-timeout":        c.OpenTSDBTimeout,
+		"protobuf-timeout":        c.ProtobufTimeout,
+	} {
+		if timeout < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) processMaxConcurrentConnections() error {
+	if c.MaxConcurrentConnections < 0 {
+		return fmt.Errorf("max-concurrent-connections must not be negative")
+	} else if c.MaxConcurrentConnections > 0 {
+		log.Printf("Each service will handle at most %d connections at a time (max-concurrent-connections).", c.MaxConcurrentConnections)
+	}
+	return nil
+}
+
+func (c *Config) processAcceptBackoff() error {
+	if c.AcceptBackoffInitial.Duration < 0 || c.AcceptBackoffMax.Duration < 0 {
+		return fmt.Errorf("accept-backoff-initial and accept-backoff-max must not be negative")
+	}
+	if c.AcceptBackoffInitial.Duration == 0 {
+		c.AcceptBackoffInitial.Duration = dftAcceptBackoffInitial
+	}
+	if c.AcceptBackoffMax.Duration == 0 {
+		c.AcceptBackoffMax.Duration = dftAcceptBackoffMax
+	}
+	if c.AcceptBackoffInitial.Duration > c.AcceptBackoffMax.Duration {
+		return fmt.Errorf("accept-backoff-initial (%v) must not be more than accept-backoff-max (%v)", c.AcceptBackoffInitial.Duration, c.AcceptBackoffMax.Duration)
+	}
+	return nil
+}
+
+const dftFindCacheTTL = 5 * time.Second
+
+func (c *Config) processFindCacheTTL() error {
+	if c.FindCacheTTL.Duration < 0 {
+		return fmt.Errorf("find-cache-ttl must not be negative")
+	} else if c.FindCacheTTL.Duration == 0 {
+		c.FindCacheTTL.Duration = dftFindCacheTTL
+	}
+	return nil
+}
+
+const dftSourceIdleExpiry = time.Hour
+
+func (c *Config) processSourceIdleExpiry() error {
+	if c.SourceIdleExpiry.Duration < 0 {
+		return fmt.Errorf("source-idle-expiry must not be negative")
+	} else if c.SourceIdleExpiry.Duration == 0 {
+		c.SourceIdleExpiry.Duration = dftSourceIdleExpiry
+	}
+	return nil
+}
+
+// The database/sql default.
+const dftDbMaxIdleConns = 2
+
+func (c *Config) processDbPool() error {
+	if c.DbMaxOpenConns < 0 || c.DbMaxIdleConns < 0 || c.DbConnMaxLifetime.Duration < 0 {
+		return fmt.Errorf("db-max-open-conns, db-max-idle-conns and db-conn-max-lifetime must not be negative")
+	}
+	if c.DbMaxIdleConns == 0 {
+		c.DbMaxIdleConns = dftDbMaxIdleConns
+	}
+	if c.DbMaxOpenConns > 0 && c.DbMaxIdleConns > c.DbMaxOpenConns {
+		c.DbMaxIdleConns = c.DbMaxOpenConns // as database/sql would
+	}
+	return nil
+}
+
+const (
+	dftDbConnectRetries = 10
+	dftDbConnectTimeout = 5 * time.Minute
+)
+
+func (c *Config) processDbConnect() error {
+	if c.DbConnectRetries < 0 || c.DbConnectTimeout.Duration < 0 {
+		return fmt.Errorf("db-connect-retries and db-connect-timeout must not be negative")
+	}
+	if c.DbConnectTimeout.Duration == 0 {
+		c.DbConnectTimeout.Duration = dftDbConnectTimeout
+	}
+	return nil
+}
+
+const dftIngestMaxBodySize = 10 << 20
+
+func (c *Config) processIngestMaxBodySize() error {
+	if c.IngestMaxBodySize < 0 {
+		return fmt.Errorf("ingest-max-body-size must not be negative")
+	} else if c.IngestMaxBodySize == 0 {
+		c.IngestMaxBodySize = dftIngestMaxBodySize
+	}
+	return nil
+}
+
+const dftRenderMaxSeries = 10000
+
+func (c *Config) processRenderMaxSeries() error {
+	if c.RenderMaxSeries < 0 {
+		return fmt.Errorf("render-max-series must not be negative")
+	} else if c.RenderMaxSeries == 0 {
+		c.RenderMaxSeries = dftRenderMaxSeries
+	}
+	return nil
+}
+
+const dftHttpGzipMinSize = 1024
+
+func (c *Config) processHttpGzipMinSize() error {
+	if c.HttpGzipMinSize == 0 {
+		c.HttpGzipMinSize = dftHttpGzipMinSize
+	}
+	return nil
+}
+
+const dftQueueHighWaterMark = 0.9
+
+func (c *Config) processQueueFull() error {
+	if c.QueueHighWaterMark < 0 || c.QueueHighWaterMark > 1 {
+		return fmt.Errorf("queue-high-water-mark must be between 0 and 1")
+	} else if c.QueueHighWaterMark == 0 {
+		c.QueueHighWaterMark = dftQueueHighWaterMark
+	}
+	for name := range c.QueueFullPolicy {
+		if protocolCountersByName(name) == nil {
+			return fmt.Errorf("queue-full-policy: unknown protocol %q", name)
+		}
+	}
+	return nil
+}
+
+func (c *Config) processClusterPeers() error {
+	if len(c.ClusterPeers) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, peer := range c.ClusterPeers {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return fmt.Errorf("cluster-peers: %q: %v", peer, err)
+		}
+		if seen[peer] {
+			return fmt.Errorf("cluster-peers: %q is listed more than once", peer)
+		}
+		seen[peer] = true
+	}
+	if !seen[c.ClusterSelf] {
+		return fmt.Errorf("cluster-self (%q) must be one of cluster-peers", c.ClusterSelf)
+	}
+	// Only the peers may send relayed items, see queuePickleItems.
+	c.ClusterPeerIPs = make(map[string]bool)
+	for _, peer := range c.ClusterPeers {
+		host, _, _ := net.SplitHostPort(peer)
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return fmt.Errorf("cluster-peers: %q: %v", peer, err)
+		}
+		for _, ip := range ips {
+			c.ClusterPeerIPs[ip.String()] = true
+		}
+	}
+	log.Printf("Data points of series owned by the other %d cluster-peers will be relayed to them.", len(c.ClusterPeers)-1)
+	return nil
+}
+
+func (c *Config) processRateLimit() error {
+	if c.RateLimitPerIP < 0 {
+		return fmt.Errorf("rate-limit-per-ip must not be negative")
+	}
+	c.RateLimitExemptNets = nil
+	for _, cidr := range c.RateLimitExempt {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			cidr = fmt.Sprintf("%s/%d", cidr, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("rate-limit-exempt: %v", err)
+		}
+		c.RateLimitExemptNets = append(c.RateLimitExemptNets, ipNet)
+	}
+	if c.RateLimitPerIP > 0 {
+		log.Printf("Graphite text and pickle data points are limited to %v a second per IP, except from %v (rate-limit-per-ip).", c.RateLimitPerIP, c.RateLimitExempt)
+	}
+	return nil
+}
+
+const dftFileTailStateFile = "file-tail.state"
+
+func (c *Config) processGraphiteAuto() error {
+	if c.GraphiteAutoPickleBytes == nil {
+		c.GraphiteAutoPickleBytes = dftAutoPickleBytes
+	}
+	for _, b := range c.GraphiteAutoPickleBytes {
+		if b < 0 || b > 255 {
+			return fmt.Errorf("graphite-auto-pickle-bytes: %d is not a byte", b)
+		}
+	}
+	return nil
+}
+
+func (c *Config) processFileTail(wd string) error {
+	for i, path := range c.FileTailFiles {
+		if !filepath.IsAbs(path) {
+			c.FileTailFiles[i] = filepath.Join(wd, path)
+		}
+	}
+	if c.FileTailStateFile == "" {
+		c.FileTailStateFile = dftFileTailStateFile
+	}
+	if !filepath.IsAbs(c.FileTailStateFile) {
+		c.FileTailStateFile = filepath.Join(wd, c.FileTailStateFile)
+	}
+	return nil
+}
+
+const dftSpoolMaxSize = 256 << 20
+
+func (c *Config) processSpool(wd string) error {
+	if c.SpoolDir != "" && !filepath.IsAbs(c.SpoolDir) {
+		c.SpoolDir = filepath.Join(wd, c.SpoolDir)
+	}
+	if c.SpoolMaxSize < 0 {
+		return fmt.Errorf("spool-max-size must not be negative")
+	} else if c.SpoolMaxSize == 0 {
+		c.SpoolMaxSize = dftSpoolMaxSize
+	}
+	return nil
+}
+
+func (c *Config) processHttpBasicAuth(wd string) error {
+	c.HttpBasicAuthUsers = nil
+	if c.HttpBasicAuthFile != "" {
+		if !filepath.IsAbs(c.HttpBasicAuthFile) {
+			c.HttpBasicAuthFile = filepath.Join(wd, c.HttpBasicAuthFile)
+		}
+		data, err := ioutil.ReadFile(c.HttpBasicAuthFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read http-basic-auth-file: %v", err)
+		}
+		if c.HttpBasicAuthUsers, err = h.ParseHtpasswd(string(data)); err != nil {
+			return fmt.Errorf("%s %v", c.HttpBasicAuthFile, err)
+		}
+	}
+	if c.HttpBasicAuthUser != "" {
+		if c.HttpBasicAuthPassword == "" {
+			return fmt.Errorf("http-basic-auth-user requires an http-basic-auth-password")
+		}
+		if c.HttpBasicAuthUsers == nil {
+			c.HttpBasicAuthUsers = make(h.BasicAuthUsers)
+		}
+		c.HttpBasicAuthUsers[c.HttpBasicAuthUser] = c.HttpBasicAuthPassword
+	}
+	if len(c.HttpBasicAuthUsers) > 0 {
+		log.Printf("The HTTP server requires basic auth by one of %d user(s), except for %v (http-basic-auth-exempt).", len(c.HttpBasicAuthUsers), c.HttpBasicAuthExempt)
+	}
+	return nil
+}
+
+// processDelete makes sure that DELETE /series and POST /rename, if
+// enabled, are behind basic auth, so it must come after
+// processHttpBasicAuth.
+func (c *Config) processDelete() error {
+	if !c.DeleteEnabled {
+		return nil
+	}
+	if len(c.HttpBasicAuthUsers) == 0 {
+		return fmt.Errorf("delete-enabled requires http basic auth (http-basic-auth-user or http-basic-auth-file)")
+	}
+	for _, path := range c.HttpBasicAuthExempt {
+		if path == "/series" || path == "/rename" {
+			return fmt.Errorf("delete-enabled: %s must not be in http-basic-auth-exempt", path)
+		}
+	}
+	log.Printf("Series can be deleted with DELETE /series and renamed with POST /rename (delete-enabled).")
+	return nil
+}
+
+// processRenameExisting refuses a rename-existing that deletes series,
+// when there is no POST /rename (without delete-enabled) for it.
+func (c *Config) processRenameExisting() error {
+	if c.RenameExisting != x.RenameExistingFail && !c.DeleteEnabled {
+		return fmt.Errorf("rename-existing other than \"fail\" deletes series, it requires delete-enabled")
+	}
+	return nil
+}
+
 func (c *Config) processDSSpec() error {
 	// TODO validate function, regular expression, all that
-	for _, ds := range c.DSs {
+	dsSpecs := append(append([]DSSpec{}, c.StorageSchemas...), c.DSs...)
+	if c.CatchAllDataSourceSpec != nil {
+		dsSpecs = append(dsSpecs, *c.CatchAllDataSourceSpec)
+		log.Printf("Series not matching any ds regexp will be created using the catch-all-ds spec.")
+	}
+	for _, ds := range dsSpecs {
+		if c.MaxRrasPerDs > 0 && len(ds.RRAs) > c.MaxRrasPerDs {
+			return fmt.Errorf("DS %q: %d RRAs, but max-rras-per-ds is %d", ds.label(), len(ds.RRAs), c.MaxRrasPerDs)
+		}
+		if ds.Min != nil && ds.Max != nil && *ds.Min > *ds.Max {
+			return fmt.Errorf("DS %q: min (%v) is greater than max (%v)", ds.label(), *ds.Min, *ds.Max)
+		}
 		for _, rra := range ds.RRAs {
 			if (rra.Step.Nanoseconds() % ds.Step.Duration.Nanoseconds()) != 0 {
 				newStep := time.Duration(rra.Step.Nanoseconds()/ds.Step.Duration.Nanoseconds()*ds.Step.Duration.Nanoseconds()) * time.Nanosecond
-				log.Printf("DS %q: RRA step (%v) is not a multiple of DS Step (%v), auto adjusting Step to %v.", ds.Regexp.String(), rra.Step, ds.Step.Duration, newStep)
+				log.Printf("DS %q: RRA step (%v) is not a multiple of DS Step (%v), auto adjusting Step to %v.", ds.label(), rra.Step, ds.Step.Duration, newStep)
 				if newStep.Nanoseconds() == 0 {
-					return fmt.Errorf("DS %q: invalid Step (%v)", ds.Regexp.String(), newStep)
+					return fmt.Errorf("DS %q: invalid Step (%v)", ds.label(), newStep)
 				}
 				rra.Step = newStep
 			}
@@ -262,12 +955,172 @@ func (c *Config) processDSSpec() error {
 	return nil
 }
 
+func (c *Config) processStorageSchemasFile(wd string) error {
+	if c.StorageSchemasFile == "" {
+		return nil
+	}
+	if !filepath.IsAbs(c.StorageSchemasFile) {
+		c.StorageSchemasFile = filepath.Join(wd, c.StorageSchemasFile)
+	}
+	data, err := ioutil.ReadFile(c.StorageSchemasFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read storage-schemas-file: %v", err)
+	}
+	if c.StorageSchemas, err = parseStorageSchemas(string(data)); err != nil {
+		return fmt.Errorf("%s %v", c.StorageSchemasFile, err)
+	}
+	log.Printf("Read %d storage schemas from '%s', they take precedence over [[ds]].", len(c.StorageSchemas), c.StorageSchemasFile)
+	return nil
+}
+
+func (c *Config) processStorageAggregationFile(wd string) error {
+	if c.StorageAggregationFile == "" {
+		return nil
+	}
+	if !filepath.IsAbs(c.StorageAggregationFile) {
+		c.StorageAggregationFile = filepath.Join(wd, c.StorageAggregationFile)
+	}
+	data, err := ioutil.ReadFile(c.StorageAggregationFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read storage-aggregation-file: %v", err)
+	}
+	if c.StorageAggregations, err = parseStorageAggregations(string(data)); err != nil {
+		return fmt.Errorf("%s %v", c.StorageAggregationFile, err)
+	}
+	log.Printf("Read %d storage aggregations from '%s'.", len(c.StorageAggregations), c.StorageAggregationFile)
+	return nil
+}
+
+func (c *Config) processDerivedMetricsFile(wd string) error {
+	if c.DerivedMetricsFile == "" {
+		return nil
+	}
+	if !filepath.IsAbs(c.DerivedMetricsFile) {
+		c.DerivedMetricsFile = filepath.Join(wd, c.DerivedMetricsFile)
+	}
+	data, err := ioutil.ReadFile(c.DerivedMetricsFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read derived-metrics-file: %v", err)
+	}
+	c.DerivedMetrics = nil
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		dm, err := x.ParseDerivedMetric(line)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", c.DerivedMetricsFile, n+1, err)
+		}
+		c.DerivedMetrics = append(c.DerivedMetrics, dm)
+	}
+	log.Printf("Read %d derived metrics from '%s'.", len(c.DerivedMetrics), c.DerivedMetricsFile)
+	return nil
+}
+
+func (c *Config) processFlushPriorityRulesFile(wd string) error {
+	if c.FlushPriorityRulesFile == "" {
+		return nil
+	}
+	if !filepath.IsAbs(c.FlushPriorityRulesFile) {
+		c.FlushPriorityRulesFile = filepath.Join(wd, c.FlushPriorityRulesFile)
+	}
+	data, err := ioutil.ReadFile(c.FlushPriorityRulesFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read flush-priority-rules-file: %v", err)
+	}
+	c.FlushPriorityRules = nil
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := x.ParseFlushPriorityRule(line)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", c.FlushPriorityRulesFile, n+1, err)
+		}
+		c.FlushPriorityRules = append(c.FlushPriorityRules, r)
+	}
+	log.Printf("Read %d flush priority rules from '%s'.", len(c.FlushPriorityRules), c.FlushPriorityRulesFile)
+	return nil
+}
+
+func (c *Config) processAggregationRulesFile(wd string) error {
+	if c.AggregationRulesFile == "" {
+		return nil
+	}
+	if !filepath.IsAbs(c.AggregationRulesFile) {
+		c.AggregationRulesFile = filepath.Join(wd, c.AggregationRulesFile)
+	}
+	data, err := ioutil.ReadFile(c.AggregationRulesFile)
+	if err != nil {
+		return fmt.Errorf("Unable to read aggregation-rules-file: %v", err)
+	}
+	c.AggregationRules = nil
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := x.ParseAggregationRule(line)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", c.AggregationRulesFile, n+1, err)
+		}
+		c.AggregationRules = append(c.AggregationRules, r)
+	}
+	log.Printf("Read %d aggregation rules from '%s'.", len(c.AggregationRules), c.AggregationRulesFile)
+	return nil
+}
+
+func (c *Config) processNameRewriteScript() error {
+	if c.NameRewriteScript == "" {
+		return nil
+	}
+	var err error
+	if c.NameRewriter, err = x.NewNameRewriter(c.NameRewriteScript); err != nil {
+		return fmt.Errorf("Invalid name-rewrite-script: %v", err)
+	}
+	log.Printf("Incoming series will be renamed by %q (name-rewrite-script).", c.NameRewriteScript)
+	return nil
+}
+
+// FindMatchingDSSpec returns the spec of the first storage schema,
+// then of the first [[ds]], whose regexp matches name, or the
+// catch-all-ds spec. The first matching storage aggregation, if any,
+// then sets the function (and xff) of all of its RRAs.
 func (c *Config) FindMatchingDSSpec(name string) *rrd.DSSpec {
+	spec := c.findMatchingDSSpec(name)
+	if spec == nil {
+		return nil
+	}
+	for _, agg := range c.StorageAggregations {
+		if agg.Regexp.MatchString(name) {
+			for _, rra := range spec.RRAs {
+				rra.Function = agg.Function
+				if agg.Xff != nil {
+					rra.Xff = *agg.Xff
+				}
+			}
+			break
+		}
+	}
+	return spec
+}
+
+func (c *Config) findMatchingDSSpec(name string) *rrd.DSSpec {
+	for _, dsSpec := range c.StorageSchemas {
+		if dsSpec.Regexp.Regexp.MatchString(name) {
+			return convertDSSpec(&dsSpec)
+		}
+	}
 	for _, dsSpec := range c.DSs {
 		if dsSpec.Regexp.Regexp.MatchString(name) {
 			return convertDSSpec(&dsSpec)
 		}
 	}
+	if c.CatchAllDataSourceSpec != nil {
+		return convertDSSpec(c.CatchAllDataSourceSpec)
+	}
 	return nil
 }
 
@@ -276,6 +1129,10 @@ func convertDSSpec(dsSpec *DSSpec) *rrd.DSSpec {
 		Step:      dsSpec.Step.Duration,
 		Heartbeat: dsSpec.Heartbeat.Duration,
 		RRAs:      make([]*rrd.RRASpec, len(dsSpec.RRAs)),
+		Min:       dsSpec.Min,
+		Max:       dsSpec.Max,
+		Secondary: dsSpec.Secondary,
+		Align:     dsSpec.Align,
 	}
 	for i, r := range dsSpec.RRAs {
 		rr := rrd.RRASpec(r)
@@ -284,6 +1141,18 @@ func convertDSSpec(dsSpec *DSSpec) *rrd.DSSpec {
 	return rrdDSSpec
 }
 
+// reloadConfiger processes a config re-read on SIGHUP (see
+// reload()). The log file is already open and being cycled, so that is
+// not done again.
+type reloadConfiger struct{ *Config }
+
+func (c reloadConfiger) processConfigLogCycleInterval() error {
+	if c.LogCycle.Duration == 0 {
+		return fmt.Errorf("log-cycle-interval setting empty")
+	}
+	return nil
+}
+
 type configer interface {
 	processConfigPidFile(string) error
 	processConfigLogFile(string) error
@@ -294,8 +1163,36 @@ type configer interface {
 	processMinCacheDuration() error
 	processStatFlushInterval() error
 	processStatsNamePrefix() error
+	processInternalStats() error
 	processWorkers() error
+	processMaxRrasPerDs() error
+	processConnTimeouts() error
+	processGraphiteTlsSniPrefixes() error
+	processMaxConcurrentConnections() error
+	processAcceptBackoff() error
+	processQueueFull() error
+	processClusterPeers() error
+	processIngestMaxBodySize() error
+	processHttpGzipMinSize() error
+	processRenderMaxSeries() error
+	processFindCacheTTL() error
+	processSourceIdleExpiry() error
+	processDbPool() error
+	processDbConnect() error
 	processDSSpec() error
+	processRateLimit() error
+	processHttpBasicAuth(string) error
+	processDelete() error
+	processRenameExisting() error
+	processFileTail(string) error
+	processSpool(string) error
+	processGraphiteAuto() error
+	processDerivedMetricsFile(string) error
+	processFlushPriorityRulesFile(string) error
+	processAggregationRulesFile(string) error
+	processStorageSchemasFile(string) error
+	processStorageAggregationFile(string) error
+	processNameRewriteScript() error
 }
 
 func processConfig(c configer, wd string) error {
@@ -327,11 +1224,95 @@ func processConfig(c configer, wd string) error {
 	if err := c.processStatsNamePrefix(); err != nil {
 		return err
 	}
+	if err := c.processInternalStats(); err != nil {
+		return err
+	}
 	if err := c.processWorkers(); err != nil {
 		return err
 	}
+	if err := c.processMaxRrasPerDs(); err != nil {
+		return err
+	}
+	if err := c.processConnTimeouts(); err != nil {
+		return err
+	}
+	if err := c.processGraphiteTlsSniPrefixes(); err != nil {
+		return err
+	}
+	if err := c.processMaxConcurrentConnections(); err != nil {
+		return err
+	}
+	if err := c.processAcceptBackoff(); err != nil {
+		return err
+	}
+	if err := c.processQueueFull(); err != nil {
+		return err
+	}
+	if err := c.processClusterPeers(); err != nil {
+		return err
+	}
+	if err := c.processIngestMaxBodySize(); err != nil {
+		return err
+	}
+	if err := c.processHttpGzipMinSize(); err != nil {
+		return err
+	}
+	if err := c.processRenderMaxSeries(); err != nil {
+		return err
+	}
+	if err := c.processFindCacheTTL(); err != nil {
+		return err
+	}
+	if err := c.processSourceIdleExpiry(); err != nil {
+		return err
+	}
+	if err := c.processDbPool(); err != nil {
+		return err
+	}
+	if err := c.processDbConnect(); err != nil {
+		return err
+	}
+	if err := c.processRateLimit(); err != nil {
+		return err
+	}
+	if err := c.processHttpBasicAuth(wd); err != nil {
+		return err
+	}
+	if err := c.processDelete(); err != nil {
+		return err
+	}
+	if err := c.processRenameExisting(); err != nil {
+		return err
+	}
+	if err := c.processFileTail(wd); err != nil {
+		return err
+	}
+	if err := c.processSpool(wd); err != nil {
+		return err
+	}
+	if err := c.processGraphiteAuto(); err != nil {
+		return err
+	}
+	if err := c.processStorageSchemasFile(wd); err != nil {
+		return err
+	}
+	if err := c.processStorageAggregationFile(wd); err != nil {
+		return err
+	}
 	if err := c.processDSSpec(); err != nil {
 		return err
 	}
+	if err := c.processDerivedMetricsFile(wd); err != nil {
+		return err
+	}
+	if err := c.processFlushPriorityRulesFile(wd); err != nil {
+		return err
+	}
+	if err := c.processAggregationRulesFile(wd); err != nil {
+		return err
+	}
+	if err := c.processNameRewriteScript(); err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,279 @@
+package daemon
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/tgres/tgres/rrd"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCatchAllDataSourceSpec(t *testing.T) {
+	cfg := &Config{}
+	if _, err := toml.Decode(`
+[[ds]]
+regexp = "^foo\\."
+step = "10s"
+heartbeat = "2h"
+rras = ["10s:6h", "1m:240h"]
+
+[catch-all-ds]
+step = "5m"
+heartbeat = "2h"
+rras = ["5m:168h"]
+`, cfg); err != nil {
+		t.Fatalf("toml.Decode(): %v", err)
+	}
+	if err := cfg.processDSSpec(); err != nil {
+		t.Fatalf("processDSSpec(): %v", err)
+	}
+
+	if spec := cfg.FindMatchingDSSpec("foo.bar"); spec == nil || spec.Step != 10*time.Second || len(spec.RRAs) != 2 {
+		t.Errorf("foo.bar: expected the foo spec, got %+v", spec)
+	}
+	if spec := cfg.FindMatchingDSSpec("unknown.metric"); spec == nil || spec.Step != 5*time.Minute || len(spec.RRAs) != 1 {
+		t.Errorf("unknown.metric: expected the catch-all spec, got %+v", spec)
+	}
+
+	cfg.CatchAllDataSourceSpec = nil
+	if spec := cfg.FindMatchingDSSpec("unknown.metric"); spec != nil {
+		t.Errorf("unknown.metric: expected no spec without a catch-all, got %+v", spec)
+	}
+}
+
+func TestMaxRrasPerDs(t *testing.T) {
+	for n, ok := range map[int]bool{8: true, 9: false} {
+		cfg := &Config{}
+		spec := DSSpec{Regexp: regex{regexp.MustCompile("foo")}, Step: duration{10 * time.Second}}
+		for i := 0; i < n; i++ {
+			spec.RRAs = append(spec.RRAs, RRASpec{Function: "AVERAGE", Step: 10 * time.Second, Size: time.Hour})
+		}
+		cfg.DSs = []DSSpec{spec}
+		if err := cfg.processMaxRrasPerDs(); err != nil {
+			t.Fatalf("processMaxRrasPerDs(): %v", err)
+		}
+		if err := cfg.processDSSpec(); (err == nil) != ok {
+			t.Errorf("%d RRAs with the default max-rras-per-ds: expected ok %v, got %v", n, ok, err)
+		}
+	}
+}
+
+func TestCatchAllDSSpecErrors(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	min, max := 2.0, 1.0
+	rra := func(step time.Duration) RRASpec {
+		return RRASpec{Function: "AVERAGE", Step: step, Size: time.Hour}
+	}
+	for _, c := range []struct {
+		desc string
+		spec DSSpec
+		ok   bool
+	}{
+		{"too many RRAs", DSSpec{Step: duration{10 * time.Second}, RRAs: []RRASpec{rra(10 * time.Second), rra(time.Minute)}}, false},
+		{"min > max", DSSpec{Step: duration{10 * time.Second}, Min: &min, Max: &max}, false},
+		{"RRA step not a multiple", DSSpec{Step: duration{10 * time.Second}, RRAs: []RRASpec{rra(15 * time.Second)}}, true},
+		{"RRA step too small", DSSpec{Step: duration{10 * time.Second}, RRAs: []RRASpec{rra(5 * time.Second)}}, false},
+	} {
+		out.Reset()
+		cfg := &Config{MaxRrasPerDs: 1, CatchAllDataSourceSpec: &c.spec}
+		err := cfg.processDSSpec()
+		if (err == nil) != c.ok {
+			t.Errorf("%s: expected ok %v, got %v", c.desc, c.ok, err)
+		}
+		if msg := fmt.Sprint(err, out.String()); !strings.Contains(msg, `DS "catch-all-ds"`) {
+			t.Errorf("%s: expected catch-all-ds in the error or log, got %q", c.desc, msg)
+		}
+	}
+}
+
+func TestSeriesAliasRules(t *testing.T) {
+	cfg := &Config{}
+	if _, err := toml.Decode(`series-alias-rules = ['^(web\d+)\.example\.com\. $1.']`, cfg); err != nil {
+		t.Fatalf("toml.Decode(): %v", err)
+	}
+	if len(cfg.SeriesAliasRules) != 1 || cfg.SeriesAliasRules[0].Canonical != "$1." {
+		t.Errorf("unexpected rules %+v", cfg.SeriesAliasRules)
+	}
+}
+
+func TestInternalStatsConfig(t *testing.T) {
+	cfg := &Config{}
+	if _, err := toml.Decode(`internal-stats-enabled = true`, cfg); err != nil {
+		t.Fatalf("toml.Decode(): %v", err)
+	}
+	if err := cfg.processInternalStats(); err != nil {
+		t.Fatalf("processInternalStats(): %v", err)
+	}
+	if cfg.InternalStatsInterval.Duration != dftInternalStatsInterval || cfg.InternalStatsPrefix != "tgres" {
+		t.Errorf("expected the defaults, got %v %q", cfg.InternalStatsInterval.Duration, cfg.InternalStatsPrefix)
+	}
+}
+
+func TestClusterPeersConfig(t *testing.T) {
+	for _, c := range []struct {
+		conf string
+		ok   bool
+	}{
+		{``, true},
+		{`cluster-peers = ["10.0.0.1:2004", "10.0.0.2:2004"]` + "\n" + `cluster-self = "10.0.0.1:2004"`, true},
+		{`cluster-peers = ["10.0.0.1:2004", "10.0.0.2:2004"]` + "\n" + `cluster-self = "10.0.0.3:2004"`, false},
+		{`cluster-peers = ["10.0.0.1:2004", "10.0.0.1:2004"]` + "\n" + `cluster-self = "10.0.0.1:2004"`, false},
+		{`cluster-peers = ["a"]` + "\n" + `cluster-self = "a"`, false},
+	} {
+		cfg := &Config{}
+		if _, err := toml.Decode(c.conf, cfg); err != nil {
+			t.Fatalf("toml.Decode(): %v", err)
+		}
+		if err := cfg.processClusterPeers(); (err == nil) != c.ok {
+			t.Errorf("%q: expected ok %v, got %v", c.conf, c.ok, err)
+		}
+		if c.ok && len(cfg.ClusterPeers) > 0 && !cfg.ClusterPeerIPs["10.0.0.2"] {
+			t.Errorf("%q: expected 10.0.0.2 in ClusterPeerIPs, got %v", c.conf, cfg.ClusterPeerIPs)
+		}
+	}
+}
+
+func TestDeleteRenameEnabled(t *testing.T) {
+	auth := `http-basic-auth-user = "tgres"` + "\n" + `http-basic-auth-password = "secret"` + "\n"
+	for _, c := range []struct {
+		conf string
+		ok   bool
+	}{
+		{``, true},
+		{`delete-enabled = true`, false}, // no basic auth
+		{auth + `delete-enabled = true`, true},
+		{auth + `delete-enabled = true` + "\n" + `http-basic-auth-exempt = ["/series"]`, false},
+		{auth + `delete-enabled = true` + "\n" + `http-basic-auth-exempt = ["/rename"]`, false},
+		{`rename-existing = "fail"`, true},
+		{`rename-existing = "replace"`, false}, // deletes, without delete-enabled
+		{auth + `delete-enabled = true` + "\n" + `rename-existing = "replace"`, true},
+		{`rename-existing = "merge"`, false}, // deletes from
+		{auth + `delete-enabled = true` + "\n" + `rename-existing = "merge"`, true},
+		{auth + `delete-enabled = true` + "\n" + `rename-existing = "keep"`, false},
+	} {
+		cfg := &Config{}
+		_, err := toml.Decode(c.conf, cfg)
+		if err == nil {
+			if err := cfg.processHttpBasicAuth(""); err != nil {
+				t.Fatalf("processHttpBasicAuth(): %v", err)
+			}
+			err = cfg.processDelete()
+		}
+		if err == nil {
+			err = cfg.processRenameExisting()
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("%q: expected ok %v, got %v", c.conf, c.ok, err)
+		}
+	}
+}
+
+func TestStorageSchemas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage-schemas.conf")
+	ioutil.WriteFile(path, []byte(`
+# comment
+[carbon]
+pattern = ^carbon\.
+retentions = 60:90d
+
+[default]
+pattern = .*
+retentions = 10s:6h,1m:7d
+align = floor
+`), 0644)
+
+	cfg := &Config{StorageSchemasFile: path,
+		DSs: []DSSpec{{Regexp: regex{regexp.MustCompile("foo")}, Step: duration{time.Second}}}}
+	if err := cfg.processStorageSchemasFile(dir); err != nil {
+		t.Fatalf("processStorageSchemasFile(): %v", err)
+	}
+	if spec := cfg.FindMatchingDSSpec("carbon.agents.a"); spec == nil || spec.Step != time.Minute ||
+		len(spec.RRAs) != 1 || spec.RRAs[0].Size != 90*24*time.Hour {
+		t.Errorf("carbon.agents.a: expected the carbon schema, got %+v", spec)
+	}
+	if spec := cfg.FindMatchingDSSpec("foo.bar"); spec == nil || spec.Step != 10*time.Second || len(spec.RRAs) != 2 || spec.Align != rrd.AlignFloor {
+		t.Errorf("foo.bar: expected the default schema to take precedence over [[ds]], got %+v", spec)
+	}
+
+	// The file is re-read (e.g. on a reload)
+	ioutil.WriteFile(path, []byte("[all]\npattern = .*\nretentions = 5m:1440\n"), 0644)
+	if err := cfg.processStorageSchemasFile(dir); err != nil {
+		t.Fatalf("processStorageSchemasFile(): %v", err)
+	}
+	if spec := cfg.FindMatchingDSSpec("carbon.agents.a"); spec == nil || spec.Step != 5*time.Minute ||
+		spec.RRAs[0].Size != 5*24*time.Hour {
+		t.Errorf("carbon.agents.a: expected the new schema, got %+v", spec)
+	}
+
+	for _, bad := range []string{
+		"pattern = .*",
+		"[x]\npattern = .*",
+		"[x]\npattern = (\nretentions = 1m:1d",
+		"[x]\npattern = .*\nretentions = 1m",
+		"[x]\npattern = .*\nretentions = 1m:10s",
+		"[x]\nfoo = bar",
+		"[x]\npattern = .*\nretentions = 1m:1d\nalign = round",
+	} {
+		if _, err := parseStorageSchemas(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestStorageAggregations(t *testing.T) {
+	aggs, err := parseStorageAggregations(`
+[count]
+pattern = \.count$
+xFilesFactor = 0
+aggregationMethod = sum
+
+[max]
+pattern = \.max$
+aggregationMethod = max
+`)
+	if err != nil {
+		t.Fatalf("parseStorageAggregations(): %v", err)
+	}
+	cfg := &Config{StorageAggregations: aggs,
+		DSs: []DSSpec{{Regexp: regex{regexp.MustCompile(".*")}, Step: duration{10 * time.Second},
+			RRAs: []RRASpec{{Function: "AVERAGE", Step: 10 * time.Second, Size: time.Hour, Xff: 0.5}}}}}
+
+	for name, expect := range map[string]rrd.RRASpec{
+		"foo.count": {Function: "SUM", Xff: 0},
+		"foo.max":   {Function: "MAX", Xff: 0.5},
+		"foo.bar":   {Function: "AVERAGE", Xff: 0.5},
+	} {
+		spec := cfg.FindMatchingDSSpec(name)
+		if rra := spec.RRAs[0]; rra.Function != expect.Function || rra.Xff != expect.Xff {
+			t.Errorf("%s: expected %s (xff %v), got %s (xff %v)", name, expect.Function, expect.Xff, rra.Function, rra.Xff)
+		}
+	}
+	if cfg.DSs[0].RRAs[0].Function != "AVERAGE" {
+		t.Errorf("expected the [[ds]] spec itself to be unchanged")
+	}
+
+	for _, bad := range []string{
+		"[x]\naggregationMethod = sum",
+		"[x]\npattern = .*\naggregationMethod = median",
+		"[x]\npattern = .*\nxFilesFactor = 2",
+	} {
+		if _, err := parseStorageAggregations(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
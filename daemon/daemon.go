@@ -19,6 +19,7 @@ import (
 	"flag"
 	"fmt"
 	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/serde"
 	x "github.com/tgres/tgres/transceiver"
 	"log"
@@ -40,12 +41,13 @@ var (
 	gracefulChildPid int
 )
 
-func parseFlags() (textCfgPath, gracefulProtos, join string) {
+func parseFlags() (textCfgPath, gracefulProtos, join string, stdin bool) {
 
 	// Parse the flags, if any
 	flag.StringVar(&textCfgPath, "c", "./etc/tgres.conf", "path to config file")
 	flag.StringVar(&join, "join", "", "List of add:port,addr:port,... of nodes to join")
 	flag.StringVar(&gracefulProtos, "graceful", "", "list of fds (internal use only)")
+	flag.BoolVar(&stdin, "stdin", false, "read graphite text from stdin until EOF, flush and exit (rather than listen)")
 	flag.Parse()
 
 	return
@@ -68,7 +70,7 @@ func Init() { // not to be confused with init()
 	log.SetPrefix(fmt.Sprintf("[%d] ", os.Getpid()))
 	log.Printf("Tgres starting.")
 
-	cfgPath, gracefulProtos, join := parseFlags()
+	cfgPath, gracefulProtos, join, stdin := parseFlags()
 
 	// This creates the Cfg variable
 	if err := ReadConfig(cfgPath); err != nil {
@@ -87,13 +89,25 @@ func Init() { // not to be confused with init()
 	savePid(Cfg.PidPath)
 
 	// Initialize Database
-	db, err := serde.InitDb(Cfg.DbConnectString, "")
+	db, err := connectDb("DB", func() (rrd.SerDe, error) { return serde.Open(Cfg.DbDriver, Cfg.DbDSN, "") })
 	if err != nil {
 		log.Fatalf("Error connecting to the DB: %v", err)
 		return
 	}
 
 	log.Printf("Initialized DB connection.")
+	dbPool = setDbPool(db)
+
+	var secondary rrd.SerDe
+	if Cfg.SecondaryStoreSpec != "" {
+		secondary, err = connectDb("secondary store DB", func() (rrd.SerDe, error) { return serde.InitDb(Cfg.SecondaryStoreSpec, "") })
+		if err != nil {
+			log.Fatalf("Error connecting to the secondary store DB: %v", err)
+			return
+		}
+		log.Printf("Initialized secondary store DB connection.")
+		setDbPool(secondary)
+	}
 
 	var (
 		c         *cluster.Cluster
@@ -141,10 +155,58 @@ func Init() { // not to be confused with init()
 	t.MaxCachedPoints = Cfg.MaxCachedPoints
 	t.StatFlushDuration = Cfg.StatFlush.Duration
 	t.StatsNamePrefix = Cfg.StatsNamePrefix
+	t.BackfillMode = Cfg.BackfillMode
+	t.MaxSeries = Cfg.MaxSeries
+	t.MaxSeriesNameLength = Cfg.MaxSeriesNameLength
+	t.TimestampSource = Cfg.TimestampSource
+	t.DerivedMetrics = Cfg.DerivedMetrics
+	t.NameRewriter = Cfg.NameRewriter
+	t.FlushPriorityRules = Cfg.FlushPriorityRules
+	t.AggregationRules = Cfg.AggregationRules
+	t.SeriesAliasRules = Cfg.SeriesAliasRules
+	t.NameReplaceRules = Cfg.NameReplaceRules
+	t.SanitizeNames = Cfg.SanitizeNames
+	t.AllowNames, t.DenyNames = Cfg.AllowNames, Cfg.DenyNames
+	t.FlushMaxRetries = Cfg.FlushMaxRetries
+	if Cfg.FlushRetryDelay.Duration != 0 {
+		t.FlushRetryDelay = Cfg.FlushRetryDelay.Duration
+	}
+	t.FlushBatchSize = Cfg.FlushBatchSize
+	t.FlushBatchInterval = Cfg.FlushBatchInterval.Duration
+	t.FlushInterval = Cfg.FlushInterval.Duration
+	t.SpoolDir, t.SpoolMaxSize = Cfg.SpoolDir, Cfg.SpoolMaxSize
+	if Cfg.DeadLetterSize != 0 {
+		t.DeadLetterSize = Cfg.DeadLetterSize
+	}
+	t.PreAggWindow = Cfg.PreAggWindow.Duration
+	t.SecondaryStore = secondary
+	t.SecondaryRetention = Cfg.SecondaryStoreRetention.Duration
+	t.MaxRrasPerDs = Cfg.MaxRrasPerDs
+	t.DropNonFinite = Cfg.DropNonFinite
+	t.DedupeSameTimestamp = Cfg.DedupeSameTimestamp
+	t.MaxFutureSkew = Cfg.MaxFutureSkew.Duration
+	t.Rcache.NamesTTL = Cfg.FindCacheTTL.Duration
+	t.QueueHighWater = Cfg.QueueHighWaterMark
 	t.DSSpecs = x.MatchingDSSpecFinder(Cfg)
+	if len(Cfg.ClusterPeers) > 0 {
+		t.Relay = newPickleRelay(Cfg.ClusterPeers, Cfg.ClusterSelf)
+	}
+
+	if Cfg.RateLimitPerIP > 0 {
+		ingestRateLimiter = newIPRateLimiter(Cfg.RateLimitPerIP, Cfg.RateLimitExemptNets)
+	}
+
+	if stdin || Cfg.StdinIngest {
+		ingestStdin(t, os.Stdin)
+		return
+	}
 
 	// Create and run the Service Manager
 	serviceMgr = newServiceManager(t)
+	go sampleIngestRates()
+	if Cfg.InternalStatsEnabled {
+		serviceMgr.startInternalStats(Cfg.InternalStatsPrefix, Cfg.InternalStatsInterval.Duration)
+	}
 	if err := serviceMgr.run(gracefulProtos); err != nil {
 		log.Printf("Could not run the service manager: %v", err)
 		return
@@ -195,24 +257,90 @@ func Init() { // not to be confused with init()
 	//std2DevNull()
 	//os.Chdir("/")
 
-	// TODOthis too could be in the transceiver for consistency?
-	for {
-		// Wait for a SIGINT or SIGTERM.
-		ch := make(chan os.Signal)
-		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
-		s := <-ch
+	serviceMgr.HandleSignals(cfgPath, wd)
+}
+
+// HandleSignals acts upon signals (see actionForSignal) until the
+// transceiver is stopped, i.e. it returns when it is time to exit.
+// The config file at cfgPath is re-read on a reload (relative paths in
+// it are relative to wd) and passed on to the child of a graceful
+// restart.
+func (r *ServiceManager) HandleSignals(cfgPath, wd string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	defer signal.Stop(ch)
+
+	for s := range ch {
 		log.Printf("Got signal: %v", s)
-		if s == syscall.SIGHUP {
+		switch actionForSignal(s) {
+		case sigReload:
 			if gracefulChildPid == 0 {
-				gracefulRestart(t, cfgPath)
+				reloadConfig(cfgPath, wd)
 			}
-		} else {
-			gracefulExit(t)
-			break
+		case sigGracefulRestart:
+			if gracefulChildPid == 0 {
+				r.gracefulRestart(cfgPath)
+			}
+		case sigGracefulExit:
+			r.gracefulExit()
+			return
+		case sigFastExit:
+			r.fastExit()
+			return
 		}
 	}
 }
 
+// What we do upon receiving a signal:
+//
+//	SIGHUP  - reload: re-read the config file and apply the settings
+//	          which can change while running (see reload()).
+//	SIGUSR2 - graceful restart: re-exec, passing the listening
+//	          sockets on to the new process.
+//	SIGTERM - graceful exit (what an orchestrator sends): stop
+//	          accepting, let connected clients finish (for up to
+//	          shutdown-drain-timeout), flush and exit.
+//	SIGINT  - fast exit (Ctrl-C): stop accepting, drop all open
+//	          connections right away, flush and exit.
+type signalAction int
+
+const (
+	sigIgnore signalAction = iota
+	sigReload
+	sigGracefulRestart
+	sigGracefulExit
+	sigFastExit
+)
+
+func actionForSignal(s os.Signal) signalAction {
+	switch s {
+	case syscall.SIGHUP:
+		return sigReload
+	case syscall.SIGUSR2:
+		return sigGracefulRestart
+	case syscall.SIGTERM:
+		return sigGracefulExit
+	case syscall.SIGINT:
+		return sigFastExit
+	}
+	return sigIgnore
+}
+
+// reloadConfig re-reads the config file, if it is valid the service
+// manager applies it.
+func reloadConfig(cfgPath, wd string) {
+	newCfg, err := readConfig(cfgPath)
+	if err != nil {
+		log.Printf("reloadConfig(): not reloading: %v", err)
+		return
+	}
+	if err := processConfig(reloadConfiger{newCfg}, wd); err != nil {
+		log.Printf("reloadConfig(): not reloading, error in config file %s: %v", cfgPath, err)
+		return
+	}
+	serviceMgr.reload(newCfg)
+}
+
 func Finish() {
 	quitting = true
 	log.Printf("main: Waiting for all other goroutines to finish...")
@@ -227,26 +355,19 @@ func Finish() {
 	os.Remove(Cfg.PidPath)
 }
 
-func gracefulRestart(t *x.Transceiver, cfgPath string) {
+func (r *ServiceManager) gracefulRestart(cfgPath string) {
 
 	if !filepath.IsAbs(os.Args[0]) {
 		log.Printf("ERROR: Graceful restart only possible when %q started with absolute path, ignoring this request.", os.Args[0])
 		return
 	}
 
-	files, protos := serviceMgr.listenerFilesAndProtocols()
-
-	log.Printf("gracefulRestart(): Beginning graceful restart with sockets: %v and protos: %q", files, protos)
-
 	mypath, _ := filepath.Abs(os.Args[0]) // TODO we should really be the starting working directory
-	args := []string{
-		"-c", cfgPath,
-		"-graceful", protos}
-
-	cmd := exec.Command(mypath, args...)
+	cmd := r.gracefulChildCmd(mypath, "-c", cfgPath)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	cmd.ExtraFiles = files
+
+	log.Printf("gracefulRestart(): Beginning graceful restart with sockets: %v and protos: %q", cmd.ExtraFiles, cmd.Args[len(cmd.Args)-1])
 
 	// The new process will kill -TERM us when it's ready
 	err := cmd.Start()
@@ -258,21 +379,58 @@ func gracefulRestart(t *x.Transceiver, cfgPath string) {
 	}
 }
 
-func gracefulExit(t *x.Transceiver) {
+// gracefulChildCmd is the command to run path with args as the child
+// of a graceful restart: the files of the listeners of the services
+// are its extra files, which belong to which service is in its
+// gracefulFdsEnv (as well as in the -graceful list it is given, for
+// older versions).
+func (r *ServiceManager) gracefulChildCmd(path string, args ...string) *exec.Cmd {
+	files, protos, mapping := r.listenerFilesAndProtocols()
+	cmd := exec.Command(path, append(args, "-graceful", protos)...)
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), gracefulFdsEnv+"="+mapping)
+	return cmd
+}
+
+func (r *ServiceManager) gracefulExit() {
 
 	log.Printf("Gracefully exiting...")
 
 	quitting = true
 
-	t.ClusterReady(false)
+	r.t.ClusterReady(false)
 
 	log.Printf("Waiting for all TCP connections to finish...")
-	serviceMgr.closeListeners()
-	log.Printf("TCP connections finished.")
+	r.drain(Cfg.ShutdownDrainTimeout.Duration)
+	log.Printf("TCP connections finished, data flushed.")
+
+	notifyGracefulChild()
+}
+
+func (r *ServiceManager) fastExit() {
+
+	log.Printf("Exiting (without waiting for clients)...")
+
+	quitting = true
 
-	// Stop the transceiver
+	r.t.ClusterReady(false)
+
+	log.Printf("Dropping all TCP connections...")
+	r.dropListeners()
+
+	r.stopInternalStats()
+	stopTransceiver(r.t)
+}
+
+func stopTransceiver(t *x.Transceiver) {
+
+	// Stop the transceiver (this flushes the data)
 	t.Stop()
 
+	notifyGracefulChild()
+}
+
+func notifyGracefulChild() {
 	if gracefulChildPid != 0 {
 		// let the child know the data is flushed
 		syscall.Kill(gracefulChildPid, syscall.SIGUSR1)
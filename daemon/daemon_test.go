@@ -0,0 +1,2392 @@
+package daemon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	pickle "github.com/hydrogen18/stalecucumber"
+	"github.com/tgres/tgres/cluster"
+	"github.com/tgres/tgres/graceful"
+	"github.com/tgres/tgres/msgpack"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/statsd"
+	"github.com/tgres/tgres/transceiver"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestActionForSignal(t *testing.T) {
+	for s, expect := range map[syscall.Signal]signalAction{
+		syscall.SIGHUP:  sigReload,
+		syscall.SIGUSR2: sigGracefulRestart,
+		syscall.SIGTERM: sigGracefulExit,
+		syscall.SIGINT:  sigFastExit,
+		syscall.SIGUSR1: sigIgnore,
+	} {
+		if a := actionForSignal(s); a != expect {
+			t.Errorf("%v: expected action %v, got %v", s, expect, a)
+		}
+	}
+}
+
+func startTestTextService(t *testing.T) (*ServiceManager, net.Conn) {
+	Cfg = &Config{GraphiteTextListenSpec: "127.0.0.1:0"}
+	gt := &graphiteTextServiceManager{}
+	if err := gt.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	conn, err := net.Dial("tcp", gt.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	time.Sleep(50 * time.Millisecond) // let it be accepted
+	return &ServiceManager{services: serviceMap{"gt": gt}}, conn
+}
+
+func TestGracefulVsFastShutdown(t *testing.T) {
+
+	// SIGTERM path: an idle client is given the drain timeout
+	sm, conn := startTestTextService(t)
+	defer conn.Close()
+	start := time.Now()
+	sm.closeListeners(300 * time.Millisecond)
+	if elapsed := time.Now().Sub(start); elapsed < 300*time.Millisecond {
+		t.Errorf("closeListeners(): expected to wait for the drain timeout, returned after %v", elapsed)
+	}
+
+	// SIGINT path: the client is dropped right away
+	sm, conn = startTestTextService(t)
+	defer conn.Close()
+	start = time.Now()
+	sm.dropListeners()
+	if elapsed := time.Now().Sub(start); elapsed > 100*time.Millisecond {
+		t.Errorf("dropListeners(): expected to return right away, took %v", elapsed)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("dropListeners(): expected the client connection to be closed")
+	}
+}
+
+// createdSerDe creates the data sources it is asked for and records
+// their flushes.
+type createdSerDe struct {
+	namesSerDe
+	sync.Mutex
+	flushed map[string]int
+}
+
+func (f *createdSerDe) CreateOrReturnDataSource(name string, dsSpec *rrd.DSSpec) (*rrd.DataSource, error) {
+	f.Lock()
+	defer f.Unlock()
+	ds := &rrd.DataSource{Id: int64(len(f.flushed) + 1), Name: name, StepMs: dsSpec.Step.Nanoseconds() / 1000000,
+		HeartbeatMs: dsSpec.Heartbeat.Nanoseconds() / 1000000, LastUpdate: time.Now().Truncate(dsSpec.Step).Add(-2 * time.Minute), LastFlushRT: time.Now()}
+	for _, r := range dsSpec.RRAs {
+		ds.RRAs = append(ds.RRAs, &rrd.RoundRobinArchive{Id: ds.Id, DsId: ds.Id, Cf: r.Function, Xff: float32(r.Xff),
+			StepsPerRow: int32(r.Step / dsSpec.Step), Size: int32(r.Size / r.Step), Width: 768, DPs: make(map[int64]float64)})
+	}
+	f.flushed[name] = 0
+	return ds, nil
+}
+
+func (f *createdSerDe) FlushDataSource(ds *rrd.DataSource) error {
+	f.Lock()
+	defer f.Unlock()
+	f.flushed[ds.Name]++
+	return nil
+}
+
+// freePort is a port nothing listens on right now.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestDrainFlushes(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	c, err := cluster.NewClusterBind("127.0.0.1", freePort(t), "127.0.0.1", 0, freePort(t), "test")
+	if err != nil {
+		t.Fatalf("NewClusterBind(): %v", err)
+	}
+	if err := c.Join([]string{}); err != nil {
+		t.Fatalf("Join(): %v", err)
+	}
+	serde := &createdSerDe{flushed: make(map[string]int)}
+	tr := transceiver.New(c, serde)
+	tr.NWorkers = 1
+	tr.MinCacheDuration, tr.MaxCacheDuration = time.Hour, 2*time.Hour // not due before the exit
+	// Ready before the transceiver starts (which makes it ready
+	// again), the metadata of a member must not be read as it is
+	// being updated.
+	if err := c.Ready(true); err != nil || !c.Members()[0].Ready() {
+		t.Fatalf("expected the cluster node to be ready (%v)", err)
+	}
+	if err := tr.Start(); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+
+	Cfg = &Config{GraphiteTextListenSpec: "127.0.0.1:0", ShutdownDrainTimeout: duration{time.Second}}
+	gt := &graphiteTextServiceManager{t: tr}
+	if err := gt.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	conn, err := net.Dial("tcp", gt.listeners[0].Addr().String())
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	now := time.Now().Truncate(10 * time.Second).Unix()
+	fmt.Fprintf(conn, "foo.bar 1 %d\n", now-60)
+
+	// What SIGTERM does (gracefulExit, less marking the node as not
+	// ready, which flushes by relinquishing every ds): closeListeners
+	// waits for the client, whatever it sends until it is done is
+	// flushed, although not due.
+	sm := &ServiceManager{t: tr, services: serviceMap{"gt": gt}}
+	done := make(chan bool)
+	go func() {
+		sm.drain(Cfg.ShutdownDrainTimeout.Duration)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	fmt.Fprintf(conn, "foo.bar 2 %d\n", now-30)
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected drain() to return once the client is done")
+	}
+	serde.Lock()
+	defer serde.Unlock()
+	if n := serde.flushed["foo.bar"]; n != 1 {
+		t.Errorf("expected foo.bar to be flushed once by drain(), got %d", n)
+	}
+}
+
+// Set in the environment of the child started by TestGracefulRestart.
+const gracefulTestChildEnv = "TGRES_TEST_GRACEFUL_CHILD"
+
+// The child of a graceful restart inherits the listening sockets and
+// accepts on them after the parent has stopped listening.
+func TestGracefulRestart(t *testing.T) {
+	sm, conn := startTestTextService(t)
+	conn.Close()
+	addr := sm.services["gt"].(*graphiteTextServiceManager).listeners[0].Addr().String()
+
+	cmd := sm.gracefulChildCmd(os.Args[0], "-test.run=^TestGracefulRestartChild$", "--")
+	cmd.Env = append(cmd.Env, gracefulTestChildEnv+"=1")
+	cmd.Stderr = os.Stderr
+	out := &syncBuffer{}
+	cmd.Stdout = out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	for _, f := range cmd.ExtraFiles {
+		f.Close()
+	}
+	sm.dropListeners()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	fmt.Fprintf(conn, "foo.bar 1 1\n")
+	conn.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("child: %v", err)
+	}
+	if !strings.Contains(out.String(), "gt: foo.bar 1 1") {
+		t.Errorf("expected the child to accept on the inherited socket, got output: %q", out.String())
+	}
+}
+
+// Not a test by itself: the child side of TestGracefulRestart.
+func TestGracefulRestartChild(t *testing.T) {
+	if os.Getenv(gracefulTestChildEnv) == "" {
+		return
+	}
+	fds, err := gracefulFds(os.Getenv(gracefulFdsEnv), os.Args[len(os.Args)-1])
+	if err != nil {
+		t.Fatalf("gracefulFds(): %v", err)
+	}
+	if len(fds["gt"]) != 1 {
+		t.Fatalf("expected one gt fd, got %v", fds)
+	}
+	l, err := net.FileListener(os.NewFile(uintptr(3+fds["gt"][0]), "gt"))
+	if err != nil {
+		t.Fatalf("FileListener(): %v", err)
+	}
+	defer l.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept(): %v", err)
+	}
+	defer conn.Close()
+	line, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll(): %v", err)
+	}
+	fmt.Printf("gt: %s", line)
+}
+
+func TestValidateListenSpecs(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	c := &Config{GraphiteTextListenSpec: ":2003", GraphiteUdpListenSpec: "[::]:2003",
+		GraphitePickleListenSpec: "127.0.0.1:2004, [::1]:2004", GraphiteTextUnixListenSpec: "/tmp/tgres.sock"}
+	if err := validateListenSpecs(c); err != nil {
+		t.Fatalf("validateListenSpecs(): %v", err)
+	}
+	logged := out.String()
+	for _, expect := range []string{
+		`"gt" service: :2003 (all interfaces, IPv4 and IPv6)`,
+		`"gu" service: [::]:2003 (all interfaces, IPv4 and IPv6)`,
+		`"gp" service: 127.0.0.1:2004 (IPv4)`,
+		`"gp" service: [::1]:2004 (IPv6)`,
+		`"gtu" service: /tmp/tgres.sock (unix socket)`,
+	} {
+		if !strings.Contains(logged, expect) {
+			t.Errorf("expected %q in the log, got %q", expect, logged)
+		}
+	}
+
+	for _, bad := range []*Config{
+		{GraphiteTextListenSpec: "2003"},
+		{StatsdUdpListenSpec: "0.0.0.0:notaport"},
+		{HttpListenSpec: "[::1:8088"},
+		{InfluxLineListenSpec: "unix://"},
+	} {
+		if err := validateListenSpecs(bad); err == nil {
+			t.Errorf("%+v: expected an error", serviceListenSpecs(bad))
+		}
+	}
+}
+
+// Each service, given its own address, binds that address and says
+// so (the UDP service used to print the text listen spec).
+func TestServicesBindTheirOwnSpecs(t *testing.T) {
+	Cfg = &Config{
+		GraphiteTextListenSpec:   "127.0.0.1:0",
+		GraphiteUdpListenSpec:    "127.0.0.2:0",
+		GraphitePickleListenSpec: "127.0.0.3:0",
+		StatsdUdpListenSpec:      "127.0.0.4:0",
+	}
+	tr := transceiver.New(nil, nil)
+	services := []struct {
+		service        trService
+		network, spec  string
+		listeningOnMsg string
+	}{
+		{&graphiteTextServiceManager{t: tr}, "tcp", Cfg.GraphiteTextListenSpec, "Graphite text protocol Listening on "},
+		{&graphiteUdpTextServiceManager{t: tr}, "udp", Cfg.GraphiteUdpListenSpec, "Graphite UDP protocol Listening on "},
+		{&graphitePickleServiceManager{t: tr}, "tcp", Cfg.GraphitePickleListenSpec, "Graphite Pickle protocol Listening on "},
+		{&statsdUdpTextServiceManager{t: tr}, "udp", Cfg.StatsdUdpListenSpec, "Statsd UDP protocol Listening on "},
+	}
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	for _, s := range services {
+		if err := s.service.Start(nil); err != nil {
+			os.Stdout = stdout
+			t.Fatalf("%s: Start(): %v", s.spec, err)
+		}
+		defer s.service.Stop()
+	}
+	os.Stdout = stdout
+	w.Close()
+	printed, _ := ioutil.ReadAll(r)
+
+	for _, s := range services {
+		files := s.service.Files()
+		if len(files) != 1 {
+			t.Errorf("%s: expected 1 file, got %d", s.spec, len(files))
+			continue
+		}
+		if bound, same := boundTo(files[0], s.network, s.spec); !same {
+			t.Errorf("%s: bound to %s instead", s.spec, bound)
+		}
+		files[0].Close()
+		if !strings.Contains(string(printed), s.listeningOnMsg+s.spec) {
+			t.Errorf("%s: expected %q to be printed, got %q", s.spec, s.listeningOnMsg+s.spec, printed)
+		}
+	}
+}
+
+// On shutdown, a UDP handler has queued its last datagram (and
+// exited) by the time the listeners are closed, before the flush.
+func TestCloseListenersWaitsForUdp(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{GraphiteUdpListenSpec: "127.0.0.1:0"}
+	g := &graphiteUdpTextServiceManager{t: transceiver.New(nil, nil)}
+	if err := g.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	conn, err := net.Dial("udp", g.conns[0].LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("foo.bar 1 1\n"))
+	time.Sleep(50 * time.Millisecond)
+
+	sm := &ServiceManager{services: serviceMap{"gu": g}}
+	sm.closeListeners(time.Second)
+	if logged := out.String(); !strings.Contains(logged, "handleGraphiteUdpTextProtocol(): Error reading") {
+		t.Errorf("closeListeners(): expected the UDP handler to have finished, log: %q", logged)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use by the logger
+// and the test.
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+// waitHandlers waits for the TCP connection (and UDP) handlers to
+// exit, so that they do not read a Cfg which the next test assigns.
+func waitHandlers(t *testing.T) {
+	if !graceful.WaitTimeout(5 * time.Second) {
+		t.Fatalf("expected the connection handlers to exit")
+	}
+	udpWg.Wait()
+}
+
+func TestConnectionLogLevel(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	for _, level := range []string{"none", "close", "all"} {
+		Cfg = &Config{GraphiteTextListenSpec: "127.0.0.1:0"}
+		if err := Cfg.ConnectionLogLevel.UnmarshalText([]byte(level)); err != nil {
+			t.Fatalf("UnmarshalText(%q): %v", level, err)
+		}
+		gt := &graphiteTextServiceManager{t: transceiver.New(nil, nil)}
+		if err := gt.Start(nil); err != nil {
+			t.Fatalf("Start(): %v", err)
+		}
+		conn, err := net.Dial("tcp", gt.listeners[0].Addr().String())
+		if err != nil {
+			t.Fatalf("Dial(): %v", err)
+		}
+		fmt.Fprintf(conn, "foo.bar 1 %d\n", time.Now().Unix())
+		conn.Close()
+		waitHandlers(t) // let it be handled
+		gt.Stop()
+
+		logged := out.String()
+		accepted := strings.Contains(logged, "accepted connection from")
+		closed := strings.Contains(logged, "closed connection from") && strings.Contains(logged, "1 data points")
+		if accepted != (level == "all") || closed != (level != "none") {
+			t.Errorf("level %q: unexpected connection logging: %q", level, logged)
+		}
+		out.Lock()
+		out.buf.Reset()
+		out.Unlock()
+	}
+
+	var l connLogLevel
+	if err := l.UnmarshalText([]byte("verbose")); err == nil {
+		t.Errorf("expected an error for an invalid level")
+	}
+}
+
+func TestLogFormat(t *testing.T) {
+	out := &syncBuffer{}
+	flags, prefix := log.Flags(), log.Prefix()
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+		log.SetPrefix(prefix)
+	}()
+
+	Cfg = &Config{}
+	if _, err := toml.Decode("log-format = \"json\"\nlog-level = \"debug\"", Cfg); err != nil {
+		t.Fatalf("toml.Decode(): %v", err)
+	}
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(logOutput(out))
+
+	client, server := net.Pipe()
+	go func() {
+		fmt.Fprintf(client, "foo.bar\n")
+		client.Close()
+	}()
+	readGraphiteText("test", graphiteTextCounters, transceiver.New(nil, nil), server, 0, "")
+	log.Printf("not logged with fields")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", lines)
+	}
+	var bad, plain map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &bad); err != nil {
+		t.Fatalf("expected JSON, got %q: %v", lines[0], err)
+	}
+	if bad["proto"] != "graphite-text" || bad["remote_addr"] != "pipe" || !strings.Contains(fmt.Sprint(bad["error"]), "foo.bar") ||
+		!strings.HasPrefix(fmt.Sprint(bad["msg"]), "test: bad packet") || bad["time"] == nil || bad["pid"] == nil {
+		t.Errorf("unexpected fields: %v", bad)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &plain); err != nil || plain["msg"] != "not logged with fields" {
+		t.Errorf("expected a plain line to become JSON, got %q: %v", lines[1], err)
+	}
+
+	// The text format is unchanged
+	out.Lock()
+	out.buf.Reset()
+	out.Unlock()
+	Cfg.LogFormat = logFormatText
+	log.SetOutput(logOutput(out))
+	logFields{"proto": "graphite-text", "error": fmt.Errorf("oops")}.Printf("foo: %v", "oops")
+	if logged := out.String(); logged != "foo: oops\n" {
+		t.Errorf("expected the text format to be unchanged, got %q", logged)
+	}
+
+	var f logFormat
+	if err := f.UnmarshalText([]byte("xml")); err == nil {
+		t.Errorf("expected an error for an invalid log-format")
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	defer func(d time.Duration) { parseErrorSummaryInterval = d }(parseErrorSummaryInterval)
+	parseErrorSummaryInterval = 20 * time.Millisecond
+	parseErrors = &parseErrorSummary{} // not one pending with another interval
+	defer log.SetOutput(os.Stderr)
+
+	for _, c := range []struct {
+		level            string
+		perLine, summary bool
+	}{
+		{"debug", true, false},
+		{"info", false, true},
+		{"warn", false, true},
+		{"error", false, false},
+	} {
+		out := &syncBuffer{}
+		log.SetOutput(out)
+		Cfg = &Config{}
+		if err := Cfg.LogLevel.UnmarshalText([]byte(c.level)); err != nil {
+			t.Fatalf("UnmarshalText(%q): %v", c.level, err)
+		}
+
+		client, server := net.Pipe()
+		go func() {
+			fmt.Fprintf(client, "foo.a\nfoo.b\nfoo.c\n")
+			client.Close()
+		}()
+		remote := &remoteConn{server, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}}
+		readGraphiteText("test", graphiteTextCounters, transceiver.New(nil, nil), remote, 0, "")
+		time.Sleep(3 * parseErrorSummaryInterval) // let it be summarized
+
+		logged := out.String()
+		if perLine := strings.Count(logged, "bad packet") == 3; perLine != c.perLine {
+			t.Errorf("level %q: unexpected per-line logging: %q", c.level, logged)
+		}
+		if summary := strings.Contains(logged, "3 graphite-text parse errors from 10.0.0.1 in the last"); summary != c.summary {
+			t.Errorf("level %q: unexpected summary: %q", c.level, logged)
+		}
+	}
+
+	var l logLevel
+	if err := l.UnmarshalText([]byte("verbose")); err == nil {
+		t.Errorf("expected an error for an invalid log-level")
+	}
+}
+
+// namesSerDe only knows the names of some existing series.
+type namesSerDe struct {
+	names map[string]int64
+}
+
+func (f *namesSerDe) CreateOrReturnDataSource(name string, dsSpec *rrd.DSSpec) (*rrd.DataSource, error) {
+	return nil, nil
+}
+func (f *namesSerDe) FetchDataSource(id int64) (*rrd.DataSource, error) { return nil, nil }
+func (f *namesSerDe) FetchDataSources() ([]*rrd.DataSource, error)      { return nil, nil }
+func (f *namesSerDe) FetchDataSourceNames() (map[string]int64, error)   { return f.names, nil }
+func (f *namesSerDe) FlushDataSource(ds *rrd.DataSource) error          { return nil }
+func (f *namesSerDe) SeriesQuery(ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
+	return nil, nil
+}
+func (f *namesSerDe) ListDbClientIps() ([]string, error) { return nil, nil }
+func (f *namesSerDe) MyDbAddr() (*string, error)         { return nil, nil }
+
+func TestPickleMaxSeriesDrops(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{}
+	tr := transceiver.New(nil, &namesSerDe{names: map[string]int64{"foo.a": 1, "foo.b": 2}})
+	if err := tr.Rcache.Reload(); err != nil {
+		t.Fatalf("Rcache.Reload(): %v", err)
+	}
+	tr.MaxSeries = 2
+	// The cap applies to the series as renamed, Foo.A is foo.a
+	rule := &transceiver.SeriesAliasRule{}
+	if err := rule.UnmarshalText([]byte(`^Foo\.A$ foo.a`)); err != nil {
+		t.Fatalf("UnmarshalText(): %v", err)
+	}
+	tr.SeriesAliasRules = []*transceiver.SeriesAliasRule{rule}
+
+	now := time.Now().Unix()
+	var items []interface{}
+	for _, name := range []string{"foo.a", "foo.b", "foo.c", "foo.d", "Foo.A", "foo.e"} {
+		items = append(items, []interface{}{name, []interface{}{now, 1.0}})
+	}
+	var buf bytes.Buffer
+	if _, err := pickle.NewPickler(&buf).Pickle(items); err != nil {
+		t.Fatalf("Pickle(): %v", err)
+	}
+
+	server, client := net.Pipe()
+	go func() {
+		client.Write(buf.Bytes())
+		client.Close()
+	}()
+	handleGraphitePickleProtocol(tr, server, 0)
+
+	if logged := out.String(); !strings.Contains(logged, "dropped 3 data points for new series, max-series (2) reached") {
+		t.Errorf("expected 3 drops to be reported, got %q", logged)
+	}
+	if n := strings.Count(out.String(), "WARNING: max-series (2) reached"); n != 1 {
+		t.Errorf("expected the cap to be warned about once, got %d times", n)
+	}
+	if n := tr.Stats().RejectedSeriesFull; n != 3 {
+		t.Errorf("expected 3 rejected for max-series, got %d", n)
+	}
+}
+
+func TestPickleFloatTimestamps(t *testing.T) {
+	Cfg = &Config{}
+	tr := transceiver.New(nil, nil)
+	sub, _ := tr.Subscribe("*", 3)
+	items := []interface{}{
+		[]interface{}{"foo.a", []interface{}{1465839830.0, 1.0}},
+		[]interface{}{"foo.b", []interface{}{1465839840.7, int64(2)}},
+		[]interface{}{"foo.c", []interface{}{int64(1465839850), 3.0}},
+	}
+	if n, _ := queuePickleItems(tr, graphitePickleCounters.from(nil), items); n != 3 {
+		t.Fatalf("expected 3 queued, got %d", n)
+	}
+	for _, expect := range []int64{1465839830, 1465839840, 1465839850} {
+		if dp := <-sub.C; dp.TimeStamp.Unix() != expect {
+			t.Errorf("%s: expected a time stamp of %d, got %v", dp.Name, expect, dp.TimeStamp.Unix())
+		}
+	}
+
+	// Neither an int nor a float is still a bad item, whatever the value
+	for _, value := range []interface{}{1.0, int64(1)} {
+		items = []interface{}{[]interface{}{"foo.a", []interface{}{"yesterday", value}}}
+		if n, _ := queuePickleItems(tr, graphitePickleCounters.from(nil), items); n != 0 {
+			t.Errorf("expected a string time stamp to be skipped (value %v), got %d queued", value, n)
+		}
+	}
+}
+
+func TestPickleBadItem(t *testing.T) {
+	Cfg = &Config{}
+	tr := transceiver.New(nil, nil)
+	sub, _ := tr.Subscribe("*", 3)
+	now := time.Now().Unix()
+	items := []interface{}{
+		[]interface{}{"foo.a", []interface{}{now, 1.0}},
+		[]interface{}{"foo.b", []interface{}{now}},
+		[]interface{}{"foo.c", []interface{}{now, 3.0}},
+		"not a tuple",
+		[]interface{}{"foo.d", []interface{}{now, int64(4)}},
+		[]interface{}{"foo.e", []interface{}{"yesterday", int64(5)}},
+	}
+	before := atomic.LoadInt64(&graphitePickleCounters.parseErrors)
+	if n, _ := queuePickleItems(tr, graphitePickleCounters.from(nil), items); n != 3 {
+		t.Fatalf("expected the 3 good items queued, got %d", n)
+	}
+	if errs := atomic.LoadInt64(&graphitePickleCounters.parseErrors) - before; errs != 3 {
+		t.Errorf("expected 3 parse errors, got %d", errs)
+	}
+	for _, expect := range []string{"foo.a", "foo.c", "foo.d"} {
+		if dp := <-sub.C; dp.Name != expect {
+			t.Errorf("expected %s, got %s", expect, dp.Name)
+		}
+	}
+}
+
+func TestPickleGzip(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+
+	var plain bytes.Buffer
+	now := time.Now().Unix()
+	for _, name := range []string{"foo.a", "foo.b"} {
+		item := []interface{}{[]interface{}{name, []interface{}{now, 1.0}}}
+		if _, err := pickle.NewPickler(&plain).Pickle(item); err != nil {
+			t.Fatalf("Pickle(): %v", err)
+		}
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(plain.Bytes())
+	gz.Close()
+
+	for _, tc := range []struct {
+		desc    string
+		allow   bool
+		payload []byte
+		want    string
+	}{
+		{"plain", true, plain.Bytes(), "2 data points"},
+		{"gzip", true, compressed.Bytes(), "2 data points"},
+		{"gzip not allowed", false, compressed.Bytes(), "Error reading"},
+	} {
+		out := &syncBuffer{}
+		log.SetOutput(out)
+		Cfg = &Config{ConnectionLogLevel: connLogClose, GraphitePickleAllowGzip: tc.allow}
+		server, client := net.Pipe()
+		go func() {
+			client.Write(tc.payload)
+			client.Close()
+		}()
+		handleGraphitePickleProtocol(transceiver.New(nil, nil), server, 0)
+		if logged := out.String(); !strings.Contains(logged, tc.want) {
+			t.Errorf("%s: expected %q in the log, got %q", tc.desc, tc.want, logged)
+		}
+	}
+}
+
+func TestPickleFraming(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+
+	now := time.Now().Unix()
+	var framed, bare bytes.Buffer
+	for _, name := range []string{"foo.a", "foo.b"} {
+		item := []interface{}{[]interface{}{name, []interface{}{now, 1.0}}}
+		if err := writePickleFrame(&framed, item); err != nil {
+			t.Fatalf("writePickleFrame(): %v", err)
+		}
+		if _, err := pickle.NewPickler(&bare).Pickle(item); err != nil {
+			t.Fatalf("Pickle(): %v", err)
+		}
+		if name == "foo.a" {
+			// a bad frame in between is skipped
+			framed.Write([]byte{0, 0, 0, 3, 'x', 'y', 'z'})
+		}
+	}
+
+	for _, tc := range []struct {
+		desc    string
+		framing pickleFraming
+		payload []byte
+		want    string
+	}{
+		{"auto, framed", pickleFramingAuto, framed.Bytes(), "2 data points"},
+		{"auto, bare", pickleFramingAuto, bare.Bytes(), "2 data points"},
+		{"length", pickleFramingLength, framed.Bytes(), "2 data points"},
+		{"none", pickleFramingNone, bare.Bytes(), "2 data points"},
+		{"length, bare", pickleFramingLength, bare.Bytes(), "exceeds"},
+	} {
+		out := &syncBuffer{}
+		log.SetOutput(out)
+		Cfg = &Config{ConnectionLogLevel: connLogClose, GraphitePickleFraming: tc.framing}
+		server, client := net.Pipe()
+		go func() {
+			client.Write(tc.payload)
+			client.Close()
+		}()
+		handleGraphitePickleProtocol(transceiver.New(nil, nil), server, 0)
+		if logged := out.String(); !strings.Contains(logged, tc.want) {
+			t.Errorf("%s: expected %q in the log, got %q", tc.desc, tc.want, logged)
+		}
+	}
+
+	var f pickleFraming
+	if err := f.UnmarshalText([]byte("bogus")); err == nil {
+		t.Errorf("expected an error for an invalid graphite-pickle-framing")
+	}
+}
+
+func TestPickleTopLevelNotList(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{ConnectionLogLevel: connLogClose, LogLevel: logLevelDebug}
+	tr := transceiver.New(nil, nil)
+
+	now := time.Now().Unix()
+	var buf bytes.Buffer
+	for _, obj := range []interface{}{
+		"not a list",
+		[]interface{}{
+			[]interface{}{"foo.a", []interface{}{now, 1.0}},
+			[]interface{}{"foo.b", []interface{}{now, 2.0}},
+		},
+	} {
+		if _, err := pickle.NewPickler(&buf).Pickle(obj); err != nil {
+			t.Fatalf("Pickle(): %v", err)
+		}
+	}
+
+	server, client := net.Pipe()
+	go func() {
+		client.Write(buf.Bytes())
+		client.Close()
+	}()
+	handleGraphitePickleProtocol(tr, server, 0)
+
+	logged := out.String()
+	if !strings.Contains(logged, "top-level object is not a list") {
+		t.Errorf("expected the bad pickle to be logged, got %q", logged)
+	}
+	if !strings.Contains(logged, "2 data points") {
+		t.Errorf("expected the valid pickle to be processed, got %q", logged)
+	}
+}
+
+// msgpackFrame is v MessagePack encoded, prefixed with its length.
+func msgpackFrame(t testing.TB, v interface{}) []byte {
+	b, err := msgpack.Marshal(v)
+	if err != nil {
+		t.Fatalf("msgpack.Marshal(): %v", err)
+	}
+	return append([]byte{byte(len(b) >> 24), byte(len(b) >> 16), byte(len(b) >> 8), byte(len(b))}, b...)
+}
+
+func TestMsgpackProtocol(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{ConnectionLogLevel: connLogClose, LogLevel: logLevelDebug}
+	now := time.Now().Unix()
+	var buf bytes.Buffer
+	buf.Write(msgpackFrame(t, []interface{}{[]interface{}{"foo.a", []interface{}{now, 1.0}}}))
+	buf.Write([]byte{0, 0, 0, 3, 0xc1, 'y', 'z'}) // a bad message in between is skipped
+	buf.Write(msgpackFrame(t, "not an array"))
+	buf.Write(msgpackFrame(t, []interface{}{
+		[]interface{}{"foo.b", []interface{}{now, int64(2)}},
+		[]interface{}{"foo.c", []interface{}{now}},
+	}))
+
+	server, client := net.Pipe()
+	go func() {
+		client.Write(buf.Bytes())
+		client.Close()
+	}()
+	handleMsgpackProtocol(transceiver.New(nil, nil), server, 0)
+
+	logged := out.String()
+	for _, want := range []string{"bad message", "not an array", "dp wrong length", "2 data points"} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("expected %q in the log, got %q", want, logged)
+		}
+	}
+}
+
+// A batch as carbon sends them, to compare decoding it pickled and
+// MessagePack encoded.
+func benchBatch() []interface{} {
+	now := time.Now().Unix()
+	items := make([]interface{}, 500)
+	for i := range items {
+		items[i] = []interface{}{fmt.Sprintf("foo.bar.%d", i), []interface{}{now, float64(i) * 1.5}}
+	}
+	return items
+}
+
+// walkBatch type checks the items the way queuePickleItems does.
+func walkBatch(b *testing.B, obj interface{}) {
+	items, err := pickle.ListOrTuple(obj, nil)
+	for _, item := range items {
+		itemSlice, _ := pickle.ListOrTuple(item, err)
+		_, err = pickle.String(itemSlice[0], err)
+		dp, _ := pickle.ListOrTuple(itemSlice[1], err)
+		_, err = pickle.Int(dp[0], err)
+		_, err = pickle.Float(dp[1], err)
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkPickleBatch(b *testing.B) {
+	var buf bytes.Buffer
+	if _, err := pickle.NewPickler(&buf).Pickle(benchBatch()); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(buf.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		obj, err := pickle.Unpickle(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			b.Fatal(err)
+		}
+		walkBatch(b, obj)
+	}
+}
+
+func BenchmarkMsgpackBatch(b *testing.B) {
+	msg, err := msgpack.Marshal(benchBatch())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		obj, err := msgpack.Unmarshal(msg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		walkBatch(b, obj)
+	}
+}
+
+func TestGraphiteAutoProtocol(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+
+	now := time.Now().Unix()
+	var framed, bare bytes.Buffer
+	item := []interface{}{[]interface{}{"foo.a", []interface{}{now, 1.0}}}
+	if err := writePickleFrame(&framed, item); err != nil {
+		t.Fatalf("writePickleFrame(): %v", err)
+	}
+	if _, err := pickle.NewPickler(&bare).Pickle(item); err != nil {
+		t.Fatalf("Pickle(): %v", err)
+	}
+	text := []byte(fmt.Sprintf("foo.a 1 %d\nfoo.b 2 %d\n", now, now))
+
+	for _, tc := range []struct {
+		desc    string
+		bytes   []int
+		payload []byte
+		want    string
+	}{
+		{"text", nil, text, "2 data points"},
+		{"framed pickle", nil, framed.Bytes(), "1 data points"},
+		{"bare pickle", nil, bare.Bytes(), "1 data points"},
+		{"overridden", []int{'f'}, text, "handleGraphitePickleProtocol()"},
+	} {
+		out := &syncBuffer{}
+		log.SetOutput(out)
+		Cfg = &Config{ConnectionLogLevel: connLogClose}
+		Cfg.GraphiteAutoPickleBytes = tc.bytes
+		if err := Cfg.processGraphiteAuto(); err != nil {
+			t.Fatalf("processGraphiteAuto(): %v", err)
+		}
+		server, client := net.Pipe()
+		go func() {
+			client.Write(tc.payload)
+			client.Close()
+		}()
+		handleGraphiteAutoProtocol(transceiver.New(nil, nil), server)
+		if logged := out.String(); !strings.Contains(logged, tc.want) {
+			t.Errorf("%s: expected %q in the log, got %q", tc.desc, tc.want, logged)
+		}
+	}
+
+	Cfg = &Config{GraphiteAutoPickleBytes: []int{256}}
+	if err := Cfg.processGraphiteAuto(); err == nil {
+		t.Errorf("expected an error for a graphite-auto-pickle-bytes value that is not a byte")
+	}
+}
+
+// fileService is a service with (inherited) files.
+type fileService struct{ files []*os.File }
+
+func (s *fileService) Files() []*os.File            { return s.files }
+func (s *fileService) Start(files []*os.File) error { s.files = files; return nil }
+func (s *fileService) Stop()                        {}
+
+func TestGracefulFdsChangedServices(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// The parent has gt (on two listen specs), gp and www running,
+	// gu is not listening.
+	parent := &ServiceManager{services: serviceMap{
+		"gt":  &fileService{[]*os.File{os.Stdin, r}},
+		"gu":  &fileService{},
+		"gp":  &fileService{[]*os.File{os.Stdout}},
+		"www": &fileService{[]*os.File{os.Stderr}},
+	}}
+	files, protos, mapping := parent.listenerFilesAndProtocols()
+	if len(files) != 4 || len(strings.Split(protos, ",")) != 4 {
+		t.Fatalf("expected 4 files, got %v (%q)", files, protos)
+	}
+
+	// The child (e.g. a newer version with a mon service) goes by the
+	// mapping, not by the positional list, which is out of date.
+	fds, err := gracefulFds(mapping, "gu,gt,www,gp")
+	if err != nil {
+		t.Fatalf("gracefulFds(): %v", err)
+	}
+	for n, f := range files {
+		var (
+			name string
+			i    int
+		)
+		for k, s := range parent.services {
+			for j, sf := range s.Files() {
+				if sf == f {
+					name, i = k, j
+				}
+			}
+		}
+		// The files of a service are adopted in the same order.
+		if len(fds[name]) <= i || fds[name][i] != n {
+			t.Errorf("%s: expected to adopt file %d, got %v", name, n, fds[name])
+		}
+	}
+	if len(fds["gt"]) != 2 {
+		t.Errorf("gt: expected to adopt 2 files, got %v", fds["gt"])
+	}
+	if _, ok := fds["gu"]; ok {
+		t.Errorf("gu: expected no file to adopt")
+	}
+	if _, ok := fds["mon"]; ok {
+		t.Errorf("mon: expected no file to adopt (new service)")
+	}
+
+	// An older parent only passes the positional list.
+	if fds, _ = gracefulFds("", "gt,www,gt"); len(fds["gt"]) != 2 || fds["gt"][1] != 2 || fds["www"][0] != 1 {
+		t.Errorf("expected positional fds, got %v", fds)
+	}
+
+	if _, err = gracefulFds("gt=x", ""); err == nil {
+		t.Errorf("expected an error for an invalid mapping")
+	}
+}
+
+func TestUdpDoubleGracefulRestart(t *testing.T) {
+	Cfg = &Config{GraphiteUdpListenSpec: "127.0.0.1:0"}
+
+	parent := &graphiteUdpTextServiceManager{}
+	if err := parent.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	addr := parent.conns[0].LocalAddr().String()
+
+	// Each restart the child adopts the previous generation's conn
+	// (which came from net.FileConn) and passes it on.
+	g := parent
+	for i := 0; i < 2; i++ {
+		files := g.Files()
+		if len(files) != 1 {
+			t.Fatalf("restart %d: expected 1 file, got %v", i+1, files)
+		}
+		f := files[0]
+		child := &graphiteUdpTextServiceManager{}
+		if err := child.Start(files); err != nil {
+			t.Fatalf("restart %d: Start(): %v", i+1, err)
+		}
+		f.Close()
+		g.Stop()
+		if a := child.conns[0].LocalAddr().String(); a != addr {
+			t.Errorf("restart %d: expected to listen on %s, got %s", i+1, addr, a)
+		}
+		g = child
+	}
+	g.Stop()
+	waitHandlers(t)
+
+	// A conn without a file is logged, not a panic.
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	if files := (&graphiteUdpTextServiceManager{conns: []net.Conn{c1}}).Files(); len(files) != 0 {
+		t.Errorf("expected no file for a %T", c1)
+	}
+	c1.Close()
+}
+
+func TestGraphiteTextProxyProtocol(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{ConnectionLogLevel: connLogClose, GraphiteTextProxyProtocol: true}
+	tr := transceiver.New(nil, nil)
+
+	for _, c := range []struct {
+		send, expect string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 2003\r\nfoo.bar 1.5 1000\n", "closed connection from 192.0.2.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 2003\r\nfoo.bar 1.5 1000\n", "closed connection from [2001:db8::1]:56324"},
+		{"foo.bar 1.5 1000\n", "expected a PROXY header"},
+	} {
+		server, client := net.Pipe()
+		go func() {
+			fmt.Fprint(client, c.send)
+			client.Close()
+		}()
+		handleGraphiteTextProtocol(tr, server, 0)
+
+		logged := out.String()
+		if !strings.Contains(logged, c.expect) {
+			t.Errorf("%q: expected %q to be logged, got %q", c.send, c.expect, logged)
+		}
+		if strings.Contains(c.send, "PROXY") && !strings.Contains(logged, "1 data points") {
+			t.Errorf("%q: expected the line after the header to be parsed, got %q", c.send, logged)
+		}
+		out.Lock()
+		out.buf.Reset()
+		out.Unlock()
+	}
+}
+
+// testTLSConfig returns a server config with a self-signed cert.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"tenant-a.example.com", "tenant-b.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate(): %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestGraphiteTLSSniPrefixes(t *testing.T) {
+	Cfg = &Config{
+		GraphiteTlsSniPrefixes: map[string]string{
+			"tenant-a.example.com": "tenant_a.",
+			"Tenant-B.Example.com": "tenant_b.",
+		},
+		GraphiteTlsDefaultPrefix: "unknown.",
+	}
+	if err := Cfg.processGraphiteTlsSniPrefixes(); err != nil {
+		t.Fatalf("processGraphiteTlsSniPrefixes(): %v", err)
+	}
+	config := testTLSConfig(t)
+
+	for sni, expect := range map[string]string{
+		"tenant-a.example.com": "tenant_a.",
+		"TENANT-B.example.com": "tenant_b.",
+		"other.example.com":    "unknown.",
+	} {
+		server, client := net.Pipe()
+		go func(sni string) {
+			tc := tls.Client(client, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+			fmt.Fprintf(tc, "foo.bar 1 %d\n", time.Now().Unix())
+			tc.Close()
+		}(sni)
+
+		tc, prefix, err := graphiteTLSHandshake(server, config)
+		if err != nil {
+			t.Fatalf("%s: graphiteTLSHandshake(): %v", sni, err)
+		}
+		if prefix != expect {
+			t.Errorf("%s: expected prefix %q, got %q", sni, expect, prefix)
+		}
+		data, _ := ioutil.ReadAll(tc)
+		if !strings.HasPrefix(string(data), "foo.bar 1 ") {
+			t.Errorf("%s: expected the line after the handshake, got %q", sni, data)
+		}
+		tc.Close()
+	}
+}
+
+func TestParseGraphitePacket(t *testing.T) {
+	Cfg = &Config{LogLevel: logLevelDebug}
+	for _, c := range []struct {
+		line  string
+		name  string
+		ts    time.Time
+		value float64
+	}{
+		{"foo.bar 12.5 1000", "foo.bar", time.Unix(1000, 0), 12.5},
+		{"foo.bar  12.5\t1000\r", "foo.bar", time.Unix(1000, 0), 12.5},
+		{"  foo.bar 12.5 1000  ", "foo.bar", time.Unix(1000, 0), 12.5},
+		{"foo.bar 12.5 1000.25", "foo.bar", time.Unix(1000, 250000000), 12.5},
+		{"foo.bar -1e3 1000", "foo.bar", time.Unix(1000, 0), -1000},
+	} {
+		name, _, ts, v, err := parseGraphitePacket(c.line)
+		if err != nil || name != c.name || !ts.Equal(c.ts) || v != c.value {
+			t.Errorf("%q: expected %s %v %v, got %s %v %v (%v)", c.line, c.name, c.value, c.ts, name, v, ts, err)
+		}
+	}
+
+	for _, line := range []string{
+		"",
+		"foo.bar",
+		"foo.bar 12.5",      // cut short
+		"foo.bar 12.5 10 x", // trailing garbage
+		"foo.bar x 1000",
+		"foo.bar 12.5 1000x",
+		"foo.bar 12.5 NaN",
+	} {
+		if _, _, _, _, err := parseGraphitePacket(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+
+	// Bad lines are skipped, not queued, CRLF line endings are fine.
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+	dps := parseGraphiteDatagram([]byte("foo.a 1 1000\r\nfoo.b 2\r\nfoo.c 3 1000.5\r\n"), graphiteUdpCounters.from(nil))
+	if len(dps) != 2 || dps[0].Name != "foo.a" || dps[1].Name != "foo.c" || dps[1].TimeStamp.UnixNano() != 1000500000000 {
+		t.Errorf("expected foo.a and foo.c, got %v", dps)
+	}
+	if !strings.Contains(out.String(), "bad packet") {
+		t.Errorf("expected the bad line to be logged, got %q", out.String())
+	}
+}
+
+func TestParseGraphiteTaggedPacket(t *testing.T) {
+	Cfg = &Config{}
+	name, tags, _, v, err := parseGraphitePacket(`disk.used;host=web01;dc=us-east;path=a\;b\=c 42 1000`)
+	if err != nil || name != "disk.used" || v != 42 {
+		t.Fatalf("expected disk.used 42, got %q %v (%v)", name, v, err)
+	}
+	if len(tags) != 3 || tags["host"] != "web01" || tags["dc"] != "us-east" || tags["path"] != "a;b=c" {
+		t.Errorf("expected host, dc and an unescaped path tag, got %v", tags)
+	}
+
+	if _, _, _, _, err := parseGraphitePacket("disk.used;host 42 1000"); err == nil {
+		t.Errorf("expected a tag without a value to be an error")
+	}
+
+	// The tag order of the client does not matter
+	dps := parseGraphiteDatagram([]byte("disk.used;host=web01;dc=us-east 1 1000\ndisk.used;dc=us-east;host=web01 2 1000\n"), graphiteUdpCounters.from(nil))
+	if len(dps) != 2 || dps[0].Name != "disk.used;dc=us-east;host=web01" || dps[1].Name != dps[0].Name {
+		t.Errorf("expected disk.used;dc=us-east;host=web01 twice, got %v", dps)
+	}
+}
+
+func TestGraphiteAllowTimestampless(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		Cfg = &Config{GraphiteAllowTimestampless: allow}
+		before := time.Now()
+		name, _, ts, v, err := parseGraphitePacket("foo.bar 12.5")
+		if !allow {
+			if err == nil {
+				t.Errorf("expected a line without a time stamp to be rejected by default")
+			}
+			continue
+		}
+		if err != nil || name != "foo.bar" || v != 12.5 {
+			t.Fatalf("expected foo.bar 12.5, got %q %v (%v)", name, v, err)
+		}
+		if ts.Before(before) || ts.After(time.Now()) {
+			t.Errorf("expected a time stamp of now, got %v", ts)
+		}
+		if _, _, ts, _, err = parseGraphitePacket("foo.bar 12.5 1000"); err != nil || ts.Unix() != 1000 {
+			t.Errorf("expected the time stamp of a three field line to be used, got %v (%v)", ts, err)
+		}
+		if _, _, _, _, err = parseGraphitePacket("foo.bar"); err == nil {
+			t.Errorf("expected a one field line to be rejected")
+		}
+	}
+
+	// Through the UDP (datagram) path
+	Cfg = &Config{GraphiteAllowTimestampless: true}
+	before := time.Now()
+	dps := parseGraphiteDatagram([]byte("foo.a 1\nfoo.b 2\n"), graphiteUdpCounters.from(nil))
+	if len(dps) != 2 {
+		t.Fatalf("expected 2 data points, got %d", len(dps))
+	}
+	for _, dp := range dps {
+		if dp.TimeStamp.Before(before) || time.Since(dp.TimeStamp) > time.Second {
+			t.Errorf("%s: expected a near-now time stamp, got %v", dp.Name, dp.TimeStamp)
+		}
+	}
+}
+
+func TestDefaultTimestampToNow(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+	Cfg = &Config{DefaultTimestampToNow: true, LogLevel: logLevelDebug}
+
+	before := time.Now()
+	dps := parseGraphiteDatagram([]byte("foo.a 1 0\nfoo.b 2\nfoo.c 3 -5\nfoo.d 4 1000\n"), graphiteUdpCounters.from(nil))
+	if len(dps) != 4 {
+		t.Fatalf("expected 4 data points, got %d", len(dps))
+	}
+	for _, dp := range dps[:3] {
+		if dp.TimeStamp.Before(before) || time.Since(dp.TimeStamp) > time.Second {
+			t.Errorf("%s: expected a near-now time stamp, got %v", dp.Name, dp.TimeStamp)
+		}
+	}
+	if ts := dps[3].TimeStamp.Unix(); ts != 1000 {
+		t.Errorf("foo.d: expected its time stamp to be kept, got %d", ts)
+	}
+	if n := strings.Count(out.String(), "using now"); n != 3 {
+		t.Errorf("expected 3 substitutions logged, got %d: %q", n, out.String())
+	}
+
+	// Through the pickle path
+	tr := transceiver.New(nil, nil)
+	sub, _ := tr.Subscribe("*", 2)
+	items := []interface{}{
+		[]interface{}{"foo.a", []interface{}{int64(0), 1.0}},
+		[]interface{}{"foo.b", []interface{}{int64(1000), 2.0}},
+	}
+	if n, _ := queuePickleItems(tr, graphitePickleCounters.from(nil), items); n != 2 {
+		t.Fatalf("expected 2 queued, got %d", n)
+	}
+	if dp := <-sub.C; dp.TimeStamp.Before(before) {
+		t.Errorf("%s: expected a near-now time stamp, got %v", dp.Name, dp.TimeStamp)
+	}
+	if dp := <-sub.C; dp.TimeStamp.Unix() != 1000 {
+		t.Errorf("%s: expected its time stamp to be kept, got %v", dp.Name, dp.TimeStamp)
+	}
+
+	// Off, 0 is kept (i.e. 1970)
+	Cfg = &Config{}
+	if ts := graphiteUdpCounters.from(nil).defaultTimestamp("foo.a", time.Unix(0, 0)); ts.Unix() != 0 {
+		t.Errorf("expected no substitution without default-timestamp-to-now, got %v", ts)
+	}
+}
+
+func TestGraphiteTextStrict(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	tr := transceiver.New(nil, nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+
+	read := func(strict bool, lines string, deadline time.Duration) (string, chan bool) {
+		Cfg = &Config{GraphiteTextStrict: strict}
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial(): %v", err)
+		}
+		server, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept(): %v", err)
+		}
+		if deadline > 0 {
+			server.SetDeadline(time.Now().Add(deadline))
+		}
+		done := make(chan bool)
+		go func() {
+			readGraphiteText("test", graphiteTextCounters, tr, server, 0, "")
+			server.Close()
+			close(done)
+		}()
+		if deadline > 0 {
+			go fmt.Fprint(client, lines) // and never read
+			return "", done
+		}
+		fmt.Fprint(client, lines)
+		client.(*net.TCPConn).CloseWrite()
+		reply, _ := ioutil.ReadAll(client)
+		client.Close()
+		return string(reply), done
+	}
+
+	reply, done := read(true, "foo.a 1 1000\nbogus\nfoo.c 3 1000\n", 0)
+	<-done
+	if !strings.HasPrefix(reply, "ERR: expected 3 fields") || strings.Count(reply, "\n") != 1 {
+		t.Errorf("strict: expected one ERR line, got %q", reply)
+	}
+	reply, done = read(false, "bogus\n", 0)
+	<-done
+	if reply != "" {
+		t.Errorf("not strict: expected nothing written back, got %q", reply)
+	}
+
+	// A client which doesn't read what's written back is closed at
+	// the deadline
+	start := time.Now()
+	_, done = read(true, strings.Repeat("bogus\n", 1<<20), 200*time.Millisecond)
+	select {
+	case <-done:
+		if elapsed := time.Now().Sub(start); elapsed < 200*time.Millisecond {
+			t.Errorf("strict: expected the handler to keep writing back until the deadline, gave up after %v", elapsed)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("strict: expected the handler to give up writing back at the deadline")
+	}
+}
+
+// dpRecorder records queued data points by name.
+type dpRecorder map[string]float64
+
+func (r dpRecorder) QueueDataPoint(name string, ts time.Time, v float64) { r[name] = v }
+
+// dpsRecorder receives the data points queued by the UDP handler.
+type dpsRecorder chan []*rrd.DataPoint
+
+func (r dpsRecorder) QueueDataPoints(dps []*rrd.DataPoint) { r <- dps }
+func (r dpsRecorder) QueueFull() bool                      { return false }
+
+func TestGraphiteUdpMultipleLines(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	saved := udpReadBufferSize
+	udpReadBufferSize = 64
+	defer func() { udpReadBufferSize = saved }()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	r := make(dpsRecorder, 2)
+	go handleGraphiteUdpTextProtocol(r, conn)
+	defer conn.Close()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer client.Close()
+
+	receive := func() []*rrd.DataPoint {
+		select {
+		case dps := <-r:
+			return dps
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for data points")
+		}
+		return nil
+	}
+
+	ts := time.Now().Unix()
+	fmt.Fprintf(client, "foo.a 1 %d\nfoo.b 2 %d\nfoo.c 3 %d\n", ts, ts, ts)
+	if dps := receive(); len(dps) != 3 || dps[0].Name != "foo.a" || dps[2].Value != 3 {
+		t.Errorf("expected 3 data points, got %v", dps)
+	}
+
+	// Larger than the buffer, the incomplete last line is dropped.
+	fmt.Fprintf(client, "foo.a 1 %d\nfoo.b 2 %d\nfoo.c 3 %d\n", ts, ts, ts)
+	fmt.Fprintf(client, "foo.long.name.a 1 %d\nfoo.long.name.b 2 %d\nfoo.long.name.c 3 %d\n", ts, ts, ts)
+	receive()
+	if dps := receive(); len(dps) != 2 || dps[1].Name != "foo.long.name.b" {
+		t.Errorf("expected the 2 complete lines, got %v", dps)
+	}
+	if !strings.Contains(out.String(), "exceeds 64 bytes") {
+		t.Errorf("expected the truncated datagram to be logged, got %q", out.String())
+	}
+}
+
+func TestSelfStats(t *testing.T) {
+	s, r, now := &selfStats{}, make(dpRecorder), time.Now()
+	s.emit(r, "self", &transceiver.Stats{}, 0, now)
+
+	graphiteTextCounters.dataPoint(3)
+	influxLineCounters.dataPoint(2)
+	graphitePickleCounters.parseError()
+	s.emit(r, "self", &transceiver.Stats{QueueDepth: 7, RejectedFiltered: 4, RejectedInvalid: 3, RejectedNameLength: 2, RejectedSeriesFull: 1, DeadLetterTotal: 6}, 2, now)
+	for name, expect := range map[string]float64{
+		"self.queue.depth":          7,
+		"self.datapoints.received":  5,
+		"self.connections.active":   2,
+		"self.parse.errors":         1,
+		"self.rejected.filtered":    4,
+		"self.rejected.invalid":     3,
+		"self.rejected.name_length": 2,
+		"self.rejected.series_full": 1,
+		"self.flush.dead_letters":   6,
+	} {
+		if v, ok := r[name]; !ok || v != expect {
+			t.Errorf("%s: expected %v, got %v (%v)", name, expect, v, ok)
+		}
+	}
+}
+
+func TestInternalStatsStop(t *testing.T) {
+	tr := transceiver.New(nil, nil)
+	sub, _ := tr.Subscribe("self.*", 1024)
+	r := &ServiceManager{t: tr}
+	r.startInternalStats("self", time.Millisecond)
+	select {
+	case <-sub.C:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the internal stats to be emitted")
+	}
+	r.stopInternalStats()
+	for len(sub.C) > 0 {
+		<-sub.C
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := len(sub.C); n != 0 {
+		t.Errorf("expected no internal stats after stopInternalStats(), got %d", n)
+	}
+	r.stopInternalStats() // a second time is fine
+}
+
+func TestStatsdUdpDatagram(t *testing.T) {
+	stats := parseStatsdDatagram([]byte("hits:1|c|@0.1\nbytes:5|c\nbogus:x|c\nrt:320|ms\nrt:100|ms|@0.5\nrt:200|ms\ntemp:42|g\n"), statsdUdpCounters.from(nil))
+	if len(stats) != 6 {
+		t.Fatalf("expected 6 stats (and one bad line), got %d", len(stats))
+	}
+
+	r := make(dpRecorder)
+	agg := statsd.NewAggregator(r, "stats")
+	for _, st := range stats {
+		if err := agg.Process(st); err != nil {
+			t.Fatalf("Process(%+v): %v", st, err)
+		}
+	}
+	agg.Flush()
+
+	// Counters are rates over the (sub-second) flush window, sampled
+	// ones scaled up: 1|c|@0.1 counts for 10.
+	if r["stats.hits"] <= 10 || math.Abs(r["stats.hits"]/r["stats.bytes"]-2) > 1e-9 {
+		t.Errorf("expected the hits rate to be twice that of bytes, got %v and %v", r["stats.hits"], r["stats.bytes"])
+	}
+	for name, expect := range map[string]float64{
+		"stats.gauges.temp":     42,
+		"stats.timers.rt.lower": 100,
+		"stats.timers.rt.upper": 320,
+		"stats.timers.rt.sum":   620,
+		"stats.timers.rt.count": 4, // one of them sampled at 0.5
+		"stats.timers.rt.mean":  620.0 / 3,
+	} {
+		if v, ok := r[name]; !ok || v != expect {
+			t.Errorf("%s: expected %v, got %v (%v)", name, expect, v, ok)
+		}
+	}
+}
+
+func TestInheritedFileListenSpecChanged(t *testing.T) {
+	freePort := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen(): %v", err)
+		}
+		defer l.Close()
+		return l.Addr().String()
+	}
+
+	for _, moved := range []bool{false, true} {
+		parent, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen(): %v", err)
+		}
+		f, err := parent.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatalf("File(): %v", err)
+		}
+		parent.Close()
+
+		spec := parent.Addr().String()
+		if moved {
+			spec = freePort()
+		}
+		Cfg = &Config{GraphiteTextListenSpec: spec}
+		g := &graphiteTextServiceManager{}
+		if err := g.Start([]*os.File{f}); err != nil {
+			t.Fatalf("moved %v: Start(): %v", moved, err)
+		}
+		if a := g.listeners[0].Addr().String(); a != spec {
+			t.Errorf("moved %v: expected to listen on %s, got %s", moved, spec, a)
+		}
+		if _, err := getsockname(f); moved != (err != nil) {
+			t.Errorf("moved %v: expected the inherited fd to be closed only if moved, got %v", moved, err)
+		}
+		g.Stop()
+		f.Close()
+	}
+
+	// UDP, and the unspecified address
+	if sameAddr("udp", "0.0.0.0:8125", net.IPv4(127, 0, 0, 1), 8125) || !sameAddr("udp", ":8125", net.IPv6zero, 8125) {
+		t.Errorf("sameAddr(): unexpected result for the unspecified address")
+	}
+}
+
+func TestMultipleListenSpecs(t *testing.T) {
+	if specs := splitListenSpecs(" 127.0.0.1:2003, ,[::1]:2003"); len(specs) != 2 || specs[1] != "[::1]:2003" {
+		t.Errorf("splitListenSpecs(): unexpected %q", specs)
+	}
+
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{GraphiteTextListenSpec: "127.0.0.1:0,127.0.0.1:0", ConnectionLogLevel: connLogClose}
+	tr := transceiver.New(nil, nil)
+	parent := &graphiteTextServiceManager{t: tr}
+	if err := parent.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	if len(parent.listeners) != 2 {
+		t.Fatalf("expected 2 listeners, got %d", len(parent.listeners))
+	}
+	addrs := []string{parent.listeners[0].Addr().String(), parent.listeners[1].Addr().String()}
+
+	// Both are passed on and adopted by the child, in order.
+	files := parent.Files()
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %v", files)
+	}
+	g := &graphiteTextServiceManager{t: tr}
+	if err := g.Start(files); err != nil {
+		t.Fatalf("Start(files): %v", err)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	parent.Stop()
+	defer g.Stop()
+
+	for i, addr := range addrs {
+		if a := g.listeners[i].Addr().String(); a != addr {
+			t.Errorf("listener %d: expected %s, got %s", i, addr, a)
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial(%s): %v", addr, err)
+		}
+		fmt.Fprintf(conn, "foo.bar 1 %d\n", time.Now().Unix())
+		conn.Close()
+	}
+	time.Sleep(50 * time.Millisecond) // let them be handled
+
+	if n := strings.Count(out.String(), "closed connection from"); n != 2 {
+		t.Errorf("expected a connection on each listener, got %d: %q", n, out.String())
+	}
+}
+
+func TestReload(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{GraphiteTextListenSpec: "127.0.0.1:0", Workers: 2,
+		MaxCache: duration{10 * time.Second}, MinCache: duration{time.Second}}
+	tr := transceiver.New(nil, nil)
+	gt, gu := &graphiteTextServiceManager{t: tr}, &graphiteUdpTextServiceManager{t: tr}
+	sm := &ServiceManager{t: tr, services: serviceMap{"gt": gt, "gu": gu}}
+	if err := sm.run(""); err != nil {
+		t.Fatalf("run(): %v", err)
+	}
+	defer sm.dropListeners()
+	listener := gt.listeners[0]
+
+	newCfg := *Cfg
+	newCfg.MaxCache = duration{20 * time.Second}
+	newCfg.Workers = 4
+	newCfg.GraphiteUdpListenSpec = "127.0.0.1:0"
+	sm.reload(&newCfg)
+
+	if tr.MaxCacheDuration != 20*time.Second {
+		t.Errorf("expected max-cache-duration to be applied, got %v", tr.MaxCacheDuration)
+	}
+	if Cfg != &newCfg || Cfg.Workers != 2 {
+		t.Errorf("expected the new config, with workers unchanged, got %v workers", Cfg.Workers)
+	}
+	if len(gt.listeners) != 1 || gt.listeners[0] != listener {
+		t.Errorf("expected the gt service not to be restarted")
+	}
+	if len(gu.conns) != 1 {
+		t.Errorf("expected the gu service to be started, got %d conns", len(gu.conns))
+	}
+	logged := out.String()
+	for _, expect := range []string{
+		`restarting the "gu" service`,
+		"applied: max-cache-duration, graphite-udp-listen-spec.",
+		"graceful restart (SIGUSR2): workers.",
+	} {
+		if !strings.Contains(logged, expect) {
+			t.Errorf("expected %q to be logged, got %q", expect, logged)
+		}
+	}
+}
+
+// A disabled service is not started (and has no files to pass on to
+// a graceful restart child) until a reload enables it.
+func TestDisabledService(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	off := false
+	Cfg = &Config{GraphiteTextListenSpec: "127.0.0.1:0", GraphitePickleListenSpec: "127.0.0.1:0", GraphitePickleEnabled: &off}
+	tr := transceiver.New(nil, nil)
+	gt, gp := &graphiteTextServiceManager{t: tr}, &graphitePickleServiceManager{t: tr}
+	sm := &ServiceManager{t: tr, services: serviceMap{"gt": gt, "gp": gp}}
+	if err := sm.run(""); err != nil {
+		t.Fatalf("run(): %v", err)
+	}
+	defer sm.dropListeners()
+
+	if files := gp.Files(); files != nil {
+		t.Errorf("expected no files from the disabled gp service, got %v", files)
+	}
+	if files, protos, _ := sm.listenerFilesAndProtocols(); len(files) != 1 || protos != "gt" {
+		t.Errorf("expected only the gt listener, got %v (%q)", files, protos)
+	}
+	if bound, missing := sm.boundServices(); len(bound) != 1 || len(missing) != 0 {
+		t.Errorf("expected gt bound and nothing missing, got %v and %v", bound, missing)
+	}
+
+	// Enable gp, disable gt
+	newCfg := *Cfg
+	newCfg.GraphitePickleEnabled, newCfg.GraphiteTextEnabled = nil, &off
+	sm.reload(&newCfg)
+	if _, protos, _ := sm.listenerFilesAndProtocols(); protos != "gp" {
+		t.Errorf("expected only the gp listener after the reload, got %q", protos)
+	}
+}
+
+func TestMaxConcurrentConnections(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{GraphiteTextListenSpec: "127.0.0.1:0", MaxConcurrentConnections: 1}
+	gt := &graphiteTextServiceManager{t: transceiver.New(nil, nil)}
+	if err := gt.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	defer gt.Stop()
+	addr := gt.listeners[0].Addr().String()
+
+	c1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	time.Sleep(50 * time.Millisecond) // let it be accepted
+	if n := gt.connectionsInUse(); n != 1 {
+		t.Errorf("expected 1 connection in use, got %d", n)
+	}
+
+	// Over the limit, closed right away
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection over the limit to be closed, got %v", err)
+	}
+	c2.Close()
+	if !strings.Contains(out.String(), "refusing connection from") {
+		t.Errorf("expected the refused connection to be logged, got %q", out.String())
+	}
+
+	serviceMgr = &ServiceManager{services: serviceMap{"gt": gt}}
+	defer func() { serviceMgr = nil }()
+	w := httptest.NewRecorder()
+	connectionsMetricsHandler(func(http.ResponseWriter, *http.Request) {})(w, httptest.NewRequest("GET", "/metrics", nil))
+	if body := w.Body.String(); !strings.Contains(body, `tgres_connections_in_use{service="gt"} 1`) {
+		t.Errorf("expected the connections in use in the metrics, got %q", body)
+	}
+
+	c1.Close()
+	time.Sleep(50 * time.Millisecond) // let it be handled
+	if n := gt.connectionsInUse(); n != 0 {
+		t.Errorf("expected no connections in use, got %d", n)
+	}
+}
+
+// flakyListener fails Accept with a temporary error fails times,
+// then accepts conn.
+type flakyListener struct {
+	net.Listener
+	fails, accepts int
+	conn           net.Conn
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.accepts++
+	if l.accepts <= l.fails {
+		return nil, tempError{}
+	}
+	return l.conn, nil
+}
+
+func TestAcceptRetrying(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{AcceptBackoffInitial: duration{time.Millisecond}, AcceptBackoffMax: duration{3 * time.Millisecond}}
+	server, client := net.Pipe()
+	defer client.Close()
+	l := &flakyListener{fails: 3, conn: server}
+	if conn, err := acceptRetrying("test", "graphite-text", l); err != nil || conn != server {
+		t.Fatalf("expected the connection after the temporary errors, got %v (%v)", conn, err)
+	}
+	if l.accepts != 4 {
+		t.Errorf("expected 4 Accept calls, got %d", l.accepts)
+	}
+	for _, retry := range []string{"retrying in 1ms", "retrying in 2ms", "retrying in 3ms"} {
+		if !strings.Contains(out.String(), retry) {
+			t.Errorf("expected %q in the log, got %q", retry, out.String())
+		}
+	}
+
+	// Any other error is returned
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	if _, err := acceptRetrying("test", "graphite-text", closed); err == nil {
+		t.Errorf("expected a non-temporary error to be returned")
+	}
+
+	// The defaults
+	Cfg = &Config{}
+	for last, expect := range map[time.Duration]time.Duration{
+		0:                       dftAcceptBackoffInitial,
+		dftAcceptBackoffInitial: 2 * dftAcceptBackoffInitial,
+		dftAcceptBackoffMax:     dftAcceptBackoffMax,
+	} {
+		if next := acceptBackoff(last); next != expect {
+			t.Errorf("acceptBackoff(%v): expected %v, got %v", last, expect, next)
+		}
+	}
+}
+
+func TestGraphitePickleTLS(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "tgres-tls")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cert := testTLSConfig(t).Certificates[0]
+	keyDer, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey(): %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "tgres.crt"), filepath.Join(dir, "tgres.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	Cfg = &Config{GraphitePickleTLSListenSpec: "127.0.0.1:0", TLSCertFile: certFile, TLSKeyFile: keyFile,
+		ConnectionLogLevel: connLogClose}
+	tr := transceiver.New(nil, nil)
+	parent := &graphitePickleTLSServiceManager{graphitePickleServiceManager{t: tr}}
+	if err := parent.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+
+	// The child still speaks TLS on the inherited listener
+	f := parent.Files()[0]
+	g := &graphitePickleTLSServiceManager{graphitePickleServiceManager{t: tr}}
+	if err := g.Start([]*os.File{f}); err != nil {
+		t.Fatalf("Start(file): %v", err)
+	}
+	f.Close()
+	parent.Stop()
+	defer g.Stop()
+	addr := g.listeners[0].Addr().String()
+
+	if _, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11}); err == nil {
+		t.Errorf("expected TLS 1.1 to be refused by default")
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial(): %v", err)
+	}
+	pickle.NewPickler(conn).Pickle([]interface{}{[]interface{}{"foo.bar", []interface{}{time.Now().Unix(), 1.0}}})
+	conn.Close()
+	time.Sleep(50 * time.Millisecond) // let it be handled
+
+	if logged := out.String(); !strings.Contains(logged, "closed connection from") || !strings.Contains(logged, "1 data points") {
+		t.Errorf("expected one data point over TLS, got %q", logged)
+	}
+
+	var v tlsVersion
+	if err := v.UnmarshalText([]byte("1.4")); err == nil {
+		t.Errorf("expected an error for an invalid TLS version")
+	}
+}
+
+func TestGraphiteTextUnixSocket(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	dir, err := ioutil.TempDir("", "tgres-unix")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "graphite.sock")
+
+	Cfg = &Config{GraphiteTextUnixListenSpec: path, UnixSocketMode: 0600, ConnectionLogLevel: connLogClose}
+	tr := transceiver.New(nil, nil)
+	parent := &graphiteTextUnixServiceManager{graphiteTextServiceManager{t: tr}}
+	if err := parent.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("expected a socket with mode 0600, got %v %v", fi, err)
+	}
+
+	// Another process must not take over a socket in use.
+	other := &graphiteTextUnixServiceManager{graphiteTextServiceManager{t: tr}}
+	if err := other.Start(nil); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("expected a socket in use to be an error, got %v", err)
+	}
+	if conn, err := net.Dial("unix", path); err != nil {
+		t.Fatalf("expected the socket to still be there, got %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// A graceful restart: the parent must not remove the socket the
+	// child has inherited.
+	files := parent.Files()
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %v", files)
+	}
+	f := files[0]
+	g := &graphiteTextUnixServiceManager{graphiteTextServiceManager{t: tr}}
+	if err := g.Start(files); err != nil {
+		t.Fatalf("Start(file): %v", err)
+	}
+	f.Close()
+	gracefulChildPid = 1
+	parent.Stop()
+	gracefulChildPid = 0
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	fmt.Fprintf(conn, "foo.bar 1 %d\n", time.Now().Unix())
+	conn.Close()
+	time.Sleep(50 * time.Millisecond) // let it be handled
+
+	if logged := out.String(); !strings.Contains(logged, "1 data points") {
+		t.Errorf("expected a data point over the unix socket, got %q", logged)
+	}
+
+	g.Stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected Stop() to remove the socket, got %v", err)
+	}
+
+	var m fileMode
+	if err := m.UnmarshalText([]byte("rw-rw----")); err == nil {
+		t.Errorf("expected an error for a non-octal mode")
+	}
+}
+
+func TestParseOpenTSDBPut(t *testing.T) {
+	name, tags, ts, v, err := parseOpenTSDBPut("put sys.cpu.user 1476123456 42.5 host=web01 cpu=0")
+	if err != nil || name != "sys.cpu.user" || v != 42.5 || ts.Unix() != 1476123456 {
+		t.Fatalf("expected sys.cpu.user 42.5 at 1476123456, got %q %v %v (%v)", name, v, ts, err)
+	}
+	if len(tags) != 2 || tags["host"] != "web01" || tags["cpu"] != "0" {
+		t.Errorf("expected the host and cpu tags, got %v", tags)
+	}
+
+	// 13 digits are milliseconds
+	if _, _, ts, _, err = parseOpenTSDBPut("put sys.cpu.user 1476123456789 1 host=web01"); err != nil || ts.UnixNano() != 1476123456789000000 {
+		t.Errorf("expected a time stamp in milliseconds, got %v (%v)", ts, err)
+	}
+
+	for _, line := range []string{
+		"sys.cpu.user 1476123456 1 host=web01",
+		"put sys.cpu.user 1476123456",
+		"put sys.cpu.user x 1 host=web01",
+		"put sys.cpu.user 1476123456 x host=web01",
+		"put sys.cpu.user 1476123456 1 host",
+	} {
+		if _, _, _, _, err := parseOpenTSDBPut(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	peers := []string{"a:2004", "b:2004", "c:2004"}
+	r := newHashRing(peers, relayVirtualNodes)
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		name := fmt.Sprintf("foo.bar%d.baz", i)
+		owners[name] = r.owner(name)
+		counts[owners[name]]++
+	}
+	for _, peer := range peers {
+		if counts[peer] < 600 || counts[peer] > 1400 {
+			t.Errorf("expected about a third of the series on %s, got %d", peer, counts[peer])
+		}
+	}
+
+	// A new peer only takes over series, the rest stay where they were
+	r = newHashRing(append(peers, "d:2004"), relayVirtualNodes)
+	moved := 0
+	for name, owner := range owners {
+		if newOwner := r.owner(name); newOwner != owner {
+			if newOwner != "d:2004" {
+				t.Fatalf("%s moved from %s to %s, not to the new peer", name, owner, newOwner)
+			}
+			moved++
+		}
+	}
+	if moved < 400 || moved > 1200 {
+		t.Errorf("expected about a quarter of the series to move, got %d", moved)
+	}
+}
+
+// relayRecorder relays everything offered to it.
+type relayRecorder struct {
+	sync.Mutex
+	names []string
+}
+
+func (r *relayRecorder) Relay(name string, ts time.Time, v float64) bool {
+	r.Lock()
+	defer r.Unlock()
+	r.names = append(r.names, name)
+	return true
+}
+func (r *relayRecorder) Stop() {}
+
+func TestPickleRelay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	peer := ln.Addr().String()
+
+	relay := newPickleRelay([]string{"self:2004", peer}, "self:2004")
+	var ours, theirs []string
+	for i := 0; len(ours) == 0 || len(theirs) == 0; i++ {
+		name := fmt.Sprintf("foo.%d", i)
+		if relay.Relay(name, time.Unix(1000, 0), float64(i)) {
+			theirs = append(theirs, name)
+		} else {
+			ours = append(ours, name)
+		}
+	}
+	relay.Stop() // sends what is queued
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	frame, err := readPickleFrame(conn)
+	if err != nil {
+		t.Fatalf("readPickleFrame(): %v", err)
+	}
+	items, err := pickle.ListOrTuple(pickle.Unpickle(bytes.NewReader(frame)))
+	if err != nil || len(items) != len(theirs) {
+		t.Fatalf("expected %d relayed items, got %v (%v)", len(theirs), items, err)
+	}
+	if item, _ := pickle.ListOrTuple(items[0], nil); len(item) != 3 || item[0] != theirs[0] {
+		t.Errorf("expected (%s, (ts, value), hops), got %v", theirs[0], item)
+	}
+
+	// The receiver queues items relayed by a peer as its own, the
+	// rest may be relayed. From a non-peer the hops are ignored, and
+	// either way a name too long is dropped.
+	Cfg = &Config{ClusterPeerIPs: map[string]bool{"10.0.0.2": true}}
+	for _, c := range []struct {
+		from    string
+		offered []string
+	}{
+		{"10.0.0.2", []string{"foo.new"}},
+		{"10.0.0.9", []string{"foo.relayed", "foo.new"}},
+	} {
+		rec := &relayRecorder{}
+		tr := transceiver.New(nil, nil)
+		tr.Relay = rec
+		tr.MaxSeriesNameLength = 11
+		var buf bytes.Buffer
+		pickle.NewPickler(&buf).Pickle([]interface{}{
+			[]interface{}{"foo.relayed", []interface{}{int64(1000), 1.0}, 1},
+			[]interface{}{"foo.too.long", []interface{}{int64(1000), 1.0}, 1},
+			[]interface{}{"foo.new", []interface{}{int64(1000), 2.0}},
+		})
+		server, client := net.Pipe()
+		go func() {
+			client.Write(buf.Bytes())
+			client.Close()
+		}()
+		handleGraphitePickleProtocol(tr, &remoteConn{server, &net.TCPAddr{IP: net.ParseIP(c.from), Port: 2004}}, 0)
+		if !reflect.DeepEqual(rec.names, c.offered) {
+			t.Errorf("from %s: expected %v to be offered to the relay, got %v", c.from, c.offered, rec.names)
+		}
+		if n := tr.Stats().RejectedNameLength; n != 1 {
+			t.Errorf("from %s: expected foo.too.long rejected for its length, got %d rejected", c.from, n)
+		}
+	}
+}
+
+func TestGraphiteTextTimeout(t *testing.T) {
+	for _, c := range []struct {
+		timeout int
+		dropped bool
+	}{
+		{1, true},
+		{3, false},
+	} {
+		Cfg = &Config{GraphiteTextListenSpec: "127.0.0.1:0", GraphiteTextTimeout: c.timeout}
+		gt := &graphiteTextServiceManager{t: transceiver.New(nil, nil)}
+		if err := gt.Start(nil); err != nil {
+			t.Fatalf("Start(): %v", err)
+		}
+		conn, err := net.Dial("tcp", gt.listeners[0].Addr().String())
+		if err != nil {
+			t.Fatalf("Dial(): %v", err)
+		}
+
+		// A line now and another after a pause longer than 1s
+		fmt.Fprintf(conn, "foo.a 1 %d\n", time.Now().Unix())
+		time.Sleep(1500 * time.Millisecond)
+		fmt.Fprintf(conn, "foo.b 2 %d\n", time.Now().Unix())
+
+		// The server closes a timed out connection, a read sees it
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		timedOut := err != nil && !isTimeout(err)
+		if timedOut != c.dropped {
+			t.Errorf("timeout %d: expected dropped %v, got %v (%v)", c.timeout, c.dropped, timedOut, err)
+		}
+		conn.Close()
+		waitHandlers(t)
+		gt.Stop()
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// fullQueue is full until emptied.
+type fullQueue struct{ full int32 }
+
+func (q *fullQueue) QueueFull() bool { return atomic.LoadInt32(&q.full) == 1 }
+
+func TestQueueFullPolicy(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{}
+	q := &fullQueue{full: 1}
+
+	// UDP drops by default
+	udp := &protocolCounters{name: "graphite-udp"}
+	if udp.admit(q, 5) || udp.dropped != 5 {
+		t.Errorf("expected 5 UDP data points dropped, got %d", udp.dropped)
+	}
+	if !strings.Contains(out.String(), "queue.full") || atomic.LoadInt64(&queueFullEvents) == 0 {
+		t.Errorf("expected a queue.full event, got %q", out.String())
+	}
+
+	// TCP blocks until there is room
+	text := &protocolCounters{name: "graphite-text"}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&q.full, 0)
+	}()
+	start := time.Now()
+	if !text.admit(q, 1) || time.Now().Sub(start) < 50*time.Millisecond || text.dropped != 0 {
+		t.Errorf("expected graphite-text to wait for room, not drop")
+	}
+
+	// Unless configured otherwise
+	if _, err := toml.Decode(`queue-full-policy = {graphite-text = "drop"}`, Cfg); err != nil {
+		t.Fatalf("toml.Decode(): %v", err)
+	}
+	if err := Cfg.processQueueFull(); err != nil {
+		t.Fatalf("processQueueFull(): %v", err)
+	}
+	atomic.StoreInt32(&q.full, 1)
+	if text.admit(q, 1) || text.dropped != 1 {
+		t.Errorf("expected graphite-text to drop when configured to")
+	}
+	if err := (&Config{QueueFullPolicy: map[string]queueFullPolicy{"carbon": queueDrop}}).processQueueFull(); err == nil {
+		t.Errorf("expected an error for an unknown protocol")
+	}
+}
+
+func TestIPRateLimiter(t *testing.T) {
+	cfg := &Config{RateLimitPerIP: 10, RateLimitExempt: []string{"10.0.0.0/8", "192.168.1.10"}}
+	if err := cfg.processRateLimit(); err != nil {
+		t.Fatalf("processRateLimit(): %v", err)
+	}
+	l := newIPRateLimiter(cfg.RateLimitPerIP, cfg.RateLimitExemptNets)
+	now := time.Now()
+	a := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1000}
+	b := &net.TCPAddr{IP: net.ParseIP("1.2.3.5"), Port: 1000}
+
+	if n := l.take(a, 15, now); n != 10 {
+		t.Errorf("expected a burst of 10, got %d", n)
+	}
+	if n := l.take(a, 1, now); n != 0 {
+		t.Errorf("expected nothing left, got %d", n)
+	}
+	if n := l.take(b, 5, now); n != 5 {
+		t.Errorf("expected another IP to have its own bucket, got %d", n)
+	}
+	if n := l.take(a, 10, now.Add(500*time.Millisecond)); n != 5 {
+		t.Errorf("expected 5 after half a second, got %d", n)
+	}
+	for _, exempt := range []string{"10.1.2.3", "192.168.1.10"} {
+		if n := l.take(&net.TCPAddr{IP: net.ParseIP(exempt)}, 1000, now); n != 1000 {
+			t.Errorf("%s: expected no limit, got %d", exempt, n)
+		}
+	}
+	if n := l.take(&net.UnixAddr{Name: "/tmp/x", Net: "unix"}, 1000, now); n != 1000 {
+		t.Errorf("unix socket: expected no limit, got %d", n)
+	}
+	if d := l.dropped(); len(d) != 1 || d["1.2.3.4"] != 11 {
+		t.Errorf("expected 11 dropped from 1.2.3.4, got %v", d)
+	}
+
+	// idle IPs are expired
+	l.take(b, 1, now.Add(2*ipRateLimiterIdle))
+	if len(l.buckets) != 1 {
+		t.Errorf("expected only the active IP to be left, got %d", len(l.buckets))
+	}
+
+	for _, bad := range []*Config{{RateLimitPerIP: -1}, {RateLimitExempt: []string{"10.0.0.0/33"}}} {
+		if err := bad.processRateLimit(); err == nil {
+			t.Errorf("%+v: expected an error", bad)
+		}
+	}
+}
+
+func TestGraphiteTextRateLimited(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{RateLimitPerIP: 2}
+	ingestRateLimiter = newIPRateLimiter(Cfg.RateLimitPerIP, nil)
+	defer func() { ingestRateLimiter = nil }()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			fmt.Fprint(conn, "foo.a 1 1\nfoo.b 1 1\nfoo.c 1 1\nfoo.d 1 1\n")
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := transceiver.New(nil, nil)
+	handleGraphiteTextProtocol(tr, conn, 0)
+	if logged := out.String(); !strings.Contains(logged, "dropped 2 data points over rate-limit-per-ip") {
+		t.Errorf("expected 2 data points to be dropped, got %q", logged)
+	}
+}
+
+func TestStdinConn(t *testing.T) {
+	out := &syncBuffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{LogLevel: logLevelDebug, LogFormat: logFormatJSON}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		fmt.Fprint(w, "foo.a 1 1000\nbogus\nfoo.b 2 1000\n")
+		w.Close()
+	}()
+
+	// What -stdin reads, the same as a graphite text connection
+	tr := transceiver.New(nil, nil)
+	readGraphiteText("test", stdinCounters, tr, stdinConn{r}, 0, "")
+	if depth := tr.Stats().QueueDepth; depth != 2 {
+		t.Errorf("expected 2 data points queued, got %d", depth)
+	}
+	if !strings.Contains(out.String(), `"proto":"stdin"`) {
+		t.Errorf("expected the bad line logged as stdin, got %q", out.String())
+	}
+	if addr := (stdinConn{r}).RemoteAddr().String(); addr != "stdin" {
+		t.Errorf("expected the remote address to be stdin, got %q", addr)
+	}
+}
+
+func TestFileTail(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(d time.Duration) { fileTailPollInterval = d }(fileTailPollInterval)
+	fileTailPollInterval = 5 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "tgres-filetail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.log")
+	if err := ioutil.WriteFile(path, []byte("old.a 1 1000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	appendTo := func(s string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(f, s)
+		f.Close()
+	}
+
+	Cfg = &Config{FileTailFiles: []string{path}, FileTailStateFile: filepath.Join(dir, "state")}
+	tr := transceiver.New(nil, nil)
+	expectDepth := func(what string, n int) {
+		for start := time.Now(); tr.Stats().QueueDepth != n && time.Since(start) < 2*time.Second; {
+			time.Sleep(time.Millisecond)
+		}
+		if depth := tr.Stats().QueueDepth; depth != n {
+			t.Fatalf("%s: expected %d data points queued, got %d", what, n, depth)
+		}
+	}
+
+	ft := &fileTailServiceManager{t: tr}
+	if err := ft.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	appendTo("foo.a 1 1000\nfoo.b 2 1000\nfoo.c 3")
+	expectDepth("from the end, a partial line pending", 2)
+	appendTo(" 1000\n")
+	expectDepth("once the line is complete", 3)
+
+	// Rotated: the new file is read from the start
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendTo("foo.d 4 1000\n")
+	expectDepth("after rotation", 4)
+	ft.Stop()
+
+	// A restart resumes where it stopped
+	appendTo("foo.e 5 1000\n")
+	ft = &fileTailServiceManager{t: tr}
+	if err := ft.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	expectDepth("after a restart", 5)
+	ft.Stop()
+
+	// Without state, file-tail-from-start reads it all
+	os.Remove(Cfg.FileTailStateFile)
+	Cfg.FileTailFromStart = true
+	ft = &fileTailServiceManager{t: tr}
+	if err := ft.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	expectDepth("from the start", 7)
+	ft.Stop()
+}
+
+func TestConnectDb(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func(d time.Duration) { dbConnectBackoff = d }(dbConnectBackoff)
+	dbConnectBackoff = time.Millisecond
+
+	for _, c := range []struct {
+		failures, retries int
+		timeout           time.Duration
+		ok                bool
+		attempts          int
+	}{
+		{0, 3, time.Minute, true, 1},
+		{2, 3, time.Minute, true, 3},                // the db came up
+		{5, 3, time.Minute, false, 4},               // out of retries
+		{1, 0, time.Minute, false, 1},               // no retries
+		{100, 100, 20 * time.Millisecond, false, 0}, // out of time
+	} {
+		Cfg = &Config{DbConnectRetries: c.retries, DbConnectTimeout: duration{c.timeout}}
+		attempts := 0
+		db, err := connectDb("DB", func() (rrd.SerDe, error) {
+			if attempts++; attempts <= c.failures {
+				return nil, fmt.Errorf("connection refused")
+			}
+			return &namesSerDe{}, nil
+		})
+		if ok := err == nil && db != nil; ok != c.ok {
+			t.Errorf("%d failures, %d retries: expected ok %v, got %v (%v)", c.failures, c.retries, c.ok, ok, err)
+		}
+		if c.attempts != 0 && attempts != c.attempts {
+			t.Errorf("%d failures, %d retries: expected %d attempts, got %d", c.failures, c.retries, c.attempts, attempts)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/serde"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The delay before the first retry of connectDb(), doubled for every
+// next one up to dbConnectMaxBackoff.
+var (
+	dbConnectBackoff    = time.Second
+	dbConnectMaxBackoff = 30 * time.Second
+)
+
+// connectDb calls open until it succeeds, for up to db-connect-retries
+// retries and db-connect-timeout in all, so that tgres can be started
+// before the database is up (e.g. in a coordinated deploy). Nothing
+// is listening until it returns.
+func connectDb(what string, open func() (rrd.SerDe, error)) (rrd.SerDe, error) {
+	deadline := time.Now().Add(Cfg.DbConnectTimeout.Duration)
+	delay := dbConnectBackoff
+	for retry := 0; ; retry++ {
+		db, err := open()
+		if err == nil || retry >= Cfg.DbConnectRetries {
+			return db, err
+		}
+		left := deadline.Sub(time.Now())
+		if left <= 0 {
+			return nil, fmt.Errorf("%v (gave up after %v)", err, Cfg.DbConnectTimeout.Duration)
+		}
+		if delay > left {
+			delay = left
+		}
+		log.Printf("connectDb(): error connecting to the %s (attempt %d of %d, retrying in %v): %v", what, retry+1, Cfg.DbConnectRetries+1, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > dbConnectMaxBackoff {
+			delay = dbConnectMaxBackoff
+		}
+	}
+}
+
+// The connection pool of the (primary) db, for /internal/db.
+var dbPool serde.DbPooler
+
+// setDbPool sizes the connection pool of db as per
+// db-max-open-conns, db-max-idle-conns and db-conn-max-lifetime, and
+// returns it (nil if db has no pool).
+func setDbPool(db rrd.SerDe) serde.DbPooler {
+	pool, ok := db.(serde.DbPooler)
+	if !ok {
+		return nil
+	}
+	pool.SetConnPool(Cfg.DbMaxOpenConns, Cfg.DbMaxIdleConns, Cfg.DbConnMaxLifetime.Duration)
+	log.Printf("DB connection pool: max open %d (0 is unlimited), max idle %d, max lifetime %v (0 is forever).",
+		Cfg.DbMaxOpenConns, Cfg.DbMaxIdleConns, Cfg.DbConnMaxLifetime.Duration)
+	return pool
+}
+
+type dbStats struct {
+	MaxOpenConnections int     `json:"maxOpenConnections"`
+	OpenConnections    int     `json:"openConnections"`
+	InUse              int     `json:"inUse"`
+	Idle               int     `json:"idle"`
+	WaitCount          int64   `json:"waitCount"`
+	WaitDuration       float64 `json:"waitDuration"` // seconds, in total
+	MaxIdleClosed      int64   `json:"maxIdleClosed"`
+	MaxLifetimeClosed  int64   `json:"maxLifetimeClosed"`
+}
+
+// internalDbHandler reports the sql.DBStats of the db connection
+// pool, to size it by.
+func internalDbHandler(w http.ResponseWriter, r *http.Request) {
+	if dbPool == nil {
+		http.Error(w, "no db connection pool", http.StatusNotFound)
+		return
+	}
+	st := dbPool.DbStats()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&dbStats{
+		MaxOpenConnections: st.MaxOpenConnections,
+		OpenConnections:    st.OpenConnections,
+		InUse:              st.InUse,
+		Idle:               st.Idle,
+		WaitCount:          st.WaitCount,
+		WaitDuration:       st.WaitDuration.Seconds(),
+		MaxIdleClosed:      st.MaxIdleClosed,
+		MaxLifetimeClosed:  st.MaxLifetimeClosed,
+	}); err != nil {
+		log.Printf("internalDbHandler(): %v", err)
+	}
+}
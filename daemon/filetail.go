@@ -0,0 +1,263 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/tgres/tgres/transceiver"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How often a tailed file is checked for more lines, a var for
+// testing.
+var fileTailPollInterval = time.Second
+
+// fileTailServiceManager tails files (file-tail-files) to which a
+// process appends graphite text lines, like tail -F: a file rotated
+// (i.e. replaced, which changes its inode) is reopened and read from
+// the start, as is a truncated one. How far each file has been read
+// is saved in file-tail-state-file, so that a restart resumes there
+// rather than ingesting lines twice. Without any saved state, a file
+// is read from its end, unless file-tail-from-start is set.
+type fileTailServiceManager struct {
+	t    *transceiver.Transceiver
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	stateLk sync.Mutex
+	state   map[string]*tailState // by path
+	dirty   bool
+}
+
+// tailState is how far a file has been read.
+type tailState struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+func (g *fileTailServiceManager) Files() []*os.File { return nil }
+
+func (g *fileTailServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	if len(cfg.FileTailFiles) == 0 {
+		logFields{"proto": "file-tail"}.Printf("Not tailing any files because file-tail-files is blank.")
+		return nil
+	}
+
+	g.state = loadTailState(cfg.FileTailStateFile)
+	g.stop = make(chan struct{})
+	for _, path := range cfg.FileTailFiles {
+		g.wg.Add(1)
+		go g.tail(path)
+	}
+
+	fmt.Printf("Graphite text tailing %s\n", strings.Join(cfg.FileTailFiles, ", "))
+	return nil
+}
+
+// Stop waits for all the lines read so far to be queued and saves
+// the state.
+func (g *fileTailServiceManager) Stop() {
+	if g.stop == nil {
+		return
+	}
+	close(g.stop)
+	g.wg.Wait()
+	g.stop = nil
+	g.saveState()
+}
+
+// tail reads the lines appended to path until stopped.
+func (g *fileTailServiceManager) tail(path string) {
+	defer g.wg.Done()
+
+	var (
+		f       *os.File
+		r       *bufio.Reader
+		inode   uint64
+		offset  int64  // of the end of the last complete line
+		partial string // a line not (yet) terminated
+		missing bool   // logged as such
+	)
+	first := true
+	for {
+		if f == nil {
+			var err error
+			if f, inode, offset, err = g.open(path, first); err != nil {
+				if !missing {
+					log.Printf("fileTailServiceManager: %v, waiting for it.", err)
+					missing = true
+				}
+			} else {
+				r, partial, missing = bufio.NewReader(f), "", false
+			}
+			first = false
+		}
+
+		if f != nil {
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					partial += line
+					break
+				}
+				offset += int64(len(partial) + len(line))
+				queueTailedLine(g.t, partial+line)
+				partial = ""
+			}
+			g.setState(path, inode, offset)
+
+			// At the end of the file, has it been rotated or truncated?
+			if st, err := os.Stat(path); err == nil {
+				if fileInode(st) != inode {
+					log.Printf("fileTailServiceManager: %s was rotated, reopening it.", path)
+					f.Close()
+					f = nil
+					continue
+				} else if st.Size() < offset+int64(len(partial)) {
+					log.Printf("fileTailServiceManager: %s was truncated, reading it from the start.", path)
+					f.Seek(0, io.SeekStart)
+					r.Reset(f)
+					offset, partial = 0, ""
+					continue
+				}
+			}
+		}
+
+		select {
+		case <-g.stop:
+			if f != nil {
+				f.Close()
+			}
+			return
+		case <-time.After(fileTailPollInterval):
+			g.saveState()
+		}
+	}
+}
+
+// open opens path at where it was last read. If there is no state
+// for it, the first time (i.e. at startup) it is at the end, unless
+// file-tail-from-start is set, otherwise (e.g. a rotated file) at the
+// start.
+func (g *fileTailServiceManager) open(path string, first bool) (*os.File, uint64, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, 0, err
+	}
+	inode := fileInode(st)
+
+	var offset int64
+	g.stateLk.Lock()
+	saved := g.state[path]
+	g.stateLk.Unlock()
+	if saved != nil && saved.Inode == inode && saved.Offset <= st.Size() {
+		offset = saved.Offset
+	} else if first && !currentCfg().FileTailFromStart {
+		offset = st.Size()
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, 0, err
+	}
+	log.Printf("fileTailServiceManager: tailing %s from offset %d.", path, offset)
+	return f, inode, offset, nil
+}
+
+func fileInode(st os.FileInfo) uint64 {
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		return uint64(sys.Ino)
+	}
+	return 0
+}
+
+// queueTailedLine parses and queues a graphite text line, the same
+// as one received over the network.
+func queueTailedLine(t *transceiver.Transceiver, line string) {
+	if line = strings.TrimSpace(line); line == "" {
+		return
+	}
+	if name, tags, ts, v, err := parseGraphitePacket(line); err != nil {
+		fileTailCounters.from(nil).logParseError(err, "fileTailServiceManager: bad packet: %v", err)
+		fileTailCounters.parseError()
+	} else if fileTailCounters.admit(t, 1) {
+		t.QueueDataPointTagged(name, tags, fileTailCounters.from(nil).defaultTimestamp(name, ts), v)
+		fileTailCounters.dataPoint(1)
+	}
+}
+
+func (g *fileTailServiceManager) setState(path string, inode uint64, offset int64) {
+	g.stateLk.Lock()
+	defer g.stateLk.Unlock()
+	if s := g.state[path]; s == nil || s.Inode != inode || s.Offset != offset {
+		g.state[path] = &tailState{Inode: inode, Offset: offset}
+		g.dirty = true
+	}
+}
+
+// saveState writes the state to file-tail-state-file (if anything
+// has changed), by way of a temporary file so that it is never
+// half-written.
+func (g *fileTailServiceManager) saveState() {
+	cfg := currentCfg()
+	g.stateLk.Lock()
+	defer g.stateLk.Unlock()
+	if !g.dirty || cfg.FileTailStateFile == "" {
+		return
+	}
+	data, _ := json.Marshal(g.state)
+	tmp := cfg.FileTailStateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		log.Printf("fileTailServiceManager: unable to save the state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, cfg.FileTailStateFile); err != nil {
+		log.Printf("fileTailServiceManager: unable to save the state: %v", err)
+		return
+	}
+	g.dirty = false
+}
+
+func loadTailState(path string) map[string]*tailState {
+	state := make(map[string]*tailState)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("fileTailServiceManager: unable to read the state, reading all files anew: %v", err)
+		}
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("fileTailServiceManager: %s: %v, reading all files anew.", filepath.Base(path), err)
+		return make(map[string]*tailState)
+	}
+	return state
+}
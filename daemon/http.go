@@ -16,24 +16,180 @@
 package daemon
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/tgres/tgres/graceful"
 	h "github.com/tgres/tgres/http"
 	x "github.com/tgres/tgres/transceiver"
-	"net"
 	"net/http"
+	"sort"
 	"time"
 )
 
-func httpServer(addr string, l net.Listener, t *x.Transceiver) {
+// httpServer serves the API on each of the listeners.
+func httpServer(listeners []*graceful.Listener, t *x.Transceiver) {
+	cfg := currentCfg()
 
-	http.HandleFunc("/metrics/find", h.GraphiteMetricsFindHandler(t))
-	http.HandleFunc("/render", h.GraphiteRenderHandler(t))
-	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "OK\n") })
+	// A mux of its own (rather than the DefaultServeMux), because
+	// the service may be restarted by reload().
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics/find", gzipHandler(queryTimeoutHandler(h.GraphiteMetricsFindHandler(t))))
+	mux.HandleFunc("/render", gzipHandler(queryTimeoutHandler(h.GraphiteRenderHandler(t, cfg.EmptyRenderPolicy, cfg.RenderMaxSeries))))
+	mux.HandleFunc("/query", gzipHandler(queryTimeoutHandler(h.QueryHandler(t, cfg.RenderMaxSeries))))
+	mux.HandleFunc("/annotations", h.AnnotationsHandler(t))
+	// The Grafana SimpleJSON datasource URL is http://<host>/simplejson
+	mux.HandleFunc("/simplejson/", h.SimpleJSONTestHandler())
+	mux.HandleFunc("/simplejson/search", h.SimpleJSONSearchHandler(t))
+	mux.HandleFunc("/simplejson/query", gzipHandler(queryTimeoutHandler(h.SimpleJSONQueryHandler(t))))
+	mux.HandleFunc("/write", h.InfluxWriteHandler(t))
+	mux.HandleFunc("/api/v1/write", func(w http.ResponseWriter, r *http.Request) {
+		// looked up on every request, so that a reload() applies it
+		h.PrometheusWriteHandler(t, currentCfg().IngestMaxBodySize)(w, r)
+	})
+	mux.HandleFunc("/ingest", func(w http.ResponseWriter, r *http.Request) {
+		// looked up on every request, so that a reload() applies it
+		h.IngestHandler(t, currentCfg().IngestMaxBodySize)(w, r)
+	})
+	mux.HandleFunc("/series", func(w http.ResponseWriter, r *http.Request) {
+		// looked up on every request, so that a reload() applies it
+		if !currentCfg().DeleteEnabled {
+			http.NotFound(w, r)
+			return
+		}
+		h.DeleteSeriesHandler(t)(w, r)
+	})
+	mux.HandleFunc("/rename", func(w http.ResponseWriter, r *http.Request) {
+		// looked up on every request, so that a reload() applies it
+		cfg := currentCfg()
+		if !cfg.DeleteEnabled {
+			http.NotFound(w, r)
+			return
+		}
+		h.RenameSeriesHandler(t, cfg.RenameExisting)(w, r)
+	})
+	mux.HandleFunc("/live", h.LiveHandler(t))
+	mux.HandleFunc("/stats", h.StatsHandler(t))
+	mux.HandleFunc("/internal/stats", internalStatsHandler(t))
+	mux.HandleFunc("/internal/sources", internalSourcesHandler)
+	mux.HandleFunc("/internal/db", internalDbHandler)
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "OK\n") })
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { fmt.Fprintf(w, "OK\n") })
+	mux.HandleFunc("/readyz", readyzHandler(t))
 
-	server := &http.Server{
-		Addr:           addr,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 16}
-	server.Serve(l)
+	if cfg.MonitoringListenSpec == "" {
+		// No dedicated monitoring listener, share this one.
+		addMonitoringHandlers(mux, t)
+	}
+
+	// looked up on every request, so that a reload() applies it
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// CORS outside of the auth, a preflight carries no credentials
+		cfg := currentCfg()
+		authed := h.BasicAuthHandler(mux, cfg.HttpBasicAuthUsers, cfg.HttpBasicAuthExempt)
+		h.CorsHandler(authed, cfg.HttpCorsAllowOrigin).ServeHTTP(w, r)
+	})
+
+	for _, l := range listeners {
+		server := &http.Server{
+			Addr:           l.Addr().String(),
+			Handler:        handler,
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   10 * time.Second,
+			MaxHeaderBytes: 1 << 16}
+		go server.Serve(l)
+	}
+}
+
+type readiness struct {
+	Ready     bool     `json:"ready"`
+	Listening []string `json:"listening"`         // the services which are bound
+	Missing   []string `json:"missing,omitempty"` // configured, but not bound
+	DbError   string   `json:"dbError,omitempty"` // if the database cannot be reached
+}
+
+// readyzHandler (a readiness probe) responds 200 once the listeners
+// of all the services with a listen spec are bound and the database
+// can be reached, otherwise 503.
+func readyzHandler(t interface {
+	Ping() error
+}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rd := &readiness{Listening: []string{}}
+		if serviceMgr != nil {
+			rd.Listening, rd.Missing = serviceMgr.boundServices()
+		} else {
+			rd.Missing = []string{"all"}
+		}
+		if err := t.Ping(); err != nil {
+			rd.DbError = err.Error()
+		}
+		rd.Ready = len(rd.Missing) == 0 && rd.DbError == ""
+
+		w.Header().Set("Content-Type", "application/json")
+		if !rd.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(rd)
+	}
+}
+
+// queryTimeoutHandler looks up query-timeout on every request, so
+// that a reload() applies it.
+func queryTimeoutHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.QueryTimeoutHandler(handler, currentCfg().QueryTimeout.Duration)(w, r)
+	}
+}
+
+// gzipHandler looks up http-gzip-min-size on every request, so that
+// a reload() applies it.
+func gzipHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.GzipHandler(handler, currentCfg().HttpGzipMinSize)(w, r)
+	}
+}
+
+func addMonitoringHandlers(mux *http.ServeMux, t *x.Transceiver) {
+	mux.HandleFunc("/metrics", connectionsMetricsHandler(h.MetricsHandler(t)))
+	mux.HandleFunc("/health", h.HealthHandler())
+	addPprofHandlers(mux)
+}
+
+// connectionsMetricsHandler adds the connections in use by service
+// to the transceiver metrics.
+func connectionsMetricsHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r)
+		if serviceMgr == nil {
+			return
+		}
+		inUse := serviceMgr.connectionsInUse()
+		names := make([]string, 0, len(inUse))
+		for name := range inUse {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "# TYPE tgres_connections_in_use gauge\n")
+		for _, name := range names {
+			fmt.Fprintf(w, "tgres_connections_in_use{service=%q} %d\n", name, inUse[name])
+		}
+	}
+}
+
+// monitoringHttpServer serves only the monitoring endpoints so that
+// they can be firewalled separately from the data API.
+func monitoringHttpServer(listeners []*graceful.Listener, t *x.Transceiver) {
+
+	mux := http.NewServeMux()
+	addMonitoringHandlers(mux, t)
+
+	for _, l := range listeners {
+		server := &http.Server{
+			Addr:           l.Addr().String(),
+			Handler:        mux,
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   10 * time.Second,
+			MaxHeaderBytes: 1 << 16}
+		go server.Serve(l)
+	}
 }
@@ -0,0 +1,309 @@
+package daemon
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	x "github.com/tgres/tgres/transceiver"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitoringServerDedicatedPort(t *testing.T) {
+	Cfg = &Config{MonitoringListenSpec: "127.0.0.1:0"}
+
+	mon := &monitoringServer{t: x.New(nil, nil)}
+	if err := mon.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	defer mon.Stop()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", mon.listeners[0].Addr()))
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /metrics: expected 200, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "tgres_oldest_dirty_point_age ") {
+		t.Errorf("GET /metrics: unexpected body: %q", body)
+	}
+}
+
+func TestPprofEnabled(t *testing.T) {
+	Cfg = &Config{MonitoringListenSpec: "127.0.0.1:0"}
+
+	mon := &monitoringServer{t: x.New(nil, nil)}
+	if err := mon.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	defer mon.Stop()
+
+	get := func(path string) (int, []byte) {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", mon.listeners[0].Addr(), path))
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	for _, path := range []string{"/debug/pprof/", "/debug/runtime"} {
+		if code, _ := get(path); code != http.StatusNotFound {
+			t.Errorf("GET %s: expected 404 without pprof-enabled, got %d", path, code)
+		}
+	}
+
+	Cfg.PprofEnabled = true
+	if code, body := get("/debug/pprof/heap?debug=1"); code != http.StatusOK || !strings.Contains(string(body), "heap profile") {
+		t.Errorf("GET /debug/pprof/heap: expected a heap profile, got %d %q", code, body)
+	}
+	code, body := get("/debug/runtime")
+	var stats runtimeStats
+	if err := json.Unmarshal(body, &stats); code != http.StatusOK || err != nil {
+		t.Fatalf("GET /debug/runtime: %d %v", code, err)
+	}
+	if stats.Goroutines <= 0 || stats.HeapAlloc == 0 {
+		t.Errorf("expected goroutines and a heap, got %+v", stats)
+	}
+}
+
+func TestInternalStats(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{HttpListenSpec: "127.0.0.1:0"}
+	tr := x.New(nil, nil)
+	www := &wwwServer{t: tr}
+	if err := www.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	defer www.Stop()
+	serviceMgr = &ServiceManager{t: tr, services: serviceMap{"www": www}}
+	defer func() { serviceMgr = nil }()
+
+	get := func() *internalStats {
+		resp, err := http.Get(fmt.Sprintf("http://%s/internal/stats", www.listeners[0].Addr()))
+		if err != nil {
+			t.Fatalf("GET /internal/stats: %v", err)
+		}
+		defer resp.Body.Close()
+		stats := &internalStats{}
+		if err := json.NewDecoder(resp.Body).Decode(stats); err != nil {
+			t.Fatalf("GET /internal/stats: %v", err)
+		}
+		return stats
+	}
+
+	before := get().Protocols["graphite-text"]
+	sampleStart := time.Now()
+	graphiteTextCounters.sampleRate(sampleStart)
+
+	client, server := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		readGraphiteText("test", graphiteTextCounters, tr, server, 0, "")
+		close(done)
+	}()
+	fmt.Fprintf(client, "foo.a 1 1000\nfoo.b 2\nfoo.c 3 1000\n")
+	client.Close()
+	<-done
+	graphiteTextCounters.sampleRate(sampleStart.Add(time.Second))
+
+	stats := get()
+	after := stats.Protocols["graphite-text"]
+	if after.DataPoints-before.DataPoints != 2 || after.ParseErrors-before.ParseErrors != 1 || after.Connections-before.Connections != 1 {
+		t.Errorf("expected 2 data points, 1 parse error and 1 connection, got %+v (before %+v)", after, before)
+	}
+	if after.DataPointsPerSecond != 2 {
+		t.Errorf("expected 2 data points per second, got %v", after.DataPointsPerSecond)
+	}
+	if stats.Listeners != 1 || stats.QueueDepth != 2 || stats.Uptime <= 0 {
+		t.Errorf("expected 1 listener, a queue depth of 2 and an uptime, got %+v", stats)
+	}
+}
+
+// remoteConn is a net.Conn from a given remote address.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestInternalSources(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	Cfg = &Config{HttpListenSpec: "127.0.0.1:0", SourceIdleExpiry: duration{time.Minute}}
+	ingestSources = &sourceCounters{byIP: make(map[string]*sourceCount), lastSweep: time.Now()}
+	tr := x.New(nil, nil)
+	www := &wwwServer{t: tr}
+	if err := www.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	defer www.Stop()
+
+	client, server := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		readGraphiteText("test", graphiteTextCounters, tr, &remoteConn{server, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}}, 0, "")
+		close(done)
+	}()
+	fmt.Fprintf(client, "foo.a 1 1000\nfoo.b 2\nfoo.c 3 1000\n")
+	client.Close()
+	<-done
+	// a datagram, as handleGraphiteUdpTextProtocol() counts it
+	counters := graphiteUdpCounters.from(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2003})
+	counters.dataPoint(len(parseGraphiteDatagram([]byte("foo.a 1 1000\nfoo.b 2 1000\nfoo.c 3 1000\n"), counters)))
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/internal/sources", www.listeners[0].Addr()))
+	if err != nil {
+		t.Fatalf("GET /internal/sources: %v", err)
+	}
+	defer resp.Body.Close()
+	var sources []sourceStats
+	if err := json.NewDecoder(resp.Body).Decode(&sources); err != nil {
+		t.Fatalf("GET /internal/sources: %v", err)
+	}
+	if len(sources) != 2 {
+		t.Fatalf("expected 2 sources, got %+v", sources)
+	}
+	if s := sources[0]; s.IP != "10.0.0.2" || s.DataPoints != 3 || s.Connections != 0 || s.ParseErrors != 0 {
+		t.Errorf("expected 10.0.0.2 first with 3 data points, got %+v", s)
+	}
+	if s := sources[1]; s.IP != "10.0.0.1" || s.DataPoints != 2 || s.Connections != 1 || s.ParseErrors != 1 {
+		t.Errorf("expected 10.0.0.1 with 2 data points, 1 connection and 1 parse error, got %+v", s)
+	}
+
+	// Idle hosts expire
+	ingestSources.get(&net.TCPAddr{IP: net.ParseIP("10.0.0.3")}, time.Now().Add(2*time.Minute))
+	if sources := ingestSources.sources(); len(sources) != 1 || sources[0].IP != "10.0.0.3" {
+		t.Errorf("expected only 10.0.0.3 after the others were idle, got %+v", sources)
+	}
+}
+
+type pingSerDe struct {
+	namesSerDe
+	err error
+}
+
+func (p *pingSerDe) Ping() error { return p.err }
+
+func TestHealthzReadyz(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	serde := &pingSerDe{err: fmt.Errorf("connection refused")}
+	Cfg = &Config{HttpListenSpec: "127.0.0.1:0", GraphiteTextListenSpec: "127.0.0.1:0"}
+	tr := x.New(nil, serde)
+	www, gt := &wwwServer{t: tr}, &graphiteTextServiceManager{t: tr}
+	if err := www.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	defer www.Stop()
+	serviceMgr = &ServiceManager{t: tr, services: serviceMap{"www": www, "gt": gt}}
+	defer func() { serviceMgr = nil }()
+
+	get := func(path string) (int, *readiness) {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", www.listeners[0].Addr(), path))
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		rd := &readiness{}
+		if path == "/readyz" {
+			if err := json.NewDecoder(resp.Body).Decode(rd); err != nil {
+				t.Fatalf("GET %s: %v", path, err)
+			}
+		}
+		return resp.StatusCode, rd
+	}
+
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz: expected 200, got %d", code)
+	}
+
+	// gt is not started yet, and the database is down
+	code, rd := get("/readyz")
+	if code != http.StatusServiceUnavailable || rd.Ready || len(rd.Missing) != 1 || rd.Missing[0] != "gt" ||
+		rd.DbError != "connection refused" || len(rd.Listening) != 1 || rd.Listening[0] != "www" {
+		t.Errorf("/readyz: expected 503, missing gt and a db error, got %d %+v", code, rd)
+	}
+
+	if err := gt.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	defer gt.Stop()
+	serde.err = nil
+	if code, rd := get("/readyz"); code != http.StatusOK || !rd.Ready || strings.Join(rd.Listening, ",") != "gt,www" {
+		t.Errorf("/readyz: expected 200 with gt and www listening, got %d %+v", code, rd)
+	}
+}
+
+// poolSerDe is a serde.DbPooler.
+type poolSerDe struct {
+	maxOpen, maxIdle int
+	maxLifetime      time.Duration
+}
+
+func (p *poolSerDe) SetConnPool(maxOpen, maxIdle int, maxLifetime time.Duration) {
+	p.maxOpen, p.maxIdle, p.maxLifetime = maxOpen, maxIdle, maxLifetime
+}
+
+func (p *poolSerDe) DbStats() sql.DBStats {
+	return sql.DBStats{MaxOpenConnections: p.maxOpen, OpenConnections: 3, InUse: 2, Idle: 1, WaitCount: 5, WaitDuration: 1500 * time.Millisecond}
+}
+
+func TestInternalDb(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	defer func() { dbPool = nil }()
+
+	Cfg = &Config{HttpListenSpec: "127.0.0.1:0", DbMaxOpenConns: 4, DbMaxIdleConns: 8, DbConnMaxLifetime: duration{time.Hour}}
+	if err := Cfg.processDbPool(); err != nil {
+		t.Fatalf("processDbPool(): %v", err)
+	}
+	pool := &poolSerDe{}
+	dbPool = setDbPool(struct {
+		rrd.SerDe
+		*poolSerDe
+	}{nil, pool})
+	if pool.maxOpen != 4 || pool.maxIdle != 4 || pool.maxLifetime != time.Hour {
+		t.Errorf("expected the pool to be sized 4, 4 (no more than open), 1h, got %+v", pool)
+	}
+
+	www := &wwwServer{t: x.New(nil, nil)}
+	if err := www.Start(nil); err != nil {
+		t.Fatalf("Start(): %v", err)
+	}
+	defer www.Stop()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/internal/db", www.listeners[0].Addr()))
+	if err != nil {
+		t.Fatalf("GET /internal/db: %v", err)
+	}
+	defer resp.Body.Close()
+	var st dbStats
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatalf("GET /internal/db: %v", err)
+	}
+	if st.MaxOpenConnections != 4 || st.InUse != 2 || st.WaitCount != 5 || st.WaitDuration != 1.5 {
+		t.Errorf("unexpected /internal/db stats %+v", st)
+	}
+
+	Cfg = &Config{DbMaxOpenConns: -1}
+	if err := Cfg.processDbPool(); err == nil {
+		t.Errorf("expected an error for a negative db-max-open-conns")
+	}
+}
@@ -0,0 +1,111 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/tgres/tgres/graceful"
+	"github.com/tgres/tgres/influx"
+	"github.com/tgres/tgres/transceiver"
+	"net"
+	"os"
+	"time"
+)
+
+// influxLineServiceManager accepts InfluxDB line protocol over TCP,
+// one point per line. (It is also accepted over HTTP at /write.)
+type influxLineServiceManager struct {
+	streamListeners
+	t *transceiver.Transceiver
+}
+
+func (g *influxLineServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	var err error
+
+	if cfg.InfluxLineListenSpec != "" {
+		err = g.listen("influxLineServiceManager", files, cfg.InfluxLineListenSpec)
+	} else {
+		logFields{"proto": "influx-line"}.Printf("Not starting InfluxDB line protocol because influx-line-listen-spec is blank")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error starting InfluxDB line protocol serviceManager: %v", err)
+	}
+
+	fmt.Println("InfluxDB line protocol Listening on " + displayListenSpecs(cfg.InfluxLineListenSpec))
+
+	for _, l := range g.listeners {
+		go g.influxLineServer(l)
+	}
+
+	return nil
+}
+
+func (g *influxLineServiceManager) influxLineServer(listener *graceful.Listener) error {
+
+	for {
+		conn, err := acceptRetrying("influxLineServer()", "influx-line", listener)
+		if err != nil {
+			return err
+		}
+
+		if !g.admit("influxLineServer()", conn) {
+			continue
+		}
+		logConnAccepted("influxLineServer()", conn)
+		go func() {
+			defer g.release()
+			handleInfluxLineProtocol(g.t, conn, currentCfg().InfluxLineTimeout)
+		}()
+	}
+}
+
+func handleInfluxLineProtocol(t *transceiver.Transceiver, conn net.Conn, timeout int) {
+
+	defer conn.Close() // decrements graceful.TcpWg
+
+	var count int
+	defer logConnClosed("handleInfluxLineProtocol()", conn, time.Now(), &count)
+	counters := influxLineCounters.from(conn.RemoteAddr())
+	counters.connection()
+
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	}
+
+	connbuf := bufio.NewScanner(conn)
+	for connbuf.Scan() {
+		if dps, err := influx.ParseLine(connbuf.Text(), time.Nanosecond, time.Now()); err != nil {
+			counters.logParseError(err, "handleInfluxLineProtocol(): bad line: %v", err)
+			counters.parseError()
+		} else if len(dps) > 0 && counters.admit(t, len(dps)) {
+			t.QueueDataPoints(dps)
+			counters.dataPoint(len(dps))
+			count += len(dps)
+		}
+
+		if timeout != 0 {
+			conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		}
+	}
+
+	if err := connbuf.Err(); err != nil {
+		logFields{"proto": "influx-line", "remote_addr": conn.RemoteAddr(), "error": err}.Printf("handleInfluxLineProtocol(): Error reading: %v", err)
+	}
+}
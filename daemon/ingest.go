@@ -0,0 +1,282 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/json"
+	x "github.com/tgres/tgres/transceiver"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var processStart = time.Now()
+
+// protocolCounters count what a protocol has received, they are
+// incremented by the handler goroutines with atomic ops.
+type protocolCounters struct {
+	name        string
+	dataPoints  int64
+	connections int64
+	parseErrors int64
+	dropped     int64 // because the queue was full
+
+	rateLk    sync.Mutex
+	lastCount int64
+	lastTime  time.Time
+	rate      float64 // data points per second, see sampleRate()
+}
+
+func (c *protocolCounters) dataPoint(n int) { atomic.AddInt64(&c.dataPoints, int64(n)) }
+func (c *protocolCounters) connection()     { atomic.AddInt64(&c.connections, 1) }
+func (c *protocolCounters) parseError()     { atomic.AddInt64(&c.parseErrors, 1) }
+
+// A queueFuller is the transceiver, see QueueFull().
+type queueFuller interface {
+	QueueFull() bool
+}
+
+// How often a blocked protocol checks whether there is room.
+const queueFullPollInterval = 10 * time.Millisecond
+
+// admit is whether n data points may be queued. While the queue is
+// full they are dropped (and counted), or admit waits for room, as
+// per the queue-full-policy of the protocol.
+func (c *protocolCounters) admit(q queueFuller, n int) bool {
+	if !q.QueueFull() {
+		noteQueueFull(false)
+		return true
+	}
+	noteQueueFull(true)
+	if c.queueFullPolicy() == queueDrop {
+		atomic.AddInt64(&c.dropped, int64(n))
+		return false
+	}
+	for q.QueueFull() {
+		time.Sleep(queueFullPollInterval)
+	}
+	return true
+}
+
+// queueFullPolicy is as configured, by default UDP, which cannot push
+// back, drops and the rest block.
+func (c *protocolCounters) queueFullPolicy() queueFullPolicy {
+	if p, ok := currentCfg().QueueFullPolicy[c.name]; ok {
+		return p
+	}
+	if strings.HasSuffix(c.name, "-udp") {
+		return queueDrop
+	}
+	return queueBlock
+}
+
+var (
+	queueIsFull     int32 // atomic, 1 while full
+	queueFullEvents int64 // atomic, times it became full
+)
+
+// noteQueueFull logs the queue.full event when the queue becomes full,
+// and when it no longer is.
+func noteQueueFull(full bool) {
+	if full {
+		if atomic.CompareAndSwapInt32(&queueIsFull, 0, 1) {
+			atomic.AddInt64(&queueFullEvents, 1)
+			log.Printf("queue.full: the transceiver queue is above queue-high-water-mark, blocking or dropping data points as per queue-full-policy.")
+		}
+	} else if atomic.LoadInt32(&queueIsFull) == 1 && atomic.CompareAndSwapInt32(&queueIsFull, 1, 0) {
+		log.Printf("queue.full: the transceiver queue is below queue-high-water-mark again.")
+	}
+}
+
+// sampleRate computes the rate since the previous sample (or since
+// the process started).
+func (c *protocolCounters) sampleRate(now time.Time) {
+	c.rateLk.Lock()
+	defer c.rateLk.Unlock()
+	if c.lastTime.IsZero() {
+		c.lastTime = processStart
+	}
+	count := atomic.LoadInt64(&c.dataPoints)
+	if elapsed := now.Sub(c.lastTime).Seconds(); elapsed > 0 {
+		c.rate = float64(count-c.lastCount) / elapsed
+	}
+	c.lastCount, c.lastTime = count, now
+}
+
+var (
+	graphiteTextCounters   = &protocolCounters{name: "graphite-text"} // also TLS and unix socket
+	graphitePickleCounters = &protocolCounters{name: "graphite-pickle"}
+	graphiteUdpCounters    = &protocolCounters{name: "graphite-udp"}
+	statsdUdpCounters      = &protocolCounters{name: "statsd-udp"}
+	influxLineCounters     = &protocolCounters{name: "influx-line"}
+	opentsdbCounters       = &protocolCounters{name: "opentsdb"}
+	protobufCounters       = &protocolCounters{name: "protobuf"}
+	msgpackCounters        = &protocolCounters{name: "msgpack"}
+	fileTailCounters       = &protocolCounters{name: "file-tail"}
+	stdinCounters          = &protocolCounters{name: "stdin"}
+
+	allProtocolCounters = []*protocolCounters{graphiteTextCounters, graphitePickleCounters,
+		graphiteUdpCounters, statsdUdpCounters, influxLineCounters, opentsdbCounters, protobufCounters,
+		msgpackCounters, fileTailCounters, stdinCounters}
+)
+
+func protocolCountersByName(name string) *protocolCounters {
+	for _, c := range allProtocolCounters {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+const ingestRateInterval = 10 * time.Second
+
+// sampleIngestRates makes the rates reported by /internal/stats
+// those over the last ingestRateInterval.
+func sampleIngestRates() {
+	for {
+		time.Sleep(ingestRateInterval)
+		now := time.Now()
+		for _, c := range allProtocolCounters {
+			c.sampleRate(now)
+		}
+	}
+}
+
+type protocolStats struct {
+	DataPointsPerSecond float64 `json:"dataPointsPerSecond"`
+	DataPoints          int64   `json:"dataPoints"`
+	Connections         int64   `json:"connections"`
+	ParseErrors         int64   `json:"parseErrors"`
+	Dropped             int64   `json:"dropped"`
+}
+
+type internalStats struct {
+	Uptime          float64                  `json:"uptime"` // seconds
+	Listeners       int                      `json:"listeners"`
+	QueueDepth      int                      `json:"queueDepth"`
+	QueueFullEvents int64                    `json:"queueFullEvents"`
+	Protocols       map[string]protocolStats `json:"protocols"`
+	RateLimited     map[string]int64         `json:"rateLimited,omitempty"` // by IP, see rate-limit-per-ip
+}
+
+// internalStatsHandler reports what each protocol has received.
+func internalStatsHandler(t *x.Transceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := &internalStats{
+			Uptime:          time.Now().Sub(processStart).Seconds(),
+			QueueDepth:      t.Stats().QueueDepth,
+			QueueFullEvents: atomic.LoadInt64(&queueFullEvents),
+			Protocols:       make(map[string]protocolStats),
+			RateLimited:     ingestRateLimiter.dropped(),
+		}
+		if serviceMgr != nil {
+			stats.Listeners = serviceMgr.listenerCount()
+		}
+		for _, c := range allProtocolCounters {
+			c.rateLk.Lock()
+			rate := c.rate
+			c.rateLk.Unlock()
+			stats.Protocols[c.name] = protocolStats{
+				DataPointsPerSecond: rate,
+				DataPoints:          atomic.LoadInt64(&c.dataPoints),
+				Connections:         atomic.LoadInt64(&c.connections),
+				ParseErrors:         atomic.LoadInt64(&c.parseErrors),
+				Dropped:             atomic.LoadInt64(&c.dropped),
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			log.Printf("internalStatsHandler(): %v", err)
+		}
+	}
+}
+
+// selfStats are the totals as of the previous emit(), so that the
+// data points received and parse errors are per interval.
+type selfStats struct {
+	dataPoints, parseErrors, dropped, queueFullEvents, filtered, invalid, spoolDropped int64
+	nameLength, seriesFull, deadLetters                                                int64
+}
+
+// emit queues the internal stats as data points named prefix.*.
+func (s *selfStats) emit(q interface {
+	QueueDataPoint(string, time.Time, float64)
+}, prefix string, st *x.Stats, connections int, now time.Time) {
+	var dataPoints, parseErrors, dropped int64
+	for _, c := range allProtocolCounters {
+		dataPoints += atomic.LoadInt64(&c.dataPoints)
+		parseErrors += atomic.LoadInt64(&c.parseErrors)
+		dropped += atomic.LoadInt64(&c.dropped)
+	}
+	queueFull := atomic.LoadInt64(&queueFullEvents)
+	q.QueueDataPoint(prefix+".queue.depth", now, float64(st.QueueDepth))
+	q.QueueDataPoint(prefix+".datapoints.received", now, float64(dataPoints-s.dataPoints))
+	q.QueueDataPoint(prefix+".connections.active", now, float64(connections))
+	q.QueueDataPoint(prefix+".parse.errors", now, float64(parseErrors-s.parseErrors))
+	q.QueueDataPoint(prefix+".queue.dropped", now, float64(dropped-s.dropped))
+	q.QueueDataPoint(prefix+".queue.full", now, float64(queueFull-s.queueFullEvents))
+	q.QueueDataPoint(prefix+".rejected.filtered", now, float64(st.RejectedFiltered-s.filtered))
+	s.dataPoints, s.parseErrors, s.dropped, s.queueFullEvents = dataPoints, parseErrors, dropped, queueFull
+	q.QueueDataPoint(prefix+".rejected.invalid", now, float64(st.RejectedInvalid-s.invalid))
+	q.QueueDataPoint(prefix+".flush.since_last", now, st.SinceLastFlush)
+	q.QueueDataPoint(prefix+".spool.series", now, float64(st.SpoolSeries))
+	q.QueueDataPoint(prefix+".spool.dropped", now, float64(st.SpoolDropped-s.spoolDropped))
+	s.filtered, s.invalid, s.spoolDropped = st.RejectedFiltered, st.RejectedInvalid, st.SpoolDropped
+	q.QueueDataPoint(prefix+".rejected.name_length", now, float64(st.RejectedNameLength-s.nameLength))
+	q.QueueDataPoint(prefix+".rejected.series_full", now, float64(st.RejectedSeriesFull-s.seriesFull))
+	s.nameLength, s.seriesFull = st.RejectedNameLength, st.RejectedSeriesFull
+	q.QueueDataPoint(prefix+".flush.dead_letters", now, float64(st.DeadLetterTotal-s.deadLetters))
+	s.deadLetters = st.DeadLetterTotal
+}
+
+// startInternalStats stores tgres' own stats in tgres every interval
+// (see internal-stats-enabled) until stopInternalStats().
+func (r *ServiceManager) startInternalStats(prefix string, interval time.Duration) {
+	r.internalStatsStop = make(chan bool)
+	r.internalStatsWg.Add(1)
+	go func() {
+		defer r.internalStatsWg.Done()
+		s := &selfStats{}
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				var connections int
+				for _, n := range r.connectionsInUse() {
+					connections += n
+				}
+				s.emit(r.t, prefix, r.t.Stats(), connections, time.Now())
+			case <-r.internalStatsStop:
+				return
+			}
+		}
+	}()
+}
+
+// stopInternalStats must be called before the transceiver is
+// stopped, after which queueing a data point panics.
+func (r *ServiceManager) stopInternalStats() {
+	if r.internalStatsStop != nil {
+		close(r.internalStatsStop)
+		r.internalStatsWg.Wait()
+		r.internalStatsStop = nil
+	}
+}
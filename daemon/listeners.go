@@ -0,0 +1,510 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"github.com/tgres/tgres/graceful"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// A listen spec may be a comma-separated list, e.g. to listen on
+// both an internal and an external interface, or on IPv4 and IPv6.
+func splitListenSpecs(specs string) []string {
+	var result []string
+	for _, spec := range strings.Split(specs, ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			result = append(result, spec)
+		}
+	}
+	return result
+}
+
+// serviceListenSpecs is the listen specs of each service, by network.
+func serviceListenSpecs(c *Config) map[string][2]string {
+	return map[string][2]string{
+		"gt":  {"tcp", c.GraphiteTextListenSpec},
+		"gts": {"tcp", c.GraphiteTextTLSListenSpec},
+		"gtu": {"unix", c.GraphiteTextUnixListenSpec},
+		"gu":  {"udp", c.GraphiteUdpListenSpec},
+		"gp":  {"tcp", c.GraphitePickleListenSpec},
+		"gps": {"tcp", c.GraphitePickleTLSListenSpec},
+		"ga":  {"tcp", c.GraphiteAutoListenSpec},
+		"su":  {"udp", c.StatsdUdpListenSpec},
+		"il":  {"tcp", c.InfluxLineListenSpec},
+		"ot":  {"tcp", c.OpenTSDBListenSpec},
+		"pb":  {"tcp", c.ProtobufListenSpec},
+		"mp":  {"tcp", c.MsgpackListenSpec},
+		"www": {"tcp", c.HttpListenSpec},
+		"mon": {"tcp", c.MonitoringListenSpec},
+	}
+}
+
+// serviceDisabled is true if the service is turned off with its
+// <protocol>-enabled = false, which (unlike a blank listen spec) keeps
+// the listen spec in the config. Not set is enabled.
+func serviceDisabled(c *Config, name string) bool {
+	enabled := map[string]*bool{
+		"gt":  c.GraphiteTextEnabled,
+		"gts": c.GraphiteTextTLSEnabled,
+		"gtu": c.GraphiteTextUnixEnabled,
+		"gu":  c.GraphiteUdpEnabled,
+		"gp":  c.GraphitePickleEnabled,
+		"gps": c.GraphitePickleTLSEnabled,
+		"ga":  c.GraphiteAutoEnabled,
+		"su":  c.StatsdUdpEnabled,
+		"il":  c.InfluxLineEnabled,
+		"ot":  c.OpenTSDBEnabled,
+		"pb":  c.ProtobufEnabled,
+		"mp":  c.MsgpackEnabled,
+	}[name]
+	return enabled != nil && !*enabled
+}
+
+// validateListenSpecs resolves every listen spec of the services, so
+// that a malformed one fails the start with a clear error rather
+// than midway through starting the services, and logs what each
+// one will be bound to.
+func validateListenSpecs(c *Config) error {
+	for name, ns := range serviceListenSpecs(c) {
+		network := ns[0]
+		for _, spec := range splitListenSpecs(ns[1]) {
+			if network == "unix" || strings.HasPrefix(spec, unixPrefix) {
+				if strings.TrimPrefix(spec, unixPrefix) == "" {
+					return fmt.Errorf("%q service: invalid listen spec %q: no socket path", name, spec)
+				}
+				log.Printf("validateListenSpecs(): %q service: %s (unix socket)", name, spec)
+				continue
+			}
+			var (
+				ip  net.IP
+				err error
+			)
+			if network == "udp" {
+				var addr *net.UDPAddr
+				if addr, err = net.ResolveUDPAddr(network, processListenSpec(spec)); err == nil {
+					ip = addr.IP
+				}
+			} else {
+				var addr *net.TCPAddr
+				if addr, err = net.ResolveTCPAddr(network, processListenSpec(spec)); err == nil {
+					ip = addr.IP
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("%q service: invalid listen spec %q: %v", name, spec, err)
+			}
+			log.Printf("validateListenSpecs(): %q service: %s (%s)", name, processListenSpec(spec), addrFamily(ip))
+		}
+	}
+	return nil
+}
+
+// addrFamily describes what listening on ip binds to. A wildcard
+// address, IPv4 or IPv6, is bound dual-stack where IPv6 is available.
+func addrFamily(ip net.IP) string {
+	switch {
+	case ip == nil || ip.IsUnspecified():
+		return "all interfaces, IPv4 and IPv6"
+	case ip.To4() != nil:
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+// displayListenSpecs is the listen specs as they will be bound.
+func displayListenSpecs(specs string) string {
+	var result []string
+	for _, spec := range splitListenSpecs(specs) {
+		if strings.HasPrefix(spec, unixPrefix) {
+			result = append(result, spec)
+		} else {
+			result = append(result, processListenSpec(spec))
+		}
+	}
+	return strings.Join(result, ", ")
+}
+
+// matchInherited returns for each of specs the inherited file (a
+// listener or UDP socket) bound to it, or nil. Inherited files not
+// bound to any of the specs are closed, so that a listen spec which
+// has changed since the graceful restart is bound anew rather than
+// silently ignored.
+func matchInherited(who string, files []*os.File, network string, specs []string) []*os.File {
+	result := make([]*os.File, len(specs))
+	used := make([]bool, len(files))
+	for i, spec := range specs {
+		for j, f := range files {
+			if used[j] || f == nil {
+				continue
+			}
+			if bound, same := boundTo(f, network, spec); same {
+				log.Printf("matchInherited(): %s: reusing the inherited socket bound to %s.", who, bound)
+				result[i], used[j] = f, true
+				break
+			}
+		}
+	}
+	for j, f := range files {
+		if !used[j] && f != nil {
+			bound, _ := boundTo(f, network, "")
+			log.Printf("matchInherited(): %s: the inherited socket is bound to %s, which is not in the listen spec any more, closing it.", who, bound)
+			f.Close()
+		}
+	}
+	return result
+}
+
+// boundTo returns the address the file is bound to and whether it is
+// what listening on spec would bind. If this cannot be determined,
+// it is assumed to be.
+func boundTo(file *os.File, network, spec string) (string, bool) {
+	sa, err := getsockname(file)
+	if err != nil {
+		return fmt.Sprintf("? (getsockname: %v)", err), true
+	}
+	if ua, ok := sa.(*syscall.SockaddrUnix); ok {
+		return unixPrefix + ua.Name, spec == unixPrefix+ua.Name
+	}
+	if ip, port, ok := sockaddrIPPort(sa); ok {
+		bound := (&net.TCPAddr{IP: ip, Port: port}).String()
+		return bound, !strings.HasPrefix(spec, unixPrefix) && sameAddr(network, processListenSpec(spec), ip, port)
+	}
+	return fmt.Sprintf("%v", sa), true
+}
+
+// getsockname does not use file.Fd(), which would put the socket
+// into blocking mode.
+func getsockname(file *os.File) (sa syscall.Sockaddr, err error) {
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	if cerr := rc.Control(func(fd uintptr) { sa, err = syscall.Getsockname(int(fd)) }); cerr != nil {
+		return nil, cerr
+	}
+	return sa, err
+}
+
+func sockaddrIPPort(sa syscall.Sockaddr) (net.IP, int, bool) {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.IP(sa.Addr[:]), sa.Port, true
+	case *syscall.SockaddrInet6:
+		return net.IP(sa.Addr[:]), sa.Port, true
+	}
+	return nil, 0, false
+}
+
+// sameAddr is true if ip:port is what listening on spec would bind,
+// a spec port of 0 (any) matches any port.
+func sameAddr(network, spec string, ip net.IP, port int) bool {
+	var (
+		wantIP   net.IP
+		wantPort int
+	)
+	if network == "udp" {
+		addr, err := net.ResolveUDPAddr(network, spec)
+		if err != nil {
+			return false
+		}
+		wantIP, wantPort = addr.IP, addr.Port
+	} else {
+		addr, err := net.ResolveTCPAddr(network, spec)
+		if err != nil {
+			return false
+		}
+		wantIP, wantPort = addr.IP, addr.Port
+	}
+	if wantPort != 0 && wantPort != port {
+		return false
+	}
+	if wantIP == nil || wantIP.IsUnspecified() {
+		return ip.IsUnspecified()
+	}
+	return wantIP.Equal(ip)
+}
+
+// streamListeners are the listeners of a TCP (or unix socket)
+// service, one per listen spec. Services embed it for Files(),
+// Stop() and the limit on concurrent connections (see admit()).
+type streamListeners struct {
+	listeners []*graceful.Listener
+	unixPaths []string // to be removed on Stop
+	limiter   *connLimiter
+}
+
+// connLimiter is a semaphore of max-concurrent-connections, sem is
+// nil if there is no limit. The connections in use are counted
+// either way.
+type connLimiter struct {
+	sem   chan struct{}
+	inUse int64
+}
+
+func newConnLimiter(max int) *connLimiter {
+	l := &connLimiter{}
+	if max > 0 {
+		l.sem = make(chan struct{}, max)
+	}
+	return l
+}
+
+func (l *connLimiter) acquire() bool {
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	atomic.AddInt64(&l.inUse, 1)
+	return true
+}
+
+func (l *connLimiter) release() {
+	atomic.AddInt64(&l.inUse, -1)
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+// admit is called for each accepted connection. If the service is at
+// max-concurrent-connections, the connection is logged and closed
+// right away, rather than queueing unbounded work. Otherwise the
+// handler must release() it when done.
+func (s *streamListeners) admit(who string, conn net.Conn) bool {
+	if s.limiter.acquire() {
+		return true
+	}
+	log.Printf("%s: %d connections (max-concurrent-connections), refusing connection from %v", who, cap(s.limiter.sem), conn.RemoteAddr())
+	conn.Close()
+	return false
+}
+
+func (s *streamListeners) release() {
+	s.limiter.release()
+}
+
+func (s *streamListeners) listenerCount() int { return len(s.listeners) }
+
+// connectionsInUse is the number of connections being handled.
+func (s *streamListeners) connectionsInUse() int {
+	if s.limiter == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&s.limiter.inUse))
+}
+
+func (s *streamListeners) Files() []*os.File {
+	var files []*os.File
+	for _, l := range s.listeners {
+		if f := l.File(); f != nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (s *streamListeners) Stop() {
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	for _, path := range s.unixPaths {
+		removeUnixSocket(path)
+	}
+}
+
+const (
+	dftAcceptBackoffInitial = 5 * time.Millisecond
+	dftAcceptBackoffMax     = 1 * time.Second
+)
+
+// acceptRetrying accepts a connection from l, retrying a temporary
+// error (e.g. too many open files under heavy load) after a delay
+// doubling from accept-backoff-initial up to accept-backoff-max, as
+// the golang http lib does, see
+// http://golang.org/src/net/http/server.go?s=51504:51550#L1729
+func acceptRetrying(who, proto string, l net.Listener) (net.Conn, error) {
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			tempDelay = acceptBackoff(tempDelay)
+			logFields{"proto": proto, "error": err, "retry": tempDelay}.Printf("%s: Accept error: %v; retrying in %v", who, err, tempDelay)
+			time.Sleep(tempDelay)
+			continue
+		}
+		return conn, err
+	}
+}
+
+// acceptBackoff is the delay to retry Accept after, given the last
+// one (0 if it is the first retry).
+func acceptBackoff(last time.Duration) time.Duration {
+	cfg := currentCfg()
+	initial, max := cfg.AcceptBackoffInitial.Duration, cfg.AcceptBackoffMax.Duration
+	if initial == 0 {
+		initial = dftAcceptBackoffInitial
+	}
+	if max == 0 {
+		max = dftAcceptBackoffMax
+	}
+	next := last * 2
+	if last == 0 {
+		next = initial
+	}
+	if next > max {
+		next = max
+	}
+	return next
+}
+
+// listen listens on each of the specs (see splitListenSpecs), reusing
+// the inherited files bound to them.
+func (s *streamListeners) listen(who string, files []*os.File, specs string) error {
+	s.listeners, s.unixPaths = nil, nil // if restarted by reload()
+	if s.limiter == nil {
+		s.limiter = newConnLimiter(currentCfg().MaxConcurrentConnections)
+	}
+	list := splitListenSpecs(specs)
+	inherited := matchInherited(who, files, "tcp", list)
+	for i, spec := range list {
+		l, path, err := listenStream(inherited[i], spec)
+		if err != nil {
+			s.Stop()
+			return err
+		}
+		s.listeners = append(s.listeners, graceful.NewListener(l))
+		if path != "" {
+			s.unixPaths = append(s.unixPaths, path)
+		}
+	}
+	return nil
+}
+
+// listenStream listens on spec, which is either host:port or
+// unix:///path/to/socket, or uses the inherited file. For a unix
+// socket it also returns its path.
+func listenStream(file *os.File, spec string) (net.Listener, string, error) {
+	cfg := currentCfg()
+	var path string
+	if strings.HasPrefix(spec, unixPrefix) {
+		path = strings.TrimPrefix(spec, unixPrefix)
+	}
+	if file != nil {
+		l, err := net.FileListener(file)
+		return l, path, err
+	}
+	if path == "" {
+		l, err := net.Listen("tcp", processListenSpec(spec))
+		return l, "", err
+	}
+
+	// A socket left behind by a crash would make Listen fail, but
+	// one which still accepts connections belongs to someone else.
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, "", fmt.Errorf("unix socket %s is in use", path)
+		}
+		log.Printf("listenStream(): removing stale unix socket %s", path)
+		os.Remove(path)
+	}
+	// The umask makes the socket be created with unix-socket-mode, a
+	// chmod after Listen would leave it open to anyone until then.
+	if cfg.UnixSocketMode != 0 {
+		defer syscall.Umask(syscall.Umask(int(^os.FileMode(cfg.UnixSocketMode) & os.ModePerm)))
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, "", err
+	}
+	// The socket is removed by Stop, unless a graceful restart child
+	// has inherited it.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	return l, path, nil
+}
+
+// listenPackets listens on each of the UDP specs, reusing the
+// inherited files bound to them.
+func listenPackets(who string, files []*os.File, specs string) ([]net.Conn, error) {
+	var conns []net.Conn
+	list := splitListenSpecs(specs)
+	inherited := matchInherited(who, files, "udp", list)
+	for i, spec := range list {
+		var (
+			conn net.Conn
+			err  error
+		)
+		if inherited[i] != nil {
+			conn, err = net.FileConn(inherited[i])
+		} else {
+			var udpAddr *net.UDPAddr
+			if udpAddr, err = net.ResolveUDPAddr("udp", processListenSpec(spec)); err == nil {
+				conn, err = net.ListenUDP("udp", udpAddr)
+			}
+		}
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// connFile returns a dup of the file descriptor of a UDP (or any
+// other file backed) conn, or nil if there isn't one. A conn
+// recreated by net.FileConn after a graceful restart is not
+// necessarily a *net.UDPConn, so we just check for a File() method.
+func connFile(who string, conn net.Conn) *os.File {
+	if conn == nil {
+		return nil
+	}
+	fc, ok := conn.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		log.Printf("%s: File(): %T has no file, cannot pass it on", who, conn)
+		return nil
+	}
+	f, err := fc.File()
+	if err != nil {
+		log.Printf("%s: File(): %v", who, err)
+		return nil
+	}
+	return f
+}
+
+// connFiles is connFile for all the conns.
+func connFiles(who string, conns []net.Conn) []*os.File {
+	var files []*os.File
+	for _, conn := range conns {
+		if f := connFile(who, conn); f != nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
@@ -16,10 +16,16 @@
 package daemon
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -32,11 +38,11 @@ var osRename = func(a, b string) error {
 }
 
 var renameLogFile = func() {
-	logDir, logFile := filepath.Split(Cfg.LogPath)
+	logDir, logFile := filepath.Split(currentCfg().LogPath)
 	filename := timeNow().Format(logFile + "-20060102_150405")
 	fullpath := filepath.Join(logDir, filename)
 	log.Printf("Starting new log file, current log archived as: '%s'", fullpath)
-	osRename(Cfg.LogPath, fullpath)
+	osRename(currentCfg().LogPath, fullpath)
 }
 
 var cycleLogFile = func() {
@@ -45,13 +51,13 @@ var cycleLogFile = func() {
 		renameLogFile()
 	}
 
-	file, err := os.OpenFile(Cfg.LogPath, os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0666) // open with O_SYNC
+	file, err := os.OpenFile(currentCfg().LogPath, os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0666) // open with O_SYNC
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "FATAL: Unable to open log file '%s', %s\n", Cfg.LogPath, err)
+		fmt.Fprintf(os.Stderr, "FATAL: Unable to open log file '%s', %s\n", currentCfg().LogPath, err)
 		os.Exit(1)
 	}
 
-	log.SetOutput(file)
+	log.SetOutput(logOutput(file))
 	if logFile != nil {
 		logFile.Close()
 	}
@@ -76,7 +82,7 @@ var logFileCycler = func() {
 
 	go func() { // Periodic cycling
 		for {
-			time.Sleep(Cfg.LogCycle.Duration)
+			time.Sleep(currentCfg().LogCycle.Duration)
 			cycleLogCh <- 1
 			if quitting {
 				return
@@ -87,9 +93,153 @@ var logFileCycler = func() {
 
 // Write to both stderr and log
 func logFatalf(format string, v ...interface{}) {
+	cfg := currentCfg()
 	fmt.Fprintf(os.Stderr, format, v...)
-	if Cfg.PidPath != "" && gracefulChildPid == 0 {
-		os.Remove(Cfg.PidPath)
+	if cfg.PidPath != "" && gracefulChildPid == 0 {
+		os.Remove(cfg.PidPath)
 	}
 	log.Fatalf(format, v...)
 }
+
+// logFields are the fields of a log line with log-format = "json",
+// e.g. proto (the protocol, as named in /internal/stats), remote_addr
+// and error.
+type logFields map[string]interface{}
+
+// with returns a copy of f with the field key added.
+func (f logFields) with(key string, value interface{}) logFields {
+	result := logFields{key: value}
+	for k, v := range f {
+		result[k] = v
+	}
+	return result
+}
+
+// Printf logs like log.Printf, with log-format = "json" as a JSON
+// object of the message and the fields.
+func (f logFields) Printf(format string, v ...interface{}) {
+	cfg := currentCfg()
+	msg := fmt.Sprintf(format, v...)
+	if cfg == nil || cfg.LogFormat != logFormatJSON {
+		log.Output(2, msg)
+		return
+	}
+	log.Output(2, string(jsonLogLine(f, msg)))
+}
+
+// How often the parse errors are summarized, a var for testing.
+var parseErrorSummaryInterval = time.Minute
+
+// logParseError logs a bad line (pickle, etc.) from the connection
+// of c, as per log-level: with "debug" every one, with "info" and
+// "warn" only a count by address (see parseErrorSummary), once every
+// parseErrorSummaryInterval, with "error" not at all.
+func (c connCounters) logParseError(err error, format string, v ...interface{}) {
+	switch currentCfg().LogLevel {
+	case logLevelDebug:
+		logFields{"level": "debug", "proto": c.name, "remote_addr": c.addr, "error": err}.Printf(format, v...)
+	case logLevelInfo, logLevelWarn:
+		parseErrors.add(c.name, c.addr)
+	}
+}
+
+var parseErrors = &parseErrorSummary{}
+
+// parseErrorSummary counts the parse errors by protocol and address
+// until it is logged.
+type parseErrorSummary struct {
+	sync.Mutex
+	counts map[[2]string]int
+}
+
+func (s *parseErrorSummary) add(proto string, addr net.Addr) {
+	key := [2]string{proto, "unknown"}
+	if ip := addrIP(addr); ip != nil {
+		key[1] = ip.String()
+	} else if addr != nil {
+		key[1] = addr.String()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if len(s.counts) == 0 {
+		// the first error since the last summary
+		s.counts = make(map[[2]string]int)
+		time.AfterFunc(parseErrorSummaryInterval, s.log)
+	}
+	s.counts[key]++
+}
+
+// log logs the counts, the largest first, and resets them.
+func (s *parseErrorSummary) log() {
+	s.Lock()
+	counts := s.counts
+	s.counts = nil
+	s.Unlock()
+
+	keys := make([][2]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i][0]+keys[i][1] < keys[j][0]+keys[j][1]
+	})
+	for _, key := range keys {
+		logFields{"level": "warn", "proto": key[0], "remote_addr": key[1], "count": counts[key]}.Printf(
+			"%d %s parse errors from %s in the last %v", counts[key], key[0], key[1], parseErrorSummaryInterval)
+	}
+}
+
+// jsonLogLine is a JSON object of the time, the pid, msg and fields,
+// followed by a newline. Errors and Stringers (e.g. a net.Addr) are
+// their strings, nil values are left out.
+func jsonLogLine(fields logFields, msg string) []byte {
+	line := map[string]interface{}{
+		"time": timeNow().UTC().Format(time.RFC3339Nano),
+		"pid":  os.Getpid(),
+		"msg":  msg,
+	}
+	for k, v := range fields {
+		switch x := v.(type) {
+		case nil:
+			continue
+		case error:
+			v = x.Error()
+		case fmt.Stringer:
+			v = x.String()
+		}
+		line[k] = v
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{"time": line["time"], "pid": line["pid"], "msg": msg})
+	}
+	return append(b, '\n')
+}
+
+// jsonLogWriter makes a JSON object (see jsonLogLine) of every line
+// written by the log package which is not one already, i.e. those not
+// logged with logFields.
+type jsonLogWriter struct{ w io.Writer }
+
+func (j jsonLogWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 && p[0] == '{' {
+		return j.w.Write(p)
+	}
+	if _, err := j.w.Write(jsonLogLine(nil, strings.TrimSuffix(string(p), "\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logOutput is w, or with log-format = "json" w wrapped in a
+// jsonLogWriter.
+func logOutput(w io.Writer) io.Writer {
+	if currentCfg().LogFormat == logFormatJSON {
+		return jsonLogWriter{w}
+	}
+	return w
+}
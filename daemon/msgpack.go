@@ -0,0 +1,142 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/tgres/tgres/graceful"
+	"github.com/tgres/tgres/msgpack"
+	"github.com/tgres/tgres/transceiver"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// msgpackServiceManager accepts the graphite pickle batches,
+// [(name, (timestamp, value)), ...], MessagePack encoded rather than
+// pickled, which is faster and safer to decode.
+type msgpackServiceManager struct {
+	streamListeners
+	t *transceiver.Transceiver
+}
+
+func (g *msgpackServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	var err error
+
+	if cfg.MsgpackListenSpec != "" {
+		err = g.listen("msgpackServiceManager", files, cfg.MsgpackListenSpec)
+	} else {
+		logFields{"proto": "msgpack"}.Printf("Not starting MessagePack protocol because msgpack-listen-spec is blank")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error starting MessagePack protocol serviceManager: %v", err)
+	}
+
+	fmt.Println("MessagePack protocol Listening on " + displayListenSpecs(cfg.MsgpackListenSpec))
+
+	for _, l := range g.listeners {
+		go g.msgpackServer(l)
+	}
+
+	return nil
+}
+
+func (g *msgpackServiceManager) msgpackServer(listener *graceful.Listener) error {
+
+	for {
+		conn, err := acceptRetrying("msgpackServer()", "msgpack", listener)
+		if err != nil {
+			return err
+		}
+
+		if !g.admit("msgpackServer()", conn) {
+			continue
+		}
+		logConnAccepted("msgpackServer()", conn)
+		go func() {
+			defer g.release()
+			handleMsgpackProtocol(g.t, conn, currentCfg().GraphitePickleTimeout)
+		}()
+	}
+}
+
+// handleMsgpackProtocol reads batches framed as carbon frames pickles,
+// each prefixed with its 4-byte big-endian length (see
+// readPickleFrame), until the connection is closed.
+func handleMsgpackProtocol(t *transceiver.Transceiver, conn net.Conn, timeout int) {
+
+	defer conn.Close() // decrements graceful.TcpWg
+
+	var count, dropped, limited int
+	defer logConnClosed("handleMsgpackProtocol()", conn, time.Now(), &count)
+	defer logRateLimited("handleMsgpackProtocol()", conn, &limited)
+	counters := msgpackCounters.from(conn.RemoteAddr())
+	counters.connection()
+
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		frame, err := readPickleFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				logFields{"proto": "msgpack", "remote_addr": conn.RemoteAddr(), "error": err}.Printf("handleMsgpackProtocol(): Error reading: %v", err)
+				counters.parseError()
+			}
+			break
+		}
+
+		obj, err := msgpack.Unmarshal(frame)
+		if err != nil {
+			counters.logParseError(err, "handleMsgpackProtocol(): %v: bad message, skipping it: %v", conn.RemoteAddr(), err)
+			counters.parseError()
+			continue // the next one begins after this frame
+		}
+
+		// The decoded types are those of a pickle, so
+		// queuePickleItems does the rest.
+		if items, ok := obj.([]interface{}); !ok {
+			counters.logParseError(nil, "handleMsgpackProtocol(): %v: top-level object is not an array, skipping it", conn.RemoteAddr())
+			counters.parseError()
+		} else {
+			if n := ingestRateLimiter.take(conn.RemoteAddr(), len(items), time.Now()); n < len(items) {
+				limited += len(items) - n
+				items = items[:n]
+			}
+			if len(items) > 0 && counters.admit(t, len(items)) {
+				n, d := queuePickleItems(t, counters, items)
+				count, dropped = count+n, dropped+d
+				counters.dataPoint(n)
+			}
+		}
+
+		if timeout != 0 {
+			conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		}
+	}
+
+	if dropped > 0 {
+		logFields{"proto": "msgpack", "remote_addr": conn.RemoteAddr(), "dropped": dropped}.Printf("handleMsgpackProtocol(): %v: dropped %d data points for new series, max-series (%d) reached", conn.RemoteAddr(), dropped, t.MaxSeries)
+		t.QueueStatCount("tgres.msgpack_series_full_drops", dropped)
+	}
+}
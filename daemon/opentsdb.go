@@ -0,0 +1,162 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/tgres/tgres/graceful"
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/transceiver"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// opentsdbServiceManager accepts the OpenTSDB telnet style "put"
+// protocol over TCP, one data point per line.
+type opentsdbServiceManager struct {
+	streamListeners
+	t *transceiver.Transceiver
+}
+
+func (g *opentsdbServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	var err error
+
+	if cfg.OpenTSDBListenSpec != "" {
+		err = g.listen("opentsdbServiceManager", files, cfg.OpenTSDBListenSpec)
+	} else {
+		logFields{"proto": "opentsdb"}.Printf("Not starting OpenTSDB protocol because opentsdb-listen-spec is blank")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error starting OpenTSDB protocol serviceManager: %v", err)
+	}
+
+	fmt.Println("OpenTSDB protocol Listening on " + displayListenSpecs(cfg.OpenTSDBListenSpec))
+
+	for _, l := range g.listeners {
+		go g.opentsdbServer(l)
+	}
+
+	return nil
+}
+
+func (g *opentsdbServiceManager) opentsdbServer(listener *graceful.Listener) error {
+
+	for {
+		conn, err := acceptRetrying("opentsdbServer()", "opentsdb", listener)
+		if err != nil {
+			return err
+		}
+
+		if !g.admit("opentsdbServer()", conn) {
+			continue
+		}
+		logConnAccepted("opentsdbServer()", conn)
+		go func() {
+			defer g.release()
+			handleOpenTSDBProtocol(g.t, conn, currentCfg().OpenTSDBTimeout)
+		}()
+	}
+}
+
+func handleOpenTSDBProtocol(t *transceiver.Transceiver, conn net.Conn, timeout int) {
+
+	defer conn.Close() // decrements graceful.TcpWg
+
+	var count int
+	defer logConnClosed("handleOpenTSDBProtocol()", conn, time.Now(), &count)
+	counters := opentsdbCounters.from(conn.RemoteAddr())
+	counters.connection()
+
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	}
+
+	connbuf := bufio.NewScanner(conn)
+	for connbuf.Scan() {
+		line := strings.TrimSpace(connbuf.Text())
+		if line == "" {
+			continue
+		}
+		if name, tags, ts, v, err := parseOpenTSDBPut(line); err != nil {
+			counters.logParseError(err, "handleOpenTSDBProtocol(): bad line: %v", err)
+			counters.parseError()
+		} else if counters.admit(t, 1) {
+			t.QueueDataPointTagged(name, tags, ts, v)
+			counters.dataPoint(1)
+			count++
+		}
+
+		if timeout != 0 {
+			conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		}
+	}
+
+	if err := connbuf.Err(); err != nil {
+		logFields{"proto": "opentsdb", "remote_addr": conn.RemoteAddr(), "error": err}.Printf("handleOpenTSDBProtocol(): Error reading: %v", err)
+	}
+}
+
+// Time stamps greater than this are in milliseconds (this is what
+// OpenTSDB does, 10 digits are seconds, 13 are milliseconds).
+const opentsdbMaxSeconds = 9999999999
+
+// parseOpenTSDBPut parses a "put metric timestamp value tagk=tagv ..."
+// line. The metric and the tags become a tagged series (see
+// transceiver.TaggedName).
+func parseOpenTSDBPut(line string) (string, map[string]string, time.Time, float64, error) {
+
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "put" {
+		return "", nil, time.Time{}, 0, fmt.Errorf("expected put metric timestamp value [tagk=tagv ...], got %q", line)
+	}
+
+	ts, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || ts < 0 {
+		return "", nil, time.Time{}, 0, fmt.Errorf("invalid timestamp in %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return "", nil, time.Time{}, 0, fmt.Errorf("invalid value in %q: %v", line, err)
+	}
+
+	var tags map[string]string
+	for _, tag := range fields[4:] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return "", nil, time.Time{}, 0, fmt.Errorf("invalid tag %q in %q, expected tagk=tagv", tag, line)
+		}
+		if tags == nil {
+			tags = make(map[string]string, len(fields)-4)
+		}
+		tags[kv[0]] = kv[1]
+	}
+
+	var t time.Time
+	if ts > opentsdbMaxSeconds {
+		t = time.Unix(0, ts*int64(time.Millisecond))
+	} else {
+		t = time.Unix(ts, 0)
+	}
+
+	return misc.SanitizeName(fields[1]), tags, t, value, nil
+}
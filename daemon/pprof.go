@@ -0,0 +1,90 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// addPprofHandlers adds the net/http/pprof handlers under
+// /debug/pprof/ and the runtime stats at /debug/runtime. They respond
+// 404 unless pprof-enabled, which is looked up on every request, so
+// that a reload() applies it.
+func addPprofHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprofEnabledHandler(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", pprofEnabledHandler(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", pprofEnabledHandler(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", pprofEnabledHandler(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", pprofEnabledHandler(pprof.Trace))
+	mux.HandleFunc("/debug/runtime", pprofEnabledHandler(runtimeStatsHandler))
+}
+
+func pprofEnabledHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !currentCfg().PprofEnabled {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+type runtimeStats struct {
+	Goroutines       int            `json:"goroutines"`
+	ConnectionsInUse map[string]int `json:"connectionsInUse"` // by service
+	HeapAlloc        uint64         `json:"heapAlloc"`
+	HeapObjects      uint64         `json:"heapObjects"`
+	Sys              uint64         `json:"sys"`
+	NumGC            uint32         `json:"numGC"`
+	PauseTotalMs     float64        `json:"pauseTotalMs"`
+	LastPauseMs      float64        `json:"lastPauseMs"`
+	LastGC           time.Time      `json:"lastGC"`
+}
+
+// runtimeStatsHandler responds with the goroutines, memory and GC
+// stats as JSON, along with the connections in use, so that e.g. a
+// goroutine leak can be told apart from connection churn.
+func runtimeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	stats := &runtimeStats{
+		Goroutines:       runtime.NumGoroutine(),
+		ConnectionsInUse: map[string]int{},
+		HeapAlloc:        ms.HeapAlloc,
+		HeapObjects:      ms.HeapObjects,
+		Sys:              ms.Sys,
+		NumGC:            ms.NumGC,
+		PauseTotalMs:     float64(ms.PauseTotalNs) / float64(time.Millisecond),
+	}
+	if ms.NumGC > 0 {
+		stats.LastPauseMs = float64(ms.PauseNs[(ms.NumGC+255)%256]) / float64(time.Millisecond)
+		stats.LastGC = time.Unix(0, int64(ms.LastGC))
+	}
+	if serviceMgr != nil {
+		stats.ConnectionsInUse = serviceMgr.connectionsInUse()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		log.Printf("runtimeStatsHandler(): %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/tgres/tgres/graceful"
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/protobuf"
+	"github.com/tgres/tgres/transceiver"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// protobufServiceManager accepts length delimited DataPointBatch
+// protobuf messages over TCP (see the protobuf package).
+type protobufServiceManager struct {
+	streamListeners
+	t *transceiver.Transceiver
+}
+
+func (g *protobufServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	var err error
+
+	if cfg.ProtobufListenSpec != "" {
+		err = g.listen("protobufServiceManager", files, cfg.ProtobufListenSpec)
+	} else {
+		logFields{"proto": "protobuf"}.Printf("Not starting protobuf protocol because protobuf-listen-spec is blank")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error starting protobuf protocol serviceManager: %v", err)
+	}
+
+	fmt.Println("Protobuf protocol Listening on " + displayListenSpecs(cfg.ProtobufListenSpec))
+
+	for _, l := range g.listeners {
+		go g.protobufServer(l)
+	}
+
+	return nil
+}
+
+func (g *protobufServiceManager) protobufServer(listener *graceful.Listener) error {
+
+	for {
+		conn, err := acceptRetrying("protobufServer()", "protobuf", listener)
+		if err != nil {
+			return err
+		}
+
+		if !g.admit("protobufServer()", conn) {
+			continue
+		}
+		logConnAccepted("protobufServer()", conn)
+		go func() {
+			defer g.release()
+			handleProtobufProtocol(g.t, conn, currentCfg().ProtobufTimeout)
+		}()
+	}
+}
+
+func handleProtobufProtocol(t *transceiver.Transceiver, conn net.Conn, timeout int) {
+
+	defer conn.Close() // decrements graceful.TcpWg
+
+	var count int
+	defer logConnClosed("handleProtobufProtocol()", conn, time.Now(), &count)
+	counters := protobufCounters.from(conn.RemoteAddr())
+	counters.connection()
+
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		samples, err := protobuf.ReadBatch(r)
+		if err != nil {
+			if err != io.EOF {
+				// The stream cannot be resynchronized after a bad
+				// message, so give up on the connection.
+				counters.logParseError(err, "handleProtobufProtocol(): %v: %v", conn.RemoteAddr(), err)
+				counters.parseError()
+			}
+			return
+		}
+
+		for _, s := range samples {
+			if s.Name == "" {
+				counters.parseError()
+				continue
+			}
+			if counters.admit(t, 1) {
+				t.QueueDataPoint(misc.SanitizeName(s.Name), s.TimeStamp, s.Value)
+				counters.dataPoint(1)
+				count++
+			}
+		}
+
+		if timeout != 0 {
+			conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		}
+	}
+}
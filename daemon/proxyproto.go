@@ -0,0 +1,79 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The PROXY protocol (v1) header is a single line prepended by a load
+// balancer (e.g. HAProxy) to convey the address of the real client:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 2003\r\n
+//
+// See http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+const maxProxyHeaderLen = 107
+
+// proxyConn is a conn with the PROXY header stripped, its RemoteAddr
+// is that of the real client.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+
+// readProxyHeader reads and parses the PROXY header. When the proxy
+// protocol is enabled, a connection without one is an error, because
+// it did not come from the proxy.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReaderSize(conn, maxProxyHeaderLen+1)
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("readProxyHeader(): %v: PROXY header too long", conn.RemoteAddr())
+	} else if err != nil {
+		return nil, fmt.Errorf("readProxyHeader(): %v: %v", conn.RemoteAddr(), err)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("readProxyHeader(): %v: expected a PROXY header, got %q", conn.RemoteAddr(), line)
+	}
+
+	pc := &proxyConn{Conn: conn, r: r, remote: conn.RemoteAddr()}
+	switch fields[1] {
+	case "UNKNOWN": // e.g. a health check by the proxy itself
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("readProxyHeader(): %v: invalid PROXY header %q", conn.RemoteAddr(), line)
+		}
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if ip == nil || err != nil {
+			return nil, fmt.Errorf("readProxyHeader(): %v: invalid source address in PROXY header %q", conn.RemoteAddr(), line)
+		}
+		pc.remote = &net.TCPAddr{IP: ip, Port: int(port)}
+	default:
+		return nil, fmt.Errorf("readProxyHeader(): %v: unsupported protocol in PROXY header %q", conn.RemoteAddr(), line)
+	}
+	return pc, nil
+}
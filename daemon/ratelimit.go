@@ -0,0 +1,135 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// ingestRateLimiter limits the graphite text and pickle data points
+// per source IP (see rate-limit-per-ip), nil is no limit.
+var ingestRateLimiter *ipRateLimiter
+
+// Buckets idle this long are expired, by then they are full anyway,
+// so that the limiter does not grow with every IP ever seen.
+const ipRateLimiterIdle = time.Minute
+
+// ipRateLimiter is a token bucket per source IP, of rate data points
+// a second, which allows bursts of up to a second's worth.
+type ipRateLimiter struct {
+	sync.Mutex
+	rate      float64
+	exempt    []*net.IPNet
+	buckets   map[string]*ipBucket
+	lastSweep time.Time
+}
+
+type ipBucket struct {
+	tokens  float64
+	last    time.Time
+	dropped int64
+}
+
+func newIPRateLimiter(rate float64, exempt []*net.IPNet) *ipRateLimiter {
+	return &ipRateLimiter{rate: rate, exempt: exempt, buckets: make(map[string]*ipBucket), lastSweep: time.Now()}
+}
+
+// take returns how many of n data points from addr are within the
+// limit, the rest are counted as dropped. Addresses other than IP
+// ones (e.g. unix sockets) and exempt ones are not limited.
+func (l *ipRateLimiter) take(addr net.Addr, n int, now time.Time) int {
+	if l == nil {
+		return n
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return n
+	}
+	for _, ipNet := range l.exempt {
+		if ipNet.Contains(ip) {
+			return n
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if now.Sub(l.lastSweep) > ipRateLimiterIdle {
+		for key, b := range l.buckets {
+			if now.Sub(b.last) > ipRateLimiterIdle {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	burst := math.Max(l.rate, 1)
+	key := ip.String()
+	b := l.buckets[key]
+	if b == nil {
+		b = &ipBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	allowed := n
+	if float64(allowed) > b.tokens {
+		allowed = int(b.tokens)
+	}
+	b.tokens -= float64(allowed)
+	b.dropped += int64(n - allowed)
+	return allowed
+}
+
+// addrIP is the IP of a TCP or UDP addr, otherwise nil.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// dropped returns the data points dropped so far by IP, of the IPs
+// not (yet) expired.
+func (l *ipRateLimiter) dropped() map[string]int64 {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	result := make(map[string]int64)
+	for key, b := range l.buckets {
+		if b.dropped > 0 {
+			result[key] = b.dropped
+		}
+	}
+	return result
+}
+
+// logRateLimited logs the data points of a connection dropped by the
+// ingestRateLimiter, if any, when it is closed.
+func logRateLimited(who string, conn net.Conn, limited *int) {
+	if *limited > 0 {
+		logFields{"remote_addr": conn.RemoteAddr(), "dropped": *limited}.Printf("%s: %v: dropped %d data points over rate-limit-per-ip (%v a second)", who, conn.RemoteAddr(), *limited, currentCfg().RateLimitPerIP)
+	}
+}
@@ -0,0 +1,218 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Points on the hash ring per peer, the more there are the more
+// evenly the series are spread.
+const relayVirtualNodes = 128
+
+// hashRing maps a series name to a peer by consistent hashing, so
+// that adding (or removing) a peer only moves the series of the
+// ring segments it takes over (or gives up), about 1/n of them.
+type hashRing struct {
+	hashes []uint32 // sorted
+	peers  []string // peers[i] owns hashes[i]
+}
+
+func newHashRing(peers []string, vnodes int) *hashRing {
+	r := &hashRing{}
+	for _, peer := range peers {
+		for i := 0; i < vnodes; i++ {
+			r.hashes = append(r.hashes, ringHash(fmt.Sprintf("%s-%d", peer, i)))
+			r.peers = append(r.peers, peer)
+		}
+	}
+	sort.Sort(r)
+	return r
+}
+
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// sort.Interface
+func (r *hashRing) Len() int           { return len(r.hashes) }
+func (r *hashRing) Less(i, j int) bool { return r.hashes[i] < r.hashes[j] }
+func (r *hashRing) Swap(i, j int) {
+	r.hashes[i], r.hashes[j] = r.hashes[j], r.hashes[i]
+	r.peers[i], r.peers[j] = r.peers[j], r.peers[i]
+}
+
+// owner is the peer of the first point on the ring at or after the
+// hash of name.
+func (r *hashRing) owner(name string) string {
+	h := ringHash(name)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.peers[i]
+}
+
+// pickleRelay forwards the data points of series owned by other
+// peers (see cluster-peers) to their graphite-pickle-listen-spec. A
+// relayed item is (name, (timestamp, value), hops), the hops is what
+// makes the receiver queue it as ours, never relaying it again.
+type pickleRelay struct {
+	ring  *hashRing
+	self  string
+	peers map[string]*relayPeer
+	wg    sync.WaitGroup
+}
+
+func newPickleRelay(peers []string, self string) *pickleRelay {
+	r := &pickleRelay{ring: newHashRing(peers, relayVirtualNodes), self: self, peers: make(map[string]*relayPeer)}
+	for _, addr := range peers {
+		if addr != self {
+			p := &relayPeer{addr: addr, ch: make(chan *relayedPoint, relayQueueSize)}
+			r.peers[addr] = p
+			r.wg.Add(1)
+			go func() {
+				defer r.wg.Done()
+				p.run()
+			}()
+		}
+	}
+	return r
+}
+
+func (r *pickleRelay) Relay(name string, ts time.Time, v float64) bool {
+	owner := r.ring.owner(name)
+	if owner == r.self {
+		return false
+	}
+	p := r.peers[owner]
+	select {
+	case p.ch <- &relayedPoint{name, ts, v}:
+	default:
+		atomic.AddInt64(&p.dropped, 1) // the peer is down or too slow
+	}
+	return true
+}
+
+// clusterPeer is true if addr is that of one of the cluster-peers.
+func clusterPeer(addr net.Addr) bool {
+	ip := addrIP(addr)
+	return ip != nil && currentCfg().ClusterPeerIPs[ip.String()]
+}
+
+// Stop sends what is queued and waits for it.
+func (r *pickleRelay) Stop() {
+	for _, p := range r.peers {
+		close(p.ch)
+	}
+	r.wg.Wait()
+}
+
+const (
+	relayQueueSize     = 65536
+	relayBatchSize     = 1000
+	relayFlushInterval = time.Second
+	relayDialTimeout   = 5 * time.Second
+	// Less than the (default) graphite-pickle-timeout after which
+	// the receiver closes an idle connection, an older one is not
+	// written to, but redialed.
+	relayIdleTimeout = 5 * time.Second
+)
+
+type relayedPoint struct {
+	name  string
+	ts    time.Time
+	value float64
+}
+
+type relayPeer struct {
+	addr     string
+	ch       chan *relayedPoint
+	conn     net.Conn
+	lastSent time.Time
+	dropped  int64 // atomic
+}
+
+// run sends batches of up to relayBatchSize points, at least every
+// relayFlushInterval, until ch is closed.
+func (p *relayPeer) run() {
+	defer func() {
+		if p.conn != nil {
+			p.conn.Close()
+		}
+	}()
+
+	tick := time.NewTicker(relayFlushInterval)
+	defer tick.Stop()
+
+	var batch []interface{}
+	for {
+		select {
+		case dp, ok := <-p.ch:
+			if !ok {
+				p.send(batch)
+				return
+			}
+			batch = append(batch, []interface{}{dp.name, []interface{}{dp.ts.Unix(), dp.value}, 1})
+			if len(batch) < relayBatchSize {
+				continue
+			}
+		case <-tick.C:
+		}
+		p.send(batch)
+		batch = nil
+	}
+}
+
+func (p *relayPeer) send(batch []interface{}) {
+	if dropped := atomic.SwapInt64(&p.dropped, 0); dropped > 0 {
+		log.Printf("relayPeer.send(): %s: dropped %d data points, the queue was full", p.addr, dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	if p.conn != nil && time.Now().Sub(p.lastSent) > relayIdleTimeout {
+		p.conn.Close()
+		p.conn = nil
+	}
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.addr, relayDialTimeout)
+		if err != nil {
+			log.Printf("relayPeer.send(): %s: dropping %d data points: %v", p.addr, len(batch), err)
+			return
+		}
+		p.conn = conn
+	}
+
+	p.conn.SetWriteDeadline(time.Now().Add(relayDialTimeout))
+	if err := writePickleFrame(p.conn, batch); err != nil {
+		log.Printf("relayPeer.send(): %s: dropping %d data points: %v", p.addr, len(batch), err)
+		p.conn.Close()
+		p.conn = nil
+		return
+	}
+	p.lastSent = time.Now()
+}
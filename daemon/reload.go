@@ -0,0 +1,201 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	x "github.com/tgres/tgres/transceiver"
+	"log"
+	"reflect"
+	"strings"
+)
+
+// liveSettings can be changed by a reload: they are either applied
+// to the transceiver (see Reconfigure()) or only looked up (with
+// currentCfg()) when used.
+var liveSettings = map[string]bool{
+	"max-cached-points":              true,
+	"max-cache-duration":             true,
+	"min-cache-duration":             true,
+	"stat-flush-interval":            true,
+	"flush-max-retries":              true,
+	"flush-retry-delay":              true,
+	"name-rewrite-script":            true,
+	"series-alias-rules":             true,
+	"name-replace-rules":             true,
+	"sanitize-names":                 true,
+	"allow-names":                    true,
+	"deny-names":                     true,
+	"flush-priority-rules-file":      true,
+	"aggregation-rules-file":         true,
+	"ds":                             true,
+	"catch-all-ds":                   true,
+	"storage-schemas-file":           true,
+	"storage-aggregation-file":       true,
+	"max-rras-per-ds":                true,
+	"shutdown-drain-timeout":         true,
+	"connection-log-level":           true,
+	"accept-backoff-initial":         true,
+	"accept-backoff-max":             true,
+	"log-level":                      true,
+	"query-timeout":                  true,
+	"http-cors-allow-origin":         true,
+	"graphite-auto-pickle-bytes":     true,
+	"http-gzip-min-size":             true,
+	"source-idle-expiry":             true,
+	"http-basic-auth-user":           true,
+	"http-basic-auth-password":       true,
+	"http-basic-auth-file":           true,
+	"http-basic-auth-exempt":         true,
+	"delete-enabled":                 true,
+	"pprof-enabled":                  true,
+	"rename-existing":                true,
+	"ingest-max-body-size":           true,
+	"queue-full-policy":              true,
+	"graphite-text-proxy-protocol":   true,
+	"graphite-pickle-proxy-protocol": true,
+	"graphite-pickle-allow-gzip":     true,
+	"graphite-pickle-framing":        true,
+	"graphite-allow-timestampless":   true,
+	"default-timestamp-to-now":       true,
+	"graphite-text-strict":           true,
+	"graphite-text-timeout":          true,
+	"graphite-pickle-timeout":        true,
+	"influx-line-timeout":            true,
+	"opentsdb-timeout":               true,
+	"protobuf-timeout":               true,
+	"graphite-tls-sni-prefixes":      true,
+	"graphite-tls-default-prefix":    true,
+}
+
+// serviceSettings are what each service listens with, those services
+// for which they differ after a reload are restarted.
+func serviceSettings(c *Config) map[string]string {
+	tlsKey := fmt.Sprint(c.TLSCertFile, c.TLSKeyFile, c.TLSMinVersion)
+	return map[string]string{
+		"gt":  fmt.Sprint(c.GraphiteTextListenSpec, c.UnixSocketMode),
+		"gts": fmt.Sprint(c.GraphiteTextTLSListenSpec, tlsKey),
+		"gtu": fmt.Sprint(c.GraphiteTextUnixListenSpec, c.UnixSocketMode),
+		"gu":  c.GraphiteUdpListenSpec,
+		"gp":  c.GraphitePickleListenSpec,
+		"gps": fmt.Sprint(c.GraphitePickleTLSListenSpec, tlsKey),
+		"ga":  c.GraphiteAutoListenSpec,
+		"su":  c.StatsdUdpListenSpec,
+		"il":  c.InfluxLineListenSpec,
+		"ot":  c.OpenTSDBListenSpec,
+		"pb":  c.ProtobufListenSpec,
+		"mp":  c.MsgpackListenSpec,
+		"www": fmt.Sprint(c.HttpListenSpec, c.EmptyRenderPolicy, c.RenderMaxSeries, c.MonitoringListenSpec == ""),
+		"mon": c.MonitoringListenSpec,
+		"ft":  fmt.Sprint(c.FileTailFiles, c.FileTailFromStart, c.FileTailStateFile),
+	}
+}
+
+func isServiceSetting(name string) bool {
+	switch name {
+	case "tls-cert-file", "tls-key-file", "tls-min-version", "unix-socket-mode", "empty-render-policy", "render-max-series",
+		"file-tail-files", "file-tail-from-start", "file-tail-state-file",
+		"graphite-text-enabled", "graphite-text-tls-enabled", "graphite-text-unix-enabled", "graphite-udp-enabled",
+		"graphite-pickle-enabled", "graphite-pickle-tls-enabled", "graphite-auto-enabled", "statsd-udp-enabled",
+		"influx-line-enabled", "opentsdb-enabled", "protobuf-enabled", "msgpack-enabled":
+		return true
+	}
+	return strings.HasSuffix(name, "-listen-spec")
+}
+
+// settingName is the name of a Config field in the config file.
+func settingName(f reflect.StructField) string {
+	if name := f.Tag.Get("toml"); name != "" {
+		return name
+	}
+	return strings.ToLower(f.Name)
+}
+
+// reload diffs newCfg against the current Cfg, applies the live
+// settings, restarts the services whose listen specs changed and
+// makes newCfg the current Cfg. The other settings are left as they
+// were, they require a graceful restart.
+func (r *ServiceManager) reload(newCfg *Config) {
+	old := Cfg
+
+	var applied, ignored []string
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(newCfg).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		name := settingName(ov.Type().Field(i))
+		if name == "-" || reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if liveSettings[name] || isServiceSetting(name) {
+			applied = append(applied, name)
+		} else {
+			ignored = append(ignored, name)
+			nv.Field(i).Set(ov.Field(i))
+		}
+	}
+	// Not a live setting either, see derived-metrics-file.
+	newCfg.DerivedMetrics = old.DerivedMetrics
+
+	r.t.Reconfigure(func() {
+		r.t.MaxCacheDuration = newCfg.MaxCache.Duration
+		r.t.MinCacheDuration = newCfg.MinCache.Duration
+		r.t.MaxCachedPoints = newCfg.MaxCachedPoints
+		r.t.StatFlushDuration = newCfg.StatFlush.Duration
+		r.t.FlushMaxRetries = newCfg.FlushMaxRetries
+		if newCfg.FlushRetryDelay.Duration != 0 {
+			r.t.FlushRetryDelay = newCfg.FlushRetryDelay.Duration
+		}
+		r.t.NameRewriter = newCfg.NameRewriter
+		r.t.SeriesAliasRules = newCfg.SeriesAliasRules
+		r.t.NameReplaceRules = newCfg.NameReplaceRules
+		r.t.SanitizeNames = newCfg.SanitizeNames
+		r.t.AllowNames, r.t.DenyNames = newCfg.AllowNames, newCfg.DenyNames
+		r.t.FlushPriorityRules = newCfg.FlushPriorityRules
+		r.t.AggregationRules = newCfg.AggregationRules
+		r.t.DSSpecs = x.MatchingDSSpecFinder(newCfg)
+		r.t.MaxRrasPerDs = newCfg.MaxRrasPerDs
+	})
+
+	before := serviceSettings(old)
+	cfgLk.Lock()
+	Cfg = newCfg
+	cfgLk.Unlock()
+	after := serviceSettings(newCfg)
+	for name, service := range r.services {
+		disabled := serviceDisabled(newCfg, name)
+		if before[name] == after[name] && disabled == serviceDisabled(old, name) {
+			continue
+		}
+		if disabled {
+			log.Printf("reload(): stopping the %q service, it is disabled.", name)
+			service.Stop()
+			continue
+		}
+		log.Printf("reload(): restarting the %q service.", name)
+		service.Stop()
+		if err := service.Start(nil); err != nil {
+			log.Printf("reload(): %q: %v", name, err)
+		}
+	}
+
+	if len(applied) > 0 {
+		log.Printf("reload(): applied: %s.", strings.Join(applied, ", "))
+	} else {
+		log.Printf("reload(): no changes to apply.")
+	}
+	if len(ignored) > 0 {
+		log.Printf("reload(): ignored, these require a graceful restart (SIGUSR2): %s.", strings.Join(ignored, ", "))
+	}
+}
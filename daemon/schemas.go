@@ -0,0 +1,189 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"github.com/tgres/tgres/misc"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Graphite has no heartbeat, series from a storage-schemas-file get
+// this one.
+const dftStorageSchemaHeartbeat = 2 * time.Hour
+
+// confSection is a [section] of a graphite (carbon) config file.
+type confSection struct {
+	name   string
+	line   int
+	values map[string]string
+}
+
+// parseCarbonConf parses the ini-like format of carbon config files,
+// keys not in allowed are an error.
+func parseCarbonConf(data string, allowed ...string) ([]*confSection, error) {
+	var sections []*confSection
+	for n, l := range strings.Split(data, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if strings.HasPrefix(l, "[") && strings.HasSuffix(l, "]") {
+			sections = append(sections, &confSection{name: l[1 : len(l)-1], line: n + 1, values: make(map[string]string)})
+			continue
+		}
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 || len(sections) == 0 {
+			return nil, fmt.Errorf("line %d: expected [section] or key = value, got %q", n+1, l)
+		}
+		key := strings.TrimSpace(parts[0])
+		known := false
+		for _, a := range allowed {
+			known = known || key == a
+		}
+		if !known {
+			return nil, fmt.Errorf("line %d: unknown key %q", n+1, key)
+		}
+		sections[len(sections)-1].values[key] = strings.TrimSpace(parts[1])
+	}
+	return sections, nil
+}
+
+// parseStorageSchemas parses a graphite storage-schemas.conf, e.g.:
+//
+//	[carbon]
+//	pattern = ^carbon\.
+//	retentions = 60:90d
+//
+//	[default]
+//	pattern = .*
+//	retentions = 10s:6h,1m:7d,10m:5y
+//	align = nearest
+//
+// Into a DSSpec per section, in the order of the file. A retention is
+// "precision:duration", either of which may be a number (of seconds
+// and of points respectively) or a duration. The align key (tgres
+// only) is that of a [[ds]].
+func parseStorageSchemas(data string) ([]DSSpec, error) {
+	sections, err := parseCarbonConf(data, "pattern", "retentions", "priority", "align") // priority is carbon only, ignored
+	if err != nil {
+		return nil, err
+	}
+	var specs []DSSpec
+	for _, sect := range sections {
+		pattern, retentions := sect.values["pattern"], sect.values["retentions"]
+		if pattern == "" || retentions == "" {
+			return nil, fmt.Errorf("line %d: [%s]: both pattern and retentions are required", sect.line, sect.name)
+		}
+		spec, err := storageSchema(pattern, retentions)
+		if err == nil {
+			err = spec.Align.UnmarshalText([]byte(sect.values["align"]))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: [%s]: %v", sect.line, sect.name, err)
+		}
+		specs = append(specs, *spec)
+	}
+	return specs, nil
+}
+
+func storageSchema(pattern, retentions string) (*DSSpec, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	spec := &DSSpec{Regexp: regex{re}, Heartbeat: duration{dftStorageSchemaHeartbeat}}
+	for _, r := range strings.Split(retentions, ",") {
+		parts := strings.Split(strings.TrimSpace(r), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid retention %q, expected precision:duration", r)
+		}
+		step, err := retentionDuration(parts[0], time.Second)
+		if err != nil || step <= 0 {
+			return nil, fmt.Errorf("invalid precision in retention %q", r)
+		}
+		size, err := retentionDuration(parts[1], step)
+		if err != nil || size < step {
+			return nil, fmt.Errorf("invalid duration in retention %q", r)
+		}
+		spec.RRAs = append(spec.RRAs, RRASpec{Function: "AVERAGE", Step: step, Size: size / step * step, Xff: 0.5})
+		if spec.Step.Duration == 0 || step < spec.Step.Duration {
+			spec.Step.Duration = step
+		}
+	}
+	return spec, nil
+}
+
+// retentionDuration parses a number of units or a duration.
+func retentionDuration(s string, unit time.Duration) (time.Duration, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(n) * unit, nil
+	}
+	return misc.BetterParseDuration(s)
+}
+
+// A storageAggregation sets the consolidation function (and
+// optionally the xff) of the RRAs of matching series.
+type storageAggregation struct {
+	*regexp.Regexp
+	Function string
+	Xff      *float64
+}
+
+// parseStorageAggregations parses a graphite storage-aggregation.conf,
+// e.g.:
+//
+//	[count]
+//	pattern = \.count$
+//	xFilesFactor = 0
+//	aggregationMethod = sum
+//
+// The methods are average, sum, min, max and last, the default is
+// average. Without an xFilesFactor, that of the RRA spec is kept.
+func parseStorageAggregations(data string) ([]storageAggregation, error) {
+	sections, err := parseCarbonConf(data, "pattern", "xFilesFactor", "aggregationMethod")
+	if err != nil {
+		return nil, err
+	}
+	var aggs []storageAggregation
+	for _, sect := range sections {
+		if sect.values["pattern"] == "" {
+			return nil, fmt.Errorf("line %d: [%s]: pattern is required", sect.line, sect.name)
+		}
+		re, err := regexp.Compile(sect.values["pattern"])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: [%s]: invalid pattern: %v", sect.line, sect.name, err)
+		}
+		agg := storageAggregation{Regexp: re, Function: "AVERAGE"}
+		if m, ok := sect.values["aggregationMethod"]; ok {
+			if agg.Function = strings.ToUpper(m); !validRRAFunction(agg.Function) {
+				return nil, fmt.Errorf("line %d: [%s]: invalid aggregationMethod %q (valid: average, sum, min, max, last)", sect.line, sect.name, m)
+			}
+		}
+		if x, ok := sect.values["xFilesFactor"]; ok {
+			xff, err := strconv.ParseFloat(x, 64)
+			if err != nil || xff < 0 || xff > 1 {
+				return nil, fmt.Errorf("line %d: [%s]: invalid xFilesFactor %q", sect.line, sect.name, x)
+			}
+			agg.Xff = &xff
+		}
+		aggs = append(aggs, agg)
+	}
+	return aggs, nil
+}
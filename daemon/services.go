@@ -17,39 +17,65 @@ package daemon
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
 	pickle "github.com/hydrogen18/stalecucumber"
 	"github.com/tgres/tgres/graceful"
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/statsd"
 	"github.com/tgres/tgres/transceiver"
+	"io"
 	"log"
+	"math"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// A service has a listener (or UDP socket) per listen spec, Files()
+// returns them to be passed on to the child on a graceful restart,
+// which Start()s with those it inherited.
 type trService interface {
-	File() *os.File
-	Start(*os.File) error
+	Files() []*os.File
+	Start([]*os.File) error
 	Stop()
 }
 
 type serviceMap map[string]trService
 type ServiceManager struct {
-	t        *transceiver.Transceiver
-	services serviceMap
+	t                 *transceiver.Transceiver
+	services          serviceMap
+	internalStatsStop chan bool // see startInternalStats
+	internalStatsWg   sync.WaitGroup
 }
 
 func newServiceManager(t *transceiver.Transceiver) *ServiceManager {
 	return &ServiceManager{t: t,
 		services: serviceMap{
 			"gt":  &graphiteTextServiceManager{t: t},
+			"gts": &graphiteTextTLSServiceManager{graphiteTextServiceManager{t: t}},
+			"gtu": &graphiteTextUnixServiceManager{graphiteTextServiceManager{t: t}},
 			"gu":  &graphiteUdpTextServiceManager{t: t},
 			"gp":  &graphitePickleServiceManager{t: t},
+			"gps": &graphitePickleTLSServiceManager{graphitePickleServiceManager{t: t}},
+			"ga":  &graphiteAutoServiceManager{t: t},
 			"su":  &statsdUdpTextServiceManager{t: t},
+			"il":  &influxLineServiceManager{t: t},
+			"ot":  &opentsdbServiceManager{t: t},
+			"pb":  &protobufServiceManager{t: t},
+			"mp":  &msgpackServiceManager{t: t},
+			"ft":  &fileTailServiceManager{t: t},
 			"www": &wwwServer{t: t},
+			"mon": &monitoringServer{t: t},
 		},
 	}
 }
@@ -61,88 +87,222 @@ func processListenSpec(listenSpec string) string {
 	return listenSpec
 }
 
+// On a graceful restart, the child is told which inherited fd
+// belongs to which service in this environment variable, e.g.
+// "gt=0,gt=1,www=2" means that fds 3 and 4 are graphite text
+// listeners and fd 5 is the HTTP listener. Unlike relying on the order of the -graceful
+// list, this still works when the child has a different set of
+// services than the parent.
+const gracefulFdsEnv = "TGRES_GRACEFUL_FDS"
+
 func (r *ServiceManager) run(gracefulProtos string) error {
+	cfg := currentCfg()
 
-	// TODO If a listen-spec changes in the config and a graceful
-	// restart is issued, the new config will not take effect as the
-	// open file is reused.
+	// NB: If a listen-spec changes in the config and a graceful
+	// restart is issued, the service closes the inherited file and
+	// listens anew (see matchInherited()).
 
-	if gracefulProtos == "" {
-		for _, service := range r.services {
-			if err := service.Start(nil); err != nil {
-				return err
-			}
+	if err := validateListenSpecs(cfg); err != nil {
+		return err
+	}
+
+	fds, err := gracefulFds(os.Getenv(gracefulFdsEnv), gracefulProtos)
+	if err != nil {
+		return err
+	}
+
+	for name, service := range r.services {
+		if serviceDisabled(cfg, name) {
+			log.Printf("run(): not starting the %q service, it is disabled.", name)
+			continue // its inherited fds (if any) are closed below
 		}
-	} else {
+		var files []*os.File
+		for _, n := range fds[name] {
+			files = append(files, os.NewFile(uintptr(n+3), name))
+		}
+		delete(fds, name)
+		if err := service.Start(files); err != nil {
+			return err
+		}
+	}
 
-		protos := strings.Split(gracefulProtos, ",")
+	for name, ns := range fds {
+		for _, n := range ns {
+			log.Printf("run(): no %q service running, closing inherited fd %d.", name, n+3)
+			os.NewFile(uintptr(n+3), name).Close()
+		}
+	}
+	return nil
+}
 
-		for n, p := range protos {
-			f := os.NewFile(uintptr(n+3), "")
-			if r.services[p] != nil {
-				if err := r.services[p].Start(f); err != nil {
-					return err
-				}
+// gracefulFds returns the indexes (among the inherited files) of the
+// files of each service. If there is no mapping (the parent is an
+// older version), the order of protos (the -graceful list) is used.
+func gracefulFds(mapping, protos string) (map[string][]int, error) {
+	fds := make(map[string][]int)
+	if mapping == "" {
+		if protos != "" {
+			for n, p := range strings.Split(protos, ",") {
+				fds[p] = append(fds[p], n)
 			}
 		}
+		return fds, nil
 	}
-	return nil
+	for _, pair := range strings.Split(mapping, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("gracefulFds(): invalid %s entry: %q", gracefulFdsEnv, pair)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("gracefulFds(): invalid %s fd index: %q", gracefulFdsEnv, pair)
+		}
+		fds[parts[0]] = append(fds[parts[0]], n)
+	}
+	return fds, nil
 }
 
-func (r *ServiceManager) listenerFilesAndProtocols() ([]*os.File, string) {
+// listenerFilesAndProtocols returns the files of the running services
+// to be passed to the child on a graceful restart, along with the
+// (positional) -graceful list and the gracefulFdsEnv mapping.
+func (r *ServiceManager) listenerFilesAndProtocols() ([]*os.File, string, string) {
 
 	files := []*os.File{}
 	protos := []string{}
+	mapping := []string{}
 
 	for name, service := range r.services {
-		files = append(files, service.File())
-		protos = append(protos, name)
+		for _, f := range service.Files() {
+			mapping = append(mapping, fmt.Sprintf("%s=%d", name, len(files)))
+			files = append(files, f)
+			protos = append(protos, name)
+		}
 	}
-	return files, strings.Join(protos, ",")
+	return files, strings.Join(protos, ","), strings.Join(mapping, ",")
 }
 
-func (r *ServiceManager) closeListeners() {
+// listenerCount is the number of listeners (and UDP sockets) of all
+// the services.
+func (r *ServiceManager) listenerCount() int {
+	var n int
 	for _, service := range r.services {
-		service.Stop()
+		if s, ok := service.(interface {
+			listenerCount() int
+		}); ok {
+			n += s.listenerCount()
+		}
 	}
-	graceful.TcpWg.Wait()
+	return n
 }
 
-// ---
+// boundServices returns the services which have listeners (or UDP
+// sockets), and those which have a listen spec but none.
+func (r *ServiceManager) boundServices() (bound, missing []string) {
+	cfg := currentCfg()
+	bound = []string{}
+	specs := serviceListenSpecs(cfg)
+	for name, service := range r.services {
+		if serviceDisabled(cfg, name) {
+			continue // neither bound nor missing
+		}
+		n := 0
+		if s, ok := service.(interface {
+			listenerCount() int
+		}); ok {
+			n = s.listenerCount()
+		}
+		if n > 0 {
+			bound = append(bound, name)
+		} else if specs[name][1] != "" {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(bound)
+	sort.Strings(missing)
+	return bound, missing
+}
 
-type wwwServer struct {
-	t        *transceiver.Transceiver
-	listener *graceful.Listener
+// connectionsInUse returns the number of connections being handled
+// by each of the services which limit them (see admit()).
+func (r *ServiceManager) connectionsInUse() map[string]int {
+	result := make(map[string]int)
+	for name, service := range r.services {
+		if s, ok := service.(interface {
+			connectionsInUse() int
+		}); ok {
+			result[name] = s.connectionsInUse()
+		}
+	}
+	return result
 }
 
-func (g *wwwServer) File() *os.File {
-	if g.listener != nil {
-		return g.listener.File()
+// drain stops all services, waits for their handlers to finish (see
+// closeListeners), then stops the transceiver, which flushes all the
+// data points queued so far.
+func (r *ServiceManager) drain(timeout time.Duration) {
+	r.closeListeners(timeout)
+	log.Printf("drain(): all handlers finished, flushing.")
+	r.stopInternalStats()
+	r.t.Stop()
+}
+
+// closeListeners stops all services, then waits up to timeout (0
+// means forever) for the open TCP connections to finish. Any
+// connections still open after the timeout are closed. The UDP
+// handlers finish as soon as their sockets are closed.
+func (r *ServiceManager) closeListeners(timeout time.Duration) {
+	for _, service := range r.services {
+		service.Stop()
 	}
-	return nil
+	if !graceful.WaitTimeout(timeout) {
+		log.Printf("closeListeners(): connections still open after %v, closing them.", timeout)
+		graceful.CloseConns()
+		graceful.TcpWg.Wait()
+	}
+	udpWg.Wait()
 }
 
-func (g *wwwServer) Stop() {
-	if g.listener != nil {
-		g.listener.Close()
+// dropListeners stops all services and closes all open TCP
+// connections without waiting for clients to finish.
+func (r *ServiceManager) dropListeners() {
+	for _, service := range r.services {
+		service.Stop()
 	}
+	graceful.CloseConns()
+	graceful.TcpWg.Wait()
+	udpWg.Wait()
 }
 
-func (g *wwwServer) Start(file *os.File) error {
-	var (
-		gl  net.Listener
-		err error
-	)
+// udpWg is the UDP counterpart of graceful.TcpWg: it counts the
+// running UDP handlers, so that the shutdown does not flush before
+// the last datagram is queued.
+var udpWg sync.WaitGroup
+
+// goUdpHandler runs handler in a goroutine counted by udpWg.
+func goUdpHandler(handler func()) {
+	udpWg.Add(1)
+	go func() {
+		defer udpWg.Done()
+		handler()
+	}()
+}
 
-	if Cfg.HttpListenSpec != "" {
-		if file != nil {
-			gl, err = net.FileListener(file)
-		} else {
-			gl, err = net.Listen("tcp", processListenSpec(Cfg.HttpListenSpec))
-		}
+// ---
+
+type wwwServer struct {
+	streamListeners
+	t *transceiver.Transceiver
+}
+
+func (g *wwwServer) Start(files []*os.File) error {
+	cfg := currentCfg()
+	var err error
+
+	if cfg.HttpListenSpec != "" {
+		err = g.listen("wwwServer", files, cfg.HttpListenSpec)
 	} else {
 		fmt.Printf("Not starting HTTP server because http-listen-spec is blank.\n")
-		log.Printf("Not starting HTTP server because http-listen-spec is blank.")
+		logFields{"proto": "http"}.Printf("Not starting HTTP server because http-listen-spec is blank.")
 		return nil
 	}
 
@@ -151,49 +311,58 @@ func (g *wwwServer) Start(file *os.File) error {
 		return fmt.Errorf("Error starting HTTP protocol: %v", err)
 	}
 
-	g.listener = graceful.NewListener(gl)
+	fmt.Printf("HTTP protocol Listening on %s\n", displayListenSpecs(cfg.HttpListenSpec))
 
-	fmt.Printf("HTTP protocol Listening on %s\n", processListenSpec(Cfg.HttpListenSpec))
-
-	go httpServer(Cfg.HttpListenSpec, g.listener, g.t)
+	httpServer(g.listeners, g.t)
 
 	return nil
 }
 
 // ---
 
-type graphitePickleServiceManager struct {
-	t        *transceiver.Transceiver
-	listener *graceful.Listener
+type monitoringServer struct {
+	streamListeners
+	t *transceiver.Transceiver
 }
 
-func (g *graphitePickleServiceManager) File() *os.File {
-	if g.listener != nil {
-		return g.listener.File()
+func (g *monitoringServer) Start(files []*os.File) error {
+	cfg := currentCfg()
+	var err error
+
+	if cfg.MonitoringListenSpec != "" {
+		err = g.listen("monitoringServer", files, cfg.MonitoringListenSpec)
+	} else {
+		logFields{"proto": "monitoring"}.Printf("Monitoring endpoints will be served by the HTTP server because monitoring-listen-spec is blank.")
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Error starting monitoring HTTP protocol: %v", err)
 	}
+
+	fmt.Printf("Monitoring HTTP protocol Listening on %s\n", displayListenSpecs(cfg.MonitoringListenSpec))
+
+	monitoringHttpServer(g.listeners, g.t)
+
 	return nil
 }
 
-func (g *graphitePickleServiceManager) Stop() {
-	if g.listener != nil {
-		g.listener.Close()
-	}
+// ---
+
+type graphitePickleServiceManager struct {
+	streamListeners
+	t         *transceiver.Transceiver
+	tlsConfig *tls.Config // connections are TLS, if not nil
 }
 
-func (g *graphitePickleServiceManager) Start(file *os.File) error {
-	var (
-		gl  net.Listener
-		err error
-	)
+func (g *graphitePickleServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	var err error
 
-	if Cfg.GraphitePickleListenSpec != "" {
-		if file != nil {
-			gl, err = net.FileListener(file)
-		} else {
-			gl, err = net.Listen("tcp", processListenSpec(Cfg.GraphitePickleListenSpec))
-		}
+	if cfg.GraphitePickleListenSpec != "" {
+		err = g.listen("graphitePickleServiceManager", files, cfg.GraphitePickleListenSpec)
 	} else {
-		log.Printf("Not starting Graphite Pickle Protocol because graphite-pickle-listen-spec is blank.")
+		logFields{"proto": "graphite-pickle"}.Printf("Not starting Graphite Pickle Protocol because graphite-pickle-listen-spec is blank.")
 		return nil
 	}
 
@@ -201,43 +370,35 @@ func (g *graphitePickleServiceManager) Start(file *os.File) error {
 		return fmt.Errorf("Error starting Graphite Pickle Protocol serviceManager: %v", err)
 	}
 
-	g.listener = graceful.NewListener(gl)
+	fmt.Printf("Graphite Pickle protocol Listening on %s\n", displayListenSpecs(cfg.GraphitePickleListenSpec))
 
-	fmt.Printf("Graphite Pickle protocol Listening on %s\n", processListenSpec(Cfg.GraphitePickleListenSpec))
-
-	go g.graphitePickleServer()
+	for _, l := range g.listeners {
+		go g.graphitePickleServer(l)
+	}
 
 	return nil
 }
 
-func (g *graphitePickleServiceManager) graphitePickleServer() error {
+func (g *graphitePickleServiceManager) graphitePickleServer(listener *graceful.Listener) error {
 
-	var tempDelay time.Duration
 	for {
-		conn, err := g.listener.Accept()
-
-		// This code comes from the golang http lib, it attempts to
-		// retry accepting a connection when too many files are open
-		// under heavy load.
+		conn, err := acceptRetrying("graphitePickleServer()", "graphite-pickle", listener)
 		if err != nil {
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-				log.Printf("Accept error: %v; retrying in %v", err, tempDelay)
-				time.Sleep(tempDelay)
-				continue
-			}
 			return err
 		}
-		tempDelay = 0
 
-		go handleGraphitePickleProtocol(g.t, conn, 10)
+		if !g.admit("graphitePickleServer()", conn) {
+			continue
+		}
+		logConnAccepted("graphitePickleServer()", conn)
+		go func() {
+			defer g.release()
+			if g.tlsConfig != nil {
+				handleGraphitePickleTLSProtocol(g.t, conn, g.tlsConfig, currentCfg().GraphitePickleTimeout)
+			} else {
+				handleGraphitePickleProtocol(g.t, conn, currentCfg().GraphitePickleTimeout)
+			}
+		}()
 	}
 }
 
@@ -249,103 +410,263 @@ func handleGraphitePickleProtocol(t *transceiver.Transceiver, conn net.Conn, tim
 		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
 	}
 
-	// We use the Scanner, becase it has a MaxScanTokenSize of 64K
+	if currentCfg().GraphitePickleProxyProtocol {
+		var err error
+		if conn, err = readProxyHeader(conn); err != nil {
+			logFields{"proto": "graphite-pickle", "error": err}.Printf("handleGraphitePickleProtocol(): %v", err)
+			return
+		}
+	}
 
-	var (
-		name                 string
-		tstamp               int64
-		int_value            int64
-		value                float64
-		err                  error
-		item                 interface{}
-		items, itemSlice, dp []interface{}
-	)
+	readGraphitePickle("handleGraphitePickleProtocol()", t, conn, timeout)
+}
 
-	items, err = pickle.ListOrTuple(pickle.Unpickle(conn))
-	if err == nil {
-		for _, item = range items {
-			itemSlice, err = pickle.ListOrTuple(item, err)
-			if len(itemSlice) == 2 {
-				name, err = pickle.String(itemSlice[0], err)
-				dp, err = pickle.ListOrTuple(itemSlice[1], err)
-				if len(dp) == 2 {
-					tstamp, err = pickle.Int(dp[0], err)
-					if value, err = pickle.Float(dp[1], err); err != nil {
-						if _, ok := err.(pickle.WrongTypeError); ok {
-							if int_value, err = pickle.Int(dp[1], nil); err == nil {
-								value = float64(int_value)
-							}
-						}
-					}
-					t.QueueDataPoint(name, time.Unix(tstamp, 0), value)
-				} else {
-					err = fmt.Errorf("dp wrong length: %d", len(dp))
-					break
-				}
-			} else {
-				err = fmt.Errorf("item wrong length: %d", len(itemSlice))
-				break
+// readGraphitePickle reads pickles until the connection is closed.
+func readGraphitePickle(who string, t *transceiver.Transceiver, conn net.Conn, timeout int) {
+	cfg := currentCfg()
+
+	var count, dropped, limited int
+	defer logConnClosed(who, conn, time.Now(), &count)
+	defer logRateLimited(who, conn, &limited)
+	counters := graphitePickleCounters.from(conn.RemoteAddr())
+	counters.connection()
+	fields := logFields{"proto": counters.name, "remote_addr": conn.RemoteAddr()}
+
+	// A connection can carry any number of pickles, each either
+	// prefixed with its length (as carbon sends them, see
+	// graphite-pickle-framing) or bare, ending with a STOP opcode.
+	r := bufio.NewReader(conn)
+	if cfg.GraphitePickleAllowGzip {
+		if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				counters.logParseError(err, "handleGraphitePickleProtocol(): %v: bad gzip header: %v", conn.RemoteAddr(), err)
+				counters.parseError()
+				return
 			}
+			defer gz.Close()
+			r = bufio.NewReader(gz)
 		}
 	}
+	framed := cfg.GraphitePickleFraming == pickleFramingLength
+	if cfg.GraphitePickleFraming == pickleFramingAuto {
+		// A length header begins with a zero byte (unless the pickle
+		// is 16MB or more), a pickle never does.
+		if b, err := r.Peek(1); err == nil && b[0] == 0 {
+			framed = true
+		}
+	}
+	for {
+		if _, err := r.Peek(1); err != nil {
+			if err != io.EOF {
+				fields.with("error", err).Printf("handleGraphitePickleProtocol(): Error reading: %v", err)
+			}
+			break
+		}
 
-	if timeout != 0 {
-		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		var obj interface{}
+		if framed {
+			frame, err := readPickleFrame(r)
+			if err != nil {
+				fields.with("error", err).Printf("handleGraphitePickleProtocol(): Error reading: %v", err)
+				counters.parseError()
+				break
+			}
+			if obj, err = pickle.Unpickle(bytes.NewReader(frame)); err != nil {
+				counters.logParseError(err, "handleGraphitePickleProtocol(): %v: bad pickle, skipping it: %v", conn.RemoteAddr(), err)
+				counters.parseError()
+				continue // the next one begins after this frame
+			}
+		} else {
+			var err error
+			if obj, err = pickle.Unpickle(r); err != nil {
+				fields.with("error", err).Printf("handleGraphitePickleProtocol(): Error reading: %v", err)
+				counters.parseError()
+				break // we cannot know where the next pickle begins
+			}
+		}
+
+		if items, err := pickle.ListOrTuple(obj, nil); err != nil {
+			counters.logParseError(err, "handleGraphitePickleProtocol(): %v: top-level object is not a list, skipping it: %v", conn.RemoteAddr(), err)
+			counters.parseError()
+		} else {
+			if n := ingestRateLimiter.take(conn.RemoteAddr(), len(items), time.Now()); n < len(items) {
+				limited += len(items) - n
+				items = items[:n]
+			}
+			if len(items) > 0 && counters.admit(t, len(items)) {
+				n, d := queuePickleItems(t, counters, items)
+				count, dropped = count+n, dropped+d
+				counters.dataPoint(n)
+			}
+		}
+
+		if timeout != 0 {
+			conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+		}
 	}
 
-	if err != nil {
-		log.Println("handleGraphitePickleProtocol(): Error reading:", err.Error())
+	if dropped > 0 {
+		fields.with("dropped", dropped).Printf("handleGraphitePickleProtocol(): %v: dropped %d data points for new series, max-series (%d) reached", conn.RemoteAddr(), dropped, t.MaxSeries)
+		t.QueueStatCount("tgres.pickle_series_full_drops", dropped)
 	}
 }
 
-// --
+// The largest length-prefixed pickle accepted, carbon's is 1MB.
+const maxPickleFrame = 16 << 20
 
-type graphiteUdpTextServiceManager struct {
-	t    *transceiver.Transceiver
-	conn net.Conn
+// readPickleFrame reads a 4-byte big-endian length, then that many
+// bytes.
+func readPickleFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxPickleFrame {
+		return nil, fmt.Errorf("pickle length %d exceeds %d bytes", n, maxPickleFrame)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
 }
 
-func (g *graphiteUdpTextServiceManager) Stop() {
-	if g.conn != nil {
-		g.conn.Close()
+// writePickleFrame writes v pickled, prefixed with its length, as
+// carbon does (e.g. to relay, see pickleRelay).
+func writePickleFrame(w io.Writer, v interface{}) error {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0})
+	if _, err := pickle.NewPickler(&buf).Pickle(v); err != nil {
+		return err
 	}
+	frame := buf.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	_, err := w.Write(frame)
+	return err
 }
 
-func (g *graphiteUdpTextServiceManager) File() *os.File {
-	if g.conn != nil {
-		f, _ := g.conn.(*net.UDPConn).File()
-		return f
+// queuePickleItems queues [(name, (timestamp, value)), ...], it
+// returns the number of data points queued and the number dropped
+// because of max-series. An item relayed by another node (see
+// pickleRelay) is (name, (timestamp, value), hops), the hops are
+// only heeded from one of the cluster-peers, from anyone else it is
+// an ordinary item. A malformed item is counted as a parse error and
+// skipped, the rest are still queued.
+func queuePickleItems(t *transceiver.Transceiver, counters connCounters, items []interface{}) (count, dropped int) {
+	fromPeer := t.Relay != nil && clusterPeer(counters.addr)
+	for _, item := range items {
+		name, tstamp, value, relayed, err := parsePickleItem(item)
+		if err != nil {
+			counters.logParseError(err, "queuePickleItems(): %v: skipping a bad item: %v", counters.addr, err)
+			counters.parseError()
+			continue
+		}
+		if relayed && fromPeer {
+			// already renamed by the relaying node
+			if t.QueueRelayedDataPoint(name, time.Unix(tstamp, 0), value) {
+				count++
+			} else {
+				dropped++
+			}
+			continue
+		}
+		base, tags, err := transceiver.ParseTaggedName(name)
+		if err != nil {
+			counters.logParseError(err, "queuePickleItems(): %v: skipping a bad item: %v", counters.addr, err)
+			counters.parseError()
+			continue
+		}
+		if t.QueueDataPointUnlessFull(transceiver.TaggedName(base, tags), counters.defaultTimestamp(name, time.Unix(tstamp, 0)), value) {
+			count++
+		} else {
+			dropped++
+		}
 	}
-	return nil
+	return count, dropped
 }
 
-func (g *graphiteUdpTextServiceManager) Start(file *os.File) error {
+// parsePickleItem type checks one (name, (timestamp, value)[, hops])
+// item, relayed is true if it has the hops.
+func parsePickleItem(item interface{}) (name string, tstamp int64, value float64, relayed bool, err error) {
 	var (
-		err     error
-		udpAddr *net.UDPAddr
+		int_value     int64
+		float_tstamp  float64
+		itemSlice, dp []interface{}
 	)
 
-	if Cfg.GraphiteUdpListenSpec != "" {
-		if file != nil {
-			g.conn, err = net.FileConn(file)
-		} else {
-			udpAddr, err = net.ResolveUDPAddr("udp", processListenSpec(Cfg.GraphiteUdpListenSpec))
-			if err == nil {
-				g.conn, err = net.ListenUDP("udp", udpAddr)
+	itemSlice, err = pickle.ListOrTuple(item, nil)
+	if err == nil && len(itemSlice) != 2 && len(itemSlice) != 3 {
+		err = fmt.Errorf("item wrong length: %d", len(itemSlice))
+	}
+	if err != nil {
+		return "", 0, 0, false, err
+	}
+	name, err = pickle.String(itemSlice[0], err)
+	dp, err = pickle.ListOrTuple(itemSlice[1], err)
+	if err == nil && len(dp) != 2 {
+		err = fmt.Errorf("dp wrong length: %d", len(dp))
+	}
+	if err != nil {
+		return "", 0, 0, false, err
+	}
+	if tstamp, err = pickle.Int(dp[0], nil); err != nil {
+		// some clients send 1465839830.0
+		if float_tstamp, err = pickle.Float(dp[0], nil); err != nil {
+			return "", 0, 0, false, err
+		}
+		tstamp = int64(float_tstamp)
+	}
+	if value, err = pickle.Float(dp[1], nil); err != nil {
+		if _, ok := err.(pickle.WrongTypeError); ok {
+			if int_value, err = pickle.Int(dp[1], nil); err == nil {
+				value = float64(int_value)
 			}
 		}
+	}
+	return name, tstamp, value, len(itemSlice) == 3, err
+}
+
+// --
+
+type graphiteUdpTextServiceManager struct {
+	t     *transceiver.Transceiver
+	conns []net.Conn
+}
+
+func (g *graphiteUdpTextServiceManager) Stop() {
+	for _, conn := range g.conns {
+		conn.Close()
+	}
+}
+
+func (g *graphiteUdpTextServiceManager) listenerCount() int { return len(g.conns) }
+
+func (g *graphiteUdpTextServiceManager) Files() []*os.File {
+	return connFiles("graphiteUdpTextServiceManager", g.conns)
+}
+
+func (g *graphiteUdpTextServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	var err error
+
+	if cfg.GraphiteUdpListenSpec != "" {
+		g.conns, err = listenPackets("graphiteUdpTextServiceManager", files, cfg.GraphiteUdpListenSpec)
 	} else {
-		log.Printf("Not starting Graphite UDP protocol because graphite-udp-listen-spec is blank.")
+		logFields{"proto": "graphite-udp"}.Printf("Not starting Graphite UDP protocol because graphite-udp-listen-spec is blank.")
 		return nil
 	}
 	if err != nil {
 		return fmt.Errorf("Error starting Graphite UDP Text Protocol serviceManager: %v", err)
 	}
 
-	fmt.Printf("Graphite UDP protocol Listening on %s\n", processListenSpec(Cfg.GraphiteTextListenSpec))
+	fmt.Printf("Graphite UDP protocol Listening on %s\n", displayListenSpecs(cfg.GraphiteUdpListenSpec))
 
-	// for UDP timeout must be 0
-	go handleGraphiteTextProtocol(g.t, g.conn, 0)
+	for _, conn := range g.conns {
+		conn := conn
+		goUdpHandler(func() { handleGraphiteUdpTextProtocol(g.t, conn) })
+	}
 
 	return nil
 }
@@ -353,37 +674,19 @@ func (g *graphiteUdpTextServiceManager) Start(file *os.File) error {
 // ---
 
 type graphiteTextServiceManager struct {
-	t        *transceiver.Transceiver
-	listener *graceful.Listener
+	streamListeners
+	t         *transceiver.Transceiver
+	tlsConfig *tls.Config // connections are TLS, if not nil
 }
 
-func (g *graphiteTextServiceManager) File() *os.File {
-	if g.listener != nil {
-		return g.listener.File()
-	}
-	return nil
-}
+func (g *graphiteTextServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	var err error
 
-func (g *graphiteTextServiceManager) Stop() {
-	if g.listener != nil {
-		g.listener.Close()
-	}
-}
-
-func (g *graphiteTextServiceManager) Start(file *os.File) error {
-	var (
-		gl  net.Listener
-		err error
-	)
-
-	if Cfg.GraphiteTextListenSpec != "" {
-		if file != nil {
-			gl, err = net.FileListener(file)
-		} else {
-			gl, err = net.Listen("tcp", processListenSpec(Cfg.GraphiteTextListenSpec))
-		}
+	if cfg.GraphiteTextListenSpec != "" {
+		err = g.listen("graphiteTextServiceManager", files, cfg.GraphiteTextListenSpec)
 	} else {
-		log.Printf("Not starting Graphite Text protocol because graphite-test-listen-spec is blank")
+		logFields{"proto": "graphite-text"}.Printf("Not starting Graphite Text protocol because graphite-test-listen-spec is blank")
 		return nil
 	}
 
@@ -391,45 +694,38 @@ func (g *graphiteTextServiceManager) Start(file *os.File) error {
 		return fmt.Errorf("Error starting Graphite Text Protocol serviceManager: %v", err)
 	}
 
-	g.listener = graceful.NewListener(gl)
+	fmt.Println("Graphite text protocol Listening on " + displayListenSpecs(cfg.GraphiteTextListenSpec))
 
-	fmt.Println("Graphite text protocol Listening on " + processListenSpec(Cfg.GraphiteTextListenSpec))
-
-	go g.graphiteTextServer()
+	for _, l := range g.listeners {
+		go g.graphiteTextServer(l)
+	}
 
 	return nil
 }
 
-func (g *graphiteTextServiceManager) graphiteTextServer() error {
+func (g *graphiteTextServiceManager) graphiteTextServer(listener *graceful.Listener) error {
 
-	var tempDelay time.Duration
 	for {
-		conn, err := g.listener.Accept()
-
+		conn, err := acceptRetrying("graphiteTextServer()", "graphite-text", listener)
 		if err != nil {
-			// see http://golang.org/src/net/http/server.go?s=51504:51550#L1729
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-				log.Printf("graphiteTextServer(): Accept error: %v; retrying in %v", err, tempDelay)
-				time.Sleep(tempDelay)
-				continue
-			}
 			return err
 		}
-		tempDelay = 0
 
-		go handleGraphiteTextProtocol(g.t, conn, 10)
+		if !g.admit("graphiteTextServer()", conn) {
+			continue
+		}
+		logConnAccepted("graphiteTextServer()", conn)
+		go func() {
+			defer g.release()
+			if g.tlsConfig != nil {
+				handleGraphiteTextTLSProtocol(g.t, conn, g.tlsConfig, currentCfg().GraphiteTextTimeout)
+			} else {
+				handleGraphiteTextProtocol(g.t, conn, currentCfg().GraphiteTextTimeout)
+			}
+		}()
 	}
 }
 
-// Handles incoming requests for both TCP and UDP
 func handleGraphiteTextProtocol(t *transceiver.Transceiver, conn net.Conn, timeout int) {
 
 	defer conn.Close() // decrements graceful.TcpWg
@@ -438,6 +734,31 @@ func handleGraphiteTextProtocol(t *transceiver.Transceiver, conn net.Conn, timeo
 		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
 	}
 
+	if currentCfg().GraphiteTextProxyProtocol {
+		var err error
+		if conn, err = readProxyHeader(conn); err != nil {
+			logFields{"proto": "graphite-text", "error": err}.Printf("handleGraphiteTextProtocol(): %v", err)
+			return
+		}
+	}
+
+	readGraphiteText("handleGraphiteTextProtocol()", graphiteTextCounters, t, conn, timeout, "")
+}
+
+// readGraphiteText reads lines until the connection is closed, the
+// names of all the data points get prefix (if any). With
+// graphite-text-strict, the reason a line is bad is written back as
+// "ERR: <reason>".
+func readGraphiteText(who string, pc *protocolCounters, t *transceiver.Transceiver, conn net.Conn, timeout int, prefix string) {
+
+	strict := currentCfg().GraphiteTextStrict // looked up per connection, so that a reload() applies it
+	var count, limited int
+	defer logConnClosed(who, conn, time.Now(), &count)
+	defer logRateLimited(who, conn, &limited)
+	counters := pc.from(conn.RemoteAddr())
+	counters.connection()
+	fields := logFields{"proto": counters.name, "remote_addr": conn.RemoteAddr()}
+
 	// We use the Scanner, becase it has a MaxScanTokenSize of 64K
 
 	connbuf := bufio.NewScanner(conn)
@@ -445,10 +766,23 @@ func handleGraphiteTextProtocol(t *transceiver.Transceiver, conn net.Conn, timeo
 	for connbuf.Scan() {
 		packetStr := connbuf.Text()
 
-		if name, ts, v, err := parseGraphitePacket(packetStr); err != nil {
-			log.Printf("handleGraphiteTextProtocol(): bad backet: %v")
-		} else {
-			t.QueueDataPoint(name, ts, v)
+		if name, tags, ts, v, err := parseGraphitePacket(packetStr); err != nil {
+			counters.logParseError(err, "%s: bad packet: %v", who, err)
+			counters.parseError()
+			// The deadline of the connection applies, a client which
+			// doesn't read the errors is closed once it's passed.
+			if strict {
+				if _, err := fmt.Fprintf(conn, "ERR: %v\n", err); err != nil {
+					fields.with("error", err).Printf("%s: error writing back to %v: %v", who, conn.RemoteAddr(), err)
+					return
+				}
+			}
+		} else if ingestRateLimiter.take(conn.RemoteAddr(), 1, time.Now()) == 0 {
+			limited++
+		} else if counters.admit(t, 1) {
+			t.QueueDataPointTagged(prefix+name, tags, counters.defaultTimestamp(name, ts), v)
+			counters.dataPoint(1)
+			count++
 		}
 
 		if timeout != 0 {
@@ -457,23 +791,182 @@ func handleGraphiteTextProtocol(t *transceiver.Transceiver, conn net.Conn, timeo
 	}
 
 	if err := connbuf.Err(); err != nil {
-		log.Println("handleGraphiteTextProtocol(): Error reading: %v", err)
+		fields.with("error", err).Printf("%s: Error reading: %v", who, err)
 	}
 }
 
-func parseGraphitePacket(packetStr string) (string, time.Time, float64, error) {
+// dataPointsQueuer is the transceiver, as far as the UDP handler is
+// concerned.
+type dataPointsQueuer interface {
+	QueueDataPoints([]*rrd.DataPoint)
+	queueFuller
+}
 
-	var (
-		name   string
-		tstamp int64
-		value  float64
-	)
+// A datagram is read in its entirety, therefore all of its lines are
+// queued at once.
+func handleGraphiteUdpTextProtocol(t dataPointsQueuer, conn net.Conn) {
 
-	if n, err := fmt.Sscanf(packetStr, "%s %f %d", &name, &value, &tstamp); n != 3 || err != nil {
-		return "", time.Time{}, 0, fmt.Errorf("error %v scanning input: %q", err, packetStr)
+	defer conn.Close()
+
+	buf := make([]byte, udpReadBufferSize)
+	for {
+		datagram, addr, err := readDatagram("handleGraphiteUdpTextProtocol()", conn, buf)
+		if err != nil {
+			logFields{"proto": "graphite-udp", "error": err}.Printf("handleGraphiteUdpTextProtocol(): Error reading: %v", err)
+			return
+		}
+		counters := graphiteUdpCounters.from(addr)
+		dps := parseGraphiteDatagram(datagram, counters)
+		if counters.admit(t, len(dps)) {
+			t.QueueDataPoints(dps)
+			counters.dataPoint(len(dps))
+		}
 	}
+}
 
-	return misc.SanitizeName(name), time.Unix(tstamp, 0), value, nil
+// The max UDP datagram size, a var for testing.
+var udpReadBufferSize = 65536
+
+// readDatagram reads a datagram into buf, and returns it and where it
+// came from. If it did not fit, the rest of it is lost: this is logged
+// and the incomplete last line dropped.
+func readDatagram(who string, conn net.Conn, buf []byte) ([]byte, net.Addr, error) {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		n, err := conn.Read(buf)
+		return buf[:n], conn.RemoteAddr(), err
+	}
+	n, _, flags, addr, err := uc.ReadMsgUDP(buf, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if flags&syscall.MSG_TRUNC == 0 {
+		return buf[:n], addr, nil
+	}
+	logFields{"remote_addr": addr}.Printf("%s: datagram from %v exceeds %d bytes, truncated, dropping its last line.", who, addr, len(buf))
+	datagram := buf[:n]
+	if i := bytes.LastIndexByte(datagram, '\n'); i >= 0 {
+		return datagram[:i], addr, nil
+	}
+	return nil, addr, nil
+}
+
+func parseGraphiteDatagram(datagram []byte, counters connCounters) []*rrd.DataPoint {
+	var dps []*rrd.DataPoint
+	for _, line := range strings.Split(string(datagram), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if name, tags, ts, v, err := parseGraphitePacket(line); err != nil {
+			counters.logParseError(err, "handleGraphiteUdpTextProtocol(): bad packet: %v", err)
+			counters.parseError()
+		} else {
+			dps = append(dps, &rrd.DataPoint{Name: transceiver.TaggedName(name, tags), TimeStamp: counters.defaultTimestamp(name, ts), Value: v})
+		}
+	}
+	return dps
+}
+
+// logConnAccepted and logConnClosed log connections as per the
+// connection-log-level setting.
+func logConnAccepted(who string, conn net.Conn) {
+	if currentCfg().ConnectionLogLevel >= connLogAll {
+		logFields{"remote_addr": conn.RemoteAddr()}.Printf("%s: accepted connection from %v", who, conn.RemoteAddr())
+	}
+}
+
+func logConnClosed(who string, conn net.Conn, start time.Time, count *int) {
+	if currentCfg().ConnectionLogLevel >= connLogClose {
+		elapsed := time.Now().Sub(start)
+		logFields{"remote_addr": conn.RemoteAddr(), "duration": elapsed, "data_points": *count}.Printf("%s: closed connection from %v after %v, %d data points", who, conn.RemoteAddr(), elapsed, *count)
+	}
+}
+
+// parseGraphitePacket parses a "name value timestamp" line. Fields may
+// be separated by any whitespace (a trailing \r included), a line with
+// fewer or more fields (e.g. cut short) is an error. A Graphite 1.1
+// tagged name, e.g. "disk.used;host=web01;dc=us-east", is returned as
+// the name and the tags, otherwise the tags are nil.
+func parseGraphitePacket(packetStr string) (string, map[string]string, time.Time, float64, error) {
+	cfg := currentCfg()
+
+	fields := strings.Fields(packetStr)
+
+	// A line without a time stamp is "now", if allowed
+	if (cfg.GraphiteAllowTimestampless || cfg.DefaultTimestampToNow) && len(fields) == 2 {
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return "", nil, time.Time{}, 0, fmt.Errorf("invalid value in %q: %v", packetStr, err)
+		}
+		name, tags, err := parseGraphiteName(fields[0])
+		if err != nil {
+			return "", nil, time.Time{}, 0, err
+		}
+		if cfg.DefaultTimestampToNow && cfg.LogLevel == logLevelDebug {
+			logFields{"level": "debug"}.Printf("%q: no time stamp, using now (default-timestamp-to-now)", name)
+		}
+		return name, tags, time.Now(), value, nil
+	}
+
+	if len(fields) != 3 {
+		return "", nil, time.Time{}, 0, fmt.Errorf("expected 3 fields (name value timestamp), got %d: %q", len(fields), packetStr)
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return "", nil, time.Time{}, 0, fmt.Errorf("invalid value in %q: %v", packetStr, err)
+	}
+	ts, err := parseGraphiteTimestamp(fields[2])
+	if err != nil {
+		return "", nil, time.Time{}, 0, fmt.Errorf("invalid timestamp in %q: %v", packetStr, err)
+	}
+	name, tags, err := parseGraphiteName(fields[0])
+	if err != nil {
+		return "", nil, time.Time{}, 0, err
+	}
+
+	return name, tags, ts, value, nil
+}
+
+// defaultTimestamp is ts, or now if the client sent a 0 or negative
+// time stamp and default-timestamp-to-now is on, which is logged with
+// log-level = "debug". A missing time stamp is already made now by
+// parseGraphitePacket.
+func (c connCounters) defaultTimestamp(name string, ts time.Time) time.Time {
+	cfg := currentCfg()
+	if ts.Unix() > 0 || !cfg.DefaultTimestampToNow {
+		return ts
+	}
+	if cfg.LogLevel == logLevelDebug {
+		logFields{"level": "debug", "proto": c.name, "remote_addr": c.addr}.Printf("%q from %v: time stamp %d, using now (default-timestamp-to-now)", name, c.addr, ts.Unix())
+	}
+	return time.Now()
+}
+
+// parseGraphiteName splits off the ";key=value" tags, if any, and
+// sanitizes the rest of the name.
+func parseGraphiteName(s string) (string, map[string]string, error) {
+	name, tags, err := transceiver.ParseTaggedName(s)
+	if err != nil {
+		return "", nil, err
+	}
+	return misc.SanitizeName(name), tags, nil
+}
+
+// parseGraphiteTimestamp parses seconds since the epoch, which some
+// clients send with a fraction, e.g. 1476123456.789.
+func parseGraphiteTimestamp(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, fmt.Errorf("%q is not a time", s)
+	}
+	sec := math.Floor(f)
+	return time.Unix(int64(sec), int64((f-sec)*1e9)), nil
 }
 
 // TODO isn't this identical to handleGraphiteTextProtocol?
@@ -493,7 +986,7 @@ func handleStatsdTextProtocol(t *transceiver.Transceiver, conn net.Conn, timeout
 		if stat, err := statsd.ParseStatsdPacket(connbuf.Text()); err == nil {
 			t.QueueStat(stat)
 		} else {
-			log.Printf("parseStatsdPacket(): %v", err)
+			logFields{"proto": "statsd-text", "remote_addr": conn.RemoteAddr(), "error": err}.Printf("parseStatsdPacket(): %v", err)
 		}
 
 		if timeout != 0 {
@@ -502,58 +995,90 @@ func handleStatsdTextProtocol(t *transceiver.Transceiver, conn net.Conn, timeout
 	}
 
 	if err := connbuf.Err(); err != nil {
-		log.Println("handleStatsdTextProtocol(): Error reading: %v", err)
+		logFields{"proto": "statsd-text", "remote_addr": conn.RemoteAddr(), "error": err}.Printf("handleStatsdTextProtocol(): Error reading: %v", err)
+	}
+}
+
+// handleStatsdUdpProtocol reads one datagram at a time, each may
+// contain several newline-separated stats.
+func handleStatsdUdpProtocol(t *transceiver.Transceiver, conn net.Conn) {
+
+	defer conn.Close()
+
+	buf := make([]byte, udpReadBufferSize)
+	for {
+		datagram, addr, err := readDatagram("handleStatsdUdpProtocol()", conn, buf)
+		if err != nil {
+			logFields{"proto": "statsd-udp", "error": err}.Printf("handleStatsdUdpProtocol(): Error reading: %v", err)
+			return
+		}
+		counters := statsdUdpCounters.from(addr)
+		stats := parseStatsdDatagram(datagram, counters)
+		if !counters.admit(t, len(stats)) {
+			continue
+		}
+		for _, stat := range stats {
+			t.QueueStat(stat)
+		}
+		counters.dataPoint(len(stats))
 	}
 }
 
+func parseStatsdDatagram(datagram []byte, counters connCounters) []*statsd.Stat {
+	var stats []*statsd.Stat
+	for _, line := range strings.Split(string(datagram), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if stat, err := statsd.ParseStatsdPacket(line); err != nil {
+			counters.logParseError(err, "parseStatsdPacket(): %v", err)
+			counters.parseError()
+		} else {
+			stats = append(stats, stat)
+		}
+	}
+	return stats
+}
+
 // --
 
 type statsdUdpTextServiceManager struct {
-	t    *transceiver.Transceiver
-	conn net.Conn
+	t     *transceiver.Transceiver
+	conns []net.Conn
 }
 
 func (g *statsdUdpTextServiceManager) Stop() {
-	if g.conn != nil {
-		g.conn.Close()
+	for _, conn := range g.conns {
+		conn.Close()
 	}
 }
 
-func (g *statsdUdpTextServiceManager) File() *os.File {
-	if g.conn != nil {
-		f, _ := g.conn.(*net.UDPConn).File()
-		return f
-	}
-	return nil
+func (g *statsdUdpTextServiceManager) listenerCount() int { return len(g.conns) }
+
+func (g *statsdUdpTextServiceManager) Files() []*os.File {
+	return connFiles("statsdUdpTextServiceManager", g.conns)
 }
 
-func (g *statsdUdpTextServiceManager) Start(file *os.File) error {
-	var (
-		err     error
-		udpAddr *net.UDPAddr
-	)
+func (g *statsdUdpTextServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	var err error
 
-	if Cfg.StatsdUdpListenSpec != "" {
-		if file != nil {
-			g.conn, err = net.FileConn(file)
-		} else {
-			udpAddr, err = net.ResolveUDPAddr("udp", processListenSpec(Cfg.StatsdUdpListenSpec))
-			if err == nil {
-				g.conn, err = net.ListenUDP("udp", udpAddr)
-			}
-		}
+	if cfg.StatsdUdpListenSpec != "" {
+		g.conns, err = listenPackets("statsdUdpTextServiceManager", files, cfg.StatsdUdpListenSpec)
 	} else {
-		log.Printf("Not starting Statsd UDP protocol because statsd-udp-listen-spec is blank.")
+		logFields{"proto": "statsd-udp"}.Printf("Not starting Statsd UDP protocol because statsd-udp-listen-spec is blank.")
 		return nil
 	}
 	if err != nil {
 		return fmt.Errorf("Error starting Statsd UDP Text Protocol serviceManager: %v", err)
 	}
 
-	fmt.Printf("Statsd UDP protocol Listening on %s\n", processListenSpec(Cfg.StatsdTextListenSpec))
+	fmt.Printf("Statsd UDP protocol Listening on %s\n", displayListenSpecs(cfg.StatsdUdpListenSpec))
 
-	// for UDP timeout must be 0
-	go handleStatsdTextProtocol(g.t, g.conn, 0)
+	for _, conn := range g.conns {
+		conn := conn
+		goUdpHandler(func() { handleStatsdUdpProtocol(g.t, conn) })
+	}
 
 	return nil
 }
@@ -0,0 +1,157 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ingestSources count what each remote host has sent, for
+// /internal/sources.
+var ingestSources = &sourceCounters{byIP: make(map[string]*sourceCount)}
+
+// sourceCounters are the sourceCounts by IP. Those of a host idle for
+// longer than source-idle-expiry are forgotten, so that they do not
+// grow with every IP ever seen.
+type sourceCounters struct {
+	sync.Mutex
+	byIP      map[string]*sourceCount
+	lastSweep time.Time
+}
+
+// sourceCount is what one host has sent, incremented by the handler
+// goroutines with atomic ops.
+type sourceCount struct {
+	connections int64
+	dataPoints  int64
+	parseErrors int64
+	lastSeen    int64 // unix nanoseconds
+}
+
+func (c *sourceCount) add(connections, dataPoints, parseErrors int) {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.connections, int64(connections))
+	atomic.AddInt64(&c.dataPoints, int64(dataPoints))
+	atomic.AddInt64(&c.parseErrors, int64(parseErrors))
+	atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+}
+
+// get returns the sourceCount of the IP of addr, nil if addr is not
+// an IP one (e.g. a unix socket).
+func (s *sourceCounters) get(addr net.Addr, now time.Time) *sourceCount {
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if idle := currentCfg().SourceIdleExpiry.Duration; idle > 0 && now.Sub(s.lastSweep) > idle {
+		for key, c := range s.byIP {
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastSeen))) > idle {
+				delete(s.byIP, key)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	key := ip.String()
+	c := s.byIP[key]
+	if c == nil {
+		c = &sourceCount{}
+		s.byIP[key] = c
+	}
+	atomic.StoreInt64(&c.lastSeen, now.UnixNano())
+	return c
+}
+
+// connCounters count what a connection (or a datagram) has received
+// for both the protocol and the source host.
+type connCounters struct {
+	*protocolCounters
+	src  *sourceCount
+	addr net.Addr
+}
+
+// from returns the counters of what is received from addr.
+func (c *protocolCounters) from(addr net.Addr) connCounters {
+	return connCounters{c, ingestSources.get(addr, time.Now()), addr}
+}
+
+func (c connCounters) dataPoint(n int) {
+	c.protocolCounters.dataPoint(n)
+	c.src.add(0, n, 0)
+}
+
+func (c connCounters) connection() {
+	c.protocolCounters.connection()
+	c.src.add(1, 0, 0)
+}
+
+func (c connCounters) parseError() {
+	c.protocolCounters.parseError()
+	c.src.add(0, 0, 1)
+}
+
+type sourceStats struct {
+	IP          string    `json:"ip"`
+	Connections int64     `json:"connections"`
+	DataPoints  int64     `json:"dataPoints"`
+	ParseErrors int64     `json:"parseErrors"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// sources returns the stats of every host, those which sent the most
+// data points first.
+func (s *sourceCounters) sources() []*sourceStats {
+	s.Lock()
+	result := make([]*sourceStats, 0, len(s.byIP))
+	for ip, c := range s.byIP {
+		result = append(result, &sourceStats{
+			IP:          ip,
+			Connections: atomic.LoadInt64(&c.connections),
+			DataPoints:  atomic.LoadInt64(&c.dataPoints),
+			ParseErrors: atomic.LoadInt64(&c.parseErrors),
+			LastSeen:    time.Unix(0, atomic.LoadInt64(&c.lastSeen)),
+		})
+	}
+	s.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].DataPoints != result[j].DataPoints {
+			return result[i].DataPoints > result[j].DataPoints
+		}
+		return result[i].IP < result[j].IP
+	})
+	return result
+}
+
+// internalSourcesHandler reports what each remote host has sent.
+func internalSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ingestSources.sources()); err != nil {
+		log.Printf("internalSourcesHandler(): %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"github.com/tgres/tgres/transceiver"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// stdinConn is a file (stdin) as a net.Conn, so that it is read just
+// like a graphite text connection.
+type stdinConn struct {
+	*os.File
+}
+
+type stdinAddr struct{}
+
+func (stdinAddr) Network() string { return "stdin" }
+func (stdinAddr) String() string  { return "stdin" }
+
+func (stdinConn) LocalAddr() net.Addr  { return stdinAddr{} }
+func (stdinConn) RemoteAddr() net.Addr { return stdinAddr{} }
+
+// Write discards, there is no one to write back to (e.g. with
+// graphite-text-strict), the errors are logged anyway.
+func (stdinConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// ingestStdin is the -stdin (or stdin-ingest) mode: rather than
+// listening, read graphite text lines from stdin until EOF, e.g.
+// "cat dump.txt | tgres -stdin", then stop the transceiver, which
+// flushes everything.
+func ingestStdin(t *transceiver.Transceiver, in *os.File) {
+	if err := t.Start(); err != nil {
+		log.Printf("ingestStdin(): Could not start the transceiver: %v", err)
+		return
+	}
+	start := time.Now()
+	log.Printf("ingestStdin(): reading graphite text from stdin...")
+	readGraphiteText("ingestStdin()", stdinCounters, t, stdinConn{in}, 0, "")
+	log.Printf("ingestStdin(): EOF after %v, flushing...", time.Now().Sub(start))
+	t.Stop()
+	log.Printf("ingestStdin(): done.")
+}
@@ -0,0 +1,169 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/tgres/tgres/transceiver"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// graphiteTextTLSServiceManager is the graphite text protocol over
+// TLS. The SNI server name sent by the client selects a prefix (e.g.
+// a tenant) for all the data points of the connection.
+type graphiteTextTLSServiceManager struct {
+	graphiteTextServiceManager
+}
+
+func (g *graphiteTextTLSServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	if cfg.GraphiteTextTLSListenSpec == "" {
+		logFields{"proto": "graphite-text"}.Printf("Not starting Graphite Text TLS protocol because graphite-text-tls-listen-spec is blank")
+		return nil
+	}
+
+	config, err := serverTLSConfig()
+	if err != nil {
+		return fmt.Errorf("Error starting Graphite Text TLS Protocol serviceManager: %v", err)
+	}
+
+	// The listeners are not tls.Listeners, the handshake is done by
+	// the connection handler, so that the fds can still be passed on
+	// on a graceful restart.
+	if err := g.listen("graphiteTextTLSServiceManager", files, cfg.GraphiteTextTLSListenSpec); err != nil {
+		return fmt.Errorf("Error starting Graphite Text TLS Protocol serviceManager: %v", err)
+	}
+	g.tlsConfig = config
+
+	fmt.Println("Graphite text TLS protocol Listening on " + displayListenSpecs(cfg.GraphiteTextTLSListenSpec))
+
+	for _, l := range g.listeners {
+		go g.graphiteTextServer(l)
+	}
+
+	return nil
+}
+
+// graphitePickleTLSServiceManager is the graphite pickle protocol
+// over TLS.
+type graphitePickleTLSServiceManager struct {
+	graphitePickleServiceManager
+}
+
+func (g *graphitePickleTLSServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	if cfg.GraphitePickleTLSListenSpec == "" {
+		logFields{"proto": "graphite-pickle"}.Printf("Not starting Graphite Pickle TLS protocol because graphite-pickle-tls-listen-spec is blank")
+		return nil
+	}
+
+	config, err := serverTLSConfig()
+	if err != nil {
+		return fmt.Errorf("Error starting Graphite Pickle TLS Protocol serviceManager: %v", err)
+	}
+
+	// As above, the handshake is done by the connection handler.
+	if err := g.listen("graphitePickleTLSServiceManager", files, cfg.GraphitePickleTLSListenSpec); err != nil {
+		return fmt.Errorf("Error starting Graphite Pickle TLS Protocol serviceManager: %v", err)
+	}
+	g.tlsConfig = config
+
+	fmt.Println("Graphite pickle TLS protocol Listening on " + displayListenSpecs(cfg.GraphitePickleTLSListenSpec))
+
+	for _, l := range g.listeners {
+		go g.graphitePickleServer(l)
+	}
+
+	return nil
+}
+
+// serverTLSConfig returns the config for the TLS listeners, with the
+// certificate from tls-cert-file and tls-key-file.
+func serverTLSConfig() (*tls.Config, error) {
+	cfg := currentCfg()
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	minVersion := uint16(cfg.TLSMinVersion)
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: minVersion}, nil
+}
+
+func handleGraphitePickleTLSProtocol(t *transceiver.Transceiver, conn net.Conn, config *tls.Config, timeout int) {
+
+	defer conn.Close() // decrements graceful.TcpWg
+
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	}
+
+	tc := tls.Server(conn, config)
+	defer tc.Close()
+	if err := tc.Handshake(); err != nil {
+		logFields{"proto": "graphite-pickle", "remote_addr": conn.RemoteAddr(), "error": err}.Printf("handleGraphitePickleTLSProtocol(): %v: TLS handshake: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	readGraphitePickle("handleGraphitePickleTLSProtocol()", t, tc, timeout)
+}
+
+func handleGraphiteTextTLSProtocol(t *transceiver.Transceiver, conn net.Conn, config *tls.Config, timeout int) {
+
+	defer conn.Close() // decrements graceful.TcpWg
+
+	if timeout != 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	}
+
+	tc, prefix, err := graphiteTLSHandshake(conn, config)
+	if err != nil {
+		logFields{"proto": "graphite-text", "remote_addr": conn.RemoteAddr(), "error": err}.Printf("handleGraphiteTextTLSProtocol(): %v", err)
+		return
+	}
+	defer tc.Close()
+
+	readGraphiteText("handleGraphiteTextTLSProtocol()", graphiteTextCounters, t, tc, timeout, prefix)
+}
+
+// graphiteTLSHandshake performs the TLS handshake and returns the
+// prefix for the server name requested by the client (SNI) as per
+// graphite-tls-sni-prefixes, or graphite-tls-default-prefix for an
+// unknown (or no) server name.
+func graphiteTLSHandshake(conn net.Conn, config *tls.Config) (*tls.Conn, string, error) {
+	cfg := currentCfg()
+	tc := tls.Server(conn, config)
+	if err := tc.Handshake(); err != nil {
+		return nil, "", fmt.Errorf("%v: TLS handshake: %v", conn.RemoteAddr(), err)
+	}
+
+	sni := strings.ToLower(tc.ConnectionState().ServerName)
+	prefix, ok := cfg.GraphiteTlsSniPrefixes[sni]
+	if !ok {
+		prefix = cfg.GraphiteTlsDefaultPrefix
+	}
+	if cfg.ConnectionLogLevel >= connLogAll {
+		log.Printf("graphiteTLSHandshake(): %v: server name %q, prefix %q", conn.RemoteAddr(), sni, prefix)
+	}
+	return tc, prefix, nil
+}
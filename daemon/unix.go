@@ -0,0 +1,66 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const unixPrefix = "unix://"
+
+// removeUnixSocket removes the socket file on Stop, unless it is
+// being used by the new process after a graceful restart.
+func removeUnixSocket(path string) {
+	if path != "" && gracefulChildPid == 0 {
+		os.Remove(path)
+	}
+}
+
+// graphiteTextUnixServiceManager is the graphite text protocol on a
+// unix socket, e.g. for collectors on the same host.
+type graphiteTextUnixServiceManager struct {
+	graphiteTextServiceManager
+}
+
+func (g *graphiteTextUnixServiceManager) Start(files []*os.File) error {
+	cfg := currentCfg()
+	if cfg.GraphiteTextUnixListenSpec == "" {
+		logFields{"proto": "graphite-text"}.Printf("Not starting Graphite Text unix socket protocol because graphite-text-unix-listen-spec is blank")
+		return nil
+	}
+	var specs []string
+	for _, spec := range splitListenSpecs(cfg.GraphiteTextUnixListenSpec) {
+		if !strings.HasPrefix(spec, unixPrefix) {
+			spec = unixPrefix + spec
+		}
+		specs = append(specs, spec)
+	}
+	spec := strings.Join(specs, ",")
+
+	if err := g.listen("graphiteTextUnixServiceManager", files, spec); err != nil {
+		return fmt.Errorf("Error starting Graphite Text unix socket Protocol serviceManager: %v", err)
+	}
+
+	fmt.Println("Graphite text protocol Listening on " + displayListenSpecs(spec))
+
+	for _, l := range g.listeners {
+		go g.graphiteTextServer(l)
+	}
+
+	return nil
+}
@@ -32,15 +32,22 @@ type DSGetter interface {
 	SeriesQuery(ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error)
 }
 
+// A DSGetter which is also a MultiSeriesQuerier gets all the series
+// of an ident in one call.
+type MultiSeriesQuerier interface {
+	SeriesQueries(dss map[string]*rrd.DataSource, from, to time.Time, maxPoints int64) (map[string]rrd.Series, error)
+}
+
 type DslCtx struct {
 	src                 string
 	escSrc              string
 	from, to, maxPoints int64
 	dsGetter            DSGetter
+	MaxSeries           int // a name pattern may match, 0 means no limit
 }
 
 func NewDslCtx(dsGetter DSGetter, src string, from, to, maxPoints int64) *DslCtx {
-	return &DslCtx{src, fixQuotes(escapeBadChars(src)), from, to, maxPoints, dsGetter}
+	return &DslCtx{src: src, escSrc: fixQuotes(escapeBadChars(src)), from: from, to: to, maxPoints: maxPoints, dsGetter: dsGetter}
 }
 
 func (dc *DslCtx) ParseDsl() (SeriesMap, error) {
@@ -64,6 +71,68 @@ func (dc *DslCtx) ParseDsl() (SeriesMap, error) {
 	return fv.ret, nil
 }
 
+// CheckFunctions returns an error listing the supported functions if
+// src (e.g. "scale(sumSeries(a.*), 0.1)") calls one which isn't,
+// without fetching any series. Whether src parses at all is left to
+// ParseDsl.
+func CheckFunctions(src string) error {
+	escSrc := fixQuotes(escapeBadChars(src))
+	tr, err := parser.ParseExpr(escSrc)
+	if err != nil {
+		return nil
+	}
+	ast.Inspect(tr, func(node ast.Node) bool {
+		if call, ok := node.(*ast.CallExpr); ok && err == nil {
+			name := escSrc[call.Fun.Pos()-1 : call.Fun.End()-1]
+			if !isFunction(name) {
+				err = fmt.Errorf("Unknown function %s(), the supported functions are: %s", name, strings.Join(FunctionNames(), ", "))
+			}
+		}
+		return err == nil
+	})
+	return err
+}
+
+// CheckMaxSeries returns an error if a name pattern in src matches
+// more than max series (0 means no limit), without fetching any, so
+// that a request can be refused before a response is written.
+func CheckMaxSeries(dsGetter DSGetter, src string, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	escSrc := fixQuotes(escapeBadChars(src))
+	tr, err := parser.ParseExpr(escSrc)
+	if err != nil {
+		return nil
+	}
+	ast.Inspect(tr, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok || err != nil {
+			return err == nil
+		}
+		for _, arg := range call.Args {
+			var ident string
+			switch tok := arg.(type) {
+			case *ast.SelectorExpr, *ast.Ident:
+				ident = unEscapeBadChars(escSrc[tok.Pos()-1 : tok.End()-1])
+			case *ast.BasicLit:
+				if tok.Kind != token.STRING {
+					continue
+				}
+				ident = unEscapeBadChars(tok.Value[1 : len(tok.Value)-1])
+			default:
+				continue
+			}
+			if n := len(dsGetter.DsIdsFromIdent(ident)); n > max {
+				err = fmt.Errorf("%q matches %d series, more than the limit of %d", ident, n, max)
+				break
+			}
+		}
+		return err == nil
+	})
+	return err
+}
+
 func (dc *DslCtx) seriesFromSeriesOrIdent(what interface{}) (SeriesMap, error) {
 	switch obj := what.(type) {
 	case SeriesMap:
@@ -78,6 +147,20 @@ func (dc *DslCtx) seriesFromSeriesOrIdent(what interface{}) (SeriesMap, error) {
 
 func (dc *DslCtx) seriesFromIdent(ident string, from, to time.Time) (map[string]rrd.Series, error) {
 	ids := dc.dsGetter.DsIdsFromIdent(ident)
+	if dc.MaxSeries > 0 && len(ids) > dc.MaxSeries {
+		return nil, fmt.Errorf("seriesFromIdent(): %q matches %d series, more than the limit of %d", ident, len(ids), dc.MaxSeries)
+	}
+	if mq, ok := dc.dsGetter.(MultiSeriesQuerier); ok {
+		dss := make(map[string]*rrd.DataSource, len(ids))
+		for name, id := range ids {
+			dss[name] = dc.dsGetter.GetDSById(id)
+		}
+		result, err := mq.SeriesQueries(dss, from, to, dc.maxPoints)
+		if err != nil {
+			return nil, fmt.Errorf("seriesFromIdent(): Error %v", err)
+		}
+		return result, nil
+	}
 	result := make(map[string]rrd.Series)
 	for name, id := range ids {
 		ds := dc.dsGetter.GetDSById(id)
@@ -210,13 +293,37 @@ func (v *FuncVisitor) Visit(node ast.Node) ast.Visitor {
 // Simple trick to avoid "*" which is not valid Go syntax
 
 func escapeBadChars(target string) string {
-	s := strings.Replace(target, "*", "__ASTERISK__", -1)
+	// A comma within {a,b} is part of the glob, not an argument separator.
+	var b strings.Builder
+	braces := 0
+	for _, c := range target {
+		switch {
+		case c == '{':
+			braces++
+			b.WriteString("__LBRACE__")
+		case c == '}' && braces > 0:
+			braces--
+			b.WriteString("__RBRACE__")
+		case c == ',' && braces > 0:
+			b.WriteString("__COMMA__")
+		default:
+			b.WriteRune(c)
+		}
+	}
+	s := strings.Replace(b.String(), "*", "__ASTERISK__", -1)
+	s = strings.Replace(s, "[", "__LBRACKET__", -1)
+	s = strings.Replace(s, "]", "__RBRACKET__", -1)
 	s = strings.Replace(s, "=", "__ASSIGN__", -1)
 	return strings.Replace(s, "-", "__DASH__", -1)
 }
 
 func unEscapeBadChars(target string) string {
 	s := strings.Replace(target, "__ASTERISK__", "*", -1)
+	s = strings.Replace(s, "__LBRACE__", "{", -1)
+	s = strings.Replace(s, "__RBRACE__", "}", -1)
+	s = strings.Replace(s, "__COMMA__", ",", -1)
+	s = strings.Replace(s, "__LBRACKET__", "[", -1)
+	s = strings.Replace(s, "__RBRACKET__", "]", -1)
 	s = strings.Replace(s, "__ASSIGN__", "=", -1)
 	return strings.Replace(s, "__DASH__", "-", -1)
 }
@@ -491,6 +491,25 @@ func processArgs(dc *DslCtx, fn *dslFuncType, args []interface{}) (map[string]in
 	return result, asSlice, nil
 }
 
+func isFunction(name string) bool {
+	_, ok := preprocessArgFuncs[name]
+	_, ctxOk := dslCtxFuncs[name]
+	return ok || ctxOk
+}
+
+// FunctionNames lists the functions a target may call, sorted.
+func FunctionNames() []string {
+	names := make([]string, 0, len(preprocessArgFuncs)+len(dslCtxFuncs))
+	for name, _ := range preprocessArgFuncs {
+		names = append(names, name)
+	}
+	for name, _ := range dslCtxFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func seriesFromFunction(dc *DslCtx, name string, args []interface{}) (SeriesMap, error) {
 
 	argFunc, ok := preprocessArgFuncs[name]
@@ -2291,7 +2310,9 @@ func dslHoltWintersForecast(args map[string]interface{}) (SeriesMap, error) {
 		// If we went beyond "viewport", adjust the underlying Series and MaxPoints
 		if adjustedFrom.Before(from) {
 			s.TimeRange(adjustedFrom)
-			s.MaxPoints(to.Sub(adjustedFrom).Nanoseconds() / (to.Sub(from).Nanoseconds() / maxPoints))
+			if maxPoints > 0 { // 0 is no limit
+				s.MaxPoints(to.Sub(adjustedFrom).Nanoseconds() / (to.Sub(from).Nanoseconds() / maxPoints))
+			}
 		} else {
 			// Set it back to be same as from, disregard seasonLimit when viewport has enough seasons
 			adjustedFrom = from
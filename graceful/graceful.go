@@ -20,24 +20,66 @@ import (
 	"os"
 	"sync"
 	"syscall"
+	"time"
 )
 
 var (
 	TcpWg sync.WaitGroup
+
+	connsMu sync.Mutex
+	conns   = make(map[*gracefulConn]bool)
 )
 
 type gracefulConn struct {
 	net.Conn
+	once sync.Once
 }
 
-func (w gracefulConn) Close() error {
+// Close closes the connection, the first Close decrements TcpWg
+// (even if the connection was already closed by CloseConns).
+func (w *gracefulConn) Close() error {
 	err := w.Conn.Close()
-	if err == nil {
+	w.once.Do(func() {
+		connsMu.Lock()
+		delete(conns, w)
+		connsMu.Unlock()
 		TcpWg.Done()
-	}
+	})
 	return err
 }
 
+// CloseConns closes all open connections accepted by any Listener,
+// which causes their handlers to get a read error and finish.
+func CloseConns() {
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	for c, _ := range conns {
+		c.Conn.Close()
+	}
+}
+
+// WaitTimeout waits for all connections to finish, but no longer
+// than timeout (0 means forever). It returns false if the timeout
+// was reached.
+func WaitTimeout(timeout time.Duration) bool {
+	if timeout == 0 {
+		TcpWg.Wait()
+		return true
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		connsMu.Lock()
+		n := len(conns)
+		connsMu.Unlock()
+		if n == 0 {
+			TcpWg.Wait()
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
 type Listener struct {
 	net.Listener
 	stop    chan error
@@ -68,14 +110,23 @@ func (gl *Listener) Accept() (c net.Conn, err error) {
 		return
 	}
 
-	c = gracefulConn{Conn: c}
+	gc := &gracefulConn{Conn: c}
+	connsMu.Lock()
+	conns[gc] = true
+	connsMu.Unlock()
+	c = gc
 
 	TcpWg.Add(1)
 	return
 }
 
+// File returns a dup of the listener's file (TCP or unix).
 func (gl *Listener) File() *os.File {
-	tl := gl.Listener.(*net.TCPListener)
-	fl, _ := tl.File()
-	return fl
+	if fl, ok := gl.Listener.(interface {
+		File() (*os.File, error)
+	}); ok {
+		f, _ := fl.File()
+		return f
+	}
+	return nil
 }
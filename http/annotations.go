@@ -0,0 +1,101 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"github.com/tgres/tgres/rrd"
+	x "github.com/tgres/tgres/transceiver"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Annotations as they appear in the HTTP API, time is in seconds
+// since the epoch, e.g.:
+// {"time": 1465839830, "text": "Deployed v1.2", "tags": ["deploy", "web"]}
+type annotation struct {
+	Time int64    `json:"time"`
+	Text string   `json:"text"`
+	Tags []string `json:"tags"`
+}
+
+// AnnotationsHandler stores an annotation on POST and lists the
+// annotations matching ?from=&until=&tag= on GET. The from and until
+// parameters are the same as for render, from defaults to 24 hours
+// ago, until defaults to now.
+func AnnotationsHandler(t *x.Transceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			var a annotation
+			if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+				log.Printf("AnnotationsHandler(): %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if a.Time == 0 {
+				a.Time = time.Now().Unix()
+			}
+			if err := t.StoreAnnotation(&rrd.Annotation{Time: time.Unix(a.Time, 0), Text: a.Text, Tags: a.Tags}); err != nil {
+				log.Printf("AnnotationsHandler(): %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		case "GET":
+			from, err := parseTime(r.FormValue("from"))
+			if err != nil {
+				log.Printf("AnnotationsHandler(): (from) %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			} else if from == nil {
+				tmp := time.Now().Add(-24 * time.Hour)
+				from = &tmp
+			}
+			to, err := parseTime(r.FormValue("until"))
+			if err != nil {
+				log.Printf("AnnotationsHandler(): (until) %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			} else if to == nil {
+				tmp := time.Now()
+				to = &tmp
+			}
+
+			as, err := t.FetchAnnotations(*from, *to, r.FormValue("tag"))
+			if err != nil {
+				log.Printf("AnnotationsHandler(): %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			result := make([]*annotation, len(as))
+			for n, a := range as {
+				result[n] = &annotation{Time: a.Time.Unix(), Text: a.Text, Tags: a.Tags}
+				if result[n].Tags == nil {
+					result[n].Tags = []string{}
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// BasicAuthUsers maps user names to passwords as they appear in an
+// htpasswd file, i.e. plain text or "{SHA}" followed by the base64
+// of its SHA-1 (htpasswd -s).
+type BasicAuthUsers map[string]string
+
+// ParseHtpasswd parses the "user:password" lines of an htpasswd
+// file, ignoring blank lines and # comments. Only plain text and
+// {SHA} passwords are supported, a bcrypt ($2y$) or MD5 ($apr1$)
+// one is an error.
+func ParseHtpasswd(data string) (BasicAuthUsers, error) {
+	users := make(BasicAuthUsers)
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("line %d: expected user:password", n)
+		}
+		if strings.HasPrefix(parts[1], "$") {
+			return nil, fmt.Errorf("line %d: unsupported password hash for %q, only plain text and {SHA} (htpasswd -s) are supported", n, parts[0])
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users, scanner.Err()
+}
+
+func (u BasicAuthUsers) valid(user, password string) bool {
+	expect, ok := u[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(expect, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		password = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(expect), []byte(password)) == 1
+}
+
+// BasicAuthHandler requires HTTP basic auth by one of users for the
+// requests to handler, except for paths in exempt (e.g. "/ingest",
+// so that collectors without credentials can still write). A request
+// without valid credentials gets a 401. No users means no auth.
+func BasicAuthHandler(handler http.Handler, users BasicAuthUsers, exempt []string) http.Handler {
+	if len(users) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, path := range exempt {
+			if r.URL.Path == path {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		if user, password, ok := r.BasicAuth(); !ok || !users.valid(user, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="tgres"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
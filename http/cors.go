@@ -0,0 +1,65 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CorsHandler adds CORS headers for browsers (e.g. dashboards calling
+// /render directly) to the responses of handler. allowOrigin is "*"
+// or a comma-separated list of origins, such as
+// "https://dash.example.com", blank means no CORS headers. A
+// preflight (OPTIONS) request from an allowed origin is answered
+// right away.
+func CorsHandler(handler http.Handler, allowOrigin string) http.Handler {
+	if allowOrigin == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !corsAllowed(allowOrigin, origin) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if allowOrigin == "*" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func corsAllowed(allowOrigin, origin string) bool {
+	for _, allowed := range strings.Split(allowOrigin, ",") {
+		if allowed = strings.TrimSpace(allowed); allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
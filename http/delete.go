@@ -0,0 +1,53 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	x "github.com/tgres/tgres/transceiver"
+	"log"
+	"net/http"
+)
+
+// DeleteSeriesHandler deletes the series matching the name parameter
+// (globs allowed), along with all of their data, e.g.:
+// DELETE /series?name=servers.decommissioned*.* responds with
+// {"deleted": 42}.
+func DeleteSeriesHandler(t *x.Transceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "DELETE" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := r.FormValue("name")
+		if name == "" {
+			log.Printf("DeleteSeriesHandler(): missing name")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		n, err := t.DeleteSeries(name)
+		if err != nil {
+			log.Printf("DeleteSeriesHandler(): %q: %v (after deleting %d)", name, err, n)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"deleted": n})
+	}
+}
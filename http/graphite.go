@@ -16,10 +16,15 @@
 package http
 
 import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"github.com/tgres/tgres/dsl"
 	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/rrd"
 	x "github.com/tgres/tgres/transceiver"
+	"io"
 	"log"
 	"math"
 	"net/http"
@@ -28,16 +33,22 @@ import (
 	"time"
 )
 
+// GraphiteMetricsFindHandler lists the nodes matching ?query= (a glob
+// per dot-separated level) the way graphite-web does, for browsing the
+// tree of series names.
 func GraphiteMetricsFindHandler(t *x.Transceiver) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprintf(w, "[\n")
 		nodes := t.FsFind(r.FormValue("query"))
 		for n, node := range nodes {
 			parts := strings.Split(node.Name, ".")
+			text, _ := json.Marshal(parts[len(parts)-1])
+			id, _ := json.Marshal(node.Name)
 			if node.Leaf {
-				fmt.Fprintf(w, `{"leaf": 1, "context": {}, "text": "%s", "expandable": 0, "id": "%s", "allowChildren": 0}`, parts[len(parts)-1], node.Name)
+				fmt.Fprintf(w, `{"leaf": 1, "context": {}, "text": %s, "expandable": 0, "id": %s, "allowChildren": 0}`, text, id)
 			} else {
-				fmt.Fprintf(w, `{"leaf": 0, "context": {}, "text": "%s", "expandable": 1, "id": "%s", "allowChildren": 1}`, parts[len(parts)-1], node.Name)
+				fmt.Fprintf(w, `{"leaf": 0, "context": {}, "text": %s, "expandable": 1, "id": %s, "allowChildren": 1}`, text, id)
 			}
 			if n < len(nodes)-1 {
 				fmt.Fprintf(w, ",\n")
@@ -47,7 +58,35 @@ func GraphiteMetricsFindHandler(t *x.Transceiver) http.HandlerFunc {
 	}
 }
 
-func GraphiteRenderHandler(t *x.Transceiver) http.HandlerFunc {
+// What to render for a target that matches no series.
+type EmptyRenderPolicy int
+
+const (
+	EmptyArray           EmptyRenderPolicy = iota // nothing at all (Graphite behavior)
+	EmptySeriesWithNulls                          // a series named after the target, all nulls
+)
+
+func (p *EmptyRenderPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "", "empty-array":
+		*p = EmptyArray
+	case "empty-series-with-nulls":
+		*p = EmptySeriesWithNulls
+	default:
+		return fmt.Errorf("invalid empty render policy %q, must be empty-array or empty-series-with-nulls", string(text))
+	}
+	return nil
+}
+
+// GraphiteRenderHandler renders targets as Graphite JSON, or with
+// format=ndjson one series object per line, format=csv
+// "target,time,value" rows or format=raw Graphite's
+// "target,start,end,step|v1,v2,..." lines. Those three are flushed a
+// series at a time as they are written, so that a huge result needn't
+// be held in memory. A target name pattern (e.g. "servers.*.cpu",
+// "servers.{web,db}[0-9].cpu") matching more than maxSeries series
+// renders nothing, 0 means no limit.
+func GraphiteRenderHandler(t *x.Transceiver, emptyPolicy EmptyRenderPolicy, maxSeries int) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
@@ -56,35 +95,100 @@ func GraphiteRenderHandler(t *x.Transceiver) http.HandlerFunc {
 			log.Printf("RenderHandler(): (from) %v", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
+		} else if from == nil {
+			tmp := time.Now().Add(-24 * time.Hour) // Graphite default
+			from = &tmp
 		}
 		to, err := parseTime(r.FormValue("until"))
 		if err != nil {
-			log.Printf("RenderHandler(): (unitl) %v", err)
+			log.Printf("RenderHandler(): (until) %v", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		} else if to == nil {
 			tmp := time.Now()
 			to = &tmp
 		}
-		points, err := strconv.Atoi(r.FormValue("maxDataPoints"))
-		if err != nil {
-			log.Printf("RenderHandler(): (maxDataPoints) %v", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+		var points int // as in Graphite, no maxDataPoints means no limit
+		if s := r.FormValue("maxDataPoints"); s != "" {
+			if points, err = strconv.Atoi(s); err != nil || points < 0 {
+				log.Printf("RenderHandler(): (maxDataPoints) invalid: %q", s)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 		}
 
-		fmt.Fprintf(w, "[")
+		for _, target := range r.Form["target"] {
+			err := dsl.CheckFunctions(target)
+			if err == nil {
+				err = checkMaxSeries(r.Context(), t, target, maxSeries)
+			}
+			if err != nil {
+				log.Printf("RenderHandler(): %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		format := r.FormValue("format")
+		flusher, _ := w.(http.Flusher)
+		var cw *csv.Writer
+		switch format {
+		case "ndjson":
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			cw = csv.NewWriter(w)
+		case "raw":
+			w.Header().Set("Content-Type", "text/plain")
+		default:
+			format = "json"
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, "[")
+		}
 
-		for tn, target := range r.Form["target"] {
+		nn := 0
+		write := func(name string, step int64, pts datapoints) {
+			// The name may have a quote or a backslash (e.g. an
+			// escaped tag), so it is encoded as a JSON string.
+			target, _ := json.Marshal(name)
+			switch format {
+			case "json":
+				if nn > 0 {
+					fmt.Fprintf(w, ",\n")
+				}
+				fmt.Fprintf(w, "\n"+`{"target": %s, "datapoints": [`+"\n", target)
+				writeDatapoints(w, pts)
+				fmt.Fprintf(w, "]}")
+			case "ndjson":
+				fmt.Fprintf(w, `{"target": %s, "datapoints": [`, target)
+				writeDatapoints(w, pts)
+				fmt.Fprintf(w, "]}\n")
+			case "csv":
+				writeCSV(cw, name, pts)
+				cw.Flush()
+			case "raw":
+				writeRaw(w, name, from.Unix(), step, pts)
+			}
+			if format != "json" && flusher != nil {
+				flusher.Flush()
+			}
+			nn++
+		}
 
-			seriesMap, err := processTarget(t, target, from.Unix(), to.Unix(), int64(points))
+		for _, target := range r.Form["target"] {
+
+			seriesMap, err := processTarget(r.Context(), t, target, from.Unix(), to.Unix(), int64(points), maxSeries)
 
 			if err != nil {
 				log.Printf("RenderHandler(): %v", err)
 				break // Graphite behaviour is empty list
 			}
 
-			nn := 0
+			if len(seriesMap) == 0 && emptyPolicy == EmptySeriesWithNulls {
+				pts, step := nullPoints(from, to, int64(points))
+				write(target, step, pts)
+			}
+
 			for _, name := range seriesMap.SortedKeys() {
 				series := seriesMap[name]
 
@@ -93,35 +197,100 @@ func GraphiteRenderHandler(t *x.Transceiver) http.HandlerFunc {
 					name = alias
 				}
 
-				fmt.Fprintf(w, "\n"+`{"target": "%s", "datapoints": [`+"\n", name)
-
-				n := 0
-				for series.Next() {
-					if n > 0 {
-						fmt.Fprintf(w, ",")
-					}
-					value := series.CurrentValue()
-					ts := series.CurrentPosBeginsAfter().Unix() // NOTE: Graphite protocol marks the *beginning* of the point
-					if ts > 0 {
-						if math.IsNaN(value) {
-							fmt.Fprintf(w, "[null, %v]", ts)
-						} else {
-							fmt.Fprintf(w, "[%v, %v]", value, ts)
-						}
-						n++
-					}
-				}
-				if nn < len(seriesMap)-1 || tn < len(r.Form["target"])-1 {
-					fmt.Fprintf(w, "]},\n")
-				} else {
-					fmt.Fprintf(w, "]}")
-				}
+				write(name, series.GroupByMs()/1000, seriesPoints(series))
 				series.Close()
-				nn++
 			}
 		}
-		fmt.Fprintf(w, "]\n")
+		if format == "json" {
+			fmt.Fprintf(w, "]\n")
+		}
+	}
+}
+
+// datapoints calls fn with the value and the timestamp of every point of
+// a series, in order.
+type datapoints func(fn func(value float64, ts int64))
+
+// seriesPoints are the points of series which have a timestamp.
+func seriesPoints(series rrd.Series) datapoints {
+	return func(fn func(float64, int64)) {
+		for series.Next() {
+			ts := series.CurrentPosBeginsAfter().Unix() // NOTE: Graphite protocol marks the *beginning* of the point
+			if ts > 0 {
+				fn(series.CurrentValue(), ts)
+			}
+		}
+	}
+}
+
+// nullPoints are maxPoints NaNs from from to to, or one a minute if
+// maxPoints is 0, it also returns their step.
+func nullPoints(from, to *time.Time, maxPoints int64) (datapoints, int64) {
+	step, n := int64(60), maxPoints
+	if n > 0 {
+		if step = (to.Unix() - from.Unix()) / n; step < 1 {
+			step = 1
+		}
+	} else {
+		n = (to.Unix() - from.Unix()) / step
 	}
+	return func(fn func(float64, int64)) {
+		for i := int64(0); i < n; i++ {
+			fn(math.NaN(), from.Unix()+i*step)
+		}
+	}, step
+}
+
+// writeDatapoints writes the points as a comma-separated list of
+// [value, timestamp] JSON pairs, NaNs become null.
+func writeDatapoints(w io.Writer, pts datapoints) {
+	n := 0
+	pts(func(value float64, ts int64) {
+		if n > 0 {
+			fmt.Fprintf(w, ",")
+		}
+		if math.IsNaN(value) {
+			fmt.Fprintf(w, "[null, %v]", ts)
+		} else {
+			fmt.Fprintf(w, "[%v, %v]", value, ts)
+		}
+		n++
+	})
+}
+
+// writeCSV writes a "target,time,value" row for every point, the
+// time in UTC as graphite-web formats it, NaNs as an empty value.
+func writeCSV(cw *csv.Writer, name string, pts datapoints) {
+	pts(func(value float64, ts int64) {
+		v := ""
+		if !math.IsNaN(value) {
+			v = fmt.Sprint(value)
+		}
+		cw.Write([]string{name, time.Unix(ts, 0).UTC().Format("2006-01-02 15:04:05"), v})
+	})
+}
+
+// writeRaw writes the points as a "target,start,end,step|v1,v2,..."
+// line, NaNs as None, like graphite-web. Without points start and end
+// are both from.
+func writeRaw(w io.Writer, name string, from, step int64, pts datapoints) {
+	if step < 1 {
+		step = 1
+	}
+	start, end := from, from
+	var values []string
+	pts(func(value float64, ts int64) {
+		if len(values) == 0 {
+			start = ts
+		}
+		end = ts + step
+		if math.IsNaN(value) {
+			values = append(values, "None")
+		} else {
+			values = append(values, fmt.Sprint(value))
+		}
+	})
+	fmt.Fprintf(w, "%s,%d,%d,%d|%s\n", name, start, end, step, strings.Join(values, ","))
 }
 
 func parseTime(s string) (*time.Time, error) {
@@ -150,10 +319,17 @@ func parseTime(s string) (*time.Time, error) {
 	}
 }
 
-func processTarget(t *x.Transceiver, target string, from, to, maxPoints int64) (dsl.SeriesMap, error) {
+// checkMaxSeries is dsl.CheckMaxSeries of target as processTarget
+// would parse it.
+func checkMaxSeries(ctx context.Context, t *x.Transceiver, target string, maxSeries int) error {
+	return dsl.CheckMaxSeries(dsl.DSGetter(t.Rcache.WithContext(ctx)), fmt.Sprintf("group(%s)", target), maxSeries)
+}
+
+func processTarget(ctx context.Context, t *x.Transceiver, target string, from, to, maxPoints int64, maxSeries int) (dsl.SeriesMap, error) {
 	// In our DSL everything must be a function call, so we wrap everything in group()
 	query := fmt.Sprintf("group(%s)", target)
-	dc := dsl.NewDslCtx(dsl.DSGetter(t.Rcache), query, from, to, maxPoints)
+	dc := dsl.NewDslCtx(dsl.DSGetter(t.Rcache.WithContext(ctx)), query, from, to, maxPoints)
+	dc.MaxSeries = maxSeries
 	result, err := dc.ParseDsl()
 	return result, err
 }
@@ -0,0 +1,145 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GzipHandler gzips the response of handler if the client accepts it
+// and it is at least minSize bytes, a smaller one is sent as is. The
+// response is buffered up to minSize, or until handler flushes, after
+// which it is compressed as it goes. A negative minSize means never
+// compress.
+func GzipHandler(handler http.HandlerFunc, minSize int) http.HandlerFunc {
+	if minSize < 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			handler(w, r)
+			return
+		}
+		gw := &gzipWriter{w: w, minSize: minSize}
+		defer gw.close()
+		handler(gw, r)
+	}
+}
+
+// acceptsGzip is true if the Accept-Encoding of r lists gzip (with a
+// non-zero q, if any).
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type gzipWriter struct {
+	w           http.ResponseWriter
+	minSize     int
+	buf         bytes.Buffer // until we know whether to compress
+	code        int
+	gz          *gzip.Writer
+	wroteHeader bool // to w, i.e. it's decided
+}
+
+// start sends the header and what is buffered to w, compressed unless
+// the handler has set an encoding of its own.
+func (gw *gzipWriter) start(compress bool) {
+	if compress && gw.w.Header().Get("Content-Encoding") == "" {
+		gw.w.Header().Set("Content-Encoding", "gzip")
+		gw.w.Header().Del("Content-Length") // it's that of the uncompressed response
+		gw.gz = gzip.NewWriter(gw.w)
+	} else if gw.buf.Len() > 0 {
+		gw.w.Header().Set("Content-Length", strconv.Itoa(gw.buf.Len()))
+	}
+	if gw.code == 0 {
+		gw.code = http.StatusOK
+	}
+	gw.w.WriteHeader(gw.code)
+	gw.wroteHeader = true
+	gw.write(gw.buf.Bytes())
+	gw.buf.Reset()
+}
+
+func (gw *gzipWriter) write(p []byte) (int, error) {
+	if gw.gz != nil {
+		return gw.gz.Write(p)
+	}
+	return gw.w.Write(p)
+}
+
+func (gw *gzipWriter) Header() http.Header { return gw.w.Header() }
+
+func (gw *gzipWriter) WriteHeader(code int) {
+	if gw.code == 0 {
+		gw.code = code
+	}
+}
+
+func (gw *gzipWriter) Write(p []byte) (int, error) {
+	if gw.wroteHeader {
+		return gw.write(p)
+	}
+	n, err := gw.buf.Write(p)
+	if gw.buf.Len() >= gw.minSize {
+		gw.start(true)
+	}
+	return n, err
+}
+
+// Flush compresses and sends what has been written so far, a
+// flushing handler is streaming a response of unknown size.
+func (gw *gzipWriter) Flush() {
+	if !gw.wroteHeader {
+		if gw.buf.Len() == 0 {
+			return
+		}
+		gw.start(true)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if f, ok := gw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (gw *gzipWriter) close() {
+	if !gw.wroteHeader {
+		gw.start(false) // smaller than minSize
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+	}
+}
@@ -0,0 +1,1054 @@
+package http
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	x "github.com/tgres/tgres/transceiver"
+	"golang.org/x/net/websocket"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSerDe serves a fixed set of series, each with the same values.
+type fakeSerDe struct {
+	names  map[string]int64
+	values []float64
+	start  time.Time
+}
+
+func (f *fakeSerDe) CreateOrReturnDataSource(name string, dsSpec *rrd.DSSpec) (*rrd.DataSource, error) {
+	return nil, nil
+}
+func (f *fakeSerDe) FetchDataSource(id int64) (*rrd.DataSource, error) {
+	for name, dsId := range f.names {
+		if dsId == id {
+			return &rrd.DataSource{Id: id, Name: name, StepMs: 10000}, nil
+		}
+	}
+	return nil, nil
+}
+func (f *fakeSerDe) FetchDataSources() ([]*rrd.DataSource, error)    { return nil, nil }
+func (f *fakeSerDe) FetchDataSourceNames() (map[string]int64, error) { return f.names, nil }
+func (f *fakeSerDe) FlushDataSource(ds *rrd.DataSource) error        { return nil }
+func (f *fakeSerDe) SeriesQuery(ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
+	return &fakeSeries{values: f.values, start: f.start, stepMs: ds.StepMs}, nil
+}
+func (f *fakeSerDe) ListDbClientIps() ([]string, error) { return nil, nil }
+func (f *fakeSerDe) MyDbAddr() (*string, error)         { return nil, nil }
+
+// fakeAnnotationSerDe also stores annotations (in memory)
+type fakeAnnotationSerDe struct {
+	fakeSerDe
+	annotations []*rrd.Annotation
+}
+
+func (f *fakeAnnotationSerDe) StoreAnnotation(a *rrd.Annotation) error {
+	f.annotations = append(f.annotations, a)
+	return nil
+}
+
+func (f *fakeAnnotationSerDe) FetchAnnotations(from, to time.Time, tag string) ([]*rrd.Annotation, error) {
+	var result []*rrd.Annotation
+	for _, a := range f.annotations {
+		if a.Time.Before(from) || a.Time.After(to) {
+			continue
+		}
+		match := tag == ""
+		for _, t := range a.Tags {
+			match = match || t == tag
+		}
+		if match {
+			result = append(result, a)
+		}
+	}
+	return result, nil
+}
+
+type fakeSeries struct {
+	values []float64
+	start  time.Time
+	stepMs int64
+	pos    int
+	alias  string
+}
+
+func (s *fakeSeries) Next() bool {
+	s.pos++
+	return s.pos <= len(s.values)
+}
+func (s *fakeSeries) Close() error {
+	s.pos = 0
+	return nil
+}
+func (s *fakeSeries) CurrentValue() float64 {
+	if s.pos > 0 && s.pos <= len(s.values) {
+		return s.values[s.pos-1]
+	}
+	return math.NaN()
+}
+func (s *fakeSeries) CurrentPosBeginsAfter() time.Time {
+	return s.start.Add(time.Duration(s.stepMs*int64(s.pos-1)) * time.Millisecond)
+}
+func (s *fakeSeries) CurrentPosEndsOn() time.Time {
+	return s.start.Add(time.Duration(s.stepMs*int64(s.pos)) * time.Millisecond)
+}
+func (s *fakeSeries) StepMs() int64                                 { return s.stepMs }
+func (s *fakeSeries) GroupByMs(...int64) int64                      { return s.stepMs }
+func (s *fakeSeries) TimeRange(...time.Time) (time.Time, time.Time) { return time.Time{}, time.Time{} }
+func (s *fakeSeries) LastUpdate() time.Time                         { return time.Time{} }
+func (s *fakeSeries) MaxPoints(...int64) int64                      { return 0 }
+func (s *fakeSeries) Alias(a ...string) string {
+	if len(a) > 0 {
+		s.alias = a[0]
+	}
+	return s.alias
+}
+
+func newTestTransceiver(t *testing.T, names ...string) *x.Transceiver {
+	serde := &fakeSerDe{
+		names:  make(map[string]int64),
+		values: []float64{1, math.NaN(), 3},
+		start:  time.Now().Add(-time.Minute).Truncate(10 * time.Second),
+	}
+	for n, name := range names {
+		serde.names[name] = int64(n + 1)
+	}
+	tr := x.New(nil, serde)
+	if err := tr.Rcache.Reload(); err != nil {
+		t.Fatalf("Rcache.Reload(): %v", err)
+	}
+	return tr
+}
+
+type renderedSeries struct {
+	Target     string          `json:"target"`
+	Datapoints [][]interface{} `json:"datapoints"`
+}
+
+func TestQueryHandlerGlob(t *testing.T) {
+	tr := newTestTransceiver(t, "foo.a", "foo.b", "foo.c", "bar.a")
+
+	body := `{"targets": ["foo.*", "bar.a"], "from": "-1h", "until": "now", "maxDataPoints": 100}`
+	req := httptest.NewRequest("POST", "/query", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	QueryHandler(tr, 0)(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var result []renderedSeries
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+	}
+
+	expect := []string{"foo.a", "foo.b", "foo.c", "bar.a"}
+	if len(result) != len(expect) {
+		t.Fatalf("expected %d series, got %d: %q", len(expect), len(result), w.Body.String())
+	}
+	for i, name := range expect {
+		if result[i].Target != name {
+			t.Errorf("series %d: expected target %q, got %q", i, name, result[i].Target)
+		}
+		if len(result[i].Datapoints) != 3 || result[i].Datapoints[1][0] != nil {
+			t.Errorf("series %q: unexpected datapoints: %v", name, result[i].Datapoints)
+		}
+	}
+}
+
+func TestQueryHandlerBadRequest(t *testing.T) {
+	tr := newTestTransceiver(t)
+
+	w := httptest.NewRecorder()
+	QueryHandler(tr, 0)(w, httptest.NewRequest("POST", "/query", strings.NewReader("{bogus")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid JSON, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	QueryHandler(tr, 0)(w, httptest.NewRequest("GET", "/query", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", w.Code)
+	}
+}
+
+func TestSimpleJSON(t *testing.T) {
+	tr := newTestTransceiver(t, "foo.a", "foo.b", "bar.a")
+	tr.Rcache.NamesTTL = time.Hour
+
+	w := httptest.NewRecorder()
+	SimpleJSONTestHandler()(w, httptest.NewRequest("GET", "/simplejson/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/: expected 200, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	SimpleJSONSearchHandler(tr)(w, httptest.NewRequest("POST", "/simplejson/search", strings.NewReader(`{"target": "foo.*"}`)))
+	var names []string
+	if err := json.Unmarshal(w.Body.Bytes(), &names); err != nil {
+		t.Fatalf("search: invalid JSON response %q: %v", w.Body.String(), err)
+	}
+	if len(names) != 2 || names[0] != "foo.a" || names[1] != "foo.b" {
+		t.Errorf("search: expected foo.a and foo.b, got %v", names)
+	}
+
+	to := time.Now()
+	from := to.Add(-time.Hour)
+	body := fmt.Sprintf(`{"range": {"from": %q, "to": %q}, "maxDataPoints": 100,
+		"targets": [{"target": "foo.*", "refId": "A"}, {"target": "bar.a", "refId": "B", "hide": true}]}`,
+		from.UTC().Format(time.RFC3339Nano), to.UTC().Format(time.RFC3339Nano))
+	w = httptest.NewRecorder()
+	SimpleJSONQueryHandler(tr)(w, httptest.NewRequest("POST", "/simplejson/query", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("query: expected 200, got %d", w.Code)
+	}
+	var result []renderedSeries
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("query: invalid JSON response %q: %v", w.Body.String(), err)
+	}
+	if len(result) != 2 || result[0].Target != "foo.a" || result[1].Target != "foo.b" {
+		t.Fatalf("query: expected foo.a and foo.b (bar.a is hidden), got %q", w.Body.String())
+	}
+	dps := result[0].Datapoints
+	if len(dps) != 3 || dps[0][0] != 1.0 || dps[1][0] != nil {
+		t.Fatalf("query: unexpected datapoints: %v", dps)
+	}
+	if ms := int64(dps[0][1].(float64)); ms < from.UnixNano()/1e6 || ms > to.UnixNano()/1e6 || ms%1000 != 0 {
+		t.Errorf("query: expected a millisecond timestamp within the range, got %v", dps[0][1])
+	}
+
+	w = httptest.NewRecorder()
+	SimpleJSONQueryHandler(tr)(w, httptest.NewRequest("POST", "/simplejson/query", strings.NewReader("{bogus")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("query: expected 400 for invalid JSON, got %d", w.Code)
+	}
+}
+
+// fakeDeleterSerDe can also delete (from its names)
+type fakeDeleterSerDe struct {
+	fakeSerDe
+}
+
+func (f *fakeDeleterSerDe) DeleteDataSource(id int64) error {
+	for name, dsId := range f.names {
+		if dsId == id {
+			delete(f.names, name)
+		}
+	}
+	return nil
+}
+
+func TestDeleteSeries(t *testing.T) {
+	serde := &fakeDeleterSerDe{fakeSerDe{names: map[string]int64{"dead.web1.cpu": 1, "dead.web2.cpu": 2, "live.web3.cpu": 3}}}
+	tr := x.New(nil, serde)
+
+	del := func(method, name string) (int, int) {
+		w := httptest.NewRecorder()
+		DeleteSeriesHandler(tr)(w, httptest.NewRequest(method, "/series?name="+url.QueryEscape(name), nil))
+		var result map[string]int
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result["deleted"]
+	}
+
+	if code, n := del("DELETE", "dead.*.cpu"); code != http.StatusOK || n != 2 {
+		t.Errorf("expected 200 and 2 deleted, got %d and %d", code, n)
+	}
+	if len(serde.names) != 1 || len(tr.FsFind("dead.*.cpu")) != 0 {
+		t.Errorf("expected only live.web3.cpu left, got %v in the db, %v found", serde.names, tr.FsFind("*.*.cpu"))
+	}
+	if code, n := del("DELETE", "nothing.*"); code != http.StatusOK || n != 0 {
+		t.Errorf("matching nothing: expected 200 and 0 deleted, got %d and %d", code, n)
+	}
+	if code, _ := del("DELETE", ""); code != http.StatusBadRequest {
+		t.Errorf("no name: expected 400, got %d", code)
+	}
+	if code, _ := del("GET", "live.*.cpu"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: expected 405, got %d", code)
+	}
+
+	// A serde which cannot delete
+	tr = newTestTransceiver(t, "foo.a")
+	w := httptest.NewRecorder()
+	DeleteSeriesHandler(tr)(w, httptest.NewRequest("DELETE", "/series?name=foo.a", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("non-deleting serde: expected 500, got %d", w.Code)
+	}
+}
+
+// fakeRenamerSerDe can also rename (and replace, unless replaceErr,
+// and merge), and stores the history (values) of every ds by its id.
+type fakeRenamerSerDe struct {
+	fakeDeleterSerDe
+	history    map[int64][]float64
+	replaceErr error
+}
+
+func (f *fakeRenamerSerDe) RenameDataSource(id int64, name string) error {
+	for n, dsId := range f.names {
+		if dsId == id {
+			delete(f.names, n)
+			f.names[name] = id
+		}
+	}
+	return nil
+}
+func (f *fakeRenamerSerDe) ReplaceDataSource(id int64, name string, replacedId int64) error {
+	if f.replaceErr != nil {
+		return f.replaceErr
+	}
+	f.DeleteDataSource(replacedId)
+	return f.RenameDataSource(id, name)
+}
+func (f *fakeRenamerSerDe) MergeDataSource(id, intoId int64) error {
+	for i, v := range f.history[id] {
+		if i >= len(f.history[intoId]) {
+			f.history[intoId] = append(f.history[intoId], v)
+		}
+	}
+	return f.DeleteDataSource(id)
+}
+func (f *fakeRenamerSerDe) SeriesQuery(ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
+	return &fakeSeries{values: f.history[ds.Id], start: f.start, stepMs: ds.StepMs}, nil
+}
+
+func TestRenameSeries(t *testing.T) {
+	serde := &fakeRenamerSerDe{
+		fakeDeleterSerDe: fakeDeleterSerDe{fakeSerDe{
+			names: map[string]int64{"old.cpu": 1, "other.cpu": 2},
+			start: time.Now().Add(-time.Minute).Truncate(10 * time.Second),
+		}},
+		history: map[int64][]float64{1: {1, 2, 3}, 2: {7}},
+	}
+	tr := x.New(nil, serde)
+
+	rename := func(from, to string, existing x.RenameExisting) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/rename", strings.NewReader(url.Values{"from": {from}, "to": {to}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		RenameSeriesHandler(tr, existing)(w, req)
+		return w.Code
+	}
+	history := func(name string) []interface{} {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"targets": [%q], "from": "-1h", "until": "now"}`, name)
+		QueryHandler(tr, 0)(w, httptest.NewRequest("POST", "/query", strings.NewReader(body)))
+		var result []renderedSeries
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+		}
+		var values []interface{}
+		for _, r := range result {
+			for _, dp := range r.Datapoints {
+				values = append(values, dp[0])
+			}
+		}
+		return values
+	}
+
+	if code := rename("old.cpu", "new.cpu", x.RenameExistingFail); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if h := history("new.cpu"); len(h) != 3 || h[0] != 1.0 || h[2] != 3.0 {
+		t.Errorf("expected the history of old.cpu under new.cpu, got %v", h)
+	}
+	if h := history("old.cpu"); len(h) != 0 {
+		t.Errorf("expected no more old.cpu, got %v", h)
+	}
+
+	if code := rename("old.cpu", "newer.cpu", x.RenameExistingFail); code != http.StatusNotFound {
+		t.Errorf("non-existent series: expected 404, got %d", code)
+	}
+	if code := rename("new.cpu", "other.cpu", x.RenameExistingFail); code != http.StatusConflict {
+		t.Errorf("existing target: expected 409, got %d", code)
+	}
+
+	// A failed replace changes neither series
+	serde.replaceErr = fmt.Errorf("connection reset by peer")
+	if code := rename("new.cpu", "other.cpu", x.RenameExistingReplace); code != http.StatusInternalServerError {
+		t.Errorf("failed replace: expected 500, got %d", code)
+	}
+	if h := history("other.cpu"); len(h) != 1 || len(serde.names) != 2 {
+		t.Errorf("failed replace: expected both series unchanged, got %v %v", h, serde.names)
+	}
+	serde.replaceErr = nil
+
+	if code := rename("new.cpu", "other.cpu", x.RenameExistingReplace); code != http.StatusOK {
+		t.Errorf("existing target, replace: expected 200, got %d", code)
+	}
+	if h := history("other.cpu"); len(h) != 3 || len(serde.names) != 1 {
+		t.Errorf("replace: expected the history of new.cpu under other.cpu (alone), got %v %v", h, serde.names)
+	}
+
+	// The history of the target is kept, and filled in
+	serde.names["short.cpu"], serde.history[3] = 3, []float64{5}
+	if code := rename("other.cpu", "short.cpu", x.RenameExistingMerge); code != http.StatusOK {
+		t.Errorf("existing target, merge: expected 200, got %d", code)
+	}
+	if h := history("short.cpu"); len(h) != 3 || h[0] != 5.0 || h[1] != 2.0 || len(serde.names) != 1 {
+		t.Errorf("merge: expected the history of short.cpu filled in from other.cpu, got %v %v", h, serde.names)
+	}
+	if code := rename("", "x", x.RenameExistingFail); code != http.StatusBadRequest {
+		t.Errorf("no from: expected 400, got %d", code)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	tr := x.New(nil, &fakeAnnotationSerDe{})
+	handler := AnnotationsHandler(tr)
+
+	now := time.Now().Unix()
+	for _, body := range []string{
+		fmt.Sprintf(`{"time": %d, "text": "old deploy", "tags": ["deploy"]}`, now-7200),
+		fmt.Sprintf(`{"time": %d, "text": "deploy", "tags": ["deploy", "web"]}`, now-600),
+		fmt.Sprintf(`{"time": %d, "text": "incident", "tags": ["incident"]}`, now-300),
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/annotations", strings.NewReader(body)))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("POST %s: expected 204, got %d", body, w.Code)
+		}
+	}
+
+	for query, expect := range map[string][]string{
+		"/annotations?from=-1h":                   []string{"deploy", "incident"},
+		"/annotations?from=-1h&tag=deploy":        []string{"deploy"},
+		"/annotations?from=-3h&until=-1h":         []string{"old deploy"},
+		"/annotations?from=-3h&until=now&tag=foo": []string{},
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", query, nil))
+		var result []annotation
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("GET %s: invalid JSON response %q: %v", query, w.Body.String(), err)
+		}
+		if len(result) != len(expect) {
+			t.Errorf("GET %s: expected %d annotations, got %d: %v", query, len(expect), len(result), result)
+			continue
+		}
+		for i, text := range expect {
+			if result[i].Text != text {
+				t.Errorf("GET %s: expected annotation %d to be %q, got %q", query, i, text, result[i].Text)
+			}
+		}
+	}
+}
+
+func TestRenderEmptyPolicy(t *testing.T) {
+	tr := newTestTransceiver(t, "foo.a")
+
+	for _, c := range []struct {
+		policy string
+		expect []string
+	}{
+		{"empty-array", []string{"foo.a"}},
+		{"empty-series-with-nulls", []string{"nomatch.*", "foo.a"}},
+	} {
+		var policy EmptyRenderPolicy
+		if err := policy.UnmarshalText([]byte(c.policy)); err != nil {
+			t.Fatalf("UnmarshalText(%q): %v", c.policy, err)
+		}
+
+		w := httptest.NewRecorder()
+		GraphiteRenderHandler(tr, policy, 0)(w, httptest.NewRequest("GET", "/render?target=nomatch.*&target=foo.a&from=-1h&until=now&maxDataPoints=60", nil))
+
+		var result []renderedSeries
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: invalid JSON response %q: %v", c.policy, w.Body.String(), err)
+		}
+		if len(result) != len(c.expect) {
+			t.Fatalf("%s: expected %d series, got %d: %q", c.policy, len(c.expect), len(result), w.Body.String())
+		}
+		for i, name := range c.expect {
+			if result[i].Target != name {
+				t.Errorf("%s: series %d: expected target %q, got %q", c.policy, i, name, result[i].Target)
+			}
+		}
+		if c.policy == "empty-series-with-nulls" {
+			if len(result[0].Datapoints) != 60 {
+				t.Errorf("%s: expected 60 null datapoints, got %d", c.policy, len(result[0].Datapoints))
+			}
+			for _, dp := range result[0].Datapoints {
+				if dp[0] != nil {
+					t.Errorf("%s: expected only nulls, got %v", c.policy, dp)
+					break
+				}
+			}
+		}
+	}
+}
+
+// slowSerDe is a db whose queries take until they are cancelled.
+type slowSerDe struct {
+	fakeSerDe
+	cancelled chan bool
+}
+
+func (f *slowSerDe) SeriesQueryContext(ctx context.Context, ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
+	<-ctx.Done()
+	f.cancelled <- true
+	return nil, ctx.Err()
+}
+
+func TestQueryTimeout(t *testing.T) {
+	serde := &slowSerDe{
+		fakeSerDe: fakeSerDe{names: map[string]int64{"foo.a": 1}},
+		cancelled: make(chan bool, 1),
+	}
+	tr := x.New(nil, serde)
+	if err := tr.Rcache.Reload(); err != nil {
+		t.Fatalf("Rcache.Reload(): %v", err)
+	}
+
+	handler := QueryTimeoutHandler(GraphiteRenderHandler(tr, EmptyArray, 0), 50*time.Millisecond)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	handler(w, httptest.NewRequest("GET", "/render?target=foo.a&from=-1h&until=now&maxDataPoints=60", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected %d, got %d", http.StatusGatewayTimeout, w.Code)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("request took %v, expected it to time out", d)
+	}
+	select {
+	case <-serde.cancelled: // the query was cancelled, the handler is done with it
+	case <-time.After(time.Second):
+		t.Errorf("the query was not cancelled")
+	}
+
+	// A quick request is unaffected
+	tr = newTestTransceiver(t, "foo.a")
+	w = httptest.NewRecorder()
+	QueryTimeoutHandler(GraphiteRenderHandler(tr, EmptyArray, 0), time.Second)(w, httptest.NewRequest("GET", "/render?target=foo.a&from=-1h&until=now&maxDataPoints=60", nil))
+	var result []renderedSeries
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &result) != nil || len(result) != 1 {
+		t.Errorf("expected one series, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+// flushRecorder records what was written between flushes.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	chunks []string
+	last   int
+}
+
+func (f *flushRecorder) Flush() {
+	body := f.Body.String()
+	f.chunks = append(f.chunks, body[f.last:])
+	f.last = len(body)
+}
+
+func TestRenderNdjson(t *testing.T) {
+	var names []string
+	for i := 0; i < 1000; i++ {
+		names = append(names, fmt.Sprintf("foo.s%04d", i))
+	}
+	tr := newTestTransceiver(t, names...)
+
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		QueryTimeoutHandler(GraphiteRenderHandler(tr, EmptyArray, 0), timeout)(w, httptest.NewRequest("GET", "/render?target=foo.*&from=-1h&until=now&maxDataPoints=60&format=ndjson", nil))
+
+		if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("timeout %v: expected application/x-ndjson, got %q", timeout, ct)
+		}
+		// Every series is flushed on its own, so no more than one
+		// is ever held in memory.
+		if len(w.chunks) != len(names) {
+			t.Fatalf("timeout %v: expected %d flushes, got %d", timeout, len(names), len(w.chunks))
+		}
+		for i, chunk := range w.chunks {
+			var s renderedSeries
+			if !strings.HasSuffix(chunk, "\n") || strings.Count(chunk, "\n") != 1 {
+				t.Fatalf("timeout %v: expected one line per flush, got %q", timeout, chunk)
+			}
+			if err := json.Unmarshal([]byte(chunk), &s); err != nil {
+				t.Fatalf("timeout %v: invalid JSON line %q: %v", timeout, chunk, err)
+			}
+			if s.Target != names[i] || len(s.Datapoints) != 3 {
+				t.Errorf("timeout %v: line %d: unexpected series %+v", timeout, i, s)
+			}
+		}
+		if w.last != w.Body.Len() {
+			t.Errorf("timeout %v: %d bytes written after the last flush", timeout, w.Body.Len()-w.last)
+		}
+	}
+}
+
+func TestInfluxWrite(t *testing.T) {
+	tr := newTestTransceiver(t)
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{"cpu,host=web1 usage_idle=98.5 1465839830100400200\ncpu,host=web2 usage_idle=97\n", http.StatusNoContent},
+		{"cpu,host=web1 usage_idle=98.5\ncpu usage_idle=bogus\n", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		InfluxWriteHandler(tr)(w, httptest.NewRequest("POST", "/write?db=telegraf", strings.NewReader(c.body)))
+		if w.Code != c.code {
+			t.Errorf("%q: expected %d, got %d", c.body, c.code, w.Code)
+		}
+		if c.code == http.StatusBadRequest && !strings.Contains(w.Body.String(), "line 2") {
+			t.Errorf("%q: expected the error to name line 2, got %q", c.body, w.Body.String())
+		}
+	}
+}
+
+func TestPrometheusWrite(t *testing.T) {
+	tr := newTestTransceiver(t)
+
+	w := httptest.NewRecorder()
+	PrometheusWriteHandler(tr, 0)(w, httptest.NewRequest("POST", "/api/v1/write", strings.NewReader("\x00")))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected an empty WriteRequest to be a 200, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	PrometheusWriteHandler(tr, 0)(w, httptest.NewRequest("POST", "/api/v1/write", strings.NewReader("not snappy")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	PrometheusWriteHandler(tr, 4)(w, httptest.NewRequest("POST", "/api/v1/write", strings.NewReader("not snappy")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a body over the limit to be a 413, got %d", w.Code)
+	}
+}
+
+func TestIngest(t *testing.T) {
+	tr := newTestTransceiver(t)
+
+	body := `[{"name": "foo.a", "ts": 1465839830, "value": 1.23},
+		{"name": "foo.b", "ts": "2016-06-13T17:43:50Z", "value": 2},
+		{"name": "foo.c", "ts": "yesterday", "value": 3},
+		{"name": "foo.d", "ts": 1465839830}]`
+	w := httptest.NewRecorder()
+	IngestHandler(tr, 0)(w, httptest.NewRequest("POST", "/ingest", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var result ingestResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("bad response %q: %v", w.Body.String(), err)
+	}
+	if result.Accepted != 2 || result.Rejected != 2 || len(result.Errors) != 2 || !strings.Contains(result.Errors[0], "foo.c") {
+		t.Errorf("expected 2 accepted and foo.c and foo.d rejected, got %+v", result)
+	}
+
+	w = httptest.NewRecorder()
+	IngestHandler(tr, 16)(w, httptest.NewRequest("POST", "/ingest", strings.NewReader(body)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a 413 for a body over the limit, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	IngestHandler(tr, 0)(w, httptest.NewRequest("POST", "/ingest", strings.NewReader(`{"name": "foo.a"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400 for something other than an array, got %d", w.Code)
+	}
+}
+
+func TestLive(t *testing.T) {
+	tr := newTestTransceiver(t)
+	srv := httptest.NewServer(LiveHandler(tr))
+	defer srv.Close()
+
+	w := httptest.NewRecorder()
+	LiveHandler(tr)(w, httptest.NewRequest("GET", "/live", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400 without a match, got %d", w.Code)
+	}
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/live?match=foo.*", "", srv.URL)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	tr.QueueDataPoint("bar.a", time.Unix(1465839830, 0), 1)
+	tr.QueueDataPoint("foo.a", time.Unix(1465839830, 0), 2)
+	tr.QueueDataPoint("foo.b", time.Unix(1465839840, 500000000), 3)
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expect := range []struct {
+		name      string
+		ts, value float64
+	}{{"foo.a", 1465839830, 2}, {"foo.b", 1465839840.5, 3}} {
+		var lp livePoint
+		if err := websocket.JSON.Receive(ws, &lp); err != nil {
+			t.Fatalf("Receive(): %v", err)
+		}
+		if lp.Name != expect.name || lp.Ts != expect.ts || lp.Value == nil || *lp.Value != expect.value {
+			t.Errorf("expected %+v, got %+v", expect, lp)
+		}
+	}
+	ws.Close()
+}
+
+func TestRenderGraphiteJson(t *testing.T) {
+	tr := newTestTransceiver(t, "foo.a")
+
+	// No maxDataPoints is no limit, as in Graphite
+	w := httptest.NewRecorder()
+	GraphiteRenderHandler(tr, EmptyArray, 0)(w, httptest.NewRequest("GET", "/render?"+url.Values{"target": {`alias(foo.a,"a \"b\"")`}, "from": {"-1h"}, "until": {"now"}, "format": {"json"}}.Encode(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %q", ct)
+	}
+	var result []renderedSeries
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+	}
+	// The alias keeps its escapes, which must not break the JSON
+	if len(result) != 1 || result[0].Target != `a \"b\"` {
+		t.Fatalf(`expected one series named a \"b\", got %q`, w.Body.String())
+	}
+	var nulls int
+	for _, dp := range result[0].Datapoints {
+		if dp[0] == nil {
+			nulls++
+		}
+	}
+	if nulls == 0 || nulls == len(result[0].Datapoints) {
+		t.Errorf("expected the NaN among the values to be a null, got %v", result[0].Datapoints)
+	}
+
+	w = httptest.NewRecorder()
+	GraphiteRenderHandler(tr, EmptyArray, 0)(w, httptest.NewRequest("GET", "/render?target=foo.a&maxDataPoints=x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a 400 for a bad maxDataPoints, got %d", w.Code)
+	}
+}
+
+func TestMetricsFind(t *testing.T) {
+	serde := &fakeSerDe{names: map[string]int64{"prod.web1.cpu": 1, "prod.web2.cpu": 2}}
+	tr := x.New(nil, serde)
+	tr.Rcache.NamesTTL = time.Hour
+
+	find := func(query string) []map[string]interface{} {
+		w := httptest.NewRecorder()
+		GraphiteMetricsFindHandler(tr)(w, httptest.NewRequest("GET", "/metrics/find?query="+query, nil))
+		var result []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+		}
+		return result
+	}
+
+	result := find("prod.*")
+	if len(result) != 2 || result[0]["leaf"] != 0.0 || result[0]["expandable"] != 1.0 {
+		t.Fatalf("expected 2 expandable nodes, got %v", result)
+	}
+	if result = find("prod.web1.*"); len(result) != 1 || result[0]["text"] != "cpu" || result[0]["id"] != "prod.web1.cpu" || result[0]["leaf"] != 1.0 {
+		t.Errorf("expected the prod.web1.cpu leaf, got %v", result)
+	}
+
+	// Within the TTL the names are not reloaded
+	serde.names["prod.web3.cpu"] = 3
+	if result = find("prod.*"); len(result) != 2 {
+		t.Errorf("expected the cached 2 nodes, got %v", result)
+	}
+	tr.Rcache.NamesTTL = 0
+	if result = find("prod.*"); len(result) != 3 {
+		t.Errorf("expected the reloaded 3 nodes, got %v", result)
+	}
+}
+
+func TestCors(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	request := func(method, origin string) *http.Request {
+		r := httptest.NewRequest(method, "/render?target=foo.a", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+			r.Header.Set("Access-Control-Request-Headers", "Content-Type")
+		}
+		return r
+	}
+
+	for _, c := range []struct {
+		allow, method, origin, expOrigin string
+		expCode                          int
+	}{
+		{"", "GET", "https://dash.example.com", "", http.StatusOK},
+		{"*", "GET", "https://dash.example.com", "*", http.StatusOK},
+		{"*", "GET", "", "", http.StatusOK},
+		{"https://a.example.com, https://dash.example.com", "GET", "https://dash.example.com", "https://dash.example.com", http.StatusOK},
+		{"https://a.example.com", "GET", "https://dash.example.com", "", http.StatusOK},
+		{"https://dash.example.com", "OPTIONS", "https://dash.example.com", "https://dash.example.com", http.StatusNoContent},
+	} {
+		w := httptest.NewRecorder()
+		CorsHandler(ok, c.allow).ServeHTTP(w, request(c.method, c.origin))
+		if w.Code != c.expCode {
+			t.Errorf("%q %s from %q: expected %d, got %d", c.allow, c.method, c.origin, c.expCode, w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != c.expOrigin {
+			t.Errorf("%q %s from %q: expected Access-Control-Allow-Origin %q, got %q", c.allow, c.method, c.origin, c.expOrigin, got)
+		}
+		if c.method == "OPTIONS" {
+			if w.Header().Get("Access-Control-Allow-Methods") != "GET, POST, OPTIONS" || w.Header().Get("Access-Control-Allow-Headers") != "Content-Type" {
+				t.Errorf("preflight: unexpected headers %v", w.Header())
+			}
+		} else if w.Body.String() != "ok" {
+			t.Errorf("%q %s from %q: the request did not reach the handler", c.allow, c.method, c.origin)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	users, err := ParseHtpasswd("# comment\nalice:secret\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+	if err != nil {
+		t.Fatalf("ParseHtpasswd(): %v", err)
+	}
+	if _, err := ParseHtpasswd("carol:$apr1$abc$def"); err == nil {
+		t.Errorf("expected an error for an MD5 password")
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+	handler := BasicAuthHandler(ok, users, []string{"/ingest"})
+	for _, c := range []struct {
+		path, user, password string
+		expCode              int
+	}{
+		{"/render", "", "", http.StatusUnauthorized},
+		{"/render", "alice", "wrong", http.StatusUnauthorized},
+		{"/render", "alice", "secret", http.StatusOK},
+		{"/render", "bob", "password", http.StatusOK},
+		{"/render", "bob", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", http.StatusUnauthorized},
+		{"/ingest", "", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", c.path, nil)
+		if c.user != "" {
+			r.SetBasicAuth(c.user, c.password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.expCode {
+			t.Errorf("%s as %q/%q: expected %d, got %d", c.path, c.user, c.password, c.expCode, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s as %q: no WWW-Authenticate header", c.path, c.user)
+		}
+	}
+
+	// No users, no auth
+	w := httptest.NewRecorder()
+	BasicAuthHandler(ok, nil, nil).ServeHTTP(w, httptest.NewRequest("GET", "/render", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d without users, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	big := strings.Repeat("[1, 2, 3], ", 500)
+	body := func(s string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, s)
+		}
+	}
+	get := func(handler http.HandlerFunc, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/render", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	// Large enough and accepted: compressed, without a Content-Length
+	w := get(GzipHandler(body(big), 1024), "gzip, deflate")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Length") != "" {
+		t.Errorf("expected a gzipped response without Content-Length, got %v", w.Header())
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("expected Vary: Accept-Encoding, got %q", w.Header().Get("Vary"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader(): %v", err)
+	}
+	if data, err := ioutil.ReadAll(gz); err != nil || string(data) != big {
+		t.Errorf("expected the response to decompress to what was written, got %d bytes, %v", len(data), err)
+	}
+
+	// Too small, not accepted or refused with q=0: as is, with a Content-Length
+	for _, c := range []struct {
+		size           int
+		acceptEncoding string
+		body           string
+	}{
+		{1024, "gzip", `[1, 2, 3]`},
+		{1024, "", big},
+		{1024, "gzip;q=0, identity", big},
+		{-1, "gzip", big},
+	} {
+		w := get(GzipHandler(body(c.body), c.size), c.acceptEncoding)
+		if w.Header().Get("Content-Encoding") != "" || w.Body.String() != c.body {
+			t.Errorf("%d %q: expected an uncompressed response, got %v", c.size, c.acceptEncoding, w.Header())
+		}
+		if c.size >= 0 && c.acceptEncoding == "gzip" && w.Header().Get("Content-Length") != strconv.Itoa(len(c.body)) {
+			t.Errorf("%d %q: expected Content-Length %d, got %q", c.size, c.acceptEncoding, len(c.body), w.Header().Get("Content-Length"))
+		}
+	}
+
+	// A streamed response is compressed from the first flush
+	streamed := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"target": "foo.a"}`)
+		w.(http.Flusher).Flush()
+		fmt.Fprintln(w, `{"target": "foo.b"}`)
+	}
+	w = get(GzipHandler(streamed, 1024), "gzip")
+	if gz, err = gzip.NewReader(w.Body); err != nil {
+		t.Fatalf("gzip.NewReader(): %v", err)
+	}
+	if data, _ := ioutil.ReadAll(gz); string(data) != "{\"target\": \"foo.a\"}\n{\"target\": \"foo.b\"}\n" {
+		t.Errorf("unexpected streamed response %q", data)
+	}
+}
+
+func TestRenderCsvRaw(t *testing.T) {
+	tr := newTestTransceiver(t, "foo.a", "foo.b")
+
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	GraphiteRenderHandler(tr, EmptyArray, 0)(w, httptest.NewRequest("GET", "/render?target=foo.*&from=-1h&until=now&maxDataPoints=60&format=csv", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("expected text/csv, got %q", ct)
+	}
+	if len(w.chunks) != 2 {
+		t.Errorf("expected a flush per series, got %d", len(w.chunks))
+	}
+	rows, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	if err != nil || len(rows) != 6 {
+		t.Fatalf("expected 6 rows, got %d %v: %q", len(rows), err, w.Body.String())
+	}
+	for i, exp := range []string{"1", "", "3", "1", "", "3"} {
+		if rows[i][2] != exp {
+			t.Errorf("row %d: expected value %q, got %q", i, exp, rows[i][2])
+		}
+		if _, err := time.Parse("2006-01-02 15:04:05", rows[i][1]); err != nil {
+			t.Errorf("row %d: %v", i, err)
+		}
+	}
+	if rows[0][0] != "foo.a" || rows[3][0] != "foo.b" {
+		t.Errorf("unexpected targets %q, %q", rows[0][0], rows[3][0])
+	}
+
+	w = &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	GraphiteRenderHandler(tr, EmptyArray, 0)(w, httptest.NewRequest("GET", "/render?target=foo.a&from=-1h&until=now&maxDataPoints=60&format=raw", nil))
+	var name string
+	var start, end, step int64
+	line := strings.TrimSpace(w.Body.String())
+	parts := strings.SplitN(line, "|", 2)
+	if n, err := fmt.Sscanf(strings.Replace(parts[0], ",", " ", -1), "%s %d %d %d", &name, &start, &end, &step); n != 4 || err != nil || len(parts) != 2 {
+		t.Fatalf("unexpected raw line %q: %v", line, err)
+	}
+	if name != "foo.a" || step != 10 || end-start != 30 || parts[1] != "1,None,3" {
+		t.Errorf("unexpected raw line %q", line)
+	}
+}
+
+func TestRenderFunctions(t *testing.T) {
+	tr := newTestTransceiver(t, "foo.a", "foo.b")
+
+	w := httptest.NewRecorder()
+	GraphiteRenderHandler(tr, EmptyArray, 0)(w, httptest.NewRequest("GET", "/render?"+url.Values{
+		"target": {"scale(sumSeries(foo.*), 0.1)"}, "from": {"-1h"}, "until": {"now"}, "maxDataPoints": {"60"}}.Encode(), nil))
+	var result []renderedSeries
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil || len(result) != 1 {
+		t.Fatalf("expected one series, got %q (%v)", w.Body.String(), err)
+	}
+	var values []float64
+	for _, dp := range result[0].Datapoints {
+		if v, ok := dp[0].(float64); ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) != 2 || math.Abs(values[0]-0.2) > 1e-9 || math.Abs(values[1]-0.6) > 1e-9 {
+		t.Errorf("expected (1+1)*0.1 and (3+3)*0.1, got %v", result[0].Datapoints)
+	}
+
+	w = httptest.NewRecorder()
+	GraphiteRenderHandler(tr, EmptyArray, 0)(w, httptest.NewRequest("GET", "/render?"+url.Values{
+		"target": {"foo.a", "scale(bogusSeries(foo.*), 2)"}}.Encode(), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an unknown function, got %d", http.StatusBadRequest, w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "bogusSeries") || !strings.Contains(body, "sumSeries") {
+		t.Errorf("expected the error to name the function and list the supported ones, got %q", body)
+	}
+}
+
+func TestRenderGlobs(t *testing.T) {
+	tr := newTestTransceiver(t, "servers.web1.cpu", "servers.web2.cpu", "servers.db1.cpu", "servers.dbx.cpu", "servers.cache1.cpu")
+
+	render := func(target string, maxSeries int) []string {
+		w := httptest.NewRecorder()
+		GraphiteRenderHandler(tr, EmptyArray, maxSeries)(w, httptest.NewRequest("GET", "/render?"+url.Values{
+			"target": {target}, "from": {"-1h"}, "until": {"now"}, "maxDataPoints": {"60"}}.Encode(), nil))
+		if w.Code != http.StatusOK {
+			return []string{w.Body.String()}
+		}
+		var result []renderedSeries
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: invalid JSON %q: %v", target, w.Body.String(), err)
+		}
+		names := []string{}
+		for _, s := range result {
+			names = append(names, s.Target)
+		}
+		return names
+	}
+
+	for _, c := range []struct {
+		target string
+		exp    string
+	}{
+		{"servers.*.cpu", "servers.cache1.cpu servers.db1.cpu servers.dbx.cpu servers.web1.cpu servers.web2.cpu"},
+		{"servers.{web,db}1.cpu", "servers.db1.cpu servers.web1.cpu"},
+		{"servers.db[0-9].cpu", "servers.db1.cpu"},
+		{"servers.{web,db}[0-9].cpu", "servers.db1.cpu servers.web1.cpu servers.web2.cpu"},
+		{"sumSeries(servers.{web,cache}1.cpu)", "sumSeries(servers.{web,cache}1.cpu)"},
+		{"servers.{nope,none}.cpu", ""},
+	} {
+		if got := strings.Join(render(c.target, 0), " "); got != c.exp {
+			t.Errorf("%s: expected %q, got %q", c.target, c.exp, got)
+		}
+	}
+
+	// Too many matches are refused, also within a function
+	for _, target := range []string{"servers.*.cpu", "sumSeries(servers.*.cpu)"} {
+		if got := render(target, 4); len(got) != 1 || !strings.Contains(got[0], "more than the limit of 4") {
+			t.Errorf("%s: expected a 400 above the limit, got %v", target, got)
+		}
+	}
+	if got := render("servers.web*.cpu", 4); len(got) != 2 {
+		t.Errorf("expected 2 series within the limit, got %v", got)
+	}
+
+	w := httptest.NewRecorder()
+	QueryHandler(tr, 4)(w, httptest.NewRequest("POST", "/query", strings.NewReader(`{"targets": ["servers.web1.cpu", "servers.*.cpu"]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("/query: expected a 400 above the limit, got %d", w.Code)
+	}
+}
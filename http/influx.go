@@ -0,0 +1,96 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/tgres/tgres/influx"
+	"github.com/tgres/tgres/rrd"
+	x "github.com/tgres/tgres/transceiver"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// InfluxWriteHandler accepts InfluxDB line protocol, as sent by
+// e.g. Telegraf to /write. The response is a 204, or a 400 with the
+// first parse error if any line is bad, in which case the good lines
+// are still accepted (like InfluxDB does).
+func InfluxWriteHandler(t *x.Transceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		precision, err := influx.Precision(r.FormValue("precision"))
+		if err != nil {
+			influxError(w, err)
+			return
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				influxError(w, err)
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+
+		var (
+			dps      []*rrd.DataPoint
+			firstErr error
+			now      = time.Now()
+		)
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 4096), 1024*1024)
+		for n := 1; scanner.Scan(); n++ {
+			ldps, err := influx.ParseLine(scanner.Text(), precision, now)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("line %d: %v", n, err)
+				}
+				continue
+			}
+			dps = append(dps, ldps...)
+		}
+		if err := scanner.Err(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		t.QueueDataPoints(dps)
+
+		if firstErr != nil {
+			log.Printf("InfluxWriteHandler(): %v", firstErr)
+			influxError(w, firstErr)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// influxError responds with a 400 and the error the way InfluxDB does.
+func influxError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,129 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/rrd"
+	x "github.com/tgres/tgres/transceiver"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A data point as POSTed to /ingest, ts is seconds since the epoch or
+// an RFC3339 time.
+type ingestPoint struct {
+	Name  string          `json:"name"`
+	Ts    json.RawMessage `json:"ts"`
+	Value *float64        `json:"value"`
+}
+
+type ingestResult struct {
+	Accepted int      `json:"accepted"`
+	Rejected int      `json:"rejected"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// At most this many reasons for rejected points are in the response.
+const maxIngestErrors = 10
+
+// IngestHandler accepts a JSON array of {"name": ..., "ts": ...,
+// "value": ...} data points, for clients which cannot speak any of the
+// line protocols. The response is a summary of the points accepted and
+// rejected, a body larger than maxBody bytes (if not 0) is a 413.
+func IngestHandler(t *x.Transceiver, maxBody int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if maxBody > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		}
+
+		var points []ingestPoint
+		if err := json.NewDecoder(r.Body).Decode(&points); err != nil {
+			log.Printf("IngestHandler(): %v", err)
+			if strings.Contains(err.Error(), "request body too large") {
+				http.Error(w, fmt.Sprintf("request body exceeds %d bytes", maxBody), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+
+		var (
+			result ingestResult
+			dps    = make([]*rrd.DataPoint, 0, len(points))
+		)
+		for i, p := range points {
+			dp, err := p.dataPoint()
+			if err != nil {
+				result.Rejected++
+				if len(result.Errors) < maxIngestErrors {
+					result.Errors = append(result.Errors, fmt.Sprintf("%d: %v", i, err))
+				}
+				continue
+			}
+			dps = append(dps, dp)
+			result.Accepted++
+		}
+		t.QueueDataPoints(dps)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func (p *ingestPoint) dataPoint() (*rrd.DataPoint, error) {
+	name := misc.SanitizeName(p.Name)
+	if name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+	if p.Value == nil {
+		return nil, fmt.Errorf("%s: missing value", name)
+	}
+	ts, err := parseIngestTs(p.Ts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return &rrd.DataPoint{Name: name, TimeStamp: ts, Value: *p.Value}, nil
+}
+
+// parseIngestTs parses integer seconds since the epoch or an RFC3339
+// string.
+func parseIngestTs(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 {
+		return time.Time{}, fmt.Errorf("missing ts")
+	}
+	var sec int64
+	if err := json.Unmarshal(raw, &sec); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return time.Time{}, fmt.Errorf("invalid ts %s, expected seconds since the epoch or an RFC3339 time", raw)
+	}
+	ts, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid ts %q: %v", s, err)
+	}
+	return ts, nil
+}
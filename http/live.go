@@ -0,0 +1,89 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	x "github.com/tgres/tgres/transceiver"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Points buffered per /live subscriber, beyond this a slow client
+// misses points.
+const liveBufferSize = 1024
+
+// A data point as sent by /live, ts is seconds since the epoch, value
+// is null for NaN.
+type livePoint struct {
+	Name  string   `json:"name"`
+	Ts    float64  `json:"ts"`
+	Value *float64 `json:"value"`
+}
+
+// LiveHandler streams the incoming data points of the series matching
+// the match parameter (a glob, or a /regexp/) to a websocket as JSON,
+// one message per point, until the client disconnects.
+func LiveHandler(t *x.Transceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		match := r.FormValue("match")
+		if match == "" {
+			http.Error(w, "missing match parameter", http.StatusBadRequest)
+			return
+		}
+		sub, err := t.Subscribe(match, liveBufferSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer t.Unsubscribe(sub)
+
+		websocket.Server{Handler: func(ws *websocket.Conn) {
+			// Not subject to the read/write timeouts of the server,
+			// the socket stays open as long as the client wants.
+			ws.SetDeadline(time.Time{})
+
+			// Nothing is expected from the client, this is only to
+			// know when it goes away.
+			gone := make(chan bool)
+			go func() {
+				io.Copy(ioutil.Discard, ws)
+				close(gone)
+			}()
+			for {
+				select {
+				case dp := <-sub.C:
+					lp := &livePoint{Name: dp.Name, Ts: float64(dp.TimeStamp.UnixNano()) / 1e9}
+					if !math.IsNaN(dp.Value) && !math.IsInf(dp.Value, 0) {
+						lp.Value = &dp.Value
+					}
+					if err := websocket.JSON.Send(ws, lp); err != nil {
+						return
+					}
+				case <-gone:
+					if n := sub.Dropped(); n > 0 {
+						log.Printf("LiveHandler(): %s: %d points dropped for a slow client (%q)", r.RemoteAddr, n, match)
+					}
+					return
+				}
+			}
+		}}.ServeHTTP(w, r)
+	}
+}
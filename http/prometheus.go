@@ -0,0 +1,78 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"fmt"
+	"github.com/tgres/tgres/prometheus"
+	"github.com/tgres/tgres/rrd"
+	x "github.com/tgres/tgres/transceiver"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// PrometheusWriteHandler accepts Prometheus remote write requests at
+// /api/v1/write. A series is named after its __name__ label, the
+// other labels become tags (see transceiver.TaggedName). NaN samples
+// (which include the staleness markers) are dropped. A body larger
+// than maxBody bytes (if not 0) is a 413.
+func PrometheusWriteHandler(t *x.Transceiver, maxBody int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if maxBody > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("PrometheusWriteHandler(): %v", err)
+			if strings.Contains(err.Error(), "request body too large") {
+				http.Error(w, fmt.Sprintf("request body exceeds %d bytes", maxBody), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		series, err := prometheus.ParseWriteRequest(body)
+		if err != nil {
+			log.Printf("PrometheusWriteHandler(): %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var dps []*rrd.DataPoint
+		for _, ts := range series {
+			name := ts.Labels["__name__"]
+			if name == "" {
+				continue
+			}
+			delete(ts.Labels, "__name__")
+			name = x.TaggedName(name, ts.Labels)
+			for _, s := range ts.Samples {
+				if !math.IsNaN(s.Value) {
+					dps = append(dps, &rrd.DataPoint{Name: name, TimeStamp: s.TimeStamp, Value: s.Value})
+				}
+			}
+		}
+		t.QueueDataPoints(dps)
+	}
+}
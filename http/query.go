@@ -0,0 +1,112 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	x "github.com/tgres/tgres/transceiver"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A query is a batch of render targets sharing a time range, e.g.:
+// {"targets": ["foo.*.bar", "sumSeries(baz.*)"], "from": "-1h", "until": "now", "maxDataPoints": 100}
+type query struct {
+	Targets       []string `json:"targets"`
+	From          string   `json:"from"`
+	Until         string   `json:"until"`
+	MaxDataPoints int64    `json:"maxDataPoints"`
+}
+
+// QueryHandler is a combined find and render, it resolves every
+// target (globs and all) and returns all the matching series in a
+// single response, in the same form as the render JSON output. This
+// saves a dashboard a round trip per panel. A target matching more
+// than maxSeries (if not 0) series is a 400.
+func QueryHandler(t *x.Transceiver, maxSeries int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var q query
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			log.Printf("QueryHandler(): %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		from, err := parseTime(q.From)
+		if err != nil {
+			log.Printf("QueryHandler(): (from) %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if from == nil {
+			tmp := time.Now().Add(-24 * time.Hour) // Graphite default
+			from = &tmp
+		}
+		to, err := parseTime(q.Until)
+		if err != nil {
+			log.Printf("QueryHandler(): (until) %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if to == nil {
+			tmp := time.Now()
+			to = &tmp
+		}
+
+		for _, target := range q.Targets {
+			if err := checkMaxSeries(r.Context(), t, target, maxSeries); err != nil {
+				log.Printf("QueryHandler(): %v", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "[")
+
+		n := 0
+		for _, target := range q.Targets {
+
+			seriesMap, err := processTarget(r.Context(), t, target, from.Unix(), to.Unix(), q.MaxDataPoints, maxSeries)
+			if err != nil {
+				log.Printf("QueryHandler(): %v", err)
+				continue // skip this target, but return the others
+			}
+
+			for _, name := range seriesMap.SortedKeys() {
+				series := seriesMap[name]
+				if alias := series.Alias(); alias != "" {
+					name = alias
+				}
+				if n > 0 {
+					fmt.Fprintf(w, ",")
+				}
+				fmt.Fprintf(w, "\n"+`{"target": "%s", "datapoints": [`+"\n", name)
+				writeDatapoints(w, seriesPoints(series))
+				fmt.Fprintf(w, "]}")
+				series.Close()
+				n++
+			}
+		}
+		fmt.Fprintf(w, "]\n")
+	}
+}
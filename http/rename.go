@@ -0,0 +1,61 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	x "github.com/tgres/tgres/transceiver"
+	"log"
+	"net/http"
+)
+
+// RenameSeriesHandler renames the series from to to, keeping its
+// history, e.g.: POST /rename with from=servers.web1.cpu and
+// to=servers.web1.cpu.total. If to exists, existing decides. A from
+// that doesn't exist is a 404, a to that exists (and existing is
+// RenameExistingFail) a 409.
+func RenameSeriesHandler(t *x.Transceiver, existing x.RenameExisting) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		from, to := r.FormValue("from"), r.FormValue("to")
+		if from == "" || to == "" {
+			log.Printf("RenameSeriesHandler(): from and to are required")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch err := t.RenameSeries(from, to, existing); err {
+		case nil:
+		case x.ErrNoSuchSeries:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case x.ErrSeriesExists:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			log.Printf("RenameSeriesHandler(): %q to %q: %v", from, to, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"from": from, "to": to})
+	}
+}
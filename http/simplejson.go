@@ -0,0 +1,158 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	x "github.com/tgres/tgres/transceiver"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The Grafana SimpleJSON datasource contract (see
+// https://github.com/grafana/simple-json-datasource), for Grafana to
+// query tgres as itself rather than as graphite-web. Grafana appends
+// the paths below to the datasource URL, the handlers are meant to be
+// mounted under a prefix of their own (e.g. /simplejson/).
+
+// SimpleJSONTestHandler is the "/" of the contract, Grafana's "Save &
+// Test" only wants a 200.
+func SimpleJSONTestHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "OK\n")
+	}
+}
+
+// A SimpleJSON search, e.g.: {"target": "foo.*"}
+type simpleJSONSearch struct {
+	Target string `json:"target"`
+}
+
+// SimpleJSONSearchHandler returns the names matching the target (a
+// graphite glob, all of the top level if blank) as a JSON array.
+func SimpleJSONSearchHandler(t *x.Transceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var s simpleJSONSearch
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			log.Printf("SimpleJSONSearchHandler(): %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if s.Target == "" {
+			s.Target = "*"
+		}
+
+		names := []string{}
+		for _, node := range t.FsFind(s.Target) {
+			names = append(names, node.Name)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(names)
+	}
+}
+
+// A SimpleJSON query (only what we use of it), e.g.: {"range":
+// {"from": "2016-10-31T06:33:44.866Z", "to": "2016-10-31T12:33:44.866Z"},
+// "maxDataPoints": 550, "targets": [{"target": "foo.*", "refId": "A"}]}
+type simpleJSONQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	MaxDataPoints int64 `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+		Hide   bool   `json:"hide"`
+	} `json:"targets"`
+}
+
+// SimpleJSONQueryHandler resolves every target (any render target
+// goes) over the range and returns the series as timeseries, i.e.
+// with [value, ms-timestamp] datapoints.
+func SimpleJSONQueryHandler(t *x.Transceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var q simpleJSONQuery
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			log.Printf("SimpleJSONQueryHandler(): %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		from, to := q.Range.From, q.Range.To
+		if to.IsZero() {
+			to = time.Now()
+		}
+		if from.IsZero() {
+			from = to.Add(-24 * time.Hour)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, "[")
+
+		n := 0
+		for _, target := range q.Targets {
+			if target.Hide || target.Target == "" {
+				continue
+			}
+
+			seriesMap, err := processTarget(r.Context(), t, target.Target, from.Unix(), to.Unix(), q.MaxDataPoints, 0)
+			if err != nil {
+				log.Printf("SimpleJSONQueryHandler(): %v", err)
+				continue // skip this target, but return the others
+			}
+
+			for _, name := range seriesMap.SortedKeys() {
+				series := seriesMap[name]
+				if alias := series.Alias(); alias != "" {
+					name = alias
+				}
+				if n > 0 {
+					fmt.Fprintf(w, ",")
+				}
+				jname, _ := json.Marshal(name)
+				fmt.Fprintf(w, "\n"+`{"target": %s, "datapoints": [`+"\n", jname)
+				writeDatapoints(w, seriesPointsMs(series))
+				fmt.Fprintf(w, "]}")
+				series.Close()
+				n++
+			}
+		}
+		fmt.Fprintf(w, "]\n")
+	}
+}
+
+// seriesPointsMs are like seriesPoints, but in milliseconds.
+func seriesPointsMs(series rrd.Series) datapoints {
+	return func(fn func(float64, int64)) {
+		seriesPoints(series)(func(value float64, ts int64) {
+			fn(value, ts*1000)
+		})
+	}
+}
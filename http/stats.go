@@ -0,0 +1,87 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	x "github.com/tgres/tgres/transceiver"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+func StatsHandler(t *x.Transceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(t.Stats()); err != nil {
+			log.Printf("StatsHandler(): %v", err)
+		}
+	}
+}
+
+// MetricsHandler presents the same information as StatsHandler in
+// the Prometheus text exposition format. Every numeric field of
+// x.Stats becomes a gauge named after its JSON key, converted to
+// snake case and prefixed with "tgres_", e.g. oldestDirtyPointAge
+// becomes tgres_oldest_dirty_point_age.
+func MetricsHandler(t *x.Transceiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		v := reflect.ValueOf(t.Stats()).Elem()
+		for i := 0; i < v.NumField(); i++ {
+			var value float64
+			switch f := v.Field(i); f.Kind() {
+			case reflect.Float32, reflect.Float64:
+				value = f.Float()
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				value = float64(f.Int())
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				value = float64(f.Uint())
+			default:
+				continue
+			}
+			tag := v.Type().Field(i).Tag.Get("json")
+			if tag == "" || tag == "-" {
+				continue
+			}
+			name := "tgres_" + snakeCase(strings.Split(tag, ",")[0])
+			fmt.Fprintf(w, "# TYPE %s gauge\n%s %v\n", name, name, value)
+		}
+	}
+}
+
+func HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "OK\n")
+	}
+}
+
+func snakeCase(s string) string {
+	var result []rune
+	for i, c := range s {
+		if unicode.IsUpper(c) {
+			if i > 0 {
+				result = append(result, '_')
+			}
+			c = unicode.ToLower(c)
+		}
+		result = append(result, c)
+	}
+	return string(result)
+}
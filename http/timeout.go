@@ -0,0 +1,134 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// QueryTimeoutHandler runs handler with a request context that is
+// done after timeout, which cancels the storage queries. The response
+// is buffered, and if the handler hasn't finished in time the client
+// gets a 504 instead. A handler which flushes (e.g. a streaming
+// render) gets its response sent as it goes, and if it then times out
+// the response is merely cut short. A zero timeout means no timeout.
+func QueryTimeoutHandler(handler http.HandlerFunc, timeout time.Duration) http.HandlerFunc {
+	if timeout == 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, header: make(http.Header)}
+		done, panicked := make(chan struct{}), make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			handler(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p) // in the server's goroutine, which logs it
+		case <-done:
+			tw.Lock()
+			defer tw.Unlock()
+			tw.writeHeader()
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.Lock()
+			defer tw.Unlock()
+			tw.timedOut = true
+			log.Printf("QueryTimeoutHandler(): %s timed out after %v", r.URL.Path, timeout)
+			if !tw.wroteHeader {
+				w.WriteHeader(http.StatusGatewayTimeout)
+			}
+		}
+	}
+}
+
+type timeoutWriter struct {
+	sync.Mutex
+	w           http.ResponseWriter
+	header      http.Header
+	buf         bytes.Buffer
+	code        int
+	timedOut    bool
+	wroteHeader bool // to w, i.e. it's too late for a 504
+}
+
+// writeHeader sends the header to w unless already sent, the lock
+// must be held.
+func (tw *timeoutWriter) writeHeader() {
+	if tw.wroteHeader {
+		return
+	}
+	for k, v := range tw.header {
+		tw.w.Header()[k] = v
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+	tw.w.WriteHeader(tw.code)
+	tw.wroteHeader = true
+}
+
+// Flush sends what has been buffered so far to the client.
+func (tw *timeoutWriter) Flush() {
+	tw.Lock()
+	defer tw.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeader()
+	tw.w.Write(tw.buf.Bytes())
+	tw.buf.Reset()
+	if f, ok := tw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.Lock()
+	defer tw.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+	return tw.buf.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.Lock()
+	defer tw.Unlock()
+	if !tw.timedOut && tw.code == 0 {
+		tw.code = code
+	}
+}
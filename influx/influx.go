@@ -0,0 +1,196 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package influx parses the InfluxDB line protocol, e.g.
+//
+//	cpu,host=web1,region=us usage_idle=98.5,usage_user=1i 1465839830100400200
+//
+// See https://docs.influxdata.com/influxdb/v1/write_protocols/line_protocol_reference/
+package influx
+
+import (
+	"fmt"
+	"github.com/tgres/tgres/misc"
+	"github.com/tgres/tgres/rrd"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseLine parses one line into a data point per numeric field
+// named measurement.field followed by the tags (sorted by key) as
+// .key.value. String fields are ignored, booleans are 1 or 0. The
+// timestamp is in units of precision (nanoseconds usually), now is
+// used if there is none. An empty or comment line yields nothing.
+func ParseLine(line string, precision time.Duration, now time.Time) ([]*rrd.DataPoint, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	var parts []string
+	for _, p := range split(line, ' ', true) {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("expected measurement, fields and an optional timestamp: %q", line)
+	}
+
+	key := split(parts[0], ',', false)
+	name := nameSegment(key[0])
+	if name == "" {
+		return nil, fmt.Errorf("missing measurement: %q", line)
+	}
+	tags := key[1:]
+	sort.Strings(tags)
+	var suffix string
+	for _, tag := range tags {
+		kv := split(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid tag %q: %q", tag, line)
+		}
+		suffix += "." + nameSegment(kv[0]) + "." + nameSegment(kv[1])
+	}
+
+	ts := now
+	if len(parts) == 3 {
+		n, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q: %q", parts[2], line)
+		}
+		ts = time.Unix(0, n*int64(precision))
+	}
+
+	var dps []*rrd.DataPoint
+	for _, field := range split(parts[1], ',', true) {
+		kv := splitN2(field)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid field %q: %q", field, line)
+		}
+		v, numeric, err := fieldValue(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid field %q: %v: %q", field, err, line)
+		}
+		if numeric {
+			dps = append(dps, &rrd.DataPoint{
+				Name:      misc.SanitizeName(name + "." + nameSegment(kv[0]) + suffix),
+				TimeStamp: ts,
+				Value:     v,
+			})
+		}
+	}
+	return dps, nil
+}
+
+// fieldValue parses a field value, numeric is false for a string.
+func fieldValue(s string) (v float64, numeric bool, err error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+			return 0, false, fmt.Errorf("unterminated string")
+		}
+		return 0, false, nil
+	}
+	if strings.HasSuffix(s, "i") || strings.HasSuffix(s, "u") {
+		s = s[:len(s)-1]
+	}
+	v, err = strconv.ParseFloat(s, 64)
+	return v, true, err
+}
+
+// nameSegment unescapes s and replaces dots, which would otherwise
+// add levels to the series name.
+func nameSegment(s string) string {
+	return strings.Replace(unescape(s), ".", "_", -1)
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// split splits s on sep unless it is escaped with a backslash or (if
+// quotes) inside double quotes.
+func split(s string, sep byte, quotes bool) []string {
+	var (
+		result  []string
+		start   int
+		escaped bool
+		quoted  bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, s[start:])
+}
+
+// splitN2 splits a field at the first unescaped "=".
+func splitN2(field string) []string {
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' {
+			i++
+		} else if field[i] == '=' {
+			return []string{field[:i], field[i+1:]}
+		}
+	}
+	return []string{field}
+}
+
+// Precision returns the timestamp unit of an InfluxDB precision
+// parameter, e.g. "ms", blank meaning nanoseconds.
+func Precision(s string) (time.Duration, error) {
+	switch s {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid precision %q", s)
+}
@@ -0,0 +1,50 @@
+package influx
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	now := time.Unix(1000, 0)
+	for _, c := range []struct {
+		line   string
+		names  []string
+		values []float64
+		ts     time.Time
+	}{
+		{"cpu,region=us,host=web1 usage_idle=98.5,usage_user=1i 1465839830100400200",
+			[]string{"cpu.usage_idle.host.web1.region.us", "cpu.usage_user.host.web1.region.us"},
+			[]float64{98.5, 1}, time.Unix(0, 1465839830100400200)},
+		{`disk\ io,path=/var\,log ok=true,msg="a, b=c d",n=7u`,
+			[]string{"disk_io.ok.path.-varlog", "disk_io.n.path.-varlog"},
+			[]float64{1, 7}, now},
+		{"mem,host=a.example.com used=1e3", []string{"mem.used.host.a_example_com"}, []float64{1000}, now},
+		{"# comment", nil, nil, now},
+	} {
+		dps, err := ParseLine(c.line, time.Nanosecond, now)
+		if err != nil {
+			t.Errorf("%q: %v", c.line, err)
+			continue
+		}
+		if len(dps) != len(c.names) {
+			t.Errorf("%q: expected %d points, got %d", c.line, len(c.names), len(dps))
+			continue
+		}
+		for i, dp := range dps {
+			if dp.Name != c.names[i] || dp.Value != c.values[i] || !dp.TimeStamp.Equal(c.ts) {
+				t.Errorf("%q: expected %s %v %v, got %s %v %v", c.line, c.names[i], c.values[i], c.ts, dp.Name, dp.Value, dp.TimeStamp)
+			}
+		}
+	}
+
+	for _, line := range []string{"cpu", "cpu value=x", "cpu,host value=1", "cpu value=1 yesterday", `cpu msg="unterminated`} {
+		if _, err := ParseLine(line, time.Nanosecond, now); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+
+	if dps, _ := ParseLine("cpu value=1 1465839830", time.Second, now); !dps[0].TimeStamp.Equal(time.Unix(1465839830, 0)) {
+		t.Errorf("expected precision to be applied, got %v", dps[0].TimeStamp)
+	}
+}
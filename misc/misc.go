@@ -50,12 +50,14 @@ func BetterParseDuration(s string) (time.Duration, error) {
 	}
 	if d, err := time.ParseDuration(s); err != nil {
 		if strings.HasPrefix(err.Error(), "time: unknown unit ") {
+			// (newer Go versions quote the unit in the error)
 			d, _ := strconv.ParseInt(s[0:len(s)-1], 10, 64)
-			if strings.HasPrefix(err.Error(), "time: unknown unit d in") {
+			unit := strings.Trim(strings.Fields(err.Error())[3], `"`)
+			if unit == "d" {
 				return time.Duration(d*24) * time.Hour, nil
-			} else if strings.HasPrefix(err.Error(), "time: unknown unit w in") {
+			} else if unit == "w" {
 				return time.Duration(d*168) * time.Hour, nil
-			} else if strings.HasPrefix(err.Error(), "time: unknown unit y in") {
+			} else if unit == "y" {
 				return time.Duration(d*8760) * time.Hour, nil
 			}
 		}
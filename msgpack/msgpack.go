@@ -0,0 +1,247 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package msgpack is just enough MessagePack (see
+// https://github.com/msgpack/msgpack/blob/master/spec.md) to carry
+// graphite pickle style batches, i.e. [(name, (timestamp, value)), ...].
+// Values decode to the same types as they do from a pickle (see
+// stalecucumber): arrays to []interface{}, str and bin to string,
+// integers to int64 and floats to float64.
+package msgpack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Unmarshal decodes the single object in buf. Maps and extension
+// types are not supported.
+func Unmarshal(buf []byte) (interface{}, error) {
+	d := &decoder{buf: buf}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(buf) {
+		return nil, fmt.Errorf("%d trailing bytes", len(buf)-d.pos)
+	}
+	return v, nil
+}
+
+// Nesting deeper than this is surely garbage, e.g. a run of 0x91 bytes.
+const maxDepth = 32
+
+type decoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.buf)-d.pos {
+		return nil, fmt.Errorf("truncated at offset %d", d.pos)
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of n (1, 2, 4 or 8) bytes.
+func (d *decoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (d *decoder) decode(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("nested more than %d deep", maxDepth)
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	switch c := b[0]; {
+	case c <= 0x7f: // positive fixint
+		return int64(c), nil
+	case c >= 0xe0: // negative fixint
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0: // fixstr
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90: // fixarray
+		return d.array(int(c&0x0f), depth)
+	case c == 0xc0:
+		return nil, nil
+	case c == 0xc2:
+		return false, nil
+	case c == 0xc3:
+		return true, nil
+	case c == 0xc4 || c == 0xd9: // bin8, str8
+		return d.lenStr(1)
+	case c == 0xc5 || c == 0xda: // bin16, str16
+		return d.lenStr(2)
+	case c == 0xc6 || c == 0xdb: // bin32, str32
+		return d.lenStr(4)
+	case c == 0xca:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case c == 0xcb:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case c >= 0xcc && c <= 0xcf: // uint8 - uint64
+		v, err := d.uint(1 << (c - 0xcc))
+		if err == nil && v > math.MaxInt64 {
+			return nil, fmt.Errorf("uint64 %d out of range", v)
+		}
+		return int64(v), err
+	case c == 0xd0:
+		v, err := d.uint(1)
+		return int64(int8(v)), err
+	case c == 0xd1:
+		v, err := d.uint(2)
+		return int64(int16(v)), err
+	case c == 0xd2:
+		v, err := d.uint(4)
+		return int64(int32(v)), err
+	case c == 0xd3:
+		v, err := d.uint(8)
+		return int64(v), err
+	case c == 0xdc:
+		n, err := d.uint(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case c == 0xdd:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	default:
+		return nil, fmt.Errorf("unsupported type 0x%02x at offset %d", c, d.pos-1)
+	}
+}
+
+func (d *decoder) str(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *decoder) lenStr(size int) (interface{}, error) {
+	n, err := d.uint(size)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(d.buf)-d.pos) {
+		return nil, fmt.Errorf("truncated at offset %d", d.pos)
+	}
+	return d.str(int(n))
+}
+
+func (d *decoder) array(n int, depth int) (interface{}, error) {
+	// Every element is at least one byte, which keeps a bogus length
+	// from allocating a huge slice.
+	if n > len(d.buf)-d.pos {
+		return nil, fmt.Errorf("truncated at offset %d", d.pos)
+	}
+	result := make([]interface{}, n)
+	for i := range result {
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+// Marshal encodes v, which may be made of []interface{}, string,
+// int, int64, float64, bool and nil.
+func Marshal(v interface{}) ([]byte, error) {
+	return appendValue(nil, v)
+}
+
+func appendValue(b []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if x {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case int:
+		return appendInt(b, int64(x)), nil
+	case int64:
+		return appendInt(b, x), nil
+	case float64:
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(x)), nil
+	case string:
+		switch n := len(x); {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+		}
+		return append(b, x...), nil
+	case []interface{}:
+		switch n := len(x); {
+		case n < 16:
+			b = append(b, 0x90|byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+		}
+		var err error
+		for _, item := range x {
+			if b, err = appendValue(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("cannot encode %T", v)
+}
+
+func appendInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		return append(b, byte(v))
+	case v < 0 && v >= -32:
+		return append(b, byte(int8(v)))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(int32(v)))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+}
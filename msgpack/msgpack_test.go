@@ -0,0 +1,64 @@
+package msgpack
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	items := make([]interface{}, 20)
+	for i := range items {
+		items[i] = []interface{}{"foo.bar", []interface{}{int64(1476123456), float64(i) / 2}}
+	}
+	for _, v := range []interface{}{
+		nil, true, false, int64(0), int64(127), int64(-32), int64(-33), int64(1 << 40),
+		int64(math.MinInt64), 42.5, "", "foo", long, items,
+	} {
+		b, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal(%v): %v", v, err)
+		}
+		got, err := Unmarshal(b)
+		if err != nil {
+			t.Fatalf("Unmarshal(%x): %v", b, err)
+		}
+		if !reflect.DeepEqual(got, v) {
+			t.Errorf("expected %v, got %v", v, got)
+		}
+	}
+
+	// What other encoders produce: uint, int8, float32, bin8
+	for _, c := range []struct {
+		b    []byte
+		want interface{}
+	}{
+		{[]byte{0xcd, 0x01, 0x00}, int64(256)},
+		{[]byte{0xd0, 0xff}, int64(-1)},
+		{[]byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, 1.5},
+		{[]byte{0xc4, 0x02, 'h', 'i'}, "hi"},
+	} {
+		if got, err := Unmarshal(c.b); err != nil || got != c.want {
+			t.Errorf("%x: expected %v, got %v %v", c.b, c.want, got, err)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	for _, b := range [][]byte{
+		{},
+		{0x92, 0x01},                   // truncated array
+		{0xdd, 0xff, 0xff, 0xff, 0xff}, // huge array
+		{0xa5, 'a'},                    // truncated str
+		{0x81, 0x01, 0x02},             // map
+		{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0x01, 0x02}, // trailing
+		[]byte(strings.Repeat("\x91", 100) + "\x01"),
+	} {
+		if _, err := Unmarshal(b); err == nil {
+			t.Errorf("%x: expected an error", b)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prometheus decodes the Prometheus remote write protocol,
+// i.e. a snappy compressed protobuf WriteRequest. See
+// https://prometheus.io/docs/concepts/remote_write_spec/
+package prometheus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// A TimeSeries is the labels (including __name__) and the samples of
+// one series.
+type TimeSeries struct {
+	Labels  map[string]string
+	Samples []Sample
+}
+
+// A Sample is a value at a time (in milliseconds on the wire).
+type Sample struct {
+	Value     float64
+	TimeStamp time.Time
+}
+
+// ParseWriteRequest decompresses and decodes a WriteRequest. Fields
+// other than the labels and samples (e.g. metadata) are ignored.
+func ParseWriteRequest(body []byte) ([]*TimeSeries, error) {
+	buf, err := snappyDecode(body)
+	if err != nil {
+		return nil, fmt.Errorf("snappy: %v", err)
+	}
+
+	var result []*TimeSeries
+	err = walkFields(buf, func(num int, typ int, v uint64, b []byte) error {
+		if num == 1 && typ == wireBytes {
+			ts, err := parseTimeSeries(b)
+			if err != nil {
+				return err
+			}
+			result = append(result, ts)
+		}
+		return nil
+	})
+	return result, err
+}
+
+//	message TimeSeries {
+//	  repeated Label labels = 1;
+//	  repeated Sample samples = 2;
+//	}
+func parseTimeSeries(buf []byte) (*TimeSeries, error) {
+	ts := &TimeSeries{Labels: make(map[string]string)}
+	err := walkFields(buf, func(num int, typ int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && typ == wireBytes:
+			name, value, err := parseLabel(b)
+			if err != nil {
+				return err
+			}
+			ts.Labels[name] = value
+		case num == 2 && typ == wireBytes:
+			s, err := parseSample(b)
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+		return nil
+	})
+	return ts, err
+}
+
+//	message Label {
+//	  string name  = 1;
+//	  string value = 2;
+//	}
+func parseLabel(buf []byte) (name, value string, err error) {
+	err = walkFields(buf, func(num int, typ int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && typ == wireBytes:
+			name = string(b)
+		case num == 2 && typ == wireBytes:
+			value = string(b)
+		}
+		return nil
+	})
+	return name, value, err
+}
+
+//	message Sample {
+//	  double value    = 1;
+//	  int64 timestamp = 2; // milliseconds
+//	}
+func parseSample(buf []byte) (s Sample, err error) {
+	var ms int64
+	err = walkFields(buf, func(num int, typ int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && typ == wireFixed64:
+			s.Value = math.Float64frombits(v)
+		case num == 2 && typ == wireVarint:
+			ms = int64(v)
+		}
+		return nil
+	})
+	s.TimeStamp = time.Unix(0, ms*int64(time.Millisecond))
+	return s, err
+}
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// walkFields calls f for every field of a protobuf message, v is the
+// value of varint and fixed fields, b of length delimited ones.
+func walkFields(buf []byte, f func(num int, typ int, v uint64, b []byte) error) error {
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		buf = buf[n:]
+		num, typ := int(key>>3), int(key&7)
+
+		var (
+			v uint64
+			b []byte
+		)
+		switch typ {
+		case wireVarint:
+			if v, n = binary.Uvarint(buf); n <= 0 {
+				return fmt.Errorf("field %d: invalid varint", num)
+			}
+			buf = buf[n:]
+		case wireFixed64:
+			if len(buf) < 8 {
+				return fmt.Errorf("field %d: truncated", num)
+			}
+			v, buf = binary.LittleEndian.Uint64(buf), buf[8:]
+		case wireFixed32:
+			if len(buf) < 4 {
+				return fmt.Errorf("field %d: truncated", num)
+			}
+			v, buf = uint64(binary.LittleEndian.Uint32(buf)), buf[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(buf)
+			if n <= 0 || l > uint64(len(buf)-n) {
+				return fmt.Errorf("field %d: invalid length", num)
+			}
+			b, buf = buf[n:n+int(l)], buf[n+int(l):]
+		default:
+			return fmt.Errorf("field %d: unsupported wire type %d", num, typ)
+		}
+
+		if err := f(num, typ, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// Just enough protobuf and snappy encoding to make a WriteRequest.
+
+func field(num int, b []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(num<<3|wireBytes))
+	out = binary.AppendUvarint(out, uint64(len(b)))
+	return append(out, b...)
+}
+
+func label(name, value string) []byte {
+	return field(1, append(field(1, []byte(name)), field(2, []byte(value))...))
+}
+
+func sample(v float64, ms int64) []byte {
+	b := binary.AppendUvarint(nil, 1<<3|wireFixed64)
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	b = binary.AppendUvarint(b, 2<<3|wireVarint)
+	b = binary.AppendUvarint(b, uint64(ms))
+	return field(2, b)
+}
+
+// snappyLiteral encodes src as a single literal (no compression).
+func snappyLiteral(src []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(len(src)))
+	if n := len(src) - 1; n < 60 {
+		out = append(out, byte(n<<2))
+	} else {
+		out = append(out, 61<<2, byte(n), byte(n>>8))
+	}
+	return append(out, src...)
+}
+
+func TestParseWriteRequest(t *testing.T) {
+	var ts []byte
+	ts = append(ts, label("__name__", "http_requests_total")...)
+	ts = append(ts, label("job", "api")...)
+	ts = append(ts, sample(42, 1476123456789)...)
+	ts = append(ts, sample(math.NaN(), 1476123466789)...)
+	req := append(field(1, ts), field(3, []byte("metadata is ignored"))...)
+
+	series, err := ParseWriteRequest(snappyLiteral(req))
+	if err != nil {
+		t.Fatalf("ParseWriteRequest(): %v", err)
+	}
+	if len(series) != 1 || series[0].Labels["__name__"] != "http_requests_total" || series[0].Labels["job"] != "api" {
+		t.Fatalf("expected http_requests_total{job=api}, got %v", series)
+	}
+	if s := series[0].Samples; len(s) != 2 || s[0].Value != 42 || s[0].TimeStamp.UnixNano() != 1476123456789000000 || !math.IsNaN(s[1].Value) {
+		t.Errorf("expected 42 at 1476123456.789 and a NaN, got %v", s)
+	}
+
+	if _, err := ParseWriteRequest([]byte("not snappy")); err == nil {
+		t.Errorf("expected an error for garbage")
+	}
+	if _, err := ParseWriteRequest(snappyLiteral(req[:len(req)-3])); err == nil {
+		t.Errorf("expected an error for a truncated message")
+	}
+}
+
+func TestSnappyDecode(t *testing.T) {
+	// "abcd" then a copy of 8 bytes at offset 4 (1 byte offset form)
+	if b, err := snappyDecode([]byte{12, 3 << 2, 'a', 'b', 'c', 'd', 1 | (8-4)<<2, 4}); err != nil || string(b) != "abcdabcdabcd" {
+		t.Errorf("expected abcdabcdabcd, got %q (%v)", b, err)
+	}
+	// a copy beyond what has been decoded
+	if _, err := snappyDecode([]byte{8, 0, 'a', 1 | 3<<2, 2}); err == nil {
+		t.Errorf("expected an error for a bad offset")
+	}
+}
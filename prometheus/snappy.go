@@ -0,0 +1,110 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The largest uncompressed body we accept, Prometheus sends far
+// smaller batches than this.
+const maxDecodedLen = 64 << 20
+
+// snappyDecode decodes the snappy block format (not the framed
+// stream format), which is what remote write uses. See
+// https://github.com/google/snappy/blob/main/format_description.txt
+func snappyDecode(src []byte) ([]byte, error) {
+	dlen, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid length")
+	}
+	if dlen > maxDecodedLen {
+		return nil, fmt.Errorf("decoded length %d exceeds %d", dlen, maxDecodedLen)
+	}
+	src = src[n:]
+	dst := make([]byte, 0, dlen)
+
+	for len(src) > 0 {
+		tag := src[0]
+		src = src[1:]
+
+		var length, offset int
+		switch tag & 3 {
+		case 0: // literal
+			length = int(tag >> 2)
+			if length >= 60 {
+				extra := length - 59 // the length is in the next 1 to 4 bytes
+				if len(src) < extra {
+					return nil, fmt.Errorf("truncated literal")
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if length <= 0 || length > len(src) {
+				return nil, fmt.Errorf("truncated literal")
+			}
+			if uint64(len(dst)+length) > dlen {
+				return nil, fmt.Errorf("decoded data exceeds its length %d", dlen)
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1: // copy with a 1 byte offset
+			if len(src) < 1 {
+				return nil, fmt.Errorf("truncated copy")
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag>>5)<<8 | int(src[0])
+			src = src[1:]
+		case 2: // copy with a 2 byte offset
+			if len(src) < 2 {
+				return nil, fmt.Errorf("truncated copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src))
+			src = src[2:]
+		case 3: // copy with a 4 byte offset
+			if len(src) < 4 {
+				return nil, fmt.Errorf("truncated copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src))
+			src = src[4:]
+		}
+
+		if offset <= 0 || offset > len(dst) {
+			return nil, fmt.Errorf("invalid copy offset %d", offset)
+		}
+		if uint64(len(dst)+length) > dlen {
+			return nil, fmt.Errorf("decoded data exceeds its length %d", dlen)
+		}
+		// The copy may overlap what it appends, hence byte by byte.
+		for start := len(dst) - offset; length > 0; length-- {
+			dst = append(dst, dst[start])
+			start++
+		}
+	}
+
+	if uint64(len(dst)) != dlen {
+		return nil, fmt.Errorf("decoded %d bytes, expected %d", len(dst), dlen)
+	}
+	return dst, nil
+}
@@ -0,0 +1,210 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package protobuf is a compact binary ingest protocol: a TCP stream
+// of length delimited (by a varint, i.e. as written by protobuf's
+// writeDelimitedTo) DataPointBatch messages.
+//
+//	message DataPointBatch {
+//	  message Sample {
+//	    string name  = 1;
+//	    int64 ts     = 2; // milliseconds
+//	    double value = 3;
+//	  }
+//	  repeated Sample samples = 1;
+//	}
+package protobuf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// MaxBatchSize is the largest message ReadBatch accepts.
+const MaxBatchSize = 16 << 20
+
+// A Sample is the value of a series at a time.
+type Sample struct {
+	Name      string
+	TimeStamp time.Time
+	Value     float64
+}
+
+// Marshal encodes samples as a DataPointBatch.
+func Marshal(samples []Sample) []byte {
+	var buf, s []byte
+	for _, sample := range samples {
+		s = appendKey(s[:0], 1, wireBytes)
+		s = binary.AppendUvarint(s, uint64(len(sample.Name)))
+		s = append(s, sample.Name...)
+		s = appendKey(s, 2, wireVarint)
+		s = binary.AppendUvarint(s, uint64(sample.TimeStamp.UnixNano()/int64(time.Millisecond)))
+		s = appendKey(s, 3, wireFixed64)
+		s = binary.LittleEndian.AppendUint64(s, math.Float64bits(sample.Value))
+
+		buf = appendKey(buf, 1, wireBytes)
+		buf = binary.AppendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+// Unmarshal decodes a DataPointBatch. Unknown fields are ignored.
+func Unmarshal(buf []byte) ([]Sample, error) {
+	var result []Sample
+	err := walkFields(buf, func(num int, typ int, v uint64, b []byte) error {
+		if num == 1 && typ == wireBytes {
+			s, err := parseSample(b)
+			if err != nil {
+				return err
+			}
+			result = append(result, s)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func parseSample(buf []byte) (s Sample, err error) {
+	var ms int64
+	err = walkFields(buf, func(num int, typ int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && typ == wireBytes:
+			s.Name = string(b)
+		case num == 2 && typ == wireVarint:
+			ms = int64(v)
+		case num == 3 && typ == wireFixed64:
+			s.Value = math.Float64frombits(v)
+		}
+		return nil
+	})
+	s.TimeStamp = time.Unix(0, ms*int64(time.Millisecond))
+	return s, err
+}
+
+// WriteBatch writes samples as one length delimited message.
+func WriteBatch(w io.Writer, samples []Sample) error {
+	msg := Marshal(samples)
+	_, err := w.Write(append(binary.AppendUvarint(nil, uint64(len(msg))), msg...))
+	return err
+}
+
+// ReadBatch reads one length delimited message. It returns io.EOF if
+// there are no more messages.
+func ReadBatch(r *bufio.Reader) ([]Sample, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if l > MaxBatchSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds %d", l, MaxBatchSize)
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return Unmarshal(buf)
+}
+
+// A Client sends batches to a tgres protobuf listener.
+type Client struct {
+	conn net.Conn
+}
+
+// Dial connects to a tgres protobuf listener, e.g. "localhost:2005".
+func Dial(address string) (*Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Send sends samples as one batch.
+func (c *Client) Send(samples []Sample) error {
+	return WriteBatch(c.conn, samples)
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendKey(b []byte, num, typ int) []byte {
+	return binary.AppendUvarint(b, uint64(num<<3|typ))
+}
+
+// walkFields calls f for every field of a protobuf message, v is the
+// value of varint and fixed fields, b of length delimited ones.
+func walkFields(buf []byte, f func(num int, typ int, v uint64, b []byte) error) error {
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		buf = buf[n:]
+		num, typ := int(key>>3), int(key&7)
+
+		var (
+			v uint64
+			b []byte
+		)
+		switch typ {
+		case wireVarint:
+			if v, n = binary.Uvarint(buf); n <= 0 {
+				return fmt.Errorf("field %d: invalid varint", num)
+			}
+			buf = buf[n:]
+		case wireFixed64:
+			if len(buf) < 8 {
+				return fmt.Errorf("field %d: truncated", num)
+			}
+			v, buf = binary.LittleEndian.Uint64(buf), buf[8:]
+		case wireFixed32:
+			if len(buf) < 4 {
+				return fmt.Errorf("field %d: truncated", num)
+			}
+			v, buf = uint64(binary.LittleEndian.Uint32(buf)), buf[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(buf)
+			if n <= 0 || l > uint64(len(buf)-n) {
+				return fmt.Errorf("field %d: invalid length", num)
+			}
+			b, buf = buf[n:n+int(l)], buf[n+int(l):]
+		default:
+			return fmt.Errorf("field %d: unsupported wire type %d", num, typ)
+		}
+
+		if err := f(num, typ, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
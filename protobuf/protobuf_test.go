@@ -0,0 +1,81 @@
+package protobuf
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBatchRoundTrip(t *testing.T) {
+	ts := time.Unix(1476123456, 789000000)
+	batch := []Sample{{"foo.bar", ts, 42}, {"foo.baz", ts.Add(time.Second), math.Inf(-1)}}
+
+	var buf bytes.Buffer
+	if err := WriteBatch(&buf, batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteBatch(&buf, batch[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(&buf)
+	got, err := ReadBatch(r)
+	if err != nil {
+		t.Fatalf("ReadBatch(): %v", err)
+	}
+	if len(got) != 2 || got[0].Name != "foo.bar" || !got[0].TimeStamp.Equal(ts) || got[0].Value != 42 || !math.IsInf(got[1].Value, -1) {
+		t.Errorf("expected the batch back, got %v", got)
+	}
+	if got, err = ReadBatch(r); err != nil || len(got) != 1 {
+		t.Errorf("expected the second batch of 1, got %v %v", got, err)
+	}
+	if _, err = ReadBatch(r); err != io.EOF {
+		t.Errorf("expected io.EOF at the end, got %v", err)
+	}
+
+	// A truncated message
+	msg := Marshal(batch)
+	r = bufio.NewReader(bytes.NewReader(append([]byte{byte(len(msg))}, msg[:len(msg)-3]...)))
+	if _, err = ReadBatch(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for a truncated message, got %v", err)
+	}
+	if _, err = Unmarshal([]byte{1<<3 | wireBytes, 100}); err == nil {
+		t.Errorf("expected an error for a bad length")
+	}
+}
+
+func TestClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	result := make(chan []Sample)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(result)
+			return
+		}
+		defer conn.Close()
+		samples, _ := ReadBatch(bufio.NewReader(conn))
+		result <- samples
+	}()
+
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Send([]Sample{{"foo", time.Unix(100, 0), 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if samples := <-result; len(samples) != 1 || samples[0].Name != "foo" || samples[0].TimeStamp.Unix() != 100 {
+		t.Errorf("expected foo at 100, got %v", samples)
+	}
+}
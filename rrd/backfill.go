@@ -0,0 +1,253 @@
+//
+// Copyright 2015 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rrd
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// In backfill mode a DataSource keeps the data points it received
+// (going back as far as its highest resolution RRA, and at least to
+// the beginning of the current slot of every RRA) and every update
+// recomputes the affected RRA slots from them. This way data
+// points can arrive in any order, at the expense of speed.
+
+type backfillPoint struct {
+	ms    int64
+	value float64
+}
+
+func (ds *DataSource) processBackfillDataPoint(dp *DataPoint) error {
+
+	dpTimeStamp := dp.TimeStamp.UnixNano() / 1000000
+	dsLastUpdate := ds.LastUpdate.UnixNano() / 1000000
+
+	if len(ds.backfill) == 0 && dsLastUpdate != 0 {
+		// Data up to LastUpdate is only in the RRAs, we can only
+		// build on it, not recompute it.
+		ds.backfill = []backfillPoint{{dsLastUpdate, ds.LastDs}}
+		ds.backfillFromMs = dsLastUpdate
+	}
+
+	if dpTimeStamp <= ds.backfillFromMs {
+		return fmt.Errorf("Data point time stamp %v is too old to backfill (must be after %v)", dp.TimeStamp, time.Unix(0, ds.backfillFromMs*1000000))
+	}
+
+	if ds.outOfBounds(dp.Value) {
+		dp.Value = math.NaN()
+	}
+
+	i := sort.Search(len(ds.backfill), func(i int) bool { return ds.backfill[i].ms >= dpTimeStamp })
+	if i < len(ds.backfill) && ds.backfill[i].ms == dpTimeStamp {
+		ds.backfill[i].value = dp.Value
+	} else {
+		ds.backfill = append(ds.backfill, backfillPoint{})
+		copy(ds.backfill[i+1:], ds.backfill[i:])
+		ds.backfill[i] = backfillPoint{dpTimeStamp, dp.Value}
+	}
+
+	// Affected are the period this point completes, i.e. from the
+	// previous point, and the period of the next point, which it
+	// now begins.
+	begin, end := dpTimeStamp, dpTimeStamp
+	if i > 0 {
+		begin = ds.backfill[i-1].ms
+	}
+	if i+1 < len(ds.backfill) {
+		end = ds.backfill[i+1].ms
+	}
+
+	if dpTimeStamp > dsLastUpdate {
+		ds.LastUpdate = dp.TimeStamp
+		ds.LastDs = dp.Value
+	}
+
+	// Prune after recomputing, a point may complete a slot whose
+	// points are about to be forgotten.
+	err := ds.recomputeRRAs(begin, end)
+	ds.pruneBackfill()
+	return err
+}
+
+// Forget points older than the highest resolution RRA, but not those
+// of the current (incomplete) slot of any RRA, which will be needed
+// once it is complete. The last point before is kept as the beginning
+// of the first known period.
+func (ds *DataSource) pruneBackfill() {
+	var span int64
+	for _, rra := range ds.RRAs {
+		if rraSpan := ds.StepMs * int64(rra.StepsPerRow) * int64(rra.Size); span == 0 || rraSpan < span {
+			span = rraSpan
+		}
+	}
+	dsLastUpdate := ds.LastUpdate.UnixNano() / 1000000
+	cutoff := dsLastUpdate - span
+	for _, rra := range ds.RRAs {
+		rraStepMs := ds.StepMs * int64(rra.StepsPerRow)
+		if slotBegin := dsLastUpdate / rraStepMs * rraStepMs; slotBegin < cutoff {
+			cutoff = slotBegin
+		}
+	}
+	if i := sort.Search(len(ds.backfill), func(i int) bool { return ds.backfill[i].ms > cutoff }); i > 1 {
+		ds.backfill = ds.backfill[i-1:]
+		ds.backfillFromMs = ds.backfill[0].ms
+	}
+}
+
+// backfillPdp returns the value of the PDP (begin, end] as the time
+// weighted average of the known values within it.
+func (ds *DataSource) backfillPdp(begin, end int64) (float64, bool) {
+	var sum float64
+	var knownMs int64
+	k := sort.Search(len(ds.backfill), func(i int) bool { return ds.backfill[i].ms > begin })
+	if k == 0 {
+		k = 1 // the first point only marks the beginning of a period
+	}
+	for ; k < len(ds.backfill) && ds.backfill[k-1].ms < end; k++ {
+		prev, cur := ds.backfill[k-1], ds.backfill[k]
+		if math.IsNaN(cur.value) || cur.ms-prev.ms > ds.HeartbeatMs {
+			continue
+		}
+		from, to := prev.ms, cur.ms
+		if from < begin {
+			from = begin
+		}
+		if to > end {
+			to = end
+		}
+		sum += cur.value * float64(to-from)
+		knownMs += to - from
+	}
+	if knownMs == 0 {
+		return math.NaN(), false
+	}
+	return sum / float64(knownMs), true
+}
+
+func (ds *DataSource) backfillSlot(rra *RoundRobinArchive, begin, end int64) (float64, error) {
+	var (
+		value     = math.NaN()
+		sum       float64
+		known     int
+		unknownMs int64
+	)
+	for pdpEnd := begin + ds.StepMs; pdpEnd <= end; pdpEnd += ds.StepMs {
+		v, ok := ds.backfillPdp(pdpEnd-ds.StepMs, pdpEnd)
+		if !ok {
+			unknownMs += ds.StepMs
+			continue
+		}
+		switch rra.Cf {
+		case "MAX":
+			if math.IsNaN(value) || v > value {
+				value = v
+			}
+		case "MIN":
+			if math.IsNaN(value) || v < value {
+				value = v
+			}
+		case "LAST":
+			value = v
+		case "AVERAGE", "SUM":
+			sum += v
+			known++
+		default:
+			return 0, fmt.Errorf("Invalid consolidation function: %q", rra.Cf)
+		}
+	}
+	if rra.Cf == "AVERAGE" && known > 0 {
+		value = sum / float64(known)
+	} else if rra.Cf == "SUM" && known > 0 {
+		value = sum
+	}
+	// see the xff comment in updateRRAs()
+	if rra.Xff != 1 && float64(unknownMs)/float64(end-begin) > float64(rra.Xff) {
+		value = math.NaN()
+	}
+	return value, nil
+}
+
+// recomputeRRAs recomputes all complete RRA slots overlapping
+// (begin, end]. Slots in between the recomputed ones and those
+// already waiting to be flushed are recomputed as well, because a
+// flush writes everything from rra.Start to rra.End.
+func (ds *DataSource) recomputeRRAs(begin, end int64) error {
+
+	dsLastUpdate := ds.LastUpdate.UnixNano() / 1000000
+
+	for _, rra := range ds.RRAs {
+
+		rraStepMs := ds.StepMs * int64(rra.StepsPerRow)
+		slotEnd := func(ms int64) int64 { // end of the slot ms falls in
+			return (ms + rraStepMs - 1) / rraStepMs * rraStepMs
+		}
+
+		first, last := slotEnd(begin+1), slotEnd(end)
+		var pending int64 // the first slot waiting to be flushed
+		if len(rra.DPs) > 0 {
+			if pending = rra.SlotTimeStamp(ds, rra.Start).UnixNano() / 1000000; pending < first {
+				first = pending
+			}
+			if end := rra.SlotTimeStamp(ds, rra.End).UnixNano() / 1000000; end > last {
+				last = end
+			}
+		}
+
+		// Only complete slots, whose points we all have, and which
+		// fit in the RRA.
+		if complete := dsLastUpdate / rraStepMs * rraStepMs; last > complete {
+			last = complete
+		}
+		if ds.backfillFromMs != 0 {
+			if known := slotEnd(ds.backfillFromMs) + rraStepMs; first < known {
+				first = known
+			}
+		}
+		latest := rra.Latest.UnixNano() / 1000000
+		if last > latest {
+			latest = last
+		}
+		earliest := latest - rraStepMs*int64(rra.Size-1)
+		if first < earliest {
+			first = earliest
+		}
+		if first > last {
+			continue
+		}
+
+		for slot := first; slot <= last; slot += rraStepMs {
+			value, err := ds.backfillSlot(rra, slot-rraStepMs, slot)
+			if err != nil {
+				return err
+			}
+			rra.DPs[(slot/rraStepMs)%int64(rra.Size)] = value
+		}
+
+		// The pending slots before those that can still be
+		// recomputed keep their values, and still need a flush.
+		if pending != 0 && pending < first && pending >= earliest {
+			first = pending
+		}
+		rra.Start = (first / rraStepMs) % int64(rra.Size)
+		rra.End = (last / rraStepMs) % int64(rra.Size)
+		rra.Latest = time.Unix(latest/1000, (latest%1000)*1000000)
+	}
+
+	return nil
+}
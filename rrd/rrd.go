@@ -18,6 +18,7 @@ package rrd
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"math"
@@ -35,6 +36,9 @@ type DSSpec struct {
 	Step      time.Duration
 	Heartbeat time.Duration
 	RRAs      []*RRASpec
+	Min, Max  *float64 // optional, values outside are stored as NaN
+	Secondary bool     // also keep the coarsest RRA in the secondary store
+	Align     TimestampAlign
 }
 type RRASpec struct {
 	Function string
@@ -106,6 +110,13 @@ type DataSource struct {
 	UnknownMs   int64                // Ms of the data that is "unknown" (e.g. because of exceeded HB)
 	RRAs        []*RoundRobinArchive // Array of Round Robin Archives
 	LastFlushRT time.Time            // Last time this DS was flushed (actual real time).
+	Min, Max    *float64             // Optional bounds, values outside are considered unknown (not persisted).
+	Backfill    bool                 // Accept data points out of order (not persisted, see backfill.go).
+	Secondary   bool                 // Also write the coarsest RRA to a secondary store (not persisted).
+	Align       TimestampAlign       // Move data point time stamps onto a step boundary (not persisted).
+
+	backfill       []backfillPoint // Data points kept in backfill mode
+	backfillFromMs int64           // Data before this can no longer be recomputed
 }
 
 type DataSources struct {
@@ -135,6 +146,7 @@ type DataSourceNames struct {
 	sync.RWMutex
 	names    map[string]int64
 	prefixes map[string]bool
+	loaded   time.Time // last Reload()
 }
 
 // This thing knows how to load/save series in some storage
@@ -155,6 +167,83 @@ type SerDe interface {
 	MyDbAddr() (*string, error)
 }
 
+// A SerDe may also support queries which are cancelled when ctx is
+// done (e.g. when an HTTP request times out).
+type ContextSeriesQuerier interface {
+	SeriesQueryContext(ctx context.Context, ds *DataSource, from, to time.Time, maxPoints int64) (Series, error)
+}
+
+// An Annotation is an event (e.g. a deploy or an incident) which
+// can be overlaid on graphs.
+
+type Annotation struct {
+	Time time.Time
+	Text string
+	Tags []string
+}
+
+// A SerDe can optionally also store annotations.
+
+type AnnotationSerDe interface {
+	StoreAnnotation(a *Annotation) error
+	// Annotations between from and to (inclusive), tag is optional
+	FetchAnnotations(from, to time.Time, tag string) ([]*Annotation, error)
+}
+
+// A SerDe can optionally also store the tags of Graphite tagged
+// series (e.g. "disk.used;dc=us-east;host=web01").
+
+type TagSerDe interface {
+	StoreTags(dsId int64, tags map[string]string) error
+	// Names and ids of the DSs which have all of the tags
+	FetchTaggedDataSourceNames(tags map[string]string) (map[string]int64, error)
+}
+
+// A SerDe can optionally also flush many DSs at once, which is much
+// cheaper than one at a time (see the transceiver FlushBatchSize).
+// The DSs are in the order they were flushed, and the same DS may
+// appear more than once.
+
+type BatchFlusher interface {
+	FlushDataSources(dss []*DataSource) error
+}
+
+// A SerDe can optionally also delete a DS, along with its RRAs and
+// all of their data.
+
+type DataSourceDeleter interface {
+	DeleteDataSource(id int64) error
+}
+
+// A SerDe can optionally also rename a DS.
+
+type DataSourceRenamer interface {
+	RenameDataSource(id int64, name string) error
+}
+
+// A SerDe can optionally also rename a DS to the name of another one,
+// deleting the other one (like DeleteDataSource) in the same
+// transaction.
+
+type DataSourceReplacer interface {
+	ReplaceDataSource(id int64, name string, replacedId int64) error
+}
+
+// A SerDe can optionally also merge a DS into another one, filling
+// the slots the other one has no data for with those of the DS (of
+// the same time), then deleting the DS, in the same transaction.
+
+type DataSourceMerger interface {
+	MergeDataSource(id, intoId int64) error
+}
+
+// A SerDe can optionally also check that its database is reachable
+// (e.g. for a readiness probe).
+
+type Pinger interface {
+	Ping() error
+}
+
 // This is a Series
 
 type Series interface {
@@ -259,27 +348,81 @@ func (dsns *DataSourceNames) Reload(serde SerDe) error {
 		dsns.names[name] = id
 		dsns.addPrefixes(name)
 	}
+	dsns.loaded = time.Now()
 
 	return nil
 }
 
-func (dsns *DataSourceNames) FsFind(pattern string) []*FsFindNode {
+// ReloadIfOlder does a Reload() unless the last one was less than ttl
+// ago.
+func (dsns *DataSourceNames) ReloadIfOlder(serde SerDe, ttl time.Duration) error {
+	dsns.RLock()
+	fresh := ttl > 0 && time.Now().Sub(dsns.loaded) < ttl
+	dsns.RUnlock()
+	if fresh {
+		return nil
+	}
+	return dsns.Reload(serde)
+}
+
+// Add a name without a Reload() (e.g. a newly created DS).
+func (dsns *DataSourceNames) Add(name string, dsId int64) {
+	dsns.Lock()
+	defer dsns.Unlock()
+	if dsns.names == nil {
+		dsns.names = make(map[string]int64)
+		dsns.prefixes = make(map[string]bool)
+	}
+	dsns.names[name] = dsId
+	dsns.addPrefixes(name)
+}
 
+// Delete a name without a Reload() (e.g. a deleted DS).
+func (dsns *DataSourceNames) Delete(name string) {
+	dsns.Lock()
+	defer dsns.Unlock()
+	if _, ok := dsns.names[name]; !ok {
+		return
+	}
+	delete(dsns.names, name)
+	dsns.prefixes = make(map[string]bool)
+	for name := range dsns.names {
+		dsns.addPrefixes(name)
+	}
+}
+
+func (dsns *DataSourceNames) Exists(name string) bool {
 	dsns.RLock()
 	defer dsns.RUnlock()
+	_, ok := dsns.names[name]
+	return ok
+}
 
-	dots := strings.Count(pattern, ".")
+func (dsns *DataSourceNames) Len() int {
+	dsns.RLock()
+	defer dsns.RUnlock()
+	return len(dsns.names)
+}
+
+func (dsns *DataSourceNames) FsFind(pattern string) []*FsFindNode {
+
+	dsns.RLock()
+	defer dsns.RUnlock()
 
 	set := make(map[string]*FsFindNode)
-	for k, dsId := range dsns.names {
-		if yes, _ := filepath.Match(pattern, k); yes && dots == strings.Count(k, ".") {
-			set[k] = &FsFindNode{Name: k, Leaf: true, dsId: dsId}
+	for _, pattern := range expandBraces(pattern) {
+		dots := strings.Count(pattern, ".")
+
+		for k, dsId := range dsns.names {
+			if yes, _ := filepath.Match(pattern, k); yes && dots == strings.Count(k, ".") {
+				set[k] = &FsFindNode{Name: k, Leaf: true, dsId: dsId}
+			}
 		}
-	}
 
-	for k, _ := range dsns.prefixes {
-		if yes, _ := filepath.Match(pattern, k); yes && dots == strings.Count(k, ".") {
-			set[k] = &FsFindNode{Name: k, Leaf: false}
+		for k, _ := range dsns.prefixes {
+			if yes, _ := filepath.Match(pattern, k); yes && dots == strings.Count(k, ".") {
+				set[k] = &FsFindNode{Name: k, Leaf: false}
+			}
 		}
 	}
 
@@ -295,6 +438,26 @@ func (dsns *DataSourceNames) FsFind(pattern string) []*FsFindNode {
 	return result
 }
 
+// expandBraces expands the {a,b} alternations of pattern, e.g.
+// "foo.{a,b}.cpu" becomes "foo.a.cpu" and "foo.b.cpu", the way a
+// Graphite glob does. Alternations do not nest.
+func expandBraces(pattern string) []string {
+	open := strings.Index(pattern, "{")
+	if open < 0 {
+		return []string{pattern}
+	}
+	close := strings.Index(pattern[open:], "}")
+	if close < 0 {
+		return []string{pattern}
+	}
+	close += open
+	var result []string
+	for _, alt := range strings.Split(pattern[open+1:close], ",") {
+		result = append(result, expandBraces(pattern[:open]+alt+pattern[close+1:])...)
+	}
+	return result
+}
+
 func (dsns *DataSourceNames) DsIdsFromIdent(ident string) map[string]int64 {
 	result := make(map[string]int64)
 	for _, node := range dsns.FsFind(ident) {
@@ -485,8 +648,66 @@ func (ds *DataSource) updateRange(begin, end int64, value float64) error {
 	return nil
 }
 
+func (ds *DataSource) outOfBounds(value float64) bool {
+	return (ds.Min != nil && value < *ds.Min) || (ds.Max != nil && value > *ds.Max)
+}
+
+// A TimestampAlign moves the time stamp of an incoming data point
+// onto a step boundary (since the epoch), so that clients which are a
+// few seconds off do not spread a step's worth of points over two.
+type TimestampAlign int
+
+const (
+	AlignNone    TimestampAlign = iota // as is
+	AlignNearest                       // to the nearest boundary
+	AlignFloor                         // to the step's beginning
+	AlignCeil                          // to the step's end
+)
+
+func (a *TimestampAlign) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "", "none":
+		*a = AlignNone
+	case "nearest":
+		*a = AlignNearest
+	case "floor":
+		*a = AlignFloor
+	case "ceil":
+		*a = AlignCeil
+	default:
+		return fmt.Errorf("invalid align %q, must be one of none, nearest, floor or ceil", string(text))
+	}
+	return nil
+}
+
+// Align returns ts aligned to a step of stepMs.
+func (a TimestampAlign) Align(ts time.Time, stepMs int64) time.Time {
+	if a == AlignNone || stepMs <= 0 {
+		return ts
+	}
+	ms := ts.UnixNano() / 1000000
+	floor := ms / stepMs * stepMs
+	switch a {
+	case AlignNearest:
+		if ms-floor >= stepMs-(ms-floor) {
+			floor += stepMs
+		}
+	case AlignCeil:
+		if floor != ms {
+			floor += stepMs
+		}
+	}
+	return time.Unix(0, floor*1000000)
+}
+
 func (ds *DataSource) processDataPoint(dp *DataPoint) error {
 
+	dp.TimeStamp = ds.Align.Align(dp.TimeStamp, ds.StepMs)
+
+	if ds.Backfill {
+		return ds.processBackfillDataPoint(dp)
+	}
+
 	// Do everything in milliseconds
 	dpTimeStamp := dp.TimeStamp.UnixNano() / 1000000
 	dsLastUpdate := ds.LastUpdate.UnixNano() / 1000000
@@ -508,6 +729,10 @@ func (ds *DataSource) processDataPoint(dp *DataPoint) error {
 		dp.Value = math.NaN()
 	}
 
+	if ds.outOfBounds(dp.Value) {
+		dp.Value = math.NaN()
+	}
+
 	if dsLastUpdate != 0 {
 		if err := ds.updateRange(dsLastUpdate, dpTimeStamp, dp.Value); err != nil {
 			return err
@@ -571,6 +796,8 @@ func (ds *DataSource) updateRRAs(periodBegin, periodEnd int64) error {
 					}
 				case "LAST":
 					rra.Value = ds.Value
+				case "SUM":
+					rra.Value = rra.Value + ds.Value*float64(steps)
 				case "AVERAGE":
 					rra_weight := 1.0 / float64(rra.StepsPerRow) * float64(steps)
 					rra.Value = rra.Value + ds.Value*rra_weight
@@ -638,6 +865,7 @@ func (ds *DataSource) MostlyCopy() *DataSource {
 	// Only copy elements that change or needed for saving/rendering
 	new_ds := new(DataSource)
 	new_ds.Id = ds.Id
+	new_ds.Name = ds.Name
 	new_ds.StepMs = ds.StepMs
 	new_ds.HeartbeatMs = ds.HeartbeatMs
 	new_ds.LastUpdate = ds.LastUpdate
@@ -659,6 +887,8 @@ func (rra *RoundRobinArchive) mostlyCopy() *RoundRobinArchive {
 	new_rra := new(RoundRobinArchive)
 	new_rra.Id = rra.Id
 	new_rra.DsId = rra.DsId
+	new_rra.Cf = rra.Cf
+	new_rra.Xff = rra.Xff
 	new_rra.StepsPerRow = rra.StepsPerRow
 	new_rra.Size = rra.Size
 	new_rra.Value = rra.Value
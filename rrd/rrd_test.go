@@ -0,0 +1,201 @@
+package rrd
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestProcessDataPointMinMax(t *testing.T) {
+	min, max := 0.0, 100.0
+	ds := &DataSource{
+		StepMs:      1000,
+		HeartbeatMs: 3600 * 1000,
+		LastUpdate:  time.Unix(0, 0),
+		Min:         &min,
+		Max:         &max,
+		RRAs: []*RoundRobinArchive{
+			&RoundRobinArchive{Cf: "AVERAGE", StepsPerRow: 1, Size: 10, Xff: 0.5, DPs: make(map[int64]float64)},
+		},
+	}
+
+	start := time.Unix(1000, 0)
+	for i, v := range []float64{50, 150, -1, 100} {
+		dp := &DataPoint{DS: ds, TimeStamp: start.Add(time.Duration(i) * time.Second), Value: v}
+		if err := dp.Process(); err != nil {
+			t.Fatalf("Process(): %v", err)
+		}
+		inRange := v >= min && v <= max
+		if inRange && ds.LastDs != v {
+			t.Errorf("value %v within bounds, expected it stored as is, got %v", v, ds.LastDs)
+		}
+		if !inRange && !math.IsNaN(ds.LastDs) {
+			t.Errorf("value %v outside of [%v, %v], expected NaN, got %v", v, min, max, ds.LastDs)
+		}
+	}
+}
+
+func TestTimestampAlign(t *testing.T) {
+	for _, c := range []struct {
+		align    TimestampAlign
+		ts       []int64
+		expected int64
+	}{
+		{AlignNone, []int64{1013}, 1013},
+		{AlignFloor, []int64{1010, 1013, 1019}, 1010},
+		{AlignCeil, []int64{1011, 1017, 1020}, 1020},
+		{AlignNearest, []int64{1005, 1013, 1014}, 1010},
+		{AlignNearest, []int64{1015, 1019}, 1020},
+	} {
+		for _, ts := range c.ts {
+			if got := c.align.Align(time.Unix(ts, 0), 10000).Unix(); got != c.expected {
+				t.Errorf("align %d: %d: expected %d, got %d", c.align, ts, c.expected, got)
+			}
+		}
+	}
+
+	// Points 3s past the step boundary: as is a slot is a blend of
+	// two points, aligned it is exactly one point.
+	for _, align := range []TimestampAlign{AlignNone, AlignNearest} {
+		ds := &DataSource{
+			StepMs:      10000,
+			HeartbeatMs: 3600 * 1000,
+			LastUpdate:  time.Unix(0, 0),
+			Align:       align,
+			RRAs: []*RoundRobinArchive{
+				&RoundRobinArchive{Cf: "AVERAGE", StepsPerRow: 1, Size: 10, Xff: 0.5, DPs: make(map[int64]float64)},
+			},
+		}
+		for i, v := range []float64{1, 2, 3} {
+			dp := &DataPoint{DS: ds, TimeStamp: time.Unix(1013+int64(i)*10, 0), Value: v}
+			if err := dp.Process(); err != nil {
+				t.Fatalf("Process(): %v", err)
+			}
+		}
+		if v := ds.RRAs[0].DPs[2]; (align == AlignNone) == (v == 2) {
+			t.Errorf("align %d: expected the slot ending at 1020 to be 2 only if aligned, got %v", align, v)
+		}
+	}
+}
+
+func TestSumRRA(t *testing.T) {
+	ds := &DataSource{
+		StepMs:      1000,
+		HeartbeatMs: 3600 * 1000,
+		LastUpdate:  time.Unix(0, 0),
+		RRAs: []*RoundRobinArchive{
+			&RoundRobinArchive{Cf: "SUM", StepsPerRow: 5, Size: 10, Xff: 0.5, DPs: make(map[int64]float64)},
+			&RoundRobinArchive{Cf: "AVERAGE", StepsPerRow: 5, Size: 10, Xff: 0.5, DPs: make(map[int64]float64)},
+		},
+	}
+	start := time.Unix(1000, 0)
+	for i := 0; i <= 5; i++ {
+		dp := &DataPoint{DS: ds, TimeStamp: start.Add(time.Duration(i) * time.Second), Value: float64(i)}
+		if err := dp.Process(); err != nil {
+			t.Fatalf("Process(): %v", err)
+		}
+	}
+	// the slot ending at 1005 consolidates the steps ending at 1001..1005
+	if v := ds.RRAs[0].DPs[1]; v != 15 {
+		t.Errorf("SUM: expected 15, got %v", v)
+	}
+	if v := ds.RRAs[1].DPs[1]; v != 3 {
+		t.Errorf("AVERAGE: expected 3, got %v", v)
+	}
+}
+
+func TestBackfillOutOfOrder(t *testing.T) {
+	newDs := func(backfill bool) *DataSource {
+		ds := &DataSource{StepMs: 1000, HeartbeatMs: 3600 * 1000, LastUpdate: time.Unix(0, 0), Backfill: backfill}
+		for _, cf := range []string{"AVERAGE", "MAX", "LAST", "SUM"} {
+			ds.RRAs = append(ds.RRAs, &RoundRobinArchive{Cf: cf, StepsPerRow: 5, Size: 50, Xff: 0.5, DPs: make(map[int64]float64)})
+		}
+		ds.RRAs = append(ds.RRAs, &RoundRobinArchive{Cf: "AVERAGE", StepsPerRow: 1, Size: 100, Xff: 0.5, DPs: make(map[int64]float64)})
+		return ds
+	}
+
+	start := time.Unix(1000, 0)
+	values := make([]float64, 60)
+	for i := range values {
+		values[i] = float64((i * 7) % 11)
+	}
+
+	inOrder := newDs(false)
+	for i, v := range values {
+		dp := &DataPoint{DS: inOrder, TimeStamp: start.Add(time.Duration(i) * time.Second), Value: v}
+		if err := dp.Process(); err != nil {
+			t.Fatalf("in order Process(): %v", err)
+		}
+	}
+
+	outOfOrder := newDs(true)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(len(values)) {
+		dp := &DataPoint{DS: outOfOrder, TimeStamp: start.Add(time.Duration(i) * time.Second), Value: values[i]}
+		if err := dp.Process(); err != nil {
+			t.Fatalf("out of order Process(): %v", err)
+		}
+	}
+
+	if !outOfOrder.LastUpdate.Equal(inOrder.LastUpdate) || outOfOrder.LastDs != inOrder.LastDs {
+		t.Errorf("expected last update %v (%v), got %v (%v)", inOrder.LastUpdate, inOrder.LastDs, outOfOrder.LastUpdate, outOfOrder.LastDs)
+	}
+	for n, rra := range inOrder.RRAs {
+		got := outOfOrder.RRAs[n].DPs
+		match := len(got) == len(rra.DPs)
+		for slot, v := range rra.DPs {
+			match = match && math.Abs(got[slot]-v) < 1e-9
+		}
+		if !match {
+			t.Errorf("%s/%d: out of order DPs %v do not match in order DPs %v", rra.Cf, rra.StepsPerRow, outOfOrder.RRAs[n].DPs, rra.DPs)
+		}
+		if rra.Start != outOfOrder.RRAs[n].Start || rra.End != outOfOrder.RRAs[n].End {
+			t.Errorf("%s/%d: expected start/end %d/%d, got %d/%d", rra.Cf, rra.StepsPerRow, rra.Start, rra.End, outOfOrder.RRAs[n].Start, outOfOrder.RRAs[n].End)
+		}
+		if !rra.Latest.Equal(outOfOrder.RRAs[n].Latest) {
+			t.Errorf("%s/%d: expected latest %v, got %v", rra.Cf, rra.StepsPerRow, rra.Latest, outOfOrder.RRAs[n].Latest)
+		}
+	}
+
+	// without backfill mode, out of order is an error
+	dp := &DataPoint{DS: inOrder, TimeStamp: start, Value: 1}
+	if err := dp.Process(); err == nil {
+		t.Errorf("expected an error for an out of order data point")
+	}
+}
+
+func TestBackfillCoarseRRA(t *testing.T) {
+	// The fine RRA spans 10s, the coarse one's slots are 30s, the
+	// points of a coarse slot must outlive the fine span.
+	newDs := func(backfill bool) *DataSource {
+		return &DataSource{StepMs: 1000, HeartbeatMs: 3600 * 1000, LastUpdate: time.Unix(0, 0), Backfill: backfill, RRAs: []*RoundRobinArchive{
+			&RoundRobinArchive{Cf: "AVERAGE", StepsPerRow: 1, Size: 10, Xff: 0.5, DPs: make(map[int64]float64)},
+			&RoundRobinArchive{Cf: "AVERAGE", StepsPerRow: 30, Size: 5, Xff: 0.5, DPs: make(map[int64]float64)},
+		}}
+	}
+	inOrder, backfill := newDs(false), newDs(true)
+	start := time.Unix(1020, 0)
+	for i := 0; i < 100; i++ {
+		for _, ds := range []*DataSource{inOrder, backfill} {
+			dp := &DataPoint{DS: ds, TimeStamp: start.Add(time.Duration(i) * time.Second), Value: float64(i % 7)}
+			if err := dp.Process(); err != nil {
+				t.Fatalf("Process(): %v", err)
+			}
+		}
+	}
+	coarse, got := inOrder.RRAs[1], backfill.RRAs[1]
+	if len(coarse.DPs) == 0 || len(got.DPs) != len(coarse.DPs) {
+		t.Fatalf("expected coarse DPs %v, got %v", coarse.DPs, got.DPs)
+	}
+	for slot, v := range coarse.DPs {
+		if math.Abs(got.DPs[slot]-v) > 1e-9 {
+			t.Errorf("slot %d: expected %v, got %v", slot, v, got.DPs[slot])
+		}
+	}
+	if got.Start != coarse.Start || got.End != coarse.End {
+		t.Errorf("expected start/end %d/%d, got %d/%d", coarse.Start, coarse.End, got.Start, got.End)
+	}
+	if n := len(backfill.backfill); n > 32 {
+		t.Errorf("expected at most a coarse slot of points kept, got %d", n)
+	}
+}
@@ -44,6 +44,7 @@ package serde
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"github.com/lib/pq"
@@ -85,6 +86,29 @@ func InitDb(connect_string, prefix string) (rrd.SerDe, error) {
 	}
 }
 
+func (p *pgSerDe) Ping() error {
+	return p.dbConn.Ping()
+}
+
+// A DbPooler is a serde whose *sql.DB connection pool can be sized
+// and inspected.
+type DbPooler interface {
+	SetConnPool(maxOpen, maxIdle int, maxLifetime time.Duration)
+	DbStats() sql.DBStats
+}
+
+// SetConnPool sizes the connection pool, see the database/sql
+// SetMaxOpenConns, SetMaxIdleConns and SetConnMaxLifetime.
+func (p *pgSerDe) SetConnPool(maxOpen, maxIdle int, maxLifetime time.Duration) {
+	p.dbConn.SetMaxOpenConns(maxOpen)
+	p.dbConn.SetMaxIdleConns(maxIdle)
+	p.dbConn.SetConnMaxLifetime(maxLifetime)
+}
+
+func (p *pgSerDe) DbStats() sql.DBStats {
+	return p.dbConn.Stats()
+}
+
 // A hack to use the DB to see who else is connected
 func (p *pgSerDe) ListDbClientIps() ([]string, error) {
 	const sql = "SELECT DISTINCT(client_addr) FROM pg_stat_activity"
@@ -204,6 +228,22 @@ func (p *pgSerDe) createTablesIfNotExist() error {
        dp DOUBLE PRECISION[] NOT NULL DEFAULT '{}');
 
        CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_idx_ts_rra_id_n ON %[1]sts (rra_id, n);
+
+       CREATE TABLE IF NOT EXISTS %[1]sannotation (
+       id SERIAL NOT NULL PRIMARY KEY,
+       t TIMESTAMPTZ NOT NULL,
+       text TEXT NOT NULL,
+       tags TEXT[] NOT NULL DEFAULT '{}');
+
+       CREATE INDEX IF NOT EXISTS %[1]s_idx_annotation_t ON %[1]sannotation (t);
+
+       CREATE TABLE IF NOT EXISTS %[1]sds_tag (
+       ds_id INT NOT NULL,
+       key TEXT NOT NULL,
+       value TEXT NOT NULL,
+       PRIMARY KEY (ds_id, key));
+
+       CREATE INDEX IF NOT EXISTS %[1]s_idx_ds_tag_key_value ON %[1]sds_tag (key, value);
     `
 	if rows, err := p.dbConn.Query(fmt.Sprintf(create_sql, p.prefix)); err != nil {
 		log.Printf("ERROR: initial CREATE TABLE failed: %v", err)
@@ -272,6 +312,7 @@ type dbSeries struct {
 	// Db stuff
 	db   *pgSerDe
 	rows *sql.Rows
+	ctx  context.Context // cancels the query
 
 	// These are not the same:
 	maxPoints int64 // max points we want
@@ -326,12 +367,11 @@ func (dps *dbSeries) Alias(s ...string) string {
 	return dps.alias
 }
 
-func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
-
-	var (
-		rows *sql.Rows
-		err  error
-	)
+// queryRange works out the group by interval (considering
+// maxPoints) and the time range of the query. It returns the start
+// of the range aligned to the group by interval, the group by
+// interval and the RRA step (both in ms).
+func (dps *dbSeries) queryRange() (time.Time, int64, int64) {
 
 	var (
 		finalGroupByMs int64
@@ -369,10 +409,20 @@ func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
 	}
 
 	// TODO: support milliseconds?
-	aligned_from := time.Unix(dps.from.Unix()/(finalGroupByMs/1000)*(finalGroupByMs/1000), 0)
+	return time.Unix(dps.from.Unix()/(finalGroupByMs/1000)*(finalGroupByMs/1000), 0), finalGroupByMs, rraStepMs
+}
+
+func (dps *dbSeries) seriesQuerySqlUsingViewAndSeries() (*sql.Rows, error) {
+
+	var (
+		rows *sql.Rows
+		err  error
+	)
+
+	aligned_from, finalGroupByMs, rraStepMs := dps.queryRange()
 
 	//log.Printf("sql3 %v %v %v %v %v %v %v %v", aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs), dps.ds.Id, dps.rra.Id, dps.from, dps.to, finalGroupByMs)
-	rows, err = dps.db.sql3.Query(aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs), dps.ds.Id, dps.rra.Id, dps.from, dps.to, finalGroupByMs)
+	rows, err = dps.db.sql3.QueryContext(dps.ctx, aligned_from, dps.to, fmt.Sprintf("%d milliseconds", rraStepMs), dps.ds.Id, dps.rra.Id, dps.from, dps.to, finalGroupByMs)
 
 	if err != nil {
 		log.Printf("seriesQuery(): error %v", err)
@@ -405,57 +455,61 @@ func (dps *dbSeries) Next() bool {
 			dps.latest = dps.posEnd
 		}
 		return true
-	} else {
-		// See if we have data points that haven't been synced yet
-		if len(dps.rra.DPs) > 0 && dps.latest.Before(dps.rra.Latest) {
-			// TODO this is kinda ugly?
-			// Should RRA's implement Series interface perhaps?
-
-			// because rra.DPs is a map there is no quick way to find the
-			// earliest entry, we have to traverse the map. It seems
-			// tempting to come with an alternative solution, but it's not
-			// as simple as it seems, and given that this is mostly about
-			// the tip of the series, this is good enough.
-
-			// we do not provide averaging points here for the same reason
-
-			for len(dps.rra.DPs) > 0 {
-
-				earliest := dps.rra.Latest.Add(time.Millisecond)
-				earliestSlotN := int64(-1)
-				for n, _ := range dps.rra.DPs {
-					ts := dps.rra.SlotTimeStamp(dps.ds, n)
-					if ts.Before(earliest) && ts.After(dps.latest) {
-						earliest, earliestSlotN = ts, n
-					}
+	}
+	return dps.nextUnsynced()
+}
+
+// nextUnsynced moves on to the next of the data points that haven't
+// been synced yet (i.e. those after the ones in the db), if any.
+func (dps *dbSeries) nextUnsynced() bool {
+	if len(dps.rra.DPs) > 0 && dps.latest.Before(dps.rra.Latest) {
+		// TODO this is kinda ugly?
+		// Should RRA's implement Series interface perhaps?
+
+		// because rra.DPs is a map there is no quick way to find the
+		// earliest entry, we have to traverse the map. It seems
+		// tempting to come with an alternative solution, but it's not
+		// as simple as it seems, and given that this is mostly about
+		// the tip of the series, this is good enough.
+
+		// we do not provide averaging points here for the same reason
+
+		for len(dps.rra.DPs) > 0 {
+
+			earliest := dps.rra.Latest.Add(time.Millisecond)
+			earliestSlotN := int64(-1)
+			for n, _ := range dps.rra.DPs {
+				ts := dps.rra.SlotTimeStamp(dps.ds, n)
+				if ts.Before(earliest) && ts.After(dps.latest) {
+					earliest, earliestSlotN = ts, n
+				}
+			}
+			if earliestSlotN != -1 {
+
+				dps.posBegin = dps.latest
+				dps.posEnd = earliest
+				dps.value = dps.rra.DPs[earliestSlotN]
+				dps.latest = earliest
+
+				delete(dps.rra.DPs, earliestSlotN)
+
+				var from, to time.Time
+
+				if dps.from.IsZero() {
+					from = time.Unix(0, 0)
+				} else {
+					from = dps.from
 				}
-				if earliestSlotN != -1 {
-
-					dps.posBegin = dps.latest
-					dps.posEnd = earliest
-					dps.value = dps.rra.DPs[earliestSlotN]
-					dps.latest = earliest
-
-					delete(dps.rra.DPs, earliestSlotN)
-
-					var from, to time.Time
-
-					if dps.from.IsZero() {
-						from = time.Unix(0, 0)
-					} else {
-						from = dps.from
-					}
-					if dps.to.IsZero() {
-						to = dps.rra.Latest.Add(time.Millisecond)
-					} else {
-						to = dps.to
-					}
-					if earliest.Add(time.Millisecond).After(from) && earliest.Before(to.Add(time.Millisecond)) {
-						return true
-					}
+				if dps.to.IsZero() {
+					to = dps.rra.Latest.Add(time.Millisecond)
 				} else {
-					return false
+					to = dps.to
+				}
+				if earliest.Add(time.Millisecond).After(from) && earliest.Before(to.Add(time.Millisecond)) {
+					return true
 				}
+			} else {
+				return false
 			}
 		}
 	}
@@ -656,8 +710,20 @@ func dpsAsString(dps map[int64]float64, start, end int64) string {
 	return b.String()
 }
 
-func (p *pgSerDe) FlushRoundRobinArchive(rra *rrd.RoundRobinArchive) error {
-	var n int64
+// A tsSlice is the part of a ts row which an RRA flush updates,
+// dp[start+1:end+1] = dps.
+type tsSlice struct {
+	n, start, end int64
+	dps           string
+}
+
+// rraSlices are the ts row slices covering the points of rra
+// waiting to be flushed.
+func rraSlices(rra *rrd.RoundRobinArchive) []tsSlice {
+	var (
+		n      int64
+		slices []tsSlice
+	)
 	rraSize := int64(rra.Size)
 	if int32(len(rra.DPs)) == rra.Size { // The whole thing
 		for n = 0; n < rra.SlotRow(rraSize); n++ {
@@ -666,11 +732,7 @@ func (p *pgSerDe) FlushRoundRobinArchive(rra *rrd.RoundRobinArchive) error {
 				end = (rraSize - 1) % rra.Width
 			}
 			dps := dpsAsString(rra.DPs, n*int64(rra.Width), n*int64(rra.Width)+rra.Width-1)
-			if rows, err := p.sql1.Query(1, end+1, dps, rra.Id, n); err == nil {
-				rows.Close()
-			} else {
-				return err
-			}
+			slices = append(slices, tsSlice{n, 0, end, dps})
 		}
 	} else if rra.Start <= rra.End { // Single range
 		for n = rra.Start / int64(rra.Width); n < rra.SlotRow(rra.End); n++ {
@@ -682,11 +744,7 @@ func (p *pgSerDe) FlushRoundRobinArchive(rra *rrd.RoundRobinArchive) error {
 				end = rra.End % rra.Width
 			}
 			dps := dpsAsString(rra.DPs, n*rra.Width+start, n*rra.Width+end)
-			if rows, err := p.sql1.Query(start+1, end+1, dps, rra.Id, n); err == nil {
-				rows.Close()
-			} else {
-				return err
-			}
+			slices = append(slices, tsSlice{n, start, end, dps})
 		}
 	} else { // Double range (wrap-around, end < start)
 		// range 1: 0 -> end
@@ -696,11 +754,7 @@ func (p *pgSerDe) FlushRoundRobinArchive(rra *rrd.RoundRobinArchive) error {
 				end = rra.End % rra.Width
 			}
 			dps := dpsAsString(rra.DPs, n*rra.Width+start, n*rra.Width+end)
-			if rows, err := p.sql1.Query(start+1, end+1, dps, rra.Id, n); err == nil {
-				rows.Close()
-			} else {
-				return err
-			}
+			slices = append(slices, tsSlice{n, start, end, dps})
 		}
 
 		// range 2: start -> Size
@@ -713,11 +767,18 @@ func (p *pgSerDe) FlushRoundRobinArchive(rra *rrd.RoundRobinArchive) error {
 				end = (rraSize - 1) % rra.Width
 			}
 			dps := dpsAsString(rra.DPs, n*rra.Width+start, n*rra.Width+end)
-			if rows, err := p.sql1.Query(start+1, end+1, dps, rra.Id, n); err == nil {
-				rows.Close()
-			} else {
-				return err
-			}
+			slices = append(slices, tsSlice{n, start, end, dps})
+		}
+	}
+	return slices
+}
+
+func (p *pgSerDe) FlushRoundRobinArchive(rra *rrd.RoundRobinArchive) error {
+	for _, sl := range rraSlices(rra) {
+		if rows, err := p.sql1.Query(sl.start+1, sl.end+1, sl.dps, rra.Id, sl.n); err == nil {
+			rows.Close()
+		} else {
+			return err
 		}
 	}
 
@@ -749,6 +810,350 @@ func (p *pgSerDe) FlushDataSource(ds *rrd.DataSource) error {
 	return nil
 }
 
+// FlushDataSources implements rrd.BatchFlusher. Rather than an
+// UPDATE per ts row slice, RRA and DS, everything is COPY-ed into
+// temporary tables, which then update the real ones with an UPDATE
+// ... FROM per table, all in one transaction. An UPDATE ... FROM
+// updates a row only once, so if a batch updates a ts row more than
+// once (the same ds flushed twice, or a wrapped-around RRA), the
+// slices are applied in passes, in order. Of the rra's and ds's only
+// the last versions matter.
+func (p *pgSerDe) FlushDataSources(dss []*rrd.DataSource) error {
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a no-op after Commit
+
+	const create_sql = `
+       CREATE TEMPORARY TABLE tgres_ts_batch (rra_id INT, n INT, lo INT, hi INT, dp DOUBLE PRECISION[], pass INT) ON COMMIT DROP;
+       CREATE TEMPORARY TABLE tgres_rra_batch (id INT, value DOUBLE PRECISION, unknown_ms BIGINT, latest TIMESTAMPTZ) ON COMMIT DROP;
+       CREATE TEMPORARY TABLE tgres_ds_batch (id INT, lastupdate TIMESTAMPTZ, last_ds NUMERIC, value DOUBLE PRECISION, unknown_ms BIGINT) ON COMMIT DROP;
+    `
+	if _, err := tx.Exec(create_sql); err != nil {
+		return err
+	}
+
+	var (
+		rows     [][]interface{}
+		passes   = make(map[[2]int64]int)
+		maxPass  int
+		rras     = make(map[int64]*rrd.RoundRobinArchive)
+		rraOrder []int64
+		lastDs   = make(map[int64]*rrd.DataSource)
+		dsOrder  []int64
+	)
+	for _, ds := range dss {
+		for _, rra := range ds.RRAs {
+			if len(rra.DPs) == 0 {
+				continue
+			}
+			for _, sl := range rraSlices(rra) {
+				key := [2]int64{rra.Id, sl.n}
+				pass := passes[key]
+				passes[key] = pass + 1
+				if pass+1 > maxPass {
+					maxPass = pass + 1
+				}
+				rows = append(rows, []interface{}{rra.Id, sl.n, sl.start + 1, sl.end + 1, sl.dps, pass})
+			}
+			if _, ok := rras[rra.Id]; !ok {
+				rraOrder = append(rraOrder, rra.Id)
+			}
+			rras[rra.Id] = rra
+		}
+		if _, ok := lastDs[ds.Id]; !ok {
+			dsOrder = append(dsOrder, ds.Id)
+		}
+		lastDs[ds.Id] = ds
+	}
+	if err := copyIn(tx, "tgres_ts_batch", []string{"rra_id", "n", "lo", "hi", "dp", "pass"}, rows); err != nil {
+		return err
+	}
+	rows = rows[:0]
+	for _, id := range rraOrder {
+		rra := rras[id]
+		rows = append(rows, []interface{}{rra.Id, rra.Value, rra.UnknownMs, rra.Latest})
+	}
+	if err := copyIn(tx, "tgres_rra_batch", []string{"id", "value", "unknown_ms", "latest"}, rows); err != nil {
+		return err
+	}
+	rows = rows[:0]
+	for _, id := range dsOrder {
+		ds := lastDs[id]
+		rows = append(rows, []interface{}{ds.Id, ds.LastUpdate, ds.LastDs, ds.Value, ds.UnknownMs})
+	}
+	if err := copyIn(tx, "tgres_ds_batch", []string{"id", "lastupdate", "last_ds", "value", "unknown_ms"}, rows); err != nil {
+		return err
+	}
+
+	for pass := 0; pass < maxPass; pass++ {
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %[1]sts ts SET dp[b.lo:b.hi] = b.dp FROM tgres_ts_batch b "+
+			"WHERE b.pass = $1 AND ts.rra_id = b.rra_id AND ts.n = b.n", p.prefix), pass); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("UPDATE %[1]srra rra SET value = b.value, unknown_ms = b.unknown_ms, latest = b.latest "+
+		"FROM tgres_rra_batch b WHERE rra.id = b.id", p.prefix)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("UPDATE %[1]sds ds SET lastupdate = b.lastupdate, last_ds = b.last_ds, value = b.value, "+
+		"unknown_ms = b.unknown_ms FROM tgres_ds_batch b WHERE ds.id = b.id", p.prefix)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// copyIn COPYs rows into table.
+func copyIn(tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	stmt, err := tx.Prepare(pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if _, err := stmt.Exec(row...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	return stmt.Close()
+}
+
+func (p *pgSerDe) DeleteDataSource(id int64) error {
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a no-op after Commit
+
+	if err := p.deleteDataSource(tx, id); err != nil {
+		log.Printf("DeleteDataSource(): error deleting ds %d: %v", id, err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *pgSerDe) deleteDataSource(tx *sql.Tx, id int64) error {
+
+	const sql = `DELETE FROM %[1]sts WHERE rra_id IN (SELECT id FROM %[1]srra WHERE ds_id = $1);
+       DELETE FROM %[1]srra WHERE ds_id = $1;
+       DELETE FROM %[1]sds_tag WHERE ds_id = $1;
+       DELETE FROM %[1]sds WHERE id = $1`
+
+	// One statement at a time, the driver can't bind $1 in several.
+	for _, stmt := range strings.Split(fmt.Sprintf(sql, p.prefix), ";") {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pgSerDe) ReplaceDataSource(id int64, name string, replacedId int64) error {
+
+	const sql = `UPDATE %[1]sds SET name = $2 WHERE id = $1`
+
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a no-op after Commit, neither ds changes on error
+
+	if err := p.deleteDataSource(tx, replacedId); err != nil {
+		log.Printf("ReplaceDataSource(): error deleting ds %d: %v", replacedId, err)
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(sql, p.prefix), id, name); err != nil {
+		log.Printf("ReplaceDataSource(): error renaming ds %d: %v", id, err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *pgSerDe) MergeDataSource(id, intoId int64) error {
+
+	const (
+		sqlSlot   = `UPDATE %[1]sts SET dp[$1] = $2 WHERE rra_id = $3 AND n = $4`
+		sqlLatest = `UPDATE %[1]srra SET latest = $1 WHERE id = $2`
+	)
+
+	from, err := p.FetchDataSource(id)
+	if err != nil {
+		return err
+	}
+	into, err := p.FetchDataSource(intoId)
+	if err != nil {
+		return err
+	}
+	if from == nil || into == nil {
+		return fmt.Errorf("MergeDataSource(): no ds %d or %d", id, intoId)
+	}
+
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a no-op after Commit, neither ds changes on error
+
+	for dst, src := range mergeableRRAs(from, into) {
+		srcDPs, err := p.fetchSlots(tx, src)
+		if err != nil {
+			return err
+		}
+		dstDPs, err := p.fetchSlots(tx, dst)
+		if err != nil {
+			return err
+		}
+		for slot, value := range mergeSlots(from, into, src, dst, srcDPs, dstDPs) {
+			// The array is 1-based
+			if _, err := tx.Exec(fmt.Sprintf(sqlSlot, p.prefix), slot%dst.Width+1, value, dst.Id, slot/dst.Width); err != nil {
+				log.Printf("MergeDataSource(): error merging into RRA %d: %v", dst.Id, err)
+				return err
+			}
+		}
+		if dst.Latest.IsZero() && !src.Latest.IsZero() {
+			if _, err := tx.Exec(fmt.Sprintf(sqlLatest, p.prefix), src.Latest, dst.Id); err != nil {
+				log.Printf("MergeDataSource(): error merging into RRA %d: %v", dst.Id, err)
+				return err
+			}
+		}
+	}
+	if err := p.deleteDataSource(tx, id); err != nil {
+		log.Printf("MergeDataSource(): error deleting ds %d: %v", id, err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// fetchSlots returns the stored slots of an RRA, a ts row n holds
+// the slots from n*width.
+func (p *pgSerDe) fetchSlots(tx *sql.Tx, rra *rrd.RoundRobinArchive) (map[int64]float64, error) {
+	rows, err := tx.Query(fmt.Sprintf(`SELECT n, dp FROM %[1]sts WHERE rra_id = $1`, p.prefix), rra.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dps := make(map[int64]float64)
+	for rows.Next() {
+		var (
+			n      int64
+			values []sql.NullFloat64
+		)
+		if err := rows.Scan(&n, pq.Array(&values)); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if v.Valid {
+				dps[n*rra.Width+int64(i)] = v.Float64
+			}
+		}
+	}
+	return dps, rows.Err()
+}
+
+func (p *pgSerDe) RenameDataSource(id int64, name string) error {
+
+	const sql = `UPDATE %[1]sds SET name = $2 WHERE id = $1`
+
+	if _, err := p.dbConn.Exec(fmt.Sprintf(sql, p.prefix), id, name); err != nil {
+		log.Printf("RenameDataSource(): error renaming ds %d: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+func (p *pgSerDe) StoreAnnotation(a *rrd.Annotation) error {
+
+	const sql = `INSERT INTO %[1]sannotation (t, text, tags) VALUES ($1, $2, $3)`
+
+	tags := a.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	if _, err := p.dbConn.Exec(fmt.Sprintf(sql, p.prefix), a.Time, a.Text, pq.Array(tags)); err != nil {
+		log.Printf("StoreAnnotation(): error inserting: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (p *pgSerDe) FetchAnnotations(from, to time.Time, tag string) ([]*rrd.Annotation, error) {
+
+	const sql = `SELECT t, text, tags FROM %[1]sannotation WHERE t >= $1 AND t <= $2 AND ($3 = '' OR $3 = ANY(tags)) ORDER BY t`
+
+	rows, err := p.dbConn.Query(fmt.Sprintf(sql, p.prefix), from, to, tag)
+	if err != nil {
+		log.Printf("FetchAnnotations(): error querying database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*rrd.Annotation, 0)
+	for rows.Next() {
+		var a rrd.Annotation
+		if err := rows.Scan(&a.Time, &a.Text, pq.Array(&a.Tags)); err != nil {
+			log.Printf("FetchAnnotations(): error scanning row: %v", err)
+			return nil, err
+		}
+		result = append(result, &a)
+	}
+	return result, nil
+}
+
+func (p *pgSerDe) StoreTags(dsId int64, tags map[string]string) error {
+
+	const sql = `INSERT INTO %[1]sds_tag (ds_id, key, value) VALUES ($1, $2, $3) ON CONFLICT(ds_id, key) DO UPDATE SET value = $3`
+
+	for k, v := range tags {
+		if _, err := p.dbConn.Exec(fmt.Sprintf(sql, p.prefix), dsId, k, v); err != nil {
+			log.Printf("StoreTags(): error inserting: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pgSerDe) FetchTaggedDataSourceNames(tags map[string]string) (map[string]int64, error) {
+
+	// Every tag is a key = value pair, a DS matches if it has as many
+	// matching pairs as there are tags.
+	const sql = `SELECT ds.id, ds.name FROM %[1]sds ds INNER JOIN %[1]sds_tag t ON t.ds_id = ds.id
+       WHERE (t.key, t.value) IN (SELECT UNNEST($1::TEXT[]), UNNEST($2::TEXT[]))
+       GROUP BY ds.id, ds.name HAVING COUNT(*) = $3`
+
+	keys, values := make([]string, 0, len(tags)), make([]string, 0, len(tags))
+	for k, v := range tags {
+		keys, values = append(keys, k), append(values, v)
+	}
+
+	rows, err := p.dbConn.Query(fmt.Sprintf(sql, p.prefix), pq.Array(keys), pq.Array(values), len(tags))
+	if err != nil {
+		log.Printf("FetchTaggedDataSourceNames(): error querying database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]int64, 0)
+	for rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			log.Printf("FetchTaggedDataSourceNames(): error scanning row: %v", err)
+			return nil, err
+		}
+		result[name] = id
+	}
+	return result, nil
+}
+
 // CreateOrReturnDataSource loads or returns an existing DS. This is
 // done by using upsertss first on the ds table, then for each
 // RRA. This method also attempt to create the TS empty rows with ON
@@ -808,6 +1213,10 @@ func (p *pgSerDe) CreateOrReturnDataSource(name string, dsSpec *rrd.DSSpec) (*rr
 }
 
 func (p *pgSerDe) SeriesQuery(ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
+	return p.SeriesQueryContext(context.Background(), ds, from, to, maxPoints)
+}
+
+func (p *pgSerDe) SeriesQueryContext(ctx context.Context, ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
 
 	rra := ds.BestRRA(from, to, maxPoints)
 
@@ -820,6 +1229,6 @@ func (p *pgSerDe) SeriesQuery(ds *rrd.DataSource, from, to time.Time, maxPoints
 
 	// Note that seriesQuerySqlUsingViewAndSeries() will modify "to"
 	// to be the earliest of "to" or "LastUpdate".
-	dps := &dbSeries{db: p, ds: ds, rra: rra, from: from, to: to, maxPoints: maxPoints}
+	dps := &dbSeries{db: p, ds: ds, rra: rra, from: from, to: to, maxPoints: maxPoints, ctx: ctx}
 	return rrd.Series(dps), nil
 }
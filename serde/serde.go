@@ -0,0 +1,72 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+import (
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	"math"
+)
+
+// Open returns the serde for the database driver, "postgres" (the
+// default) or "sqlite3".
+func Open(driver, dsn, prefix string) (rrd.SerDe, error) {
+	switch driver {
+	case "", "postgres":
+		return InitDb(dsn, prefix)
+	case sqliteDriver:
+		return InitSqliteDb(dsn, prefix)
+	}
+	return nil, fmt.Errorf("unknown db driver %q, must be postgres or %s", driver, sqliteDriver)
+}
+
+// mergeableRRAs pairs every RRA of into with the RRA of from of the
+// same consolidation function, resolution and size, whose slots hold
+// the same times. RRAs of into without one are not merged into.
+func mergeableRRAs(from, into *rrd.DataSource) map[*rrd.RoundRobinArchive]*rrd.RoundRobinArchive {
+	pairs := make(map[*rrd.RoundRobinArchive]*rrd.RoundRobinArchive)
+	for _, dst := range into.RRAs {
+		for _, src := range from.RRAs {
+			if src.Cf == dst.Cf && src.Size == dst.Size &&
+				from.StepMs*int64(src.StepsPerRow) == into.StepMs*int64(dst.StepsPerRow) {
+				pairs[dst] = src
+				break
+			}
+		}
+	}
+	return pairs
+}
+
+// mergeSlots returns the slots of src (an RRA of from) to fill the
+// ones of dst (its pair in into) with no data with, those of the same
+// time in both. If dst was never updated, that is all of them, and dst
+// is to take the latest of src.
+func mergeSlots(from, into *rrd.DataSource, src, dst *rrd.RoundRobinArchive, srcDPs, dstDPs map[int64]float64) map[int64]float64 {
+	filled := make(map[int64]float64)
+	for slot, value := range srcDPs {
+		if math.IsNaN(value) {
+			continue
+		}
+		if v, ok := dstDPs[slot]; ok && !math.IsNaN(v) {
+			continue
+		}
+		if !dst.Latest.IsZero() && !src.SlotTimeStamp(from, slot).Equal(dst.SlotTimeStamp(into, slot)) {
+			continue // outside of either range
+		}
+		filled[slot] = value
+	}
+	return filled
+}
@@ -0,0 +1,291 @@
+package serde
+
+import (
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testBackends are the serdes to run the same tests against: SQLite
+// if the driver is compiled in (-tags sqlite), PostgreSQL if
+// TGRES_TEST_DB_CONNECT is set (in tables of their own prefix).
+func testBackends(t *testing.T) map[string]rrd.SerDe {
+	backends := make(map[string]rrd.SerDe)
+	if driverRegistered(sqliteDriver) {
+		dir, err := ioutil.TempDir("", "tgres-sqlite")
+		if err != nil {
+			t.Fatalf("TempDir(): %v", err)
+		}
+		db, err := InitSqliteDb(filepath.Join(dir, "tgres.db"), "")
+		if err != nil {
+			t.Fatalf("InitSqliteDb(): %v", err)
+		}
+		backends["sqlite"] = db
+	}
+	if connect := os.Getenv("TGRES_TEST_DB_CONNECT"); connect != "" {
+		db, err := InitDb(connect, fmt.Sprintf("test%d_", time.Now().UnixNano()))
+		if err != nil {
+			t.Fatalf("InitDb(): %v", err)
+		}
+		backends["postgres"] = db
+	}
+	if len(backends) == 0 {
+		t.Skip("no db to test, set TGRES_TEST_DB_CONNECT and/or build with -tags sqlite")
+	}
+	return backends
+}
+
+func TestDataPointFlushQueryRoundTrip(t *testing.T) {
+	spec := &rrd.DSSpec{
+		Step:      time.Second,
+		Heartbeat: time.Hour,
+		RRAs:      []*rrd.RRASpec{&rrd.RRASpec{Function: "AVERAGE", Step: time.Second, Size: 10 * time.Minute, Xff: 0.5}},
+	}
+	for name, db := range testBackends(t) {
+		ds, err := db.CreateOrReturnDataSource("foo.bar", spec)
+		if err != nil {
+			t.Fatalf("%s: CreateOrReturnDataSource(): %v", name, err)
+		}
+		if again, err := db.CreateOrReturnDataSource("foo.bar", spec); err != nil || again.Id != ds.Id {
+			t.Errorf("%s: expected the same ds again, got %v (%v)", name, again, err)
+		}
+
+		start := time.Unix(time.Now().Unix()-60, 0)
+		for i := 0; i <= 10; i++ {
+			dp := &rrd.DataPoint{DS: ds, TimeStamp: start.Add(time.Duration(i) * time.Second), Value: float64(i)}
+			if err := dp.Process(); err != nil {
+				t.Fatalf("%s: Process(): %v", name, err)
+			}
+		}
+		expect := make(map[int64]float64)
+		for slot, v := range ds.RRAs[0].DPs {
+			expect[timeMs(ds.RRAs[0].SlotTimeStamp(ds, slot))] = v
+		}
+		if err := db.FlushDataSource(ds); err != nil {
+			t.Fatalf("%s: FlushDataSource(): %v", name, err)
+		}
+
+		stored, err := db.FetchDataSource(ds.Id)
+		if err != nil || stored == nil {
+			t.Fatalf("%s: FetchDataSource(): %v (%v)", name, stored, err)
+		}
+		if !stored.LastUpdate.Equal(ds.LastUpdate) || stored.LastDs != ds.LastDs || len(stored.RRAs) != 1 {
+			t.Errorf("%s: expected %v, got %v", name, ds, stored)
+		}
+
+		series, err := db.SeriesQuery(stored, start, start.Add(time.Minute), 0)
+		if err != nil {
+			t.Fatalf("%s: SeriesQuery(): %v", name, err)
+		}
+		got := 0
+		for series.Next() {
+			v, ts := series.CurrentValue(), timeMs(series.CurrentPosEndsOn())
+			if math.IsNaN(v) {
+				continue
+			}
+			if e, ok := expect[ts]; !ok || e != v {
+				t.Errorf("%s: unexpected %v at %v", name, v, series.CurrentPosEndsOn())
+			}
+			got++
+		}
+		series.Close()
+		if got != len(expect) {
+			t.Errorf("%s: expected %d points, got %d", name, len(expect), got)
+		}
+	}
+}
+
+func TestRenameDeleteDataSource(t *testing.T) {
+	spec := &rrd.DSSpec{
+		Step:      time.Second,
+		Heartbeat: time.Hour,
+		RRAs:      []*rrd.RRASpec{&rrd.RRASpec{Function: "AVERAGE", Step: time.Second, Size: 10 * time.Minute, Xff: 0.5}},
+	}
+	for name, db := range testBackends(t) {
+		ds, err := db.CreateOrReturnDataSource("rename.from", spec)
+		if err != nil {
+			t.Fatalf("%s: CreateOrReturnDataSource(): %v", name, err)
+		}
+		start := time.Unix(time.Now().Unix()-60, 0)
+		for i := 0; i <= 10; i++ {
+			dp := &rrd.DataPoint{DS: ds, TimeStamp: start.Add(time.Duration(i) * time.Second), Value: float64(i)}
+			if err := dp.Process(); err != nil {
+				t.Fatalf("%s: Process(): %v", name, err)
+			}
+		}
+		if err := db.FlushDataSource(ds); err != nil {
+			t.Fatalf("%s: FlushDataSource(): %v", name, err)
+		}
+
+		if err := db.(rrd.DataSourceRenamer).RenameDataSource(ds.Id, "rename.to"); err != nil {
+			t.Fatalf("%s: RenameDataSource(): %v", name, err)
+		}
+		names, err := db.FetchDataSourceNames()
+		if err != nil {
+			t.Fatalf("%s: FetchDataSourceNames(): %v", name, err)
+		}
+		if _, ok := names["rename.from"]; ok || names["rename.to"] != ds.Id {
+			t.Errorf("%s: expected rename.to to be ds %d, got %v", name, ds.Id, names)
+		}
+
+		// The history is still there, under the new name
+		stored, err := db.FetchDataSource(ds.Id)
+		if err != nil || stored == nil || stored.Name != "rename.to" {
+			t.Fatalf("%s: FetchDataSource(): %v (%v)", name, stored, err)
+		}
+		series, err := db.SeriesQuery(stored, start, start.Add(time.Minute), 0)
+		if err != nil {
+			t.Fatalf("%s: SeriesQuery(): %v", name, err)
+		}
+		got := 0
+		for series.Next() {
+			if !math.IsNaN(series.CurrentValue()) {
+				got++
+			}
+		}
+		series.Close()
+		if got != len(ds.RRAs[0].DPs) {
+			t.Errorf("%s: expected %d points after the rename, got %d", name, len(ds.RRAs[0].DPs), got)
+		}
+
+		// Replacing deletes the other ds, ours takes its name
+		other, err := db.CreateOrReturnDataSource("rename.other", spec)
+		if err != nil {
+			t.Fatalf("%s: CreateOrReturnDataSource(): %v", name, err)
+		}
+		if err := db.(rrd.DataSourceReplacer).ReplaceDataSource(ds.Id, "rename.other", other.Id); err != nil {
+			t.Fatalf("%s: ReplaceDataSource(): %v", name, err)
+		}
+		names, _ = db.FetchDataSourceNames()
+		if _, ok := names["rename.to"]; ok || names["rename.other"] != ds.Id {
+			t.Errorf("%s: expected rename.other to be ds %d, got %v", name, ds.Id, names)
+		}
+		if stored, _ := db.FetchDataSource(other.Id); stored != nil {
+			t.Errorf("%s: expected ds %d deleted, got %v", name, other.Id, stored)
+		}
+
+		if err := db.(rrd.DataSourceDeleter).DeleteDataSource(ds.Id); err != nil {
+			t.Fatalf("%s: DeleteDataSource(): %v", name, err)
+		}
+		names, _ = db.FetchDataSourceNames()
+		if _, ok := names["rename.other"]; ok {
+			t.Errorf("%s: expected rename.other deleted, got %v", name, names)
+		}
+	}
+}
+
+func TestMergeDataSource(t *testing.T) {
+	spec := &rrd.DSSpec{
+		Step:      time.Second,
+		Heartbeat: time.Hour,
+		RRAs:      []*rrd.RRASpec{&rrd.RRASpec{Function: "AVERAGE", Step: time.Second, Size: 10 * time.Minute, Xff: 0.5}},
+	}
+	for name, db := range testBackends(t) {
+		start := time.Unix(time.Now().Unix()-60, 0)
+		create := func(dsName string, from, to int, value float64) *rrd.DataSource {
+			ds, err := db.CreateOrReturnDataSource(dsName, spec)
+			if err != nil {
+				t.Fatalf("%s: CreateOrReturnDataSource(): %v", name, err)
+			}
+			for i := from; i <= to; i++ {
+				dp := &rrd.DataPoint{DS: ds, TimeStamp: start.Add(time.Duration(i) * time.Second), Value: value}
+				if err := dp.Process(); err != nil {
+					t.Fatalf("%s: Process(): %v", name, err)
+				}
+			}
+			if err := db.FlushDataSource(ds); err != nil {
+				t.Fatalf("%s: FlushDataSource(): %v", name, err)
+			}
+			return ds
+		}
+		// slots 1-8 and 6-10, the first point only starts a ds
+		from, into := create("merge.from", 0, 8, 1), create("merge.into", 5, 10, 2)
+
+		if err := db.(rrd.DataSourceMerger).MergeDataSource(from.Id, into.Id); err != nil {
+			t.Fatalf("%s: MergeDataSource(): %v", name, err)
+		}
+		names, _ := db.FetchDataSourceNames()
+		if _, ok := names["merge.from"]; ok || names["merge.into"] != into.Id {
+			t.Errorf("%s: expected only merge.into, got %v", name, names)
+		}
+
+		stored, _ := db.FetchDataSource(into.Id)
+		series, err := db.SeriesQuery(stored, start, start.Add(10*time.Second), 0)
+		if err != nil {
+			t.Fatalf("%s: SeriesQuery(): %v", name, err)
+		}
+		var values []float64
+		for series.Next() {
+			if v := series.CurrentValue(); !math.IsNaN(v) {
+				values = append(values, v)
+			}
+		}
+		series.Close()
+		// the target keeps its own, the source fills in before them
+		if expect := []float64{1, 1, 1, 1, 1, 2, 2, 2, 2, 2}; fmt.Sprint(values) != fmt.Sprint(expect) {
+			t.Errorf("%s: expected %v after the merge, got %v", name, expect, values)
+		}
+	}
+}
+
+func TestMergeSlots(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	newDs := func(latest time.Time) *rrd.DataSource {
+		return &rrd.DataSource{StepMs: 1000, RRAs: []*rrd.RoundRobinArchive{
+			&rrd.RoundRobinArchive{Cf: "AVERAGE", StepsPerRow: 1, Size: 10, Width: 768, Latest: latest}}}
+	}
+	from, into := newDs(t0.Add(5*time.Second)), newDs(t0.Add(10*time.Second))
+	src, dst := from.RRAs[0], mergeableRRAs(from, into)[into.RRAs[0]]
+	if dst != src {
+		t.Fatalf("expected the RRAs to be mergeable")
+	}
+	dst = into.RRAs[0]
+
+	srcDPs, dstDPs := make(map[int64]float64), map[int64]float64{3: 2, 4: math.NaN()}
+	for slot := int64(0); slot < 10; slot++ {
+		srcDPs[slot] = 1
+	}
+	// only t0+1s to t0+5s (slots 1-5) are in both, 3 is taken
+	filled := mergeSlots(from, into, src, dst, srcDPs, dstDPs)
+	if len(filled) != 4 || filled[1] != 1 || filled[2] != 1 || filled[4] != 1 || filled[5] != 1 {
+		t.Errorf("expected slots 1, 2, 4 and 5 filled, got %v", filled)
+	}
+
+	// Never updated, it takes them all
+	dst.Latest = time.Time{}
+	if filled := mergeSlots(from, into, src, dst, srcDPs, nil); len(filled) != 10 {
+		t.Errorf("expected all slots filled, got %v", filled)
+	}
+
+	into.StepMs = 2000
+	if pairs := mergeableRRAs(from, into); len(pairs) != 0 {
+		t.Errorf("expected different resolutions not to be mergeable, got %v", pairs)
+	}
+}
+
+func TestGroupPoints(t *testing.T) {
+	values := map[int64]float64{0: 99, 10000: 1, 20000: 2, 30000: 3}
+	points := groupPoints(values, time.Unix(0, 0), time.Unix(10, 0), time.Unix(60, 0), 10000, 20000)
+	expect := []struct {
+		ms int64
+		v  float64
+	}{
+		{20000, 1.5}, // the 99 is before from
+		{40000, 3},
+		{60000, math.NaN()},
+	}
+	if len(points) != len(expect) {
+		t.Fatalf("expected %d points, got %v", len(expect), points)
+	}
+	for i, e := range expect {
+		p := points[i]
+		if timeMs(p.t) != e.ms || !(p.v == e.v || math.IsNaN(p.v) && math.IsNaN(e.v)) {
+			t.Errorf("point %d: expected %v at %d, got %v at %d", i, e.v, e.ms, p.v, timeMs(p.t))
+		}
+	}
+}
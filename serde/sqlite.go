@@ -0,0 +1,587 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serde
+
+// A SQLite serde, for a single node (no clustering) and small or
+// embedded deployments. The schema mirrors the PostgreSQL one, except
+// that there are no arrays, so every RRA slot is a row of its own,
+// and times are stored as ms since the epoch. To keep the SQLite
+// driver (which needs cgo) out of the default build, it's only
+// registered when built with "-tags sqlite", see sqlite_driver.go.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+const sqliteDriver = "sqlite3"
+
+type sqliteSerDe struct {
+	dbConn *sql.DB
+	prefix string
+}
+
+func InitSqliteDb(dsn, prefix string) (rrd.SerDe, error) {
+	if !driverRegistered(sqliteDriver) {
+		return nil, fmt.Errorf("the %s driver is not compiled in, build with -tags sqlite", sqliteDriver)
+	}
+	dbConn, err := sql.Open(sqliteDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has but one writer at a time, more connections would
+	// only fail with "database is locked".
+	dbConn.SetMaxOpenConns(1)
+	p := &sqliteSerDe{dbConn: dbConn, prefix: prefix}
+	if err := p.dbConn.Ping(); err != nil {
+		return nil, err
+	}
+	if err := p.createTablesIfNotExist(); err != nil {
+		return nil, err
+	}
+	return rrd.SerDe(p), nil
+}
+
+func driverRegistered(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *sqliteSerDe) Ping() error {
+	return p.dbConn.Ping()
+}
+
+func (p *sqliteSerDe) createTablesIfNotExist() error {
+	create_sql := `
+       CREATE TABLE IF NOT EXISTS %[1]sds (
+       id INTEGER NOT NULL PRIMARY KEY,
+       name TEXT NOT NULL UNIQUE,
+       step_ms INTEGER NOT NULL,
+       heartbeat_ms INTEGER NOT NULL,
+       lastupdate INTEGER,
+       last_ds REAL,
+       value REAL,
+       unknown_ms INTEGER NOT NULL DEFAULT 0);
+
+       CREATE TABLE IF NOT EXISTS %[1]srra (
+       id INTEGER NOT NULL PRIMARY KEY,
+       ds_id INTEGER NOT NULL,
+       cf TEXT NOT NULL,
+       steps_per_row INTEGER NOT NULL,
+       size INTEGER NOT NULL,
+       width INTEGER NOT NULL DEFAULT 768,
+       xff REAL NOT NULL,
+       value REAL,
+       unknown_ms INTEGER NOT NULL DEFAULT 0,
+       latest INTEGER,
+       UNIQUE (ds_id, cf, steps_per_row, size, xff));
+
+       CREATE TABLE IF NOT EXISTS %[1]sdp (
+       rra_id INTEGER NOT NULL,
+       slot INTEGER NOT NULL,
+       value REAL,
+       PRIMARY KEY (rra_id, slot));
+    `
+	if _, err := p.dbConn.Exec(fmt.Sprintf(create_sql, p.prefix)); err != nil {
+		log.Printf("ERROR: initial CREATE TABLE failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// SQLite stores a NaN as a NULL.
+func nullableFloat(f float64) interface{} {
+	if math.IsNaN(f) {
+		return nil
+	}
+	return f
+}
+
+func floatOrNaN(f sql.NullFloat64) float64 {
+	if f.Valid {
+		return f.Float64
+	}
+	return math.NaN()
+}
+
+func timeMs(t time.Time) int64 {
+	return t.UnixNano() / 1000000
+}
+
+func msOrEpoch(ms sql.NullInt64) time.Time {
+	if ms.Valid {
+		return time.Unix(0, ms.Int64*1000000)
+	}
+	return time.Unix(0, 0) // Not to be confused with time.Time{} !
+}
+
+func (p *sqliteSerDe) dataSourceFromRow(rows *sql.Rows) (*rrd.DataSource, error) {
+	var (
+		ds             rrd.DataSource
+		last_ds, value sql.NullFloat64
+		lastupdate     sql.NullInt64
+	)
+	if err := rows.Scan(&ds.Id, &ds.Name, &ds.StepMs, &ds.HeartbeatMs, &lastupdate, &last_ds, &value, &ds.UnknownMs); err != nil {
+		log.Printf("dataSourceFromRow(): error scanning row: %v", err)
+		return nil, err
+	}
+	ds.LastDs, ds.Value = floatOrNaN(last_ds), floatOrNaN(value)
+	ds.LastUpdate = msOrEpoch(lastupdate)
+	return &ds, nil
+}
+
+func (p *sqliteSerDe) roundRobinArchiveFromRow(rows *sql.Rows) (*rrd.RoundRobinArchive, error) {
+	var (
+		rra    rrd.RoundRobinArchive
+		value  sql.NullFloat64
+		latest sql.NullInt64
+	)
+	if err := rows.Scan(&rra.Id, &rra.DsId, &rra.Cf, &rra.StepsPerRow, &rra.Size, &rra.Width, &rra.Xff, &value, &rra.UnknownMs, &latest); err != nil {
+		log.Printf("roundRoundRobinArchiveFromRow(): error scanning row: %v", err)
+		return nil, err
+	}
+	rra.Value = floatOrNaN(value)
+	rra.Latest = msOrEpoch(latest)
+	rra.DPs = make(map[int64]float64)
+	return &rra, nil
+}
+
+func (p *sqliteSerDe) FetchDataSourceNames() (map[string]int64, error) {
+
+	const sql = `SELECT id, name FROM %[1]sds`
+
+	rows, err := p.dbConn.Query(fmt.Sprintf(sql, p.prefix))
+	if err != nil {
+		log.Printf("FetchDataSourceNames(): error querying database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]int64, 0)
+	for rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			log.Printf("FetchDataSourceNames(): error scanning row: %v", err)
+			return nil, err
+		}
+		result[name] = id
+	}
+	return result, rows.Err()
+}
+
+const sqliteDsColumns = `id, name, step_ms, heartbeat_ms, lastupdate, last_ds, value, unknown_ms`
+
+func (p *sqliteSerDe) fetchDataSources(where string, args ...interface{}) ([]*rrd.DataSource, error) {
+
+	rows, err := p.dbConn.Query(fmt.Sprintf(`SELECT `+sqliteDsColumns+` FROM %[1]sds `+where, p.prefix), args...)
+	if err != nil {
+		log.Printf("FetchDataSources(): error querying database: %v", err)
+		return nil, err
+	}
+
+	var result []*rrd.DataSource
+	for rows.Next() {
+		ds, err := p.dataSourceFromRow(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result = append(result, ds)
+	}
+	rows.Close() // before the RRA queries, there is only one connection
+
+	for _, ds := range result {
+		if ds.RRAs, err = p.fetchRoundRobinArchives(ds.Id); err != nil {
+			log.Printf("FetchDataSources(): error fetching RRAs: %v", err)
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (p *sqliteSerDe) FetchDataSource(id int64) (*rrd.DataSource, error) {
+	dss, err := p.fetchDataSources(`WHERE id = ?`, id)
+	if err != nil || len(dss) == 0 {
+		return nil, err
+	}
+	return dss[0], nil
+}
+
+func (p *sqliteSerDe) FetchDataSources() ([]*rrd.DataSource, error) {
+	return p.fetchDataSources(``)
+}
+
+func (p *sqliteSerDe) fetchRoundRobinArchives(ds_id int64) ([]*rrd.RoundRobinArchive, error) {
+
+	const sql = `SELECT id, ds_id, cf, steps_per_row, size, width, xff, value, unknown_ms, latest FROM %[1]srra WHERE ds_id = ? ORDER BY id`
+
+	rows, err := p.dbConn.Query(fmt.Sprintf(sql, p.prefix), ds_id)
+	if err != nil {
+		log.Printf("fetchRoundRobinArchives(): error querying database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rras []*rrd.RoundRobinArchive
+	for rows.Next() {
+		rra, err := p.roundRobinArchiveFromRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		rras = append(rras, rra)
+	}
+	return rras, rows.Err()
+}
+
+func (p *sqliteSerDe) CreateOrReturnDataSource(name string, dsSpec *rrd.DSSpec) (*rrd.DataSource, error) {
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // a no-op after Commit
+
+	if _, err := tx.Exec(fmt.Sprintf(`INSERT OR IGNORE INTO %[1]sds (name, step_ms, heartbeat_ms) VALUES (?, ?, ?)`, p.prefix),
+		name, dsSpec.Step.Nanoseconds()/1000000, dsSpec.Heartbeat.Nanoseconds()/1000000); err != nil {
+		log.Printf("createDataSources(): error querying database: %v", err)
+		return nil, err
+	}
+	var dsId, stepMs int64
+	if err := tx.QueryRow(fmt.Sprintf(`SELECT id, step_ms FROM %[1]sds WHERE name = ?`, p.prefix), name).Scan(&dsId, &stepMs); err != nil {
+		log.Printf("createDataSources(): error: %v", err)
+		return nil, err
+	}
+
+	for _, rraSpec := range dsSpec.RRAs {
+		steps := rraSpec.Step.Nanoseconds() / (stepMs * 1000000)
+		size := rraSpec.Size.Nanoseconds() / rraSpec.Step.Nanoseconds()
+		if _, err := tx.Exec(fmt.Sprintf(`INSERT OR IGNORE INTO %[1]srra (ds_id, cf, steps_per_row, size, xff) VALUES (?, ?, ?, ?, ?)`, p.prefix),
+			dsId, rraSpec.Function, steps, size, rraSpec.Xff); err != nil {
+			log.Printf("createDataSources(): error creating RRAs: %v", err)
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return p.FetchDataSource(dsId)
+}
+
+func (p *sqliteSerDe) FlushDataSource(ds *rrd.DataSource) error {
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a no-op after Commit
+
+	for _, rra := range ds.RRAs {
+		if len(rra.DPs) == 0 {
+			continue
+		}
+		for slot, value := range rra.DPs {
+			if _, err := tx.Exec(fmt.Sprintf(`INSERT OR REPLACE INTO %[1]sdp (rra_id, slot, value) VALUES (?, ?, ?)`, p.prefix),
+				rra.Id, slot, nullableFloat(value)); err != nil {
+				log.Printf("flushDataSource(): error flushing RRA, probable data loss: %v", err)
+				return err
+			}
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE %[1]srra SET value = ?, unknown_ms = ?, latest = ? WHERE id = ?`, p.prefix),
+			nullableFloat(rra.Value), rra.UnknownMs, timeMs(rra.Latest), rra.Id); err != nil {
+			log.Printf("flushDataSource(): error flushing RRA, probable data loss: %v", err)
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf(`UPDATE %[1]sds SET lastupdate = ?, last_ds = ?, value = ?, unknown_ms = ? WHERE id = ?`, p.prefix),
+		timeMs(ds.LastUpdate), nullableFloat(ds.LastDs), nullableFloat(ds.Value), ds.UnknownMs, ds.Id); err != nil {
+		log.Printf("flushDataSource(): database error: %v", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (p *sqliteSerDe) DeleteDataSource(id int64) error {
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a no-op after Commit
+
+	if err := p.deleteDataSource(tx, id); err != nil {
+		log.Printf("DeleteDataSource(): error deleting ds %d: %v", id, err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *sqliteSerDe) deleteDataSource(tx *sql.Tx, id int64) error {
+
+	const sql = `DELETE FROM %[1]sdp WHERE rra_id IN (SELECT id FROM %[1]srra WHERE ds_id = ?);
+       DELETE FROM %[1]srra WHERE ds_id = ?;
+       DELETE FROM %[1]sds WHERE id = ?`
+
+	for _, stmt := range strings.Split(fmt.Sprintf(sql, p.prefix), ";") {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *sqliteSerDe) ReplaceDataSource(id int64, name string, replacedId int64) error {
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a no-op after Commit, neither ds changes on error
+
+	if err := p.deleteDataSource(tx, replacedId); err != nil {
+		log.Printf("ReplaceDataSource(): error deleting ds %d: %v", replacedId, err)
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`UPDATE %[1]sds SET name = ? WHERE id = ?`, p.prefix), name, id); err != nil {
+		log.Printf("ReplaceDataSource(): error renaming ds %d: %v", id, err)
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *sqliteSerDe) MergeDataSource(id, intoId int64) error {
+	from, err := p.FetchDataSource(id)
+	if err != nil {
+		return err
+	}
+	into, err := p.FetchDataSource(intoId)
+	if err != nil {
+		return err
+	}
+	if from == nil || into == nil {
+		return fmt.Errorf("MergeDataSource(): no ds %d or %d", id, intoId)
+	}
+
+	tx, err := p.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // a no-op after Commit, neither ds changes on error
+
+	for dst, src := range mergeableRRAs(from, into) {
+		srcDPs, err := p.fetchSlots(tx, src.Id)
+		if err != nil {
+			return err
+		}
+		dstDPs, err := p.fetchSlots(tx, dst.Id)
+		if err != nil {
+			return err
+		}
+		for slot, value := range mergeSlots(from, into, src, dst, srcDPs, dstDPs) {
+			if _, err := tx.Exec(fmt.Sprintf(`INSERT OR REPLACE INTO %[1]sdp (rra_id, slot, value) VALUES (?, ?, ?)`, p.prefix),
+				dst.Id, slot, value); err != nil {
+				log.Printf("MergeDataSource(): error merging into RRA %d: %v", dst.Id, err)
+				return err
+			}
+		}
+		if dst.Latest.IsZero() && !src.Latest.IsZero() {
+			if _, err := tx.Exec(fmt.Sprintf(`UPDATE %[1]srra SET latest = ? WHERE id = ?`, p.prefix), timeMs(src.Latest), dst.Id); err != nil {
+				log.Printf("MergeDataSource(): error merging into RRA %d: %v", dst.Id, err)
+				return err
+			}
+		}
+	}
+	if err := p.deleteDataSource(tx, id); err != nil {
+		log.Printf("MergeDataSource(): error deleting ds %d: %v", id, err)
+		return err
+	}
+	return tx.Commit()
+}
+
+// fetchSlots returns the stored slots of an RRA.
+func (p *sqliteSerDe) fetchSlots(tx *sql.Tx, rraId int64) (map[int64]float64, error) {
+	rows, err := tx.Query(fmt.Sprintf(`SELECT slot, value FROM %[1]sdp WHERE rra_id = ?`, p.prefix), rraId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dps := make(map[int64]float64)
+	for rows.Next() {
+		var (
+			slot  int64
+			value sql.NullFloat64
+		)
+		if err := rows.Scan(&slot, &value); err != nil {
+			return nil, err
+		}
+		dps[slot] = floatOrNaN(value)
+	}
+	return dps, rows.Err()
+}
+
+func (p *sqliteSerDe) RenameDataSource(id int64, name string) error {
+	if _, err := p.dbConn.Exec(fmt.Sprintf(`UPDATE %[1]sds SET name = ? WHERE id = ?`, p.prefix), name, id); err != nil {
+		log.Printf("RenameDataSource(): error renaming ds %d: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// There are no other nodes.
+
+func (p *sqliteSerDe) ListDbClientIps() ([]string, error) { return nil, nil }
+func (p *sqliteSerDe) MyDbAddr() (*string, error)         { return nil, nil }
+
+func (p *sqliteSerDe) SeriesQuery(ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
+	return p.SeriesQueryContext(context.Background(), ds, from, to, maxPoints)
+}
+
+func (p *sqliteSerDe) SeriesQueryContext(ctx context.Context, ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
+
+	rra := ds.BestRRA(from, to, maxPoints)
+
+	// If from/to are nil - assign the rra boundaries
+	rraEarliest := time.Unix(rra.GetStartGivenEndMs(ds, rra.Latest.Unix()*1000)/1000, 0)
+
+	if from.IsZero() || rraEarliest.After(from) {
+		from = rraEarliest
+	}
+
+	dps := &dbSeries{ds: ds, rra: rra, from: from, to: to, maxPoints: maxPoints, ctx: ctx}
+	return rrd.Series(&sqliteSeries{dbSeries: dps, db: p}), nil
+}
+
+// sqliteSeries is a dbSeries which, rather than have the db
+// consolidate the points, fetches the slots of the RRA and does it
+// itself, see groupPoints().
+type sqliteSeries struct {
+	*dbSeries
+	db     *sqliteSerDe
+	points []seriesPoint
+	pos    int
+	loaded bool
+}
+
+func (s *sqliteSeries) load() error {
+	alignedFrom, groupByMs, rraStepMs := s.queryRange()
+
+	rows, err := s.db.dbConn.QueryContext(s.ctx, fmt.Sprintf(`SELECT slot, value FROM %[1]sdp WHERE rra_id = ?`, s.db.prefix), s.rra.Id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	values := make(map[int64]float64)
+	for rows.Next() {
+		var (
+			slot  int64
+			value sql.NullFloat64
+		)
+		if err := rows.Scan(&slot, &value); err != nil {
+			return err
+		}
+		if value.Valid {
+			values[timeMs(s.rra.SlotTimeStamp(s.ds, slot))] = value.Float64
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.points = groupPoints(values, alignedFrom, s.from, s.to, rraStepMs, groupByMs)
+	s.pos, s.loaded = 0, true
+	return nil
+}
+
+func (s *sqliteSeries) Next() bool {
+	if !s.loaded { // First Next()
+		if err := s.load(); err != nil {
+			log.Printf("sqliteSeries.Next(): database error: %v", err)
+			return false
+		}
+	}
+	if s.pos < len(s.points) {
+		pt := s.points[s.pos]
+		s.pos++
+		s.posBegin = s.latest
+		s.posEnd = pt.t
+		s.value = pt.v
+		s.latest = s.posEnd
+		return true
+	}
+	return s.nextUnsynced()
+}
+
+func (s *sqliteSeries) Close() error {
+	s.points, s.loaded = nil, false // next Next() will re-load
+	return nil
+}
+
+type seriesPoint struct {
+	t time.Time
+	v float64
+}
+
+// groupPoints consolidates values (by their time in ms) the way the
+// PostgreSQL serde query does: there is a point every stepMs from
+// alignedFrom through to, those in the same groupByMs interval are
+// one, which is the latest of them in time, and the average of their
+// values between from and to (NaN if they have none).
+func groupPoints(values map[int64]float64, alignedFrom, from, to time.Time, stepMs, groupByMs int64) []seriesPoint {
+	var (
+		result       []seriesPoint
+		key          int64
+		sum          float64
+		n            int
+		fromMs, toMs = timeMs(from), timeMs(to)
+	)
+	flush := func() {
+		if len(result) > 0 {
+			if n > 0 {
+				result[len(result)-1].v = sum / float64(n)
+			} else {
+				result[len(result)-1].v = math.NaN()
+			}
+		}
+		sum, n = 0, 0
+	}
+	for ms := timeMs(alignedFrom); ms <= toMs; ms += stepMs {
+		if k := (ms - 1) / groupByMs; len(result) == 0 || k != key {
+			flush()
+			key = k
+			result = append(result, seriesPoint{})
+		}
+		result[len(result)-1].t = time.Unix(0, ms*1000000)
+		if v, ok := values[ms]; ok && ms >= fromMs {
+			sum += v
+			n++
+		}
+	}
+	flush()
+	return result
+}
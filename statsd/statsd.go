@@ -33,9 +33,10 @@ type dataPointQueuer interface {
 type Aggregator struct {
 	t         dataPointQueuer
 	prefix    string
-	counts    map[string]int64
+	counts    map[string]float64
 	gauges    map[string]float64
 	timers    map[string][]float64
+	tcounts   map[string]float64 // timer counts, adjusted for sampling
 	lastFlush time.Time
 }
 
@@ -43,17 +44,18 @@ func NewAggregator(t dataPointQueuer, prefix string) *Aggregator {
 	return &Aggregator{
 		t:         t,
 		prefix:    prefix,
-		counts:    make(map[string]int64),
+		counts:    make(map[string]float64),
 		gauges:    make(map[string]float64),
 		timers:    make(map[string][]float64),
+		tcounts:   make(map[string]float64),
 		lastFlush: time.Now(),
 	}
 }
 
 func (a *Aggregator) Flush() {
+	dur := time.Now().Sub(a.lastFlush)
 	for name, count := range a.counts {
-		dur := time.Now().Sub(a.lastFlush)
-		perSec := float64(count) / dur.Seconds()
+		perSec := count / dur.Seconds()
 		a.t.QueueDataPoint(a.prefix+"."+name, time.Now(), perSec)
 	}
 	for name, gauge := range a.gauges {
@@ -61,13 +63,13 @@ func (a *Aggregator) Flush() {
 	}
 	for name, times := range a.timers {
 		// count
-		a.t.QueueDataPoint(a.prefix+".timers."+name+".count", time.Now(), float64(len(times)))
+		a.t.QueueDataPoint(a.prefix+".timers."+name+".count", time.Now(), a.tcounts[name])
 
 		// lower, upper, sum, mean
 		if len(times) > 0 {
 			var (
 				lower, upper = times[0], times[0]
-				sum          float64
+				sum          = times[0]
 			)
 
 			for _, v := range times[1:] {
@@ -91,25 +93,31 @@ func (a *Aggregator) Flush() {
 
 	}
 	// clear the maps
-	a.counts = make(map[string]int64)
+	a.counts = make(map[string]float64)
 	a.gauges = make(map[string]float64)
 	a.timers = make(map[string][]float64)
+	a.tcounts = make(map[string]float64)
 	a.lastFlush = time.Now()
 }
 
+// Process adds the stat to the current flush window. A sampled
+// counter (e.g. |@0.1) counts for 1/sample, as does a sampled timer
+// towards its count.
 func (a *Aggregator) Process(st *Stat) error {
+	weight := 1.0
+	if st.Sample > 0 && st.Sample < 1 {
+		weight = 1 / st.Sample
+	}
 	if st.Metric == "c" {
-		if _, ok := a.counts[st.Name]; !ok {
-			a.counts[st.Name] = 0
-		}
-		a.counts[st.Name] += int64(st.Value)
+		a.counts[st.Name] += st.Value * weight
 	} else if st.Metric == "g" {
 		a.gauges[st.Name] = st.Value
 	} else if st.Metric == "ms" {
 		if _, ok := a.timers[st.Name]; !ok {
-			a.timers[st.Name] = make([]float64, 4)
+			a.timers[st.Name] = make([]float64, 0, 4)
 		}
 		a.timers[st.Name] = append(a.timers[st.Name], st.Value)
+		a.tcounts[st.Name] += weight
 	} else {
 		return fmt.Errorf("invalid metric type: %q, ignoring.", st.Metric)
 	}
@@ -165,8 +173,8 @@ func (st *Stat) GobDecode(b []byte) error {
 // ParseStatsdPacket parses a statsd packet e.g: gorets:1|c|@0.1. See
 // https://github.com/etsy/statsd/blob/master/docs/metric_types.md
 // There is no need to support multi-metric packets here, since it
-// uses newline as separator, the text handler in daemon/services.go
-// would take care of it.
+// uses newline as separator, the handlers in daemon/services.go take
+// care of it.
 func ParseStatsdPacket(packet string) (*Stat, error) {
 
 	var (
@@ -0,0 +1,223 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An AggregationRule (as in carbon's aggregation-rules.conf) fans
+// the incoming data points of many series into one, e.g.
+//
+//	<env>.applications.<app>.all.requests (60) = sum <env>.applications.<app>.*.requests
+//
+// In the input pattern a <field> matches one name segment, which is
+// filled in in the output name, a * matches within a segment. The
+// values of every Frequency (seconds, default 60) are summed or
+// averaged (sum or avg), and queued as a data point of the output
+// series as of the beginning of the interval, once it is over (and
+// Frequency more has passed, for stragglers). Each node aggregates the
+// series it owns.
+type AggregationRule struct {
+	Output    string
+	Frequency time.Duration
+	Method    string
+	input     *regexp.Regexp
+	rule      string
+}
+
+const dftAggregationFrequency = time.Minute
+
+var aggregationFieldRe = regexp.MustCompile(`<[^<>]+>`)
+
+// ParseAggregationRule parses an "output (frequency) = method input"
+// rule, the frequency is optional.
+func ParseAggregationRule(rule string) (*AggregationRule, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("ParseAggregationRule(): expected output (frequency) = method input, got %q", rule)
+	}
+	left, right := strings.Fields(parts[0]), strings.Fields(parts[1])
+	if len(left) < 1 || len(left) > 2 || len(right) != 2 {
+		return nil, fmt.Errorf("ParseAggregationRule(): expected output (frequency) = method input, got %q", rule)
+	}
+	r := &AggregationRule{Output: left[0], Frequency: dftAggregationFrequency, Method: right[0], rule: rule}
+	if len(left) == 2 {
+		var secs int
+		if _, err := fmt.Sscanf(left[1], "(%d)", &secs); err != nil || secs <= 0 {
+			return nil, fmt.Errorf("ParseAggregationRule(): invalid frequency %q in %q", left[1], rule)
+		}
+		r.Frequency = time.Duration(secs) * time.Second
+	}
+	if r.Method != "sum" && r.Method != "avg" {
+		return nil, fmt.Errorf("ParseAggregationRule(): invalid method %q, must be sum or avg", r.Method)
+	}
+
+	var re []string
+	fields := make(map[string]bool)
+	pos := 0
+	for _, loc := range aggregationFieldRe.FindAllStringIndex(right[1], -1) {
+		re = append(re, aggregationGlob(right[1][pos:loc[0]]))
+		field := right[1][loc[0]+1 : loc[1]-1]
+		if fields[field] {
+			return nil, fmt.Errorf("ParseAggregationRule(): field <%s> appears twice in %q", field, rule)
+		}
+		fields[field] = true
+		re = append(re, fmt.Sprintf("(?P<%s>[^.]+)", field))
+		pos = loc[1]
+	}
+	re = append(re, aggregationGlob(right[1][pos:]))
+	var err error
+	if r.input, err = regexp.Compile("^" + strings.Join(re, "") + "$"); err != nil {
+		return nil, fmt.Errorf("ParseAggregationRule(): %q: %v", rule, err)
+	}
+	for _, field := range aggregationFieldRe.FindAllString(r.Output, -1) {
+		if !fields[field[1:len(field)-1]] {
+			return nil, fmt.Errorf("ParseAggregationRule(): output field %s is not in the input of %q", field, rule)
+		}
+	}
+	return r, nil
+}
+
+func aggregationGlob(s string) string {
+	return strings.Replace(regexp.QuoteMeta(s), `\*`, `[^.]*`, -1)
+}
+
+// outputName is the name of the aggregate series that the series
+// name contributes to, "" if it doesn't match.
+func (r *AggregationRule) outputName(name string) string {
+	m := r.input.FindStringSubmatch(name)
+	if m == nil {
+		return ""
+	}
+	return aggregationFieldRe.ReplaceAllStringFunc(r.Output, func(field string) string {
+		return m[r.input.SubexpIndex(field[1:len(field)-1])]
+	})
+}
+
+func (r *AggregationRule) String() string { return r.rule }
+
+// aggregationBuffer collects the incoming values of the aggregate
+// series by interval.
+type aggregationBuffer struct {
+	sync.Mutex
+	intervals map[aggregationKey]*aggregationInterval
+}
+
+type aggregationKey struct {
+	name  string
+	start int64 // ms
+}
+
+type aggregationInterval struct {
+	rule  *AggregationRule
+	sum   float64
+	count int
+}
+
+func newAggregationBuffer() *aggregationBuffer {
+	return &aggregationBuffer{intervals: make(map[aggregationKey]*aggregationInterval)}
+}
+
+func (b *aggregationBuffer) add(rule *AggregationRule, name string, ts time.Time, value float64) {
+	freqMs := rule.Frequency.Nanoseconds() / 1000000
+	key := aggregationKey{name, ts.UnixNano() / 1000000 / freqMs * freqMs}
+	b.Lock()
+	defer b.Unlock()
+	iv := b.intervals[key]
+	if iv == nil {
+		iv = &aggregationInterval{rule: rule}
+		b.intervals[key] = iv
+	}
+	iv.sum += value
+	iv.count++
+}
+
+// drain returns the data points of the intervals over before now (all
+// of them if now is zero), and removes them from the buffer.
+func (b *aggregationBuffer) drain(now time.Time) []*rrd.DataPoint {
+	b.Lock()
+	defer b.Unlock()
+	var dps []*rrd.DataPoint
+	for key, iv := range b.intervals {
+		start := time.Unix(key.start/1000, (key.start%1000)*1000000)
+		if !now.IsZero() && now.Before(start.Add(2*iv.rule.Frequency)) {
+			continue
+		}
+		value := iv.sum
+		if iv.rule.Method == "avg" {
+			value /= float64(iv.count)
+		}
+		dps = append(dps, &rrd.DataPoint{Name: key.name, TimeStamp: start, Value: value})
+		delete(b.intervals, key)
+	}
+	return dps
+}
+
+// aggregate adds a data point to the aggregate series of every
+// matching rule.
+func (t *Transceiver) aggregate(name string, ts time.Time, v float64) {
+	if t.aggregation == nil {
+		return
+	}
+	t.liveLk.RLock()
+	rules := t.AggregationRules
+	t.liveLk.RUnlock()
+	for _, r := range rules {
+		if output := r.outputName(name); output != "" && output != name {
+			t.aggregation.add(r, output, ts, v)
+		}
+	}
+}
+
+// The aggregation buffer is checked this often for finished
+// intervals.
+const aggregationTick = time.Second
+
+func (t *Transceiver) startAggregator() {
+	log.Printf("Starting aggregator, %d rules...", len(t.AggregationRules))
+	t.aggregation = newAggregationBuffer()
+	t.aggregationStop = make(chan bool)
+	t.aggregationWg.Add(1)
+	go func() {
+		defer t.aggregationWg.Done()
+		tick := time.NewTicker(aggregationTick)
+		defer tick.Stop()
+		for {
+			select {
+			case now := <-tick.C:
+				t.queueDataPoints(t.aggregation.drain(now))
+			case <-t.aggregationStop:
+				t.queueDataPoints(t.aggregation.drain(time.Time{}))
+				return
+			}
+		}
+	}()
+}
+
+func (t *Transceiver) stopAggregator() {
+	if t.aggregationStop != nil {
+		log.Printf("stopAggregator(): flushing the aggregation buffer...")
+		close(t.aggregationStop)
+		t.aggregationWg.Wait()
+	}
+}
@@ -0,0 +1,61 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SeriesAliasRule maps names matching Regexp to a canonical name, so
+// that e.g. a host reporting as both "web1" and "web1.example.com"
+// ends up in one series. Canonical may refer to submatches as $1 etc,
+// as in regexp.Expand. Aliases are applied before storage, they do
+// not merge series which already exist.
+type SeriesAliasRule struct {
+	Regexp    *regexp.Regexp
+	Canonical string
+}
+
+// UnmarshalText parses a "<regexp> <canonical>" rule.
+func (r *SeriesAliasRule) UnmarshalText(text []byte) (err error) {
+	parts := strings.Fields(string(text))
+	if len(parts) != 2 {
+		return fmt.Errorf("series alias rule: expected a regexp and a canonical name, got %q", string(text))
+	}
+	if r.Regexp, err = regexp.Compile(parts[0]); err != nil {
+		return fmt.Errorf("series alias rule: %v", err)
+	}
+	r.Canonical = parts[1]
+	return nil
+}
+
+// canonicalName returns the name as rewritten by the first matching
+// SeriesAliasRule, or unchanged if none matches.
+func (t *Transceiver) canonicalName(name string) string {
+	t.liveLk.RLock()
+	defer t.liveLk.RUnlock()
+	for _, r := range t.SeriesAliasRules {
+		if m := r.Regexp.FindStringSubmatchIndex(name); m != nil {
+			var result []byte
+			result = append(result, name[:m[0]]...)
+			result = r.Regexp.ExpandString(result, r.Canonical, name, m)
+			return string(append(result, name[m[1]:]...))
+		}
+	}
+	return name
+}
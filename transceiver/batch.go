@@ -0,0 +1,164 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"github.com/tgres/tgres/rrd"
+	"github.com/tgres/tgres/statsd"
+	"log"
+	"time"
+)
+
+// Flushing one ds at a time is several round trips to the db apiece,
+// which doesn't keep up with a high ingest rate. If the serde is an
+// rrd.BatchFlusher and FlushBatchSize is set, a flusher instead
+// accumulates the ds's to flush, and flushes them all at once when
+// there are FlushBatchSize of them or every FlushBatchInterval,
+// whichever comes first.
+
+// batchFlusher is the flusher loop when batching. A blocking flush
+// request (e.g. a ds being relinquished) flushes the batch right away.
+// A request for a ds whose flush is being retried waits behind it,
+// like in flusher().
+func (t *Transceiver) batchFlusher(id int64, bf rrd.BatchFlusher) {
+	interval := t.FlushBatchInterval
+	if interval <= 0 {
+		interval = dftFlushBatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	retries := &flushRetries{queued: make(map[int64][]*dsFlushRequest)}
+	var batch []*dsFlushRequest
+	for {
+		select {
+		case fr, ok := <-t.flusherChs[id]:
+			if !ok {
+				t.flushBatch(id, bf, retries, batch, true)
+				log.Printf("flusher(%d): channel closed, exiting", id)
+				return
+			}
+			if retries.queue(fr) {
+				continue // behind a failed flush of the same ds
+			}
+			batch = append(batch, fr)
+			if len(batch) >= t.FlushBatchSize || fr.resp != nil {
+				t.flushBatch(id, bf, retries, batch, false)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.flushBatch(id, bf, retries, batch, false)
+			batch = nil
+		}
+	}
+}
+
+const dftFlushBatchInterval = time.Second
+
+// flushBatch flushes a batch. If it fails, it is retried like a
+// single ds (see retryFlushes), as a whole, by retryBatch. Unless
+// closing (by then the stat worker is gone), the latency and the size
+// of the batch are sent as the tgres.flush_batch.latency and
+// tgres.flush_batch.size stats.
+func (t *Transceiver) flushBatch(id int64, bf rrd.BatchFlusher, retries *flushRetries, batch []*dsFlushRequest, closing bool) {
+	var (
+		dss []*rrd.DataSource
+		frs []*dsFlushRequest
+	)
+	for _, fr := range batch {
+		if t.spooled(fr.ds, false) {
+			fr.respond(true)
+			continue
+		}
+		dss = append(dss, fr.ds)
+		frs = append(frs, fr)
+	}
+	if len(dss) == 0 {
+		return
+	}
+
+	start := time.Now()
+	err := bf.FlushDataSources(dss)
+	if !closing {
+		t.QueueStat(&statsd.Stat{Name: "tgres.flush_batch.latency", Value: float64(time.Now().Sub(start).Nanoseconds()) / 1e6, Metric: "ms"})
+		t.QueueStat(&statsd.Stat{Name: "tgres.flush_batch.size", Value: float64(len(dss)), Metric: "g"})
+	}
+
+	t.liveLk.RLock()
+	retry := t.FlushMaxRetries > 0
+	t.liveLk.RUnlock()
+	if err != nil && retry {
+		for _, ds := range dss {
+			retries.start(ds.Id)
+		}
+		t.flusherWg.Add(1)
+		go t.retryBatch(id, bf, retries, frs, err)
+		return
+	}
+	t.batchFlushed(id, frs, err)
+}
+
+// retryBatch retries the failed flush of a batch up to FlushMaxRetries
+// times, with a backoff, then flushes the requests for its ds's which
+// were queued behind it meanwhile.
+func (t *Transceiver) retryBatch(id int64, bf rrd.BatchFlusher, retries *flushRetries, frs []*dsFlushRequest, err error) {
+	defer t.flusherWg.Done()
+	t.liveLk.RLock()
+	delay, maxRetries := t.FlushRetryDelay, t.FlushMaxRetries
+	t.liveLk.RUnlock()
+
+	dss := make([]*rrd.DataSource, len(frs))
+	for i, fr := range frs {
+		dss[i] = fr.ds
+	}
+	for retry := 1; err != nil && retry <= maxRetries; retry++ {
+		log.Printf("flusher(%d): error flushing a batch of %d data sources (retrying in %v): %v", id, len(dss), delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		err = bf.FlushDataSources(dss)
+	}
+	t.batchFlushed(id, frs, err)
+
+	done := make(map[int64]bool, len(frs))
+	for _, fr := range frs {
+		if !done[fr.ds.Id] {
+			done[fr.ds.Id] = true
+			t.flusherWg.Add(1)
+			go t.retryFlushes(id, retries, fr, nil) // only the queued ones
+		}
+	}
+}
+
+// batchFlushed responds to the requests of a batch flushed with err.
+// If it failed, the ds's go to the spool, if any, or the dead-letter
+// buffer.
+func (t *Transceiver) batchFlushed(id int64, frs []*dsFlushRequest, err error) {
+	if err == nil {
+		t.markFlushed()
+		for _, fr := range frs {
+			fr.respond(true)
+		}
+		return
+	}
+	log.Printf("flusher(%d): error flushing a batch of %d data sources: %v", id, len(frs), err)
+	for _, fr := range frs {
+		spooled := t.spooled(fr.ds, true)
+		if !spooled {
+			t.deadLetters.add(fr.ds)
+		}
+		fr.respond(spooled)
+	}
+}
@@ -0,0 +1,58 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"github.com/tgres/tgres/rrd"
+	"sync"
+)
+
+// deadLetters keeps (a bounded number of) data sources which could
+// not be flushed even after FlushMaxRetries retries, so that their
+// points are not silently lost and the flusher can move on. When it
+// is full, the oldest ones are dropped.
+type deadLetters struct {
+	sync.Mutex
+	dss   []*rrd.DataSource
+	max   int
+	total int64 // ever added
+}
+
+func (d *deadLetters) add(ds *rrd.DataSource) {
+	d.Lock()
+	defer d.Unlock()
+	if d.max <= 0 {
+		return
+	}
+	if len(d.dss) >= d.max {
+		d.dss = d.dss[1:]
+	}
+	d.dss = append(d.dss, ds)
+	d.total++
+}
+
+// size returns the number of data sources and of data points (slots)
+// currently in the dead-letter buffer, and of data sources ever added.
+func (d *deadLetters) size() (dss, points int, total int64) {
+	d.Lock()
+	defer d.Unlock()
+	for _, ds := range d.dss {
+		for _, rra := range ds.RRAs {
+			points += len(rra.DPs)
+		}
+	}
+	return len(d.dss), points, d.total
+}
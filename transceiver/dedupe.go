@@ -0,0 +1,56 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import "github.com/tgres/tgres/rrd"
+
+// Normally, of several data points of a series with the same time
+// stamp, the first one counts: a data point is the value since the
+// previous one, the others cover no time at all. Some clients resend
+// a point with a corrected value, in which case the last one should
+// count. With DedupeSameTimestamp, the worker holds back the latest
+// data point of every ds (in pending), a later one with the same
+// (millisecond) time stamp replaces its value. A held back point is
+// processed when one with a later time stamp arrives, or at the next
+// periodic flush check (i.e. within the min/max cache duration), when
+// the ds is read (see requestDsCopies), or on shutdown.
+
+// dedupe returns the data point to process now, if any.
+func dedupe(pending map[int64]*rrd.DataPoint, dp *rrd.DataPoint) *rrd.DataPoint {
+	prev := pending[dp.DS.Id]
+	if prev != nil && prev.DS == dp.DS && prev.TimeStamp.UnixNano()/1e6 == dp.TimeStamp.UnixNano()/1e6 {
+		prev.Value = dp.Value // last write wins
+		return nil
+	}
+	pending[dp.DS.Id] = dp
+	return prev
+}
+
+// processPendingDs processes the held back data point of a ds, if any.
+func (t *Transceiver) processPendingDs(id, dsId int64, pending map[int64]*rrd.DataPoint, recent map[int64]bool) {
+	if dp := pending[dsId]; dp != nil {
+		t.processDataPoint(id, dp, recent)
+		delete(pending, dsId)
+	}
+}
+
+// processPending processes the held back data points.
+func (t *Transceiver) processPending(id int64, pending map[int64]*rrd.DataPoint, recent map[int64]bool) {
+	for dsId, dp := range pending {
+		t.processDataPoint(id, dp, recent)
+		delete(pending, dsId)
+	}
+}
@@ -0,0 +1,296 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A DerivedMetric is a series computed from other series, e.g.
+//
+//	foo.total = foo.a + foo.b
+//
+// Supported are +, -, *, / (with the usual precedence), parentheses
+// and numbers. Operators must be separated by spaces, because a
+// series name may contain a "-". When an input series is flushed, its
+// (highest resolution) slots are recorded, and once all of the inputs
+// for a slot are in, the result is queued as a data point for the
+// derived series. A missing input is NaN, which makes the result NaN.
+type DerivedMetric struct {
+	Name   string
+	Inputs []string
+	expr   derivedExpr
+}
+
+type derivedExpr interface {
+	eval(values map[string]float64) float64
+}
+
+type derivedName string
+type derivedConst float64
+type derivedOp struct {
+	op          string
+	left, right derivedExpr
+}
+
+func (n derivedName) eval(values map[string]float64) float64 {
+	if v, ok := values[string(n)]; ok {
+		return v
+	}
+	return math.NaN()
+}
+
+func (c derivedConst) eval(map[string]float64) float64 { return float64(c) }
+
+func (o *derivedOp) eval(values map[string]float64) float64 {
+	l, r := o.left.eval(values), o.right.eval(values)
+	switch o.op {
+	case "+":
+		return l + r
+	case "-":
+		return l - r
+	case "*":
+		return l * r
+	}
+	return l / r
+}
+
+// ParseDerivedMetric parses a "name = expression" rule.
+func ParseDerivedMetric(rule string) (*DerivedMetric, error) {
+	parts := strings.SplitN(rule, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return nil, fmt.Errorf("ParseDerivedMetric(): expected name = expression, got %q", rule)
+	}
+
+	var tokens []string
+	for _, field := range strings.Fields(parts[1]) {
+		for strings.HasPrefix(field, "(") {
+			tokens, field = append(tokens, "("), field[1:]
+		}
+		closing := 0
+		for strings.HasSuffix(field, ")") {
+			field, closing = field[:len(field)-1], closing+1
+		}
+		if field != "" {
+			tokens = append(tokens, field)
+		}
+		for ; closing > 0; closing-- {
+			tokens = append(tokens, ")")
+		}
+	}
+
+	p := &derivedParser{tokens: tokens, inputs: make(map[string]bool)}
+	expr, err := p.expr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ParseDerivedMetric(): %q: %v", rule, err)
+	}
+
+	dm := &DerivedMetric{Name: strings.TrimSpace(parts[0]), expr: expr}
+	for name := range p.inputs {
+		dm.Inputs = append(dm.Inputs, name)
+	}
+	return dm, nil
+}
+
+type derivedParser struct {
+	tokens []string
+	pos    int
+	inputs map[string]bool
+}
+
+func (p *derivedParser) next() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// expr := term (("+" | "-") term)*
+func (p *derivedParser) expr() (derivedExpr, error) {
+	left, err := p.term()
+	for err == nil && (p.next() == "+" || p.next() == "-") {
+		op := p.next()
+		p.pos++
+		var right derivedExpr
+		if right, err = p.term(); err == nil {
+			left = &derivedOp{op, left, right}
+		}
+	}
+	return left, err
+}
+
+// term := factor (("*" | "/") factor)*
+func (p *derivedParser) term() (derivedExpr, error) {
+	left, err := p.factor()
+	for err == nil && (p.next() == "*" || p.next() == "/") {
+		op := p.next()
+		p.pos++
+		var right derivedExpr
+		if right, err = p.factor(); err == nil {
+			left = &derivedOp{op, left, right}
+		}
+	}
+	return left, err
+}
+
+// factor := number | name | "(" expr ")"
+func (p *derivedParser) factor() (derivedExpr, error) {
+	tok := p.next()
+	p.pos++
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "+", "-", "*", "/", ")":
+		return nil, fmt.Errorf("unexpected %q", tok)
+	case "(":
+		expr, err := p.expr()
+		if err == nil && p.next() != ")" {
+			err = fmt.Errorf("missing )")
+		}
+		p.pos++
+		return expr, err
+	}
+	if f, err := strconv.ParseFloat(tok, 64); err == nil {
+		return derivedConst(f), nil
+	}
+	p.inputs[tok] = true
+	return derivedName(tok), nil
+}
+
+// derivedState collects the flushed input slots of derived metrics.
+type derivedState struct {
+	sync.Mutex
+	byInput map[string][]*DerivedMetric
+	pending map[*DerivedMetric]map[int64]*derivedSlot // by slot time in ms
+	done    map[*DerivedMetric]int64                  // the latest slot emitted, never reopened
+	maxWait time.Duration                             // for missing inputs
+}
+
+type derivedSlot struct {
+	values map[string]float64
+	since  time.Time
+}
+
+func newDerivedState(dms []*DerivedMetric, maxWait time.Duration) *derivedState {
+	ds := &derivedState{
+		byInput: make(map[string][]*DerivedMetric),
+		pending: make(map[*DerivedMetric]map[int64]*derivedSlot),
+		done:    make(map[*DerivedMetric]int64),
+		maxWait: maxWait,
+	}
+	for _, dm := range dms {
+		for _, input := range dm.Inputs {
+			ds.byInput[input] = append(ds.byInput[input], dm)
+		}
+		ds.pending[dm] = make(map[int64]*derivedSlot)
+	}
+	return ds
+}
+
+// record the slots of a DS about to be flushed, and return the
+// derived data points that can now be computed.
+func (d *derivedState) record(ds *rrd.DataSource, now time.Time) []*rrd.DataPoint {
+	d.Lock()
+	defer d.Unlock()
+
+	var result []*rrd.DataPoint
+
+	dms := d.byInput[ds.Name]
+	if len(dms) > 0 {
+		var rra *rrd.RoundRobinArchive // highest resolution
+		for _, r := range ds.RRAs {
+			if rra == nil || r.StepsPerRow < rra.StepsPerRow {
+				rra = r
+			}
+		}
+		if rra != nil {
+			for slot, value := range rra.DPs {
+				ms := rra.SlotTimeStamp(ds, slot).UnixNano() / 1000000
+				for _, dm := range dms {
+					if ms <= d.done[dm] {
+						continue // already emitted, a re-flush
+					}
+					s := d.pending[dm][ms]
+					if s == nil {
+						s = &derivedSlot{values: make(map[string]float64), since: now}
+						d.pending[dm][ms] = s
+					}
+					s.values[ds.Name] = value
+				}
+			}
+		}
+	}
+
+	// Compute the latest complete (or expired) slot and all those
+	// before it, in order. An earlier slot still missing an input is
+	// given up on, its point would be out of order later.
+	for dm, slots := range d.pending {
+		var ready int64
+		for ms, s := range slots {
+			if ms > ready && (len(s.values) == len(dm.Inputs) || now.Sub(s.since) > d.maxWait) {
+				ready = ms
+			}
+		}
+		if ready == 0 {
+			continue
+		}
+		var due []int64
+		for ms := range slots {
+			if ms <= ready {
+				due = append(due, ms)
+			}
+		}
+		sort.Slice(due, func(i, j int) bool { return due[i] < due[j] })
+		for _, ms := range due {
+			result = append(result, &rrd.DataPoint{
+				Name:      dm.Name,
+				TimeStamp: time.Unix(ms/1000, (ms%1000)*1000000),
+				Value:     dm.expr.eval(slots[ms].values),
+			})
+			delete(slots, ms)
+		}
+		d.done[dm] = ready
+	}
+
+	return result
+}
+
+// deriveFromFlush is called before a DS is flushed, there is nothing
+// to do unless the DS is an input of a derived metric.
+func (t *Transceiver) deriveFromFlush(ds *rrd.DataSource) {
+	if t.derived == nil {
+		return
+	}
+	if dps := t.derived.record(ds, time.Now()); len(dps) > 0 {
+		// We're in a worker, which the dispatcher may be waiting on.
+		go func() {
+			select {
+			case t.dpsCh <- dps:
+			case <-t.dispatcherDone: // we're exiting, e.g. the last flushAll
+			}
+		}()
+	}
+}
@@ -0,0 +1,119 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"sync"
+	"time"
+)
+
+// dirtySet keeps track of data sources that have received data
+// points since they were last flushed, along with the (real) time of
+// the first such data point. There is one dirtySet per worker, so
+// the lock is rarely contended, it only exists so that the set can
+// be inspected (e.g. for stats) and cleared by a flush originating
+// outside the worker (e.g. a cluster Relinquish). A ds queued to be
+// flushed stays dirty (as of the same time) until the flusher is done
+// with it, see flushing() and flushed().
+type dirtySet struct {
+	sync.Mutex
+	m        map[int64]time.Time   // not queued to be flushed yet
+	inFlight map[int64][]time.Time // queued, in order
+}
+
+func newDirtySet() *dirtySet {
+	return &dirtySet{m: make(map[int64]time.Time), inFlight: make(map[int64][]time.Time)}
+}
+
+// add marks the ds as dirty as of t, unless it is already dirty.
+func (d *dirtySet) add(dsId int64, t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.m[dsId]; !ok {
+		d.m[dsId] = t
+	}
+}
+
+// remove the ds, flushed or not.
+func (d *dirtySet) remove(dsId int64) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.m, dsId)
+	delete(d.inFlight, dsId)
+}
+
+// flushing marks the points of the ds so far as queued to be flushed,
+// and returns the time it became dirty (zero if it isn't), which is
+// to be passed to flushed() once they are.
+func (d *dirtySet) flushing(dsId int64) time.Time {
+	d.Lock()
+	defer d.Unlock()
+	t, ok := d.m[dsId]
+	if ok {
+		delete(d.m, dsId)
+		d.inFlight[dsId] = append(d.inFlight[dsId], t)
+	}
+	return t
+}
+
+// flushed marks the points queued to be flushed as of since (see
+// flushing()) as no longer dirty.
+func (d *dirtySet) flushed(dsId int64, since time.Time) {
+	if since.IsZero() {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	q := d.inFlight[dsId]
+	for i, t := range q {
+		if t.Equal(since) {
+			q = append(q[:i:i], q[i+1:]...)
+			break
+		}
+	}
+	if len(q) == 0 {
+		delete(d.inFlight, dsId)
+	} else {
+		d.inFlight[dsId] = q
+	}
+}
+
+// each calls f for every ds in the set with the time it became
+// dirty, f must not modify the set.
+func (d *dirtySet) each(f func(dsId int64, since time.Time)) {
+	d.Lock()
+	defer d.Unlock()
+	for dsId, q := range d.inFlight {
+		f(dsId, q[0]) // queued before any of m
+	}
+	for dsId, t := range d.m {
+		if _, ok := d.inFlight[dsId]; !ok {
+			f(dsId, t)
+		}
+	}
+}
+
+// oldest returns the time of the oldest unflushed data point in the
+// set, or zero time if the set is empty.
+func (d *dirtySet) oldest() time.Time {
+	var result time.Time
+	d.each(func(_ int64, t time.Time) {
+		if result.IsZero() || t.Before(result) {
+			result = t
+		}
+	})
+	return result
+}
@@ -0,0 +1,79 @@
+package transceiver
+
+import (
+	"github.com/tgres/tgres/rrd"
+	"testing"
+	"time"
+)
+
+func TestOldestDirtyPointAge(t *testing.T) {
+	tr := &Transceiver{NWorkers: 2, dirty: []*dirtySet{newDirtySet(), newDirtySet()}}
+
+	if age := tr.OldestDirtyPointAge(); age != 0 {
+		t.Errorf("empty dirty set: expected 0 age, got %v", age)
+	}
+
+	now := time.Now()
+	tr.dirty[0].add(2, now.Add(-5*time.Second))
+	tr.dirty[1].add(1, now.Add(-30*time.Second))
+	tr.dirty[1].add(1, now) // already dirty, must not move forward
+	tr.dirty[1].add(3, now.Add(-10*time.Second))
+
+	if age := tr.OldestDirtyPointAge(); age < 30*time.Second || age > 31*time.Second {
+		t.Errorf("expected age of ~30s, got %v", age)
+	}
+
+	// Queued to be flushed, it stays dirty until it is
+	since := tr.dirty[1].flushing(1)
+	tr.dirty[1].add(1, now.Add(-20*time.Second)) // arriving meanwhile
+	if age := tr.OldestDirtyPointAge(); age < 30*time.Second || age > 31*time.Second {
+		t.Errorf("expected age of ~30s while flushing, got %v", age)
+	}
+	tr.dirty[1].flushed(1, since)
+	if age := tr.OldestDirtyPointAge(); age < 20*time.Second || age > 21*time.Second {
+		t.Errorf("expected age of ~20s after flush, got %v", age)
+	}
+
+	tr.dirty[1].remove(1)
+	if age := tr.OldestDirtyPointAge(); age < 10*time.Second || age > 11*time.Second {
+		t.Errorf("expected age of ~10s after removal, got %v", age)
+	}
+
+	if s := tr.Stats(); s.OldestDirtyPointAge < 10 {
+		t.Errorf("Stats(): expected OldestDirtyPointAge >= 10, got %v", s.OldestDirtyPointAge)
+	}
+}
+
+// gateSerDe flushes once gate is closed.
+type gateSerDe struct {
+	flushCheckSerDe
+	gate chan struct{}
+}
+
+func (f *gateSerDe) FlushDataSource(ds *rrd.DataSource) error {
+	<-f.gate
+	return nil
+}
+
+func TestDirtyUntilFlushed(t *testing.T) {
+	serde := &gateSerDe{gate: make(chan struct{})}
+	tr := New(nil, serde)
+	tr.NWorkers = 1
+	tr.dirty = []*dirtySet{newDirtySet()}
+	tr.startFlushers()
+	tr.startWg.Wait()
+
+	rra := &rrd.RoundRobinArchive{StepsPerRow: 1, Size: 10, DPs: map[int64]float64{1: 1}}
+	ds := &rrd.DataSource{Id: 1, Name: "foo.bar", RRAs: []*rrd.RoundRobinArchive{rra}}
+	tr.dirty[0].add(ds.Id, time.Now().Add(-10*time.Second))
+	tr.flushDs(ds, false)
+	if age := tr.OldestDirtyPointAge(); age < 10*time.Second {
+		t.Errorf("expected age of ~10s while the flush is queued, got %v", age)
+	}
+
+	close(serde.gate)
+	tr.stopFlushers()
+	if age := tr.OldestDirtyPointAge(); age != 0 {
+		t.Errorf("expected 0 age once flushed, got %v", age)
+	}
+}
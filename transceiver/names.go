@@ -0,0 +1,145 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// NameReplaceRule replaces all matches of Regexp in incoming names
+// with Replacement, which may refer to submatches as $1 etc, as in
+// regexp.ReplaceAllString.
+type NameReplaceRule struct {
+	Regexp      *regexp.Regexp
+	Replacement string
+}
+
+// UnmarshalText parses a "<regexp> [<replacement>]" rule, without a
+// replacement the matches are removed.
+func (r *NameReplaceRule) UnmarshalText(text []byte) (err error) {
+	parts := strings.Fields(string(text))
+	if len(parts) < 1 || len(parts) > 2 {
+		return fmt.Errorf("name replace rule: expected a regexp and an optional replacement, got %q", string(text))
+	}
+	if r.Regexp, err = regexp.Compile(parts[0]); err != nil {
+		return fmt.Errorf("name replace rule: %v", err)
+	}
+	if len(parts) == 2 {
+		r.Replacement = parts[1]
+	}
+	return nil
+}
+
+var (
+	illegalNameChars = regexp.MustCompile(`[^A-Za-z0-9_\-.:]`)
+	repeatedDots     = regexp.MustCompile(`\.\.+`)
+)
+
+// sanitizeName replaces the characters which are not letters, digits
+// or one of "_-.:" with underscores, collapses repeated dots and
+// strips leading and trailing ones. Only the part before the tags
+// (see TaggedName) is sanitized.
+func sanitizeName(name string) string {
+	base, tags := name, ""
+	if i := strings.IndexByte(name, ';'); i >= 0 {
+		base, tags = name[:i], name[i:]
+	}
+	base = illegalNameChars.ReplaceAllString(base, "_")
+	base = strings.Trim(repeatedDots.ReplaceAllString(base, "."), ".")
+	if base == "" {
+		return ""
+	}
+	return base + tags
+}
+
+// replaceName applies all of the NameReplaceRules in order, then
+// sanitizeName if SanitizeNames.
+func (t *Transceiver) replaceName(name string) string {
+	t.liveLk.RLock()
+	defer t.liveLk.RUnlock()
+	for _, r := range t.NameReplaceRules {
+		name = r.Regexp.ReplaceAllString(name, r.Replacement)
+	}
+	if t.SanitizeNames {
+		name = sanitizeName(name)
+	}
+	return name
+}
+
+// NamePattern is a glob, where * matches any characters (dots
+// included) and ? any one, or a regexp between slashes, e.g.
+// "/^web\d+\./". A glob matches the whole name, a regexp any part
+// of it unless anchored.
+type NamePattern struct{ *regexp.Regexp }
+
+func (p *NamePattern) UnmarshalText(text []byte) (err error) {
+	s := string(text)
+	if len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		if p.Regexp, err = regexp.Compile(s[1 : len(s)-1]); err != nil {
+			return fmt.Errorf("name pattern: %v", err)
+		}
+		return nil
+	}
+	var re []string
+	for _, c := range s {
+		switch c {
+		case '*':
+			re = append(re, ".*")
+		case '?':
+			re = append(re, ".")
+		default:
+			re = append(re, regexp.QuoteMeta(string(c)))
+		}
+	}
+	p.Regexp, err = regexp.Compile("^" + strings.Join(re, "") + "$")
+	return err
+}
+
+// nameFiltered is true (and counted in Stats().RejectedFiltered) if
+// name matches one of the DenyNames, or none of the AllowNames if
+// there are any.
+func (t *Transceiver) nameFiltered(name string) bool {
+	t.liveLk.RLock()
+	allow, deny := t.AllowNames, t.DenyNames
+	t.liveLk.RUnlock()
+	if (len(allow) > 0 && !matchesAny(allow, name)) || matchesAny(deny, name) {
+		atomic.AddInt64(&t.rejectedFiltered, 1)
+		return true
+	}
+	return false
+}
+
+// nameTooLong is true (and counted in Stats().RejectedNameLength) if
+// name is longer than MaxSeriesNameLength.
+func (t *Transceiver) nameTooLong(name string) bool {
+	if t.MaxSeriesNameLength > 0 && len(name) > t.MaxSeriesNameLength {
+		atomic.AddInt64(&t.rejectedNameLength, 1)
+		return true
+	}
+	return false
+}
+
+func matchesAny(patterns []*NamePattern, name string) bool {
+	for _, p := range patterns {
+		if p.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"github.com/tgres/tgres/rrd"
+	"log"
+	"sync"
+	"time"
+)
+
+// preAggBuffer consolidates the data points of every series received
+// within PreAggWindow into one per DS step (the average of the
+// values, as of the latest time stamp), so that a very high rate
+// series costs one cache insert per step and window instead of one
+// per point. Points of different steps are never merged, the RRAs
+// would lose the earlier one.
+type preAggBuffer struct {
+	sync.Mutex
+	points map[preAggKey]*preAggPoint
+	steps  map[string]int64           // ms, looked up once per window
+	stepOf func(string) time.Duration // the DS step of a series
+}
+
+type preAggKey struct {
+	name string
+	end  int64 // ms, of the step, which is (end-step, end] as a PDP
+}
+
+type preAggPoint struct {
+	sum   float64
+	count int
+	ts    time.Time
+}
+
+func newPreAggBuffer(stepOf func(string) time.Duration) *preAggBuffer {
+	return &preAggBuffer{points: make(map[preAggKey]*preAggPoint), steps: make(map[string]int64), stepOf: stepOf}
+}
+
+func (b *preAggBuffer) add(name string, ts time.Time, value float64) {
+	b.Lock()
+	defer b.Unlock()
+	stepMs, ok := b.steps[name]
+	if !ok {
+		if stepMs = b.stepOf(name).Nanoseconds() / 1000000; stepMs <= 0 {
+			stepMs = 1
+		}
+		b.steps[name] = stepMs
+	}
+	ms := ts.UnixNano() / 1000000
+	key := preAggKey{name, (ms + stepMs - 1) / stepMs * stepMs}
+	p := b.points[key]
+	if p == nil {
+		p = &preAggPoint{}
+		b.points[key] = p
+	}
+	p.sum += value
+	p.count++
+	if ts.After(p.ts) {
+		p.ts = ts
+	}
+}
+
+// drain returns the consolidated data points and empties the buffer.
+func (b *preAggBuffer) drain() []*rrd.DataPoint {
+	b.Lock()
+	points := b.points
+	b.points = make(map[preAggKey]*preAggPoint, len(points))
+	b.steps = make(map[string]int64, len(b.steps)) // a reload may change them
+	b.Unlock()
+
+	dps := make([]*rrd.DataPoint, 0, len(points))
+	for key, p := range points {
+		dps = append(dps, &rrd.DataPoint{Name: key.name, TimeStamp: p.ts, Value: p.sum / float64(p.count)})
+	}
+	return dps
+}
+
+// preAggStep is the step of the DS spec of name, or PreAggWindow if
+// there is none.
+func (t *Transceiver) preAggStep(name string) time.Duration {
+	t.liveLk.RLock()
+	dsSpecs := t.DSSpecs
+	t.liveLk.RUnlock()
+	if dsSpec := dsSpecs.FindMatchingDSSpec(name); dsSpec != nil {
+		return dsSpec.Step
+	}
+	return t.PreAggWindow
+}
+
+func (t *Transceiver) startPreAggregator() {
+	log.Printf("Starting pre-aggregator, window %v...", t.PreAggWindow)
+	t.preAgg = newPreAggBuffer(t.preAggStep)
+	t.preAggStop = make(chan bool)
+	t.preAggWg.Add(1)
+	go func() {
+		defer t.preAggWg.Done()
+		tick := time.NewTicker(t.PreAggWindow)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				t.queueDataPoints(t.preAgg.drain())
+			case <-t.preAggStop:
+				t.queueDataPoints(t.preAgg.drain())
+				return
+			}
+		}
+	}()
+}
+
+func (t *Transceiver) stopPreAggregator() {
+	if t.preAggStop != nil {
+		log.Printf("stopPreAggregator(): flushing the pre-aggregation buffer...")
+		close(t.preAggStop)
+		t.preAggWg.Wait()
+	}
+}
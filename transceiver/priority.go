@@ -0,0 +1,173 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Series can be assigned a flush priority by name. When several data
+// sources are due to be flushed, the high priority ones go first, and
+// they are due as soon as MinCacheDuration has passed. Low priority
+// ones are flushed lowPriorityFactor times less often than normal.
+type FlushPriority int
+
+const (
+	FlushPriorityNormal FlushPriority = iota
+	FlushPriorityHigh
+	FlushPriorityLow
+)
+
+const lowPriorityFactor = 4
+
+func (p FlushPriority) String() string {
+	switch p {
+	case FlushPriorityHigh:
+		return "high"
+	case FlushPriorityLow:
+		return "low"
+	}
+	return "normal"
+}
+
+// rank orders priorities, high first.
+func (p FlushPriority) rank() int {
+	switch p {
+	case FlushPriorityHigh:
+		return 0
+	case FlushPriorityLow:
+		return 2
+	}
+	return 1
+}
+
+type FlushPriorityRule struct {
+	Regexp   *regexp.Regexp
+	Priority FlushPriority
+}
+
+// ParseFlushPriorityRule parses a "<high|normal|low> <regexp>" rule.
+func ParseFlushPriorityRule(rule string) (*FlushPriorityRule, error) {
+	parts := strings.Fields(rule)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("ParseFlushPriorityRule(): expected priority and regexp, got %q", rule)
+	}
+	r := &FlushPriorityRule{}
+	switch parts[0] {
+	case "high":
+		r.Priority = FlushPriorityHigh
+	case "normal":
+		r.Priority = FlushPriorityNormal
+	case "low":
+		r.Priority = FlushPriorityLow
+	default:
+		return nil, fmt.Errorf("ParseFlushPriorityRule(): invalid priority %q, must be one of high, normal or low", parts[0])
+	}
+	var err error
+	if r.Regexp, err = regexp.Compile(parts[1]); err != nil {
+		return nil, fmt.Errorf("ParseFlushPriorityRule(): %v", err)
+	}
+	return r, nil
+}
+
+// flushPriority returns the priority of the first matching rule.
+func (t *Transceiver) flushPriority(name string) FlushPriority {
+	t.liveLk.RLock()
+	defer t.liveLk.RUnlock()
+	for _, r := range t.FlushPriorityRules {
+		if r.Regexp.MatchString(name) {
+			return r.Priority
+		}
+	}
+	return FlushPriorityNormal
+}
+
+func (t *Transceiver) shouldBeFlushed(ds *rrd.DataSource, p FlushPriority) bool {
+	t.liveLk.RLock()
+	defer t.liveLk.RUnlock()
+	switch p {
+	case FlushPriorityHigh:
+		return ds.ShouldBeFlushed(t.MaxCachedPoints, t.MinCacheDuration, t.MinCacheDuration)
+	case FlushPriorityLow:
+		return ds.ShouldBeFlushed(t.MaxCachedPoints*lowPriorityFactor, t.MinCacheDuration*lowPriorityFactor, t.MaxCacheDuration*lowPriorityFactor)
+	}
+	return ds.ShouldBeFlushed(t.MaxCachedPoints, t.MinCacheDuration, t.MaxCacheDuration)
+}
+
+// flushRecent flushes those of the recently updated ds's (of worker
+// id) which are due, high priority first. The priorities map caches
+// the priority by ds id.
+func (t *Transceiver) flushRecent(id int64, recent map[int64]bool, priorities map[int64]FlushPriority) {
+	type due struct {
+		ds *rrd.DataSource
+		p  FlushPriority
+	}
+	var dues []due
+	for dsId := range recent {
+		ds := t.dss.GetById(dsId)
+		if ds == nil {
+			log.Printf("worker(%d): WAT? cannot lookup ds id (%d) to flush?", id, dsId)
+			continue
+		}
+		if p := t.cachedFlushPriority(ds, priorities); t.shouldBeFlushed(ds, p) {
+			dues = append(dues, due{ds, p})
+		}
+	}
+	sort.SliceStable(dues, func(i, j int) bool { return dues[i].p.rank() < dues[j].p.rank() })
+	for _, d := range dues {
+		t.flushDs(d.ds, false)
+		delete(recent, d.ds.Id)
+	}
+}
+
+func (t *Transceiver) cachedFlushPriority(ds *rrd.DataSource, priorities map[int64]FlushPriority) FlushPriority {
+	p, ok := priorities[ds.Id]
+	if !ok {
+		p = t.flushPriority(ds.Name)
+		priorities[ds.Id] = p
+	}
+	return p
+}
+
+// flushLag returns the age of the oldest unflushed data point by
+// priority.
+func (t *Transceiver) flushLag() map[FlushPriority]time.Duration {
+	result := make(map[FlushPriority]time.Duration)
+	now := time.Now()
+	t.liveLk.RLock()
+	hasRules := len(t.FlushPriorityRules) > 0
+	t.liveLk.RUnlock()
+	for _, d := range t.dirty {
+		d.each(func(dsId int64, since time.Time) {
+			p := FlushPriorityNormal
+			if hasRules {
+				if ds := t.dss.GetById(dsId); ds != nil {
+					p = t.flushPriority(ds.Name)
+				}
+			}
+			if age := now.Sub(since); age > result[p] {
+				result[p] = age
+			}
+		})
+	}
+	return result
+}
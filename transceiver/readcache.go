@@ -1,19 +1,35 @@
 package transceiver
 
 import (
+	"context"
 	"github.com/tgres/tgres/rrd"
+	"sort"
 	"time"
 )
 
 type ReadCache struct {
-	serde rrd.SerDe
-	dsns  *rrd.DataSourceNames
+	// FsFind() reloads the names (which are also added as series
+	// are created) only if they were loaded longer ago than this, 0
+	// means every time.
+	NamesTTL time.Duration
+	serde    rrd.SerDe
+	dsns     *rrd.DataSourceNames
+	dsCopies func(dsIds []int64) map[int64]*rrd.DataSource // in-memory ds's (with unflushed points), or nil
+	ctx      context.Context                               // for queries, see WithContext()
 }
 
 func (r *ReadCache) Reload() error {
 	return r.dsns.Reload(r.serde)
 }
 
+// WithContext returns a copy of the ReadCache whose storage queries
+// are cancelled when ctx is done, if the SerDe supports it.
+func (r *ReadCache) WithContext(ctx context.Context) *ReadCache {
+	rc := *r
+	rc.ctx = ctx
+	return &rc
+}
+
 // Satisfy DSGetter interface in tgres/dsl
 
 func (r *ReadCache) GetDSById(id int64) *rrd.DataSource {
@@ -25,13 +41,162 @@ func (r *ReadCache) DsIdsFromIdent(ident string) map[string]int64 {
 	return r.dsns.DsIdsFromIdent(ident)
 }
 
+// SeriesQuery returns the stored series merged with points that are
+// still in memory waiting to be flushed, so that e.g. until=now
+// includes the freshest data. Cached points later than to are not
+// included, and ranges ending before the last flushed update of the
+// ds are not merged at all.
 func (r *ReadCache) SeriesQuery(ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
-	return r.serde.SeriesQuery(ds, from, to, maxPoints)
+	series, err := r.SeriesQueries(map[string]*rrd.DataSource{"": ds}, from, to, maxPoints)
+	if err != nil {
+		return nil, err
+	}
+	return series[""], nil
 }
 
 // End of DSGetter
 
+// SeriesQueries is SeriesQuery for many ds's, the in-memory copies of
+// all of them are requested at once. Satisfies dsl.MultiSeriesQuerier.
+func (r *ReadCache) SeriesQueries(dss map[string]*rrd.DataSource, from, to time.Time, maxPoints int64) (map[string]rrd.Series, error) {
+	result := make(map[string]rrd.Series, len(dss))
+	var ids []int64
+	for name, ds := range dss {
+		series, err := r.storedSeries(ds, from, to, maxPoints)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = series
+		if r.dsCopies != nil && (to.IsZero() || !to.Before(ds.LastUpdate)) {
+			ids = append(ids, ds.Id)
+		}
+	}
+	if len(ids) == 0 {
+		return result, nil
+	}
+	copies := r.dsCopies(ids)
+	for name, ds := range dss {
+		if cached := copies[ds.Id]; cached != nil {
+			result[name] = newCachedSeries(result[name], cached, from, to)
+		}
+	}
+	return result, nil
+}
+
+func (r *ReadCache) storedSeries(ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
+	if cq, ok := r.serde.(rrd.ContextSeriesQuerier); ok && r.ctx != nil {
+		return cq.SeriesQueryContext(r.ctx, ds, from, to, maxPoints)
+	}
+	return r.serde.SeriesQuery(ds, from, to, maxPoints)
+}
+
 func (r *ReadCache) FsFind(pattern string) []*rrd.FsFindNode {
-	r.dsns.Reload(r.serde)
+	r.dsns.ReloadIfOlder(r.serde, r.NamesTTL)
 	return r.dsns.FsFind(pattern)
 }
+
+type cachedPoint struct {
+	begin, end time.Time
+	value      float64
+}
+
+type cachedPoints []cachedPoint
+
+// sort.Interface
+func (cps cachedPoints) Len() int           { return len(cps) }
+func (cps cachedPoints) Less(i, j int) bool { return cps[i].end.Before(cps[j].end) }
+func (cps cachedPoints) Swap(i, j int)      { cps[i], cps[j] = cps[j], cps[i] }
+
+// cachedSeries is a stored series followed by the unflushed points
+// of the matching RRA. Where both have the same slot, the cached
+// value wins, it is more recent.
+type cachedSeries struct {
+	rrd.Series
+	points     cachedPoints
+	lastUpdate time.Time
+	n          int          // next cached point
+	cur        *cachedPoint // current position is a cached point
+	storedDone bool
+}
+
+func newCachedSeries(stored rrd.Series, ds *rrd.DataSource, from, to time.Time) rrd.Series {
+	var rra *rrd.RoundRobinArchive
+	for _, r := range ds.RRAs {
+		if ds.StepMs*int64(r.StepsPerRow) == stored.StepMs() {
+			rra = r
+			break
+		}
+	}
+	if rra == nil || len(rra.DPs) == 0 {
+		return stored
+	}
+
+	step := time.Duration(stored.StepMs()) * time.Millisecond
+	points := make(cachedPoints, 0, len(rra.DPs))
+	for slot, value := range rra.DPs {
+		end := rra.SlotTimeStamp(ds, slot)
+		if end.After(from) && (to.IsZero() || !end.After(to)) {
+			points = append(points, cachedPoint{begin: end.Add(-step), end: end, value: value})
+		}
+	}
+	sort.Sort(points)
+
+	return &cachedSeries{Series: stored, points: points, lastUpdate: ds.LastUpdate}
+}
+
+func (s *cachedSeries) Next() bool {
+	s.cur = nil
+	if !s.storedDone {
+		if s.Series.Next() {
+			end := s.Series.CurrentPosEndsOn()
+			for s.n < len(s.points) && !s.points[s.n].end.After(end) {
+				// only a slot at the same resolution can be replaced
+				if s.points[s.n].end.Equal(end) && s.Series.GroupByMs() == s.Series.StepMs() {
+					s.cur = &s.points[s.n]
+				}
+				s.n++
+			}
+			return true
+		}
+		s.storedDone = true
+	}
+	if s.n < len(s.points) {
+		s.cur = &s.points[s.n]
+		s.n++
+		return true
+	}
+	return false
+}
+
+func (s *cachedSeries) Close() error {
+	s.n, s.cur, s.storedDone = 0, nil, false
+	return s.Series.Close()
+}
+
+func (s *cachedSeries) CurrentValue() float64 {
+	if s.cur != nil {
+		return s.cur.value
+	}
+	return s.Series.CurrentValue()
+}
+
+func (s *cachedSeries) CurrentPosBeginsAfter() time.Time {
+	if s.cur != nil {
+		return s.cur.begin
+	}
+	return s.Series.CurrentPosBeginsAfter()
+}
+
+func (s *cachedSeries) CurrentPosEndsOn() time.Time {
+	if s.cur != nil {
+		return s.cur.end
+	}
+	return s.Series.CurrentPosEndsOn()
+}
+
+func (s *cachedSeries) LastUpdate() time.Time {
+	if s.lastUpdate.After(s.Series.LastUpdate()) {
+		return s.lastUpdate
+	}
+	return s.Series.LastUpdate()
+}
@@ -0,0 +1,118 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	"log"
+)
+
+// RenameExisting determines what RenameSeries does when the new name
+// is already taken by another series.
+type RenameExisting int
+
+const (
+	RenameExistingFail    RenameExisting = iota // don't rename (default)
+	RenameExistingReplace                       // delete the other series, the renamed one takes its place
+	RenameExistingMerge                         // keep the other series, fill its gaps from the renamed one
+)
+
+func (e *RenameExisting) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "", "fail":
+		*e = RenameExistingFail
+	case "replace":
+		*e = RenameExistingReplace
+	case "merge":
+		*e = RenameExistingMerge
+	default:
+		return fmt.Errorf("invalid rename existing %q, must be fail, replace or merge", string(text))
+	}
+	return nil
+}
+
+var (
+	ErrNoSuchSeries = errors.New("no such series")
+	ErrSeriesExists = errors.New("series already exists")
+)
+
+// RenameSeries renames the series from to to, with all of its history
+// (the data stays with the ds id, only the name changes). If to
+// exists, existing decides, RenameExistingFail returns
+// ErrSeriesExists, RenameExistingMerge keeps the history of to and
+// fills in the slots it has no data for from that of from. It returns ErrNoSuchSeries if there is no series
+// from. Points of from not yet flushed are lost, and points arriving
+// after this for from create it anew.
+func (t *Transceiver) RenameSeries(from, to string, existing RenameExisting) error {
+	renamer, ok := t.serde.(rrd.DataSourceRenamer)
+	if !ok {
+		return fmt.Errorf("the serde cannot rename data sources")
+	}
+	if err := t.Rcache.Reload(); err != nil { // names created by other nodes too
+		return err
+	}
+	fromId, ok := t.Rcache.DsIdsFromIdent(from)[from]
+	if !ok || from == "" {
+		return ErrNoSuchSeries
+	}
+	if toId, ok := t.Rcache.DsIdsFromIdent(to)[to]; ok && to != "" {
+		if existing == RenameExistingFail {
+			return ErrSeriesExists
+		}
+		if existing == RenameExistingMerge {
+			merger, ok := t.serde.(rrd.DataSourceMerger)
+			if !ok {
+				return fmt.Errorf("the serde cannot merge data sources")
+			}
+			if err := merger.MergeDataSource(fromId, toId); err != nil {
+				return err
+			}
+			// the cached ds of to has only unflushed points, it stays
+			t.forgetSeries(from, fromId)
+			log.Printf("RenameSeries(): %q exists, merged %q (ds %d) into it (ds %d).", to, from, fromId, toId)
+			return nil
+		}
+		replacer, ok := t.serde.(rrd.DataSourceReplacer)
+		if !ok {
+			return fmt.Errorf("the serde cannot replace data sources")
+		}
+		if err := replacer.ReplaceDataSource(fromId, to, toId); err != nil {
+			return err
+		}
+		t.forgetSeries(to, toId)
+		log.Printf("RenameSeries(): %q exists, deleted it (ds %d) to be replaced.", to, toId)
+	} else if err := renamer.RenameDataSource(fromId, to); err != nil {
+		return err
+	}
+	t.forgetSeries(from, fromId)
+	t.Rcache.dsns.Add(to, fromId)
+	log.Printf("RenameSeries(): renamed %q to %q (ds %d).", from, to, fromId)
+	return nil
+}
+
+// forgetSeries drops the ds from the caches, a data point for name
+// after this creates (or loads) it again.
+func (t *Transceiver) forgetSeries(name string, dsId int64) {
+	if ds := t.dss.GetById(dsId); ds != nil {
+		t.dss.Delete(ds)
+	}
+	if len(t.dirty) > 0 {
+		t.dirty[t.dsShard(dsId)].remove(dsId)
+	}
+	t.Rcache.dsns.Delete(name)
+}
@@ -0,0 +1,95 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// maxRewrittenNameLen bounds the output (and therefore the execution)
+// of a rewrite script, templates cannot loop forever otherwise.
+const maxRewrittenNameLen = 1024
+
+// A NameRewriter renames incoming data points using a Go template
+// (https://golang.org/pkg/text/template/). The template is executed
+// with the name split into .Segments (and the whole .Name), e.g.
+//
+//	{{index .Segments 2}}.{{index .Segments 0}}
+//
+// rewrites "a.b.c" to "c.a". Besides the template builtins, there is
+// join (e.g. {{join .Segments "_"}}), drop (e.g. {{drop .Segments 1}},
+// the segments without the second one), lower, upper and replace. A
+// template has no access to anything outside of the name. An empty
+// result drops the data point.
+type NameRewriter struct {
+	tmpl *template.Template
+}
+
+type nameRewriteData struct {
+	Name     string
+	Segments []string
+}
+
+var nameRewriteFuncs = template.FuncMap{
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"replace": func(s, old, new string) string {
+		return strings.Replace(s, old, new, -1)
+	},
+	"drop": func(segments []string, i int) []string {
+		if i < 0 || i >= len(segments) {
+			return segments
+		}
+		return append(append([]string{}, segments[:i]...), segments[i+1:]...)
+	},
+}
+
+func NewNameRewriter(script string) (*NameRewriter, error) {
+	tmpl, err := template.New("name-rewrite").Funcs(nameRewriteFuncs).Option("missingkey=error").Parse(script)
+	if err != nil {
+		return nil, fmt.Errorf("NewNameRewriter(): %v", err)
+	}
+	return &NameRewriter{tmpl: tmpl}, nil
+}
+
+// Rewrite returns the new name, or an error if the template fails
+// (e.g. an index out of range) or its output is too long.
+func (r *NameRewriter) Rewrite(name string) (string, error) {
+	w := &limitedBuffer{max: maxRewrittenNameLen}
+	if err := r.tmpl.Execute(w, &nameRewriteData{Name: name, Segments: strings.Split(name, ".")}); err != nil {
+		return "", fmt.Errorf("Rewrite(%q): %v", name, err)
+	}
+	return strings.TrimSpace(w.String()), nil
+}
+
+var errNameTooLong = errors.New("rewritten name too long")
+
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		return 0, errNameTooLong
+	}
+	return b.Buffer.Write(p)
+}
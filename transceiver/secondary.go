@@ -0,0 +1,129 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"github.com/tgres/tgres/rrd"
+	"log"
+	"time"
+)
+
+// A ds marked Secondary also has its coarsest archive written to the
+// SecondaryStore (e.g. a cheaper database for long retention), after
+// every flush and asynchronously, by the secondaryFlusher. There the
+// archive has the same step and consolidation function, and is kept
+// for SecondaryRetention, if that is longer.
+
+// secondaryFlush queues a (copy of a Secondary) ds being flushed
+// for the secondary store, it never blocks the caller.
+func (t *Transceiver) secondaryFlush(ds *rrd.DataSource) {
+	if t.secondaryCh == nil {
+		return
+	}
+	select {
+	case t.secondaryCh <- ds:
+	default:
+		log.Printf("secondaryFlush(): secondary store is not keeping up, dropping flush of %q", ds.Name)
+		t.QueueStatCount("tgres.secondary_store_drops", 1)
+	}
+}
+
+func (t *Transceiver) startSecondaryFlusher() {
+	log.Printf("Starting secondary store flusher...")
+	t.secondaryCh = make(chan *rrd.DataSource, 1024)
+	t.secondaryWg.Add(1)
+	go t.secondaryFlusher()
+}
+
+func (t *Transceiver) stopSecondaryFlusher() {
+	if t.secondaryCh != nil {
+		log.Printf("stopSecondaryFlusher(): waiting for the secondary store flusher to finish...")
+		close(t.secondaryCh)
+		t.secondaryWg.Wait()
+	}
+}
+
+func (t *Transceiver) secondaryFlusher() {
+	defer t.secondaryWg.Done()
+
+	dss := make(map[string]*rrd.DataSource) // in the secondary store, by name
+	for ds := range t.secondaryCh {
+		if err := t.flushSecondary(dss, ds); err != nil {
+			log.Printf("secondaryFlusher(): error flushing %q: %v", ds.Name, err)
+		}
+	}
+}
+
+// coarsestRRA returns the archive with the longest step (and of
+// those the longest), or nil.
+func coarsestRRA(ds *rrd.DataSource) *rrd.RoundRobinArchive {
+	var result *rrd.RoundRobinArchive
+	for _, rra := range ds.RRAs {
+		if result == nil || rra.StepsPerRow > result.StepsPerRow ||
+			(rra.StepsPerRow == result.StepsPerRow && rra.Size > result.Size) {
+			result = rra
+		}
+	}
+	return result
+}
+
+func (t *Transceiver) flushSecondary(dss map[string]*rrd.DataSource, ds *rrd.DataSource) error {
+	rra := coarsestRRA(ds)
+	if rra == nil || len(rra.DPs) == 0 {
+		return nil
+	}
+	stepMs := ds.StepMs * int64(rra.StepsPerRow)
+
+	sds := dss[ds.Name]
+	if sds == nil {
+		step := time.Duration(stepMs) * time.Millisecond
+		size := step * time.Duration(rra.Size)
+		if t.SecondaryRetention > size {
+			size = t.SecondaryRetention / step * step
+		}
+		spec := &rrd.DSSpec{
+			Step:      time.Duration(ds.StepMs) * time.Millisecond,
+			Heartbeat: time.Duration(ds.HeartbeatMs) * time.Millisecond,
+			RRAs:      []*rrd.RRASpec{&rrd.RRASpec{Function: rra.Cf, Step: step, Size: size, Xff: float64(rra.Xff)}},
+		}
+		var err error
+		if sds, err = t.SecondaryStore.CreateOrReturnDataSource(ds.Name, spec); err != nil {
+			return err
+		}
+		dss[ds.Name] = sds
+	}
+
+	// The slots are not the same if the sizes differ
+	srra := sds.RRAs[0]
+	srra.DPs = make(map[int64]float64, len(rra.DPs))
+	var first, last int64
+	for slot, value := range rra.DPs {
+		ms := rra.SlotTimeStamp(ds, slot).UnixNano() / 1000000
+		srra.DPs[(ms/stepMs)%int64(srra.Size)] = value
+		if first == 0 || ms < first {
+			first = ms
+		}
+		if ms > last {
+			last = ms
+		}
+	}
+	srra.Start = (first / stepMs) % int64(srra.Size)
+	srra.End = (last / stepMs) % int64(srra.Size)
+	srra.Latest, srra.Value, srra.UnknownMs = rra.Latest, rra.Value, rra.UnknownMs
+	sds.LastUpdate, sds.LastDs, sds.Value, sds.UnknownMs = ds.LastUpdate, ds.LastDs, ds.Value, ds.UnknownMs
+
+	return t.SecondaryStore.FlushDataSource(sds)
+}
@@ -0,0 +1,357 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// If SpoolDir is set, a ds which could not be flushed (even after
+// FlushMaxRetries retries) is appended to a spool on disk rather than
+// the dead-letter buffer, and from then on so is every ds flushed,
+// until the spoolReplayer has flushed all of the spool (in order,
+// once the db is back). This way a ds is never flushed out of order,
+// and nothing is lost if the db is down for a while or tgres is
+// restarted meanwhile. The spool is a series of segment files, the
+// oldest of which are dropped (and counted) when it exceeds
+// SpoolMaxSize in all.
+
+// How often the spoolReplayer looks for work, and retries a failed
+// flush.
+var spoolReplayInterval = time.Second
+
+type spool struct {
+	sync.Mutex
+	dir     string
+	maxSize int64 // of all the segments
+	segMax  int64 // of a segment, before it's rotated
+	segs    []*spoolSegment
+	cur     *spoolSegment // being appended to, if not nil
+	f       *os.File      // of cur
+	nextSeq int
+	active  bool  // flushes go to the spool
+	dropped int64 // ds's, when the spool was full
+	stop    chan bool
+	wg      sync.WaitGroup
+}
+
+type spoolSegment struct {
+	path    string
+	size    int64
+	entries int
+}
+
+const spoolSegmentPrefix, spoolSegmentSuffix = "spool-", ".log"
+
+// openSpool opens the spool in dir, creating dir if need be. A spool
+// left over from before is active, i.e. has to be replayed first.
+func openSpool(dir string, maxSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, spoolSegmentPrefix+"*"+spoolSegmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	segMax := maxSize / 16
+	if segMax < 64<<10 {
+		segMax = 64 << 10
+	}
+	s := &spool{dir: dir, maxSize: maxSize, segMax: segMax, stop: make(chan bool)}
+	seqs := make(map[string]int)
+	for _, path := range paths {
+		name := filepath.Base(path)
+		seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, spoolSegmentPrefix), spoolSegmentSuffix))
+		if err != nil {
+			continue // not ours
+		}
+		seqs[path] = seq
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return seqs[paths[i]] < seqs[paths[j]] })
+	for _, path := range paths {
+		if _, ok := seqs[path]; !ok {
+			continue
+		}
+		seg := &spoolSegment{path: path}
+		if st, err := os.Stat(path); err == nil {
+			seg.size = st.Size()
+		}
+		seg.entries, _ = readSpoolSegment(path, func(*rrd.DataSource) bool { return true })
+		s.segs = append(s.segs, seg)
+	}
+	s.active = len(s.segs) > 0
+	return s, nil
+}
+
+// add appends ds to the spool, activating it, unless onlyIfActive
+// and the spool isn't active, in which case it returns false.
+func (s *spool) add(ds *rrd.DataSource, onlyIfActive bool) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if onlyIfActive && !s.active {
+		return false, nil
+	}
+	rec, err := encodeSpoolRecord(ds)
+	if err != nil {
+		return false, err
+	}
+	if s.f == nil {
+		path := filepath.Join(s.dir, fmt.Sprintf("%s%d%s", spoolSegmentPrefix, s.nextSeq, spoolSegmentSuffix))
+		if s.f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return false, err
+		}
+		s.nextSeq++
+		s.cur = &spoolSegment{path: path}
+	}
+	if _, err := s.f.Write(rec); err != nil {
+		return false, err
+	}
+	s.active = true
+	s.cur.size += int64(len(rec))
+	s.cur.entries++
+	if s.cur.size >= s.segMax {
+		s.rotate()
+	}
+	s.trim()
+	return true, nil
+}
+
+// rotate closes the current segment, fsyncing it first, so that a
+// closed segment is always complete on disk.
+func (s *spool) rotate() {
+	if s.f == nil {
+		return
+	}
+	if err := s.f.Sync(); err != nil {
+		log.Printf("spool: error syncing %s: %v", s.cur.path, err)
+	}
+	s.f.Close()
+	s.segs = append(s.segs, s.cur)
+	s.f, s.cur = nil, nil
+}
+
+// trim drops the oldest closed segments while the spool is too big.
+func (s *spool) trim() {
+	total := int64(0)
+	if s.cur != nil {
+		total = s.cur.size
+	}
+	for _, seg := range s.segs {
+		total += seg.size
+	}
+	for total > s.maxSize && len(s.segs) > 0 {
+		seg := s.segs[0]
+		log.Printf("spool: full, dropping %d data sources in %s", seg.entries, seg.path)
+		os.Remove(seg.path)
+		s.segs = s.segs[1:]
+		s.dropped += int64(seg.entries)
+		total -= seg.size
+	}
+}
+
+// next returns the oldest segment to replay, rotating the current one
+// if there is nothing else. If the spool is empty, it's no longer
+// active, and next returns nil.
+func (s *spool) next() *spoolSegment {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.segs) == 0 && s.cur != nil {
+		s.rotate()
+	}
+	if len(s.segs) == 0 {
+		s.active = false
+		return nil
+	}
+	return s.segs[0]
+}
+
+// done removes a replayed segment.
+func (s *spool) done(seg *spoolSegment) {
+	s.Lock()
+	defer s.Unlock()
+	os.Remove(seg.path)
+	for i, sg := range s.segs {
+		if sg == seg {
+			s.segs = append(s.segs[:i], s.segs[i+1:]...)
+			break
+		}
+	}
+}
+
+// size returns the number of ds's in the spool, its size in bytes, and
+// the number of ds's dropped from it.
+func (s *spool) size() (entries int, nbytes, dropped int64) {
+	s.Lock()
+	defer s.Unlock()
+	if s.cur != nil {
+		entries, nbytes = s.cur.entries, s.cur.size
+	}
+	for _, seg := range s.segs {
+		entries += seg.entries
+		nbytes += seg.size
+	}
+	return entries, nbytes, s.dropped
+}
+
+func (s *spool) close() {
+	s.Lock()
+	defer s.Unlock()
+	s.rotate()
+}
+
+// A spool record is the length and the CRC-32 of the gob encoded ds,
+// followed by it. A torn record (e.g. after a crash) ends a segment.
+func encodeSpoolRecord(ds *rrd.DataSource) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 8))
+	if err := gob.NewEncoder(&buf).Encode(ds); err != nil {
+		return nil, err
+	}
+	rec := buf.Bytes()
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(rec)-8))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(rec[8:]))
+	return rec, nil
+}
+
+// readSpoolSegment calls fn with every ds in the segment at path, in
+// order, until fn returns false. It returns how many there were.
+func readSpoolSegment(path string, fn func(*rrd.DataSource) bool) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	hdr := make([]byte, 8)
+	for n := 0; ; n++ {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(hdr[0:4]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return n, err
+		}
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(hdr[4:8]) {
+			return n, fmt.Errorf("bad checksum in %s", path)
+		}
+		var ds rrd.DataSource
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&ds); err != nil {
+			return n, err
+		}
+		if !fn(&ds) {
+			return n + 1, nil
+		}
+	}
+}
+
+func (t *Transceiver) startSpool() error {
+	var err error
+	if t.spool, err = openSpool(t.SpoolDir, t.SpoolMaxSize); err != nil {
+		return err
+	}
+	if entries, _, _ := t.spool.size(); entries > 0 {
+		log.Printf("Spool: %d data sources left in %s, replaying them first.", entries, t.SpoolDir)
+	}
+	t.spool.wg.Add(1)
+	go t.spoolReplayer()
+	return nil
+}
+
+func (t *Transceiver) stopSpool() {
+	if t.spool != nil {
+		log.Printf("stopSpool(): waiting for the spool replayer to finish...")
+		close(t.spool.stop)
+		t.spool.wg.Wait()
+		t.spool.close()
+	}
+}
+
+// spooled is true if ds went to the spool, which it does if the
+// spool is active (or failed is set, which activates it).
+func (t *Transceiver) spooled(ds *rrd.DataSource, failed bool) bool {
+	if t.spool == nil {
+		return false
+	}
+	ok, err := t.spool.add(ds, !failed)
+	if err != nil {
+		log.Printf("spooled(): error spooling data source %v: %v", ds, err)
+	}
+	return ok
+}
+
+// spoolReplayer flushes the spooled ds's, oldest first, a failed
+// flush is retried until it succeeds.
+func (t *Transceiver) spoolReplayer() {
+	defer t.spool.wg.Done()
+	for {
+		seg := t.spool.next()
+		if seg == nil {
+			select {
+			case <-t.spool.stop:
+				return
+			case <-time.After(spoolReplayInterval):
+			}
+			continue
+		}
+
+		stopped := false
+		n, err := readSpoolSegment(seg.path, func(ds *rrd.DataSource) bool {
+			for {
+				err := t.serde.FlushDataSource(ds)
+				if err == nil {
+					t.markFlushed()
+					return true
+				}
+				log.Printf("spoolReplayer(): error flushing data source %v (retrying in %v): %v", ds, spoolReplayInterval, err)
+				select {
+				case <-t.spool.stop:
+					stopped = true
+					return false
+				case <-time.After(spoolReplayInterval):
+				}
+			}
+		})
+		if stopped {
+			return // the rest of the segment is replayed next time
+		}
+		if err != nil {
+			log.Printf("spoolReplayer(): error reading %s, skipping the rest of it: %v", seg.path, err)
+		}
+		log.Printf("spoolReplayer(): replayed %d data sources from %s", n, seg.path)
+		t.spool.done(seg)
+	}
+}
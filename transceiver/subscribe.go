@@ -0,0 +1,99 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"github.com/tgres/tgres/rrd"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Subscription receives the incoming data points of the series
+// matching its pattern on C, as they are queued (i.e. renamed and
+// restamped, before any consolidation). A subscriber which does not
+// keep up misses points rather than holding up the ingestion.
+type Subscription struct {
+	C       <-chan *rrd.DataPoint
+	c       chan *rrd.DataPoint
+	pattern *NamePattern
+	dropped int64
+}
+
+// Dropped is the number of points not sent on C because it was full.
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+type subscribers struct {
+	sync.RWMutex
+	n    int32 // len(subs), so that publish is cheap when there are none
+	subs map[*Subscription]bool
+}
+
+// Subscribe to the data points of the series matching match (a glob,
+// or a /regexp/, as AllowNames), with a buffer of size points.
+func (t *Transceiver) Subscribe(match string, size int) (*Subscription, error) {
+	p := &NamePattern{}
+	if err := p.UnmarshalText([]byte(match)); err != nil {
+		return nil, err
+	}
+	c := make(chan *rrd.DataPoint, size)
+	s := &Subscription{C: c, c: c, pattern: p}
+	t.subscribers.Lock()
+	if t.subscribers.subs == nil {
+		t.subscribers.subs = make(map[*Subscription]bool)
+	}
+	t.subscribers.subs[s] = true
+	atomic.StoreInt32(&t.subscribers.n, int32(len(t.subscribers.subs)))
+	t.subscribers.Unlock()
+	return s, nil
+}
+
+// Unsubscribe stops the data points to s and closes its C.
+func (t *Transceiver) Unsubscribe(s *Subscription) {
+	t.subscribers.Lock()
+	if t.subscribers.subs[s] {
+		delete(t.subscribers.subs, s)
+		close(s.c)
+	}
+	atomic.StoreInt32(&t.subscribers.n, int32(len(t.subscribers.subs)))
+	t.subscribers.Unlock()
+}
+
+// publish sends a data point to every matching subscriber which has
+// room for it.
+func (t *Transceiver) publish(name string, ts time.Time, v float64) {
+	if atomic.LoadInt32(&t.subscribers.n) == 0 {
+		return
+	}
+	var dp *rrd.DataPoint
+	t.subscribers.RLock()
+	defer t.subscribers.RUnlock()
+	for s := range t.subscribers.subs {
+		if !s.pattern.MatchString(name) {
+			continue
+		}
+		if dp == nil {
+			dp = &rrd.DataPoint{Name: name, TimeStamp: ts, Value: v}
+		}
+		select {
+		case s.c <- dp:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+//
+// Copyright 2016 Gregory Trubetskoy. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transceiver
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tgres/tgres/rrd"
+)
+
+// TaggedName returns the name of a Graphite tagged series, i.e.
+// "name;key1=value1;key2=value2" with tags sorted by key, so that
+// the same tags in any order make the same series. Any ";", "=" or
+// "\" in a tag is escaped with a "\".
+func TaggedName(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{name}
+	for _, k := range keys {
+		parts = append(parts, escapeTag(k)+"="+escapeTag(tags[k]))
+	}
+	return strings.Join(parts, ";")
+}
+
+var tagEscaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `=`, `\=`)
+
+func escapeTag(s string) string {
+	return tagEscaper.Replace(s)
+}
+
+// ParseTaggedName splits "name;key1=value1;key2=value2" into the name
+// and the tags, unescaping "\;", "\=" and "\\". The tags are nil if
+// there are none.
+func ParseTaggedName(s string) (string, map[string]string, error) {
+	parts := splitUnescaped(s, ';', -1)
+	if len(parts) == 1 {
+		return unescapeTag(parts[0]), nil, nil
+	}
+	tags := make(map[string]string, len(parts)-1)
+	for _, part := range parts[1:] {
+		kv := splitUnescaped(part, '=', 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return "", nil, fmt.Errorf("invalid tag %q in %q, expected key=value", part, s)
+		}
+		tags[unescapeTag(kv[0])] = unescapeTag(kv[1])
+	}
+	return unescapeTag(parts[0]), tags, nil
+}
+
+// splitUnescaped is strings.SplitN which ignores a sep preceded by a
+// "\", the result is still escaped.
+func splitUnescaped(s string, sep byte, n int) []string {
+	var result []string
+	start := 0
+	for i := 0; i < len(s) && (n < 0 || len(result) < n-1); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			result = append(result, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, s[start:])
+}
+
+func unescapeTag(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// QueueDataPointTagged queues a data point for the tagged series of
+// name and tags (see TaggedName). The tags are stored when the series
+// is created, if the serde supports it, and can be queried with
+// FetchTaggedDataSourceNames.
+func (t *Transceiver) QueueDataPointTagged(name string, tags map[string]string, ts time.Time, v float64) {
+	t.QueueDataPoint(TaggedName(name, tags), ts, v)
+}
+
+// storeTags stores the tags of a tagged DS, if any.
+func (t *Transceiver) storeTags(dsId int64, name string) {
+	tserde, ok := t.serde.(rrd.TagSerDe)
+	if !ok || strings.IndexByte(name, ';') < 0 {
+		return
+	}
+	_, tags, err := ParseTaggedName(name)
+	if err == nil && len(tags) > 0 {
+		err = tserde.StoreTags(dsId, tags)
+	}
+	if err != nil {
+		log.Printf("storeTags(): %q: %v", name, err)
+	}
+}
+
+func (t *Transceiver) FetchTaggedDataSourceNames(tags map[string]string) (map[string]int64, error) {
+	if tserde, ok := t.serde.(rrd.TagSerDe); ok {
+		return tserde.FetchTaggedDataSourceNames(tags)
+	}
+	return nil, fmt.Errorf("tags not supported by this serde")
+}
@@ -16,12 +16,15 @@
 package transceiver
 
 import (
+	"fmt"
 	"github.com/tgres/tgres/cluster"
 	"github.com/tgres/tgres/rrd"
 	"github.com/tgres/tgres/statsd"
 	"log"
+	"math"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,6 +32,14 @@ type MatchingDSSpecFinder interface {
 	FindMatchingDSSpec(name string) *rrd.DSSpec
 }
 
+// A Relayer forwards data points of series which another node owns
+// (e.g. by consistent hashing the name), Relay is false for those
+// which are ours. Stop is called by Transceiver.Stop.
+type Relayer interface {
+	Relay(name string, ts time.Time, v float64) bool
+	Stop()
+}
+
 type Transceiver struct {
 	cluster                            *cluster.Cluster
 	serde                              rrd.SerDe
@@ -37,28 +48,93 @@ type Transceiver struct {
 	MaxCachedPoints                    int
 	StatFlushDuration                  time.Duration
 	StatsNamePrefix                    string
+	BackfillMode                       bool // accept out of order data points
+	MaxSeries                          int  // do not create series beyond this many, 0 is no limit
+	seriesFullWarned                   int32
+	rejectedSeriesFull                 int64 // by SeriesFull
+	MaxSeriesNameLength                int   // drop data points with longer names, 0 is no limit
+	rejectedNameLength                 int64 // by nameTooLong
+	TimestampSource                    TimestampSource
+	DerivedMetrics                     []*DerivedMetric // series computed from other series at flush
+	NameRewriter                       *NameRewriter    // renames incoming data points, if not nil
+	FlushMaxRetries                    int              // retries of a failed flush before it's dead-lettered
+	FlushRetryDelay                    time.Duration    // before the first retry, doubled for every next one
+	FlushBatchSize                     int              // ds's flushed at once if the serde is a BatchFlusher, 0 is off
+	FlushBatchInterval                 time.Duration    // flush a smaller batch after this long, see batch.go
+	FlushInterval                      time.Duration    // flush every dirty ds at least this often, 0 is off
+	lastFlush                          int64            // UnixNano of the last successful flush, see markFlushed
+	DeadLetterSize                     int              // max data sources kept in the dead-letter buffer
+	SpoolDir                           string           // spool ds's which failed to flush here, see spool.go
+	SpoolMaxSize                       int64            // bytes, of all of the spool
+	PreAggWindow                       time.Duration    // consolidate incoming points per series, 0 is off
+	SecondaryStore                     rrd.SerDe        // for the coarsest archive of Secondary ds's, see secondary.go
+	SecondaryRetention                 time.Duration    // in SecondaryStore (if longer than in the primary)
+	MaxRrasPerDs                       int              // refuse to create a ds with more RRAs, 0 is no limit (the daemon always sets one)
+	QueueHighWater                     float64          // QueueFull() when a queue is this full (0 to 1), 0 is never
+	FlushPriorityRules                 []*FlushPriorityRule
+	SeriesAliasRules                   []*SeriesAliasRule
+	NameReplaceRules                   []*NameReplaceRule // see names.go
+	AggregationRules                   []*AggregationRule // see aggregation.go
+	SanitizeNames                      bool               // see sanitizeName
+	AllowNames, DenyNames              []*NamePattern     // see nameFiltered
+	rejectedFiltered                   int64              // by AllowNames and DenyNames
+	DropNonFinite                      bool               // drop NaN and Inf values, see validDataPoint
+	DedupeSameTimestamp                bool               // the last of points with the same timestamp wins, see dedupe
+	MaxFutureSkew                      time.Duration      // drop points further ahead of now, 0 is no limit
+	rejectedInvalid                    int64              // by validDataPoint
+	subscribers                        subscribers        // see Subscribe
 	DSSpecs                            MatchingDSSpecFinder
+	Relay                              Relayer      // if set, takes the data points of series owned by other nodes
+	liveLk                             sync.RWMutex // see Reconfigure
+	liveGen                            int          // incremented by Reconfigure
 	dss                                *rrd.DataSources
 	Rcache                             *ReadCache
+	derived                            *derivedState
 	dpCh                               chan *rrd.DataPoint    // incoming data point
+	dpsCh                              chan []*rrd.DataPoint  // incoming data points in batches
 	workerChs                          []chan *rrd.DataPoint  // incoming data point with ds
 	flusherChs                         []chan *dsFlushRequest // ds to flush
-	stCh                               chan *statsd.Stat      // incoming statd stats
+	dirty                              []*dirtySet            // per worker unflushed ds's
+	deadLetters                        deadLetters            // ds's that failed to flush
+	spool                              *spool                 // if SpoolDir
+	preAgg                             *preAggBuffer          // if PreAggWindow
+	preAggStop                         chan bool
+	preAggWg                           sync.WaitGroup
+	aggregation                        *aggregationBuffer // see aggregation.go
+	aggregationStop                    chan bool
+	aggregationWg                      sync.WaitGroup
+	secondaryCh                        chan *rrd.DataSource // ds copies for the SecondaryStore
+	secondaryWg                        sync.WaitGroup
+	dsCopyChs                          []chan *dsCopyRequest // copies of ds's (with unflushed points) for readers
+	stCh                               chan *statsd.Stat     // incoming statd stats
 	workerWg                           sync.WaitGroup
 	flusherWg                          sync.WaitGroup
 	statWg                             sync.WaitGroup
 	dispatcherWg                       sync.WaitGroup
+	dispatcherDone                     chan struct{} // closed when the dispatcher exits
 	startWg                            sync.WaitGroup
 }
 
 type dsFlushRequest struct {
-	ds   *rrd.DataSource
-	resp chan bool
+	ds         *rrd.DataSource
+	resp       chan bool
+	dirty      *dirtySet // of the worker, the ds stays in it until respond()
+	dirtySince time.Time
+}
+
+// respond once the ds is flushed, spooled or dead-lettered.
+func (fr *dsFlushRequest) respond(ok bool) {
+	if fr.dirty != nil {
+		fr.dirty.flushed(fr.ds.Id, fr.dirtySince)
+	}
+	if fr.resp != nil {
+		fr.resp <- ok
+	}
 }
 
 type dsCopyRequest struct {
-	dsId int64
-	resp chan *rrd.DataSource
+	dsIds []int64
+	resp  chan map[int64]*rrd.DataSource
 }
 
 type dftDSFinder struct{}
@@ -93,7 +169,7 @@ func (_ *dftDSFinder) FindMatchingDSSpec(name string) *rrd.DSSpec {
 }
 
 func New(clstr *cluster.Cluster, serde rrd.SerDe) *Transceiver {
-	return &Transceiver{
+	t := &Transceiver{
 		cluster:           clstr,
 		serde:             serde,
 		NWorkers:          4,
@@ -102,12 +178,20 @@ func New(clstr *cluster.Cluster, serde rrd.SerDe) *Transceiver {
 		MaxCachedPoints:   256,
 		StatFlushDuration: 10 * time.Second,
 		StatsNamePrefix:   "stats",
+		FlushRetryDelay:   100 * time.Millisecond,
+		DropNonFinite:     true,
+		DeadLetterSize:    1024,
+		MaxRrasPerDs:      8,
 		DSSpecs:           &dftDSFinder{},
 		dss:               &rrd.DataSources{},
 		Rcache:            &ReadCache{serde: serde, dsns: &rrd.DataSourceNames{}},
-		dpCh:              make(chan *rrd.DataPoint, 65536), // so we can survive a graceful restart
-		stCh:              make(chan *statsd.Stat, 65536),   // ditto
+		dpCh:              make(chan *rrd.DataPoint, 65536),  // so we can survive a graceful restart
+		dpsCh:             make(chan []*rrd.DataPoint, 1024), // ditto
+		stCh:              make(chan *statsd.Stat, 65536),    // ditto
+		dispatcherDone:    make(chan struct{}),
 	}
+	t.Rcache.dsCopies = t.requestDsCopies
+	return t
 }
 
 func (t *Transceiver) Start() error {
@@ -118,6 +202,16 @@ func (t *Transceiver) Start() error {
 		return err
 	}
 
+	// Min/Max are not stored in the db, they come from the current config.
+	for _, ds := range t.dss.List() {
+		if dsSpec := t.DSSpecs.FindMatchingDSSpec(ds.Name); dsSpec != nil {
+			ds.Min, ds.Max = dsSpec.Min, dsSpec.Max
+			ds.Secondary = dsSpec.Secondary
+			ds.Align = dsSpec.Align
+		}
+		ds.Backfill = t.BackfillMode
+	}
+
 	// ZZZ
 	if err := t.Rcache.Reload(); err != nil {
 		log.Printf("transceiver.Start(): dss.Reload() error: %v", err)
@@ -134,6 +228,19 @@ func (t *Transceiver) Start() error {
 		return result, nil
 	})
 
+	if len(t.DerivedMetrics) > 0 {
+		t.derived = newDerivedState(t.DerivedMetrics, 2*t.MaxCacheDuration)
+	}
+
+	if t.SecondaryStore != nil {
+		t.startSecondaryFlusher()
+	}
+	if t.SpoolDir != "" {
+		if err := t.startSpool(); err != nil {
+			log.Printf("transceiver.Start(): error opening the spool: %v", err)
+			return err
+		}
+	}
 	t.startWorkers()
 	t.startFlushers()
 	t.startStatWorker()
@@ -142,7 +249,13 @@ func (t *Transceiver) Start() error {
 	t.startWg.Wait()
 	log.Printf("Transceiver: All workers running, starting dispatcher.")
 
+	t.dispatcherWg.Add(1) // before Start returns, a Stop waits for it
 	go t.dispatcher()
+	if t.PreAggWindow > 0 {
+		t.startPreAggregator()
+	}
+	// Even without rules, a reload may add some.
+	t.startAggregator()
 	log.Printf("Transceiver: Ready.")
 
 	return nil
@@ -150,6 +263,13 @@ func (t *Transceiver) Start() error {
 
 func (t *Transceiver) Stop() {
 
+	if t.Relay != nil {
+		t.Relay.Stop()
+	}
+
+	t.stopPreAggregator()
+	t.stopAggregator()
+
 	log.Printf("Closing dispatcher channel...")
 	close(t.dpCh)
 	t.dispatcherWg.Wait()
@@ -160,6 +280,26 @@ func (t *Transceiver) Stop() {
 	t.cluster.Shutdown()
 }
 
+// Reconfigure calls f, which may change those settings which can
+// change while the transceiver is running (e.g. on a config reload):
+// MaxCacheDuration, MinCacheDuration, MaxCachedPoints,
+// StatFlushDuration, FlushMaxRetries, FlushRetryDelay, NameRewriter,
+// SeriesAliasRules, NameReplaceRules, SanitizeNames, AllowNames,
+// DenyNames, FlushPriorityRules, DSSpecs and MaxRrasPerDs. The
+// others are only read by Start.
+func (t *Transceiver) Reconfigure(f func()) {
+	t.liveLk.Lock()
+	defer t.liveLk.Unlock()
+	f()
+	t.liveGen++
+}
+
+func (t *Transceiver) liveGeneration() int {
+	t.liveLk.RLock()
+	defer t.liveLk.RUnlock()
+	return t.liveGen
+}
+
 func (t *Transceiver) ClusterReady(ready bool) {
 	t.cluster.Ready(ready)
 }
@@ -214,9 +354,21 @@ func (t *Transceiver) stopStatWorker() {
 }
 
 func (t *Transceiver) createOrLoadDS(dp *rrd.DataPoint) error {
-	if dsSpec := t.DSSpecs.FindMatchingDSSpec(dp.Name); dsSpec != nil {
+	t.liveLk.RLock()
+	dsSpecs, maxRras := t.DSSpecs, t.MaxRrasPerDs
+	t.liveLk.RUnlock()
+	if dsSpec := dsSpecs.FindMatchingDSSpec(dp.Name); dsSpec != nil {
+		if maxRras > 0 && len(dsSpec.RRAs) > maxRras {
+			return fmt.Errorf("%q: %d RRAs exceeds the maximum of %d per DS (max-rras-per-ds)", dp.Name, len(dsSpec.RRAs), maxRras)
+		}
 		if ds, err := t.serde.CreateOrReturnDataSource(dp.Name, dsSpec); err == nil {
+			ds.Min, ds.Max = dsSpec.Min, dsSpec.Max
+			ds.Secondary = dsSpec.Secondary
+			ds.Align = dsSpec.Align
+			ds.Backfill = t.BackfillMode
 			t.dss.Insert(ds)
+			t.Rcache.dsns.Add(ds.Name, ds.Id)
+			t.storeTags(ds.Id, ds.Name)
 			// tell the cluster about it (TODO should Insert() do this?)
 			t.cluster.LoadDistData(func() ([]cluster.DistDatum, error) {
 				return []cluster.DistDatum{&distDatumDataSource{t, ds}}, nil
@@ -230,8 +382,8 @@ func (t *Transceiver) createOrLoadDS(dp *rrd.DataPoint) error {
 }
 
 func (t *Transceiver) dispatcher() {
-	t.dispatcherWg.Add(1)
 	defer t.dispatcherWg.Done()
+	defer close(t.dispatcherDone)
 
 	// Monitor Cluster changes
 	clusterChgCh := t.cluster.NotifyClusterChanges()
@@ -276,47 +428,246 @@ func (t *Transceiver) dispatcher() {
 				}
 			}
 			continue
+		case dps := <-t.dpsCh:
+			for _, dp := range dps {
+				t.dispatch(dp, snd)
+			}
+			continue
 		case dp, ok = <-t.dpCh:
 		}
 
 		if !ok {
 			log.Printf("dispatcher(): channel closed, shutting down")
+			for len(t.dpsCh) > 0 { // what's left of batches
+				for _, dp := range <-t.dpsCh {
+					t.dispatch(dp, snd)
+				}
+			}
 			t.stopStatWorker()
 			t.stopWorkers()
 			t.stopFlushers()
+			t.stopSpool()
+			t.stopSecondaryFlusher()
 			break
 		}
 
-		if dp.DS = t.dss.GetByName(dp.Name); dp.DS == nil {
-			if err := t.createOrLoadDS(dp); err != nil {
-				log.Printf("dispatcher(): createDataSource() error: %v", err)
-				continue
-			}
+		t.dispatch(dp, snd)
+	}
+}
+
+func (t *Transceiver) dispatch(dp *rrd.DataPoint, snd chan *cluster.Msg) {
+
+	if dp.DS = t.dss.GetByName(dp.Name); dp.DS == nil {
+		if t.SeriesFull(dp.Name) {
+			t.QueueStatCount("tgres.series_full_drops", 1)
+			return
+		}
+		if err := t.createOrLoadDS(dp); err != nil {
+			log.Printf("dispatcher(): createDataSource() error: %v", err)
+			return
 		}
+	}
 
-		for _, node := range t.cluster.NodesForDistDatum(&distDatumDataSource{t, dp.DS}) {
-			if node.Name() == t.cluster.LocalNode().Name() {
-				t.workerChs[dp.DS.Id%int64(t.NWorkers)] <- dp // This dp is for us
-			} else if dp.Hops == 0 { // we do not forward more than once
-				if node.Ready() {
-					dp.Hops++
-					if msg, err := cluster.NewMsgGob(node, dp); err == nil {
-						snd <- msg
-						t.QueueStatCount("tgres.dispatcher_forward", 1)
-					}
-				} else {
-					// This should be a very rare thing
-					log.Printf("dispatcher(): Returning the data point to dispatcher!")
-					time.Sleep(100 * time.Millisecond)
-					t.dpCh <- dp
+	for _, node := range t.cluster.NodesForDistDatum(&distDatumDataSource{t, dp.DS}) {
+		if node.Name() == t.cluster.LocalNode().Name() {
+			t.workerChs[t.dsShard(dp.DS.Id)] <- dp // This dp is for us
+		} else if dp.Hops == 0 { // we do not forward more than once
+			if node.Ready() {
+				dp.Hops++
+				if msg, err := cluster.NewMsgGob(node, dp); err == nil {
+					snd <- msg
+					t.QueueStatCount("tgres.dispatcher_forward", 1)
 				}
+			} else {
+				// This should be a very rare thing
+				log.Printf("dispatcher(): Returning the data point to dispatcher!")
+				time.Sleep(100 * time.Millisecond)
+				t.dpCh <- dp
 			}
 		}
 	}
 }
 
+// TimestampSource determines whether data points are placed in time
+// by the timestamp provided by the client or by the time of arrival.
+type TimestampSource int
+
+const (
+	TimestampEmbedded       TimestampSource = iota // the client's (default)
+	TimestampArrival                               // ours
+	TimestampPreferEmbedded                        // the client's, unless zero or negative
+)
+
+func (s *TimestampSource) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "", "embedded":
+		*s = TimestampEmbedded
+	case "arrival":
+		*s = TimestampArrival
+	case "preferEmbedded":
+		*s = TimestampPreferEmbedded
+	default:
+		return fmt.Errorf("invalid timestamp source %q, must be one of embedded, arrival or preferEmbedded", string(text))
+	}
+	return nil
+}
+
+func (t *Transceiver) timestamp(ts time.Time) time.Time {
+	switch t.TimestampSource {
+	case TimestampArrival:
+		return time.Now()
+	case TimestampPreferEmbedded:
+		if ts.Unix() <= 0 {
+			return time.Now()
+		}
+	}
+	return ts
+}
+
 func (t *Transceiver) QueueDataPoint(name string, ts time.Time, v float64) {
-	t.dpCh <- &rrd.DataPoint{Name: name, TimeStamp: ts, Value: v}
+	t.queueRenamed(name, ts, v, false)
+}
+
+// QueueDataPointUnlessFull is QueueDataPoint, but a data point of a
+// new series (as renamed) is dropped right away if MaxSeries are
+// reached (see SeriesFull), rather than by the dispatcher, so that
+// the caller can count it. It is false if so.
+func (t *Transceiver) QueueDataPointUnlessFull(name string, ts time.Time, v float64) bool {
+	return t.queueRenamed(name, ts, v, true)
+}
+
+func (t *Transceiver) queueRenamed(name string, ts time.Time, v float64, checkFull bool) bool {
+	if t.nameTooLong(name) || t.nameFiltered(name) {
+		return true
+	}
+	if name = t.rewriteName(name); name == "" {
+		return true
+	}
+	if ts = t.timestamp(ts); t.Relay != nil && t.Relay.Relay(name, ts, v) {
+		return true // whether it is full is up to its owner
+	}
+	if checkFull && t.SeriesFull(name) {
+		return false
+	}
+	t.queueDataPoint(name, ts, v)
+	return true
+}
+
+// QueueRelayedDataPoint queues a data point relayed to us by another
+// node, which has already renamed and restamped it, and which must
+// not be relayed again. The name is still checked against our own
+// MaxSeriesNameLength, AllowNames and DenyNames. Like
+// QueueDataPointUnlessFull, it is false if MaxSeries are reached.
+func (t *Transceiver) QueueRelayedDataPoint(name string, ts time.Time, v float64) bool {
+	if t.nameTooLong(name) || t.nameFiltered(name) {
+		return true
+	}
+	if t.SeriesFull(name) {
+		return false
+	}
+	t.queueDataPoint(name, ts, v)
+	return true
+}
+
+// validDataPoint is false (and the point is counted in
+// Stats().RejectedInvalid) if v is NaN or Inf (with DropNonFinite),
+// or ts is before the epoch, or more than MaxFutureSkew from now.
+// Either would wreck the consolidation of an RRA.
+func (t *Transceiver) validDataPoint(ts time.Time, v float64) bool {
+	if (t.DropNonFinite && (math.IsNaN(v) || math.IsInf(v, 0))) ||
+		ts.Unix() < 0 ||
+		(t.MaxFutureSkew > 0 && ts.Sub(time.Now()) > t.MaxFutureSkew) {
+		atomic.AddInt64(&t.rejectedInvalid, 1)
+		return false
+	}
+	return true
+}
+
+func (t *Transceiver) queueDataPoint(name string, ts time.Time, v float64) {
+	if !t.validDataPoint(ts, v) {
+		return
+	}
+	t.publish(name, ts, v)
+	t.aggregate(name, ts, v)
+	if t.preAgg != nil {
+		t.preAgg.add(name, ts, v)
+	} else {
+		t.dpCh <- &rrd.DataPoint{Name: name, TimeStamp: ts, Value: v}
+	}
+}
+
+// QueueDataPoints queues many data points at once (e.g. all the
+// lines of a UDP datagram), which is cheaper than one at a time.
+func (t *Transceiver) QueueDataPoints(dps []*rrd.DataPoint) {
+	queue := dps[:0]
+	for _, dp := range dps {
+		if t.nameTooLong(dp.Name) || t.nameFiltered(dp.Name) {
+			continue
+		}
+		if dp.Name = t.rewriteName(dp.Name); dp.Name != "" {
+			dp.TimeStamp = t.timestamp(dp.TimeStamp)
+			if !t.validDataPoint(dp.TimeStamp, dp.Value) {
+				continue
+			}
+			if t.Relay != nil && t.Relay.Relay(dp.Name, dp.TimeStamp, dp.Value) {
+				continue
+			}
+			t.publish(dp.Name, dp.TimeStamp, dp.Value)
+			t.aggregate(dp.Name, dp.TimeStamp, dp.Value)
+			if t.preAgg != nil {
+				t.preAgg.add(dp.Name, dp.TimeStamp, dp.Value)
+			} else {
+				queue = append(queue, dp)
+			}
+		}
+	}
+	t.queueDataPoints(queue)
+}
+
+// queueDataPoints queues data points as they are, i.e. not renamed or
+// restamped (e.g. derived metrics).
+func (t *Transceiver) queueDataPoints(dps []*rrd.DataPoint) {
+	if len(dps) > 0 {
+		t.dpsCh <- dps
+	}
+}
+
+// rewriteName applies the NameRewriter, if any, the NameReplaceRules,
+// SanitizeNames, then the SeriesAliasRules. A failed rewrite leaves
+// the name as is, "" means the point should be dropped (and is
+// counted as tgres.name_rewrite_drops).
+func (t *Transceiver) rewriteName(name string) string {
+	t.liveLk.RLock()
+	rewriter := t.NameRewriter
+	t.liveLk.RUnlock()
+	if rewriter != nil {
+		newName, err := rewriter.Rewrite(name)
+		if err != nil {
+			log.Printf("rewriteName(): %v", err)
+			t.QueueStatCount("tgres.name_rewrite_errors", 1)
+		} else {
+			name = newName
+		}
+	}
+	if name = t.replaceName(name); name == "" {
+		t.QueueStatCount("tgres.name_rewrite_drops", 1)
+		return ""
+	}
+	return t.canonicalName(name)
+}
+
+// SeriesFull is true (and counted in Stats().RejectedSeriesFull) if
+// name is a new series, but MaxSeries have already been created. The
+// first time, this is logged.
+func (t *Transceiver) SeriesFull(name string) bool {
+	if t.MaxSeries > 0 && !t.Rcache.dsns.Exists(name) && t.Rcache.dsns.Len() >= t.MaxSeries {
+		atomic.AddInt64(&t.rejectedSeriesFull, 1)
+		if atomic.CompareAndSwapInt32(&t.seriesFullWarned, 0, 1) {
+			log.Printf("SeriesFull(): WARNING: max-series (%d) reached, data points for new series (e.g. %q) are dropped, existing series are still updated.", t.MaxSeries, name)
+		}
+		return true
+	}
+	return false
 }
 
 func (t *Transceiver) QueueStat(st *statsd.Stat) {
@@ -334,13 +685,31 @@ func (t *Transceiver) worker(id int64) {
 	defer t.workerWg.Done()
 
 	recent := make(map[int64]bool)
+	pending := make(map[int64]*rrd.DataPoint) // see dedupe
+	priorities := make(map[int64]FlushPriority)
+	prioritiesGen := t.liveGeneration()
+
+	var flushTick <-chan time.Time
+	if t.FlushInterval > 0 {
+		ticker := time.NewTicker(t.FlushInterval)
+		defer ticker.Stop()
+		flushTick = ticker.C
+	}
 
 	periodicFlushCheck := make(chan int)
 	go func() {
 		for {
-			// Sleep randomly between min and max cache durations (is this wise?)
-			i := int(t.MaxCacheDuration.Nanoseconds()-t.MinCacheDuration.Nanoseconds()) / 1000
-			time.Sleep(time.Duration(rand.Intn(i))*time.Millisecond + t.MinCacheDuration)
+			t.liveLk.RLock()
+			hasRules, minCache, maxCache := len(t.FlushPriorityRules) > 0, t.MinCacheDuration, t.MaxCacheDuration
+			t.liveLk.RUnlock()
+			if hasRules {
+				// High priority ds's are due after MinCacheDuration
+				time.Sleep(minCache)
+			} else {
+				// Sleep randomly between min and max cache durations (is this wise?)
+				i := int(maxCache.Nanoseconds()-minCache.Nanoseconds()) / 1000
+				time.Sleep(time.Duration(rand.Intn(i))*time.Millisecond + minCache)
+			}
 			periodicFlushCheck <- 1
 		}
 	}()
@@ -351,56 +720,113 @@ func (t *Transceiver) worker(id int64) {
 	for {
 		var (
 			ds            *rrd.DataSource
+			periodic      bool
 			channelClosed bool
 		)
 
 		select {
 		case <-periodicFlushCheck:
-			// Nothing to do here
+			periodic = true
+			t.processPending(id, pending, recent)
+		case <-flushTick:
+			t.processPending(id, pending, recent)
+			t.flushAll(id, recent)
+			continue
+		case r := <-t.dsCopyChs[id]:
+			copies := make(map[int64]*rrd.DataSource, len(r.dsIds))
+			for _, dsId := range r.dsIds {
+				t.processPendingDs(id, dsId, pending, recent) // the copy includes it
+				if cached := t.dss.GetById(dsId); cached != nil {
+					copies[dsId] = cached.MostlyCopy()
+				}
+			}
+			r.resp <- copies
+			continue
 		case dp, ok := <-t.workerChs[id]:
-			if ok {
-				ds = dp.DS // at this point dp.ds has to be already set
-				if err := dp.Process(); err == nil {
-					recent[ds.Id] = true
-				} else {
-					log.Printf("worker(%d): dp.process(%s) error: %v", id, dp.DS.Name, err)
+			if ok && t.dsShard(dp.DS.Id) != id {
+				// This should never happen, but if it did, two workers
+				// would be updating (and flushing) the same DS.
+				log.Printf("worker(%d): BUG: ds %d belongs to worker %d, dropping data point.", id, dp.DS.Id, t.dsShard(dp.DS.Id))
+			} else if ok {
+				if t.DedupeSameTimestamp {
+					dp = dedupe(pending, dp) // the one before it, if any
+				}
+				if dp != nil {
+					ds = dp.DS // at this point dp.ds has to be already set
+					t.processDataPoint(id, dp, recent)
 				}
 			} else {
 				channelClosed = true
 			}
 		}
 
-		if ds == nil {
+		if gen := t.liveGeneration(); gen != prioritiesGen {
+			// The FlushPriorityRules may have changed
+			priorities, prioritiesGen = make(map[int64]FlushPriority), gen
+		}
+
+		if periodic {
 			// periodic flush - check recent
-			for dsId, _ := range recent {
-				ds = t.dss.GetById(dsId)
-				if ds == nil {
-					log.Printf("worker(%d): WAT? cannot lookup ds id (%d) to flush?", id, dsId)
-					continue
-				}
-				if ds.ShouldBeFlushed(t.MaxCachedPoints, t.MinCacheDuration, t.MaxCacheDuration) {
-					t.flushDs(ds, false)
-					delete(recent, ds.Id)
-				}
-			}
-		} else if ds.ShouldBeFlushed(t.MaxCachedPoints, t.MinCacheDuration, t.MaxCacheDuration) {
+			t.flushRecent(id, recent, priorities)
+		} else if ds != nil && t.shouldBeFlushed(ds, t.cachedFlushPriority(ds, priorities)) {
 			// flush just this one ds
 			t.flushDs(ds, false)
 			delete(recent, ds.Id)
 		}
 
 		if channelClosed {
+			// We're shutting down, flush what's left, due or not.
+			t.processPending(id, pending, recent)
+			t.flushAll(id, recent)
 			break
 		}
 	}
 }
 
+// processDataPoint adds the data point to its ds, the worker's ds.
+func (t *Transceiver) processDataPoint(id int64, dp *rrd.DataPoint, recent map[int64]bool) {
+	if err := dp.Process(); err == nil {
+		recent[dp.DS.Id] = true
+		t.dirty[id].add(dp.DS.Id, time.Now())
+	} else {
+		log.Printf("worker(%d): dp.process(%s) error: %v", id, dp.DS.Name, err)
+	}
+}
+
+// flushAll flushes every recent (i.e. dirty) ds of the worker,
+// regardless of whether it's due.
+func (t *Transceiver) flushAll(id int64, recent map[int64]bool) {
+	if len(recent) == 0 {
+		return
+	}
+	log.Printf("worker(%d): flushing %d data sources.", id, len(recent))
+	for dsId := range recent {
+		if ds := t.dss.GetById(dsId); ds != nil {
+			t.flushDs(ds, false)
+		}
+		delete(recent, dsId)
+	}
+}
+
+// dsShard returns the worker (and flusher) responsible for the data
+// source. A DS is only ever processed by its own worker and flushed
+// by its own flusher, which means its rows in the db are never
+// written to concurrently.
+func (t *Transceiver) dsShard(dsId int64) int64 {
+	return dsId % int64(t.NWorkers)
+}
+
 func (t *Transceiver) flushDs(ds *rrd.DataSource, block bool) {
-	fr := &dsFlushRequest{ds: ds.MostlyCopy()}
+	t.deriveFromFlush(ds)
+	dirty := t.dirty[t.dsShard(ds.Id)]
+	fr := &dsFlushRequest{ds: ds.MostlyCopy(), dirty: dirty, dirtySince: dirty.flushing(ds.Id)}
 	if block {
 		fr.resp = make(chan bool, 1)
 	}
-	t.flusherChs[ds.Id%int64(t.NWorkers)] <- fr
+	t.flusherChs[t.dsShard(ds.Id)] <- fr
+	if ds.Secondary {
+		t.secondaryFlush(fr.ds)
+	}
 	if block {
 		<-fr.resp
 	}
@@ -408,14 +834,67 @@ func (t *Transceiver) flushDs(ds *rrd.DataSource, block bool) {
 	ds.ClearRRAs(block) // block = clearLU in this case (see rrd.go)
 }
 
+// requestDsCopies asks the workers owning the ds's for copies of
+// them, including the points that have not been flushed yet. Each
+// worker gets one request for all of its ds's, and the workers are
+// all asked before any is waited on. A ds which isn't cached here is
+// missing from the result, as are those of workers that don't
+// respond in time (e.g. because workers aren't running).
+func (t *Transceiver) requestDsCopies(dsIds []int64) map[int64]*rrd.DataSource {
+	result := make(map[int64]*rrd.DataSource, len(dsIds))
+	if len(t.dsCopyChs) == 0 || len(dsIds) == 0 {
+		return result
+	}
+	byShard := make(map[int64][]int64)
+	for _, dsId := range dsIds {
+		shard := t.dsShard(dsId)
+		byShard[shard] = append(byShard[shard], dsId)
+	}
+
+	timeout := time.After(time.Second)
+	reqs := make([]*dsCopyRequest, 0, len(byShard))
+	for shard, ids := range byShard {
+		r := &dsCopyRequest{dsIds: ids, resp: make(chan map[int64]*rrd.DataSource, 1)}
+		select {
+		case t.dsCopyChs[shard] <- r:
+			reqs = append(reqs, r)
+		case <-timeout:
+			log.Printf("requestDsCopies(): timed out waiting for worker %d", shard)
+			return result
+		}
+	}
+	for _, r := range reqs {
+		select {
+		case copies := <-r.resp:
+			for dsId, ds := range copies {
+				result[dsId] = ds
+			}
+		case <-timeout:
+			log.Printf("requestDsCopies(): timed out waiting for workers")
+			return result
+		}
+	}
+	return result
+}
+
+// requestDsCopy is requestDsCopies for a single ds, it returns nil if
+// there is no copy.
+func (t *Transceiver) requestDsCopy(dsId int64) *rrd.DataSource {
+	return t.requestDsCopies([]int64{dsId})[dsId]
+}
+
 func (t *Transceiver) startWorkers() {
 
 	t.workerChs = make([]chan *rrd.DataPoint, t.NWorkers)
+	t.dirty = make([]*dirtySet, t.NWorkers)
+	t.dsCopyChs = make([]chan *dsCopyRequest, t.NWorkers)
 
 	log.Printf("Starting %d workers...", t.NWorkers)
 	t.startWg.Add(t.NWorkers)
 	for i := 0; i < t.NWorkers; i++ {
 		t.workerChs[i] = make(chan *rrd.DataPoint, 1024)
+		t.dirty[i] = newDirtySet()
+		t.dsCopyChs[i] = make(chan *dsCopyRequest)
 
 		go t.worker(int64(i))
 	}
@@ -429,16 +908,25 @@ func (t *Transceiver) flusher(id int64) {
 	log.Printf("  - flusher(%d) started.", id)
 	t.startWg.Done()
 
+	if bf, ok := t.serde.(rrd.BatchFlusher); ok && t.FlushBatchSize > 0 {
+		t.batchFlusher(id, bf)
+		return
+	}
+
+	retries := &flushRetries{queued: make(map[int64][]*dsFlushRequest)}
 	for {
 		fr, ok := <-t.flusherChs[id]
 		if ok {
-			if err := t.serde.FlushDataSource(fr.ds); err != nil {
-				log.Printf("flusher(%d): error flushing data source %v: %v", id, fr.ds, err)
-				if fr.resp != nil {
-					fr.resp <- false
-				}
-			} else if fr.resp != nil {
-				fr.resp <- true
+			if retries.queue(fr) {
+				continue // behind a failed flush of the same ds
+			}
+			t.liveLk.RLock()
+			retry := t.FlushMaxRetries > 0
+			t.liveLk.RUnlock()
+			if err := t.flushRequest(id, fr, retry); err != nil {
+				retries.start(fr.ds.Id)
+				t.flusherWg.Add(1)
+				go t.retryFlushes(id, retries, fr, err)
 			}
 		} else {
 			log.Printf("flusher(%d): channel closed, exiting", id)
@@ -448,7 +936,98 @@ func (t *Transceiver) flusher(id int64) {
 
 }
 
+// flushRequest flushes (or spools) the ds of fr and responds to fr.
+// If retry is true, a failed flush is not dead-lettered (nor
+// responded to), but its error returned.
+func (t *Transceiver) flushRequest(id int64, fr *dsFlushRequest, retry bool) error {
+	if t.spooled(fr.ds, false) {
+		fr.respond(true)
+	} else if err := t.serde.FlushDataSource(fr.ds); err != nil {
+		if retry {
+			return err
+		}
+		log.Printf("flusher(%d): error flushing data source %v: %v", id, fr.ds, err)
+		spooled := t.spooled(fr.ds, true)
+		if !spooled {
+			t.deadLetters.add(fr.ds)
+		}
+		fr.respond(spooled)
+	} else {
+		t.markFlushed()
+		fr.respond(true)
+	}
+	return nil
+}
+
+// retryFlushes retries the failed flush of fr up to FlushMaxRetries
+// times, with a backoff, then flushes the requests for the same ds
+// which were queued behind it meanwhile. The flusher goes on with the
+// other ds's, while the flushes of this one stay in order.
+func (t *Transceiver) retryFlushes(id int64, retries *flushRetries, fr *dsFlushRequest, err error) {
+	defer t.flusherWg.Done()
+	for fr != nil {
+		t.liveLk.RLock()
+		delay, maxRetries := t.FlushRetryDelay, t.FlushMaxRetries
+		t.liveLk.RUnlock()
+		for retry := 1; err != nil; retry++ {
+			log.Printf("flusher(%d): error flushing data source %v (retrying in %v): %v", id, fr.ds, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+			err = t.flushRequest(id, fr, retry < maxRetries)
+		}
+		if fr = retries.next(fr.ds.Id); fr != nil {
+			err = t.flushRequest(id, fr, maxRetries > 0)
+		}
+	}
+}
+
+// flushRetries are the ds's of a flusher being retried (see
+// retryFlushes), with the flush requests queued behind them.
+type flushRetries struct {
+	sync.Mutex
+	queued map[int64][]*dsFlushRequest
+}
+
+func (r *flushRetries) start(dsId int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.queued[dsId] = nil
+}
+
+// queue fr if its ds is being retried, false if it isn't.
+func (r *flushRetries) queue(fr *dsFlushRequest) bool {
+	r.Lock()
+	defer r.Unlock()
+	q, ok := r.queued[fr.ds.Id]
+	if ok {
+		r.queued[fr.ds.Id] = append(q, fr)
+	}
+	return ok
+}
+
+// next returns the next request queued for the ds, or nil if there
+// are none and the ds is no longer being retried.
+func (r *flushRetries) next(dsId int64) *dsFlushRequest {
+	r.Lock()
+	defer r.Unlock()
+	q := r.queued[dsId]
+	if len(q) == 0 {
+		delete(r.queued, dsId)
+		return nil
+	}
+	r.queued[dsId] = q[1:]
+	return q[0]
+}
+
+// markFlushed records the time of a successful flush (see
+// SinceLastFlush in Stats).
+func (t *Transceiver) markFlushed() {
+	atomic.StoreInt64(&t.lastFlush, time.Now().UnixNano())
+}
+
 func (t *Transceiver) startFlushers() {
+	t.deadLetters.max = t.DeadLetterSize
+	t.markFlushed() // as good as, by way of a starting point
 
 	t.flusherChs = make([]chan *dsFlushRequest, t.NWorkers)
 
@@ -503,8 +1082,11 @@ func (t *Transceiver) statWorker() {
 			// experiments show that it will not stay aligned on a
 			// multiple of duration if the system clock is
 			// adjusted. This thing will mostly remain aligned.
+			t.liveLk.RLock()
+			interval := t.StatFlushDuration
+			t.liveLk.RUnlock()
 			clock := time.Now()
-			time.Sleep(clock.Truncate(t.StatFlushDuration).Add(t.StatFlushDuration).Sub(clock))
+			time.Sleep(clock.Truncate(interval).Add(interval).Sub(clock))
 			if len(flushCh) == 0 {
 				flushCh <- 1
 			} else {
@@ -564,10 +1146,152 @@ func (t *Transceiver) statWorker() {
 	}
 }
 
+// Stats is a snapshot of the transceiver state for monitoring purposes.
+type Stats struct {
+	// Age in seconds of the oldest data point not yet flushed. If
+	// this keeps growing, flushing is not keeping up.
+	OldestDirtyPointAge float64 `json:"oldestDirtyPointAge"`
+	// The same by flush priority (see priority.go).
+	FlushLagHigh   float64 `json:"flushLagHigh"`
+	FlushLagNormal float64 `json:"flushLagNormal"`
+	FlushLagLow    float64 `json:"flushLagLow"`
+	// Data sources (and their points) which failed to flush after
+	// all retries, and are held in memory.
+	DeadLetterSeries int `json:"deadLetterSeries"`
+	DeadLetterPoints int `json:"deadLetterPoints"`
+	// Data sources ever dead-lettered, including those since dropped
+	// from the full buffer.
+	DeadLetterTotal int64 `json:"deadLetterTotal"`
+	// Incoming data points (and batches of them) not yet dispatched
+	// to the workers.
+	QueueDepth int `json:"queueDepth"`
+	// Incoming data points dropped by the allow/deny name lists,
+	// since the start.
+	RejectedFiltered int64 `json:"rejectedFiltered"`
+	// Incoming data points dropped for a non-finite value or an
+	// impossible timestamp, since the start.
+	RejectedInvalid int64 `json:"rejectedInvalid"`
+	// Incoming data points dropped for a name longer than
+	// MaxSeriesNameLength, or for a new series beyond MaxSeries,
+	// since the start.
+	RejectedNameLength int64 `json:"rejectedNameLength"`
+	RejectedSeriesFull int64 `json:"rejectedSeriesFull"`
+	// Data sources in the spool (see SpoolDir), its size in bytes,
+	// and data sources dropped from it because it was full.
+	SpoolSeries  int   `json:"spoolSeries"`
+	SpoolBytes   int64 `json:"spoolBytes"`
+	SpoolDropped int64 `json:"spoolDropped"`
+
+	// Seconds since a flush last succeeded (or the flushers started),
+	// it keeps growing if flushing stalls (or there's nothing to flush).
+	SinceLastFlush float64 `json:"sinceLastFlush"`
+}
+
+// QueueFull is true when the incoming data points (or batches of
+// them) fill more than QueueHighWater of their queue, i.e. the
+// dispatcher is falling behind. Ingestion should then push back or
+// drop, rather than block in QueueDataPoint(s).
+func (t *Transceiver) QueueFull() bool {
+	return t.QueueHighWater > 0 &&
+		(float64(len(t.dpCh)) >= t.QueueHighWater*float64(cap(t.dpCh)) ||
+			float64(len(t.dpsCh)) >= t.QueueHighWater*float64(cap(t.dpsCh)))
+}
+
+func (t *Transceiver) Stats() *Stats {
+	dss, points, total := t.deadLetters.size()
+	lag := t.flushLag()
+	st := &Stats{
+		OldestDirtyPointAge: t.OldestDirtyPointAge().Seconds(),
+		FlushLagHigh:        lag[FlushPriorityHigh].Seconds(),
+		FlushLagNormal:      lag[FlushPriorityNormal].Seconds(),
+		FlushLagLow:         lag[FlushPriorityLow].Seconds(),
+		DeadLetterSeries:    dss,
+		DeadLetterPoints:    points,
+		DeadLetterTotal:     total,
+		QueueDepth:          len(t.dpCh) + len(t.dpsCh),
+		RejectedFiltered:    atomic.LoadInt64(&t.rejectedFiltered),
+		RejectedInvalid:     atomic.LoadInt64(&t.rejectedInvalid),
+		RejectedNameLength:  atomic.LoadInt64(&t.rejectedNameLength),
+		RejectedSeriesFull:  atomic.LoadInt64(&t.rejectedSeriesFull),
+		SinceLastFlush:      time.Now().Sub(time.Unix(0, atomic.LoadInt64(&t.lastFlush))).Seconds(),
+	}
+	if t.spool != nil {
+		st.SpoolSeries, st.SpoolBytes, st.SpoolDropped = t.spool.size()
+	}
+	return st
+}
+
+// OldestDirtyPointAge returns how long ago the oldest data point
+// not yet flushed (still in the cache, or queued to be flushed)
+// arrived, across all workers. It is zero if there is nothing to
+// flush.
+func (t *Transceiver) OldestDirtyPointAge() time.Duration {
+	var oldest time.Time
+	for _, d := range t.dirty {
+		if o := d.oldest(); !o.IsZero() && (oldest.IsZero() || o.Before(oldest)) {
+			oldest = o
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Now().Sub(oldest)
+}
+
+// Ping checks that the serde's database is reachable, a serde which
+// cannot tell is assumed to be.
+func (t *Transceiver) Ping() error {
+	if t.serde == nil {
+		return fmt.Errorf("no serde")
+	}
+	if pserde, ok := t.serde.(rrd.Pinger); ok {
+		return pserde.Ping()
+	}
+	return nil
+}
+
+func (t *Transceiver) StoreAnnotation(a *rrd.Annotation) error {
+	if aserde, ok := t.serde.(rrd.AnnotationSerDe); ok {
+		return aserde.StoreAnnotation(a)
+	}
+	return fmt.Errorf("annotations not supported by this serde")
+}
+
+func (t *Transceiver) FetchAnnotations(from, to time.Time, tag string) ([]*rrd.Annotation, error) {
+	if aserde, ok := t.serde.(rrd.AnnotationSerDe); ok {
+		return aserde.FetchAnnotations(from, to, tag)
+	}
+	return nil, fmt.Errorf("annotations not supported by this serde")
+}
+
 func (t *Transceiver) FsFind(pattern string) []*rrd.FsFindNode {
 	return t.Rcache.FsFind(pattern)
 }
 
+// DeleteSeries deletes the series matching pattern (a graphite glob)
+// from the serde, along with all of their data, and forgets them. It
+// returns how many were deleted, matching none isn't an error. A
+// series receiving data points after this is created anew.
+func (t *Transceiver) DeleteSeries(pattern string) (int, error) {
+	deleter, ok := t.serde.(rrd.DataSourceDeleter)
+	if !ok {
+		return 0, fmt.Errorf("the serde cannot delete data sources")
+	}
+	if err := t.Rcache.Reload(); err != nil { // names created by other nodes too
+		return 0, err
+	}
+	n := 0
+	for name, dsId := range t.Rcache.DsIdsFromIdent(pattern) {
+		if err := deleter.DeleteDataSource(dsId); err != nil {
+			return n, err
+		}
+		t.forgetSeries(name, dsId)
+		log.Printf("DeleteSeries(): deleted %q (ds %d).", name, dsId)
+		n++
+	}
+	return n, nil
+}
+
 // Implement cluster.DistDatum for data sources
 
 type distDatumDataSource struct {
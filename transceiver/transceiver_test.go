@@ -0,0 +1,1456 @@
+package transceiver
+
+import (
+	"fmt"
+	"github.com/tgres/tgres/rrd"
+	"io/ioutil"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flushCheckSerDe counts flushes and detects concurrent flushes of
+// the same data source.
+type flushCheckSerDe struct {
+	sync.Mutex
+	inFlight map[int64]bool
+	flushes  map[int64]int
+	overlaps int
+}
+
+func (f *flushCheckSerDe) CreateOrReturnDataSource(name string, dsSpec *rrd.DSSpec) (*rrd.DataSource, error) {
+	return nil, nil
+}
+func (f *flushCheckSerDe) FetchDataSource(id int64) (*rrd.DataSource, error) { return nil, nil }
+func (f *flushCheckSerDe) FetchDataSources() ([]*rrd.DataSource, error)      { return nil, nil }
+func (f *flushCheckSerDe) FetchDataSourceNames() (map[string]int64, error)   { return nil, nil }
+func (f *flushCheckSerDe) ListDbClientIps() ([]string, error)                { return nil, nil }
+func (f *flushCheckSerDe) MyDbAddr() (*string, error)                        { return nil, nil }
+func (f *flushCheckSerDe) SeriesQuery(ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
+	return nil, nil
+}
+
+func (f *flushCheckSerDe) FlushDataSource(ds *rrd.DataSource) error {
+	f.Lock()
+	if f.inFlight[ds.Id] {
+		f.overlaps++
+	}
+	f.inFlight[ds.Id] = true
+	f.Unlock()
+
+	time.Sleep(time.Millisecond) // a slow db
+
+	f.Lock()
+	f.inFlight[ds.Id] = false
+	f.flushes[ds.Id]++
+	f.Unlock()
+	return nil
+}
+
+func TestDsShard(t *testing.T) {
+	serde := &flushCheckSerDe{inFlight: make(map[int64]bool), flushes: make(map[int64]int)}
+	tr := New(nil, serde)
+	tr.NWorkers = 2
+	tr.MinCacheDuration, tr.MaxCacheDuration = time.Hour, 2*time.Hour // not due
+	if err := tr.dss.Reload(serde); err != nil {
+		t.Fatalf("dss.Reload(): %v", err)
+	}
+	lu := time.Now().Truncate(10 * time.Second).Add(-time.Minute)
+	for _, id := range []int64{1, 2} {
+		tr.dss.Insert(&rrd.DataSource{Id: id, Name: fmt.Sprintf("foo.%d", id), StepMs: 10000, HeartbeatMs: 3600000,
+			LastUpdate: lu, LastFlushRT: time.Now(),
+			RRAs: []*rrd.RoundRobinArchive{&rrd.RoundRobinArchive{Id: id, DsId: id, Cf: "AVERAGE",
+				StepsPerRow: 1, Size: 360, Xff: 0.5, Width: 768, Latest: lu, DPs: make(map[int64]float64)}}})
+	}
+	tr.startWorkers()
+	tr.startFlushers()
+	tr.startWg.Wait()
+
+	// ds 1 to its own worker, ds 2 to the worker of ds 1
+	if tr.dsShard(1) == tr.dsShard(2) {
+		t.Fatalf("expected ds 1 and 2 to have different workers")
+	}
+	for _, id := range []int64{1, 2} {
+		ds := tr.dss.GetById(id)
+		tr.workerChs[tr.dsShard(1)] <- &rrd.DataPoint{DS: ds, Name: ds.Name, TimeStamp: lu.Add(10 * time.Second), Value: 1}
+	}
+	for len(tr.workerChs[tr.dsShard(1)]) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// one request, answered by both workers
+	copies := tr.requestDsCopies([]int64{1, 2})
+	for id, expect := range map[int64]time.Time{1: lu.Add(10 * time.Second), 2: lu} {
+		if copy := copies[id]; copy == nil {
+			t.Errorf("ds %d: expected a copy", id)
+		} else if !copy.LastUpdate.Equal(expect) {
+			t.Errorf("ds %d: expected it to be last updated at %v, got %v", id, expect, copy.LastUpdate)
+		}
+	}
+	tr.stopWorkers()
+	tr.stopFlushers()
+}
+
+func TestFlushSameDsConcurrently(t *testing.T) {
+	serde := &flushCheckSerDe{inFlight: make(map[int64]bool), flushes: make(map[int64]int)}
+	tr := New(nil, serde)
+	tr.dirty = make([]*dirtySet, tr.NWorkers)
+	for i := range tr.dirty {
+		tr.dirty[i] = newDirtySet()
+	}
+	tr.startFlushers()
+	tr.startWg.Wait()
+
+	const goroutines, flushes = 8, 20
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < flushes; i++ {
+				// each goroutine has its own copy of the same DS (id 7)
+				ds := &rrd.DataSource{Id: 7, Name: "foo.bar"}
+				tr.flushDs(ds, true)
+			}
+		}()
+	}
+	wg.Wait()
+	tr.stopFlushers()
+
+	if serde.overlaps > 0 {
+		t.Errorf("the same ds was flushed concurrently %d times", serde.overlaps)
+	}
+	if n := serde.flushes[7]; n != goroutines*flushes {
+		t.Errorf("expected %d flushes, got %d (lost updates)", goroutines*flushes, n)
+	}
+}
+
+// cacheCheckSerDe has one ds with some (flushed) data in the "db".
+type cacheCheckSerDe struct {
+	flushCheckSerDe
+	ds     *rrd.DataSource // the in-memory version
+	stored []time.Time     // flushed points end on these, values 1, 2, ...
+}
+
+func (f *cacheCheckSerDe) FetchDataSources() ([]*rrd.DataSource, error) {
+	return []*rrd.DataSource{f.ds}, nil
+}
+func (f *cacheCheckSerDe) FetchDataSource(id int64) (*rrd.DataSource, error) {
+	ds := &rrd.DataSource{Id: f.ds.Id, Name: f.ds.Name, StepMs: f.ds.StepMs}
+	if len(f.stored) > 0 {
+		ds.LastUpdate = f.stored[len(f.stored)-1] // as flushed
+	}
+	return ds, nil
+}
+func (f *cacheCheckSerDe) SeriesQuery(ds *rrd.DataSource, from, to time.Time, maxPoints int64) (rrd.Series, error) {
+	return &storedSeries{ends: f.stored, stepMs: ds.StepMs}, nil
+}
+
+type storedSeries struct {
+	ends   []time.Time
+	stepMs int64
+	pos    int
+}
+
+func (s *storedSeries) Next() bool {
+	s.pos++
+	return s.pos <= len(s.ends)
+}
+func (s *storedSeries) Close() error                { s.pos = 0; return nil }
+func (s *storedSeries) CurrentValue() float64       { return float64(s.pos) }
+func (s *storedSeries) CurrentPosEndsOn() time.Time { return s.ends[s.pos-1] }
+func (s *storedSeries) CurrentPosBeginsAfter() time.Time {
+	return s.CurrentPosEndsOn().Add(-10 * time.Second)
+}
+func (s *storedSeries) StepMs() int64            { return s.stepMs }
+func (s *storedSeries) GroupByMs(...int64) int64 { return s.stepMs }
+func (s *storedSeries) LastUpdate() time.Time    { return s.ends[len(s.ends)-1] }
+func (s *storedSeries) MaxPoints(...int64) int64 { return 0 }
+func (s *storedSeries) Alias(...string) string   { return "" }
+func (s *storedSeries) TimeRange(...time.Time) (time.Time, time.Time) {
+	return time.Time{}, time.Time{}
+}
+
+func TestSeriesQueryIncludesUnflushedPoints(t *testing.T) {
+	step := 10 * time.Second
+	lu := time.Now().Truncate(step).Add(-time.Minute)
+	serde := &cacheCheckSerDe{
+		flushCheckSerDe: flushCheckSerDe{inFlight: make(map[int64]bool), flushes: make(map[int64]int)},
+		ds: &rrd.DataSource{Id: 1, Name: "foo.bar", StepMs: 10000, HeartbeatMs: 3600000,
+			LastUpdate: lu, LastFlushRT: time.Now(),
+			RRAs: []*rrd.RoundRobinArchive{&rrd.RoundRobinArchive{Id: 1, DsId: 1, Cf: "AVERAGE",
+				StepsPerRow: 1, Size: 360, Xff: 0.5, Width: 768, Latest: lu, DPs: make(map[int64]float64)}},
+		},
+		stored: []time.Time{lu.Add(-step), lu},
+	}
+
+	tr := New(nil, serde)
+	tr.MaxCacheDuration = time.Hour // no flushing
+	if err := tr.dss.Reload(serde); err != nil {
+		t.Fatalf("dss.Reload(): %v", err)
+	}
+	tr.startWorkers()
+	tr.startFlushers()
+	tr.startWg.Wait()
+	defer tr.stopFlushers()
+	defer tr.stopWorkers() // which flushes, see TestFlushInterval
+
+	ds := tr.dss.GetById(1)
+	tr.workerChs[tr.dsShard(ds.Id)] <- &rrd.DataPoint{DS: ds, Name: ds.Name, TimeStamp: lu.Add(step), Value: 3}
+
+	query := func(to time.Time) (ends []time.Time, values []float64) {
+		series, err := tr.Rcache.SeriesQuery(tr.Rcache.GetDSById(1), lu.Add(-time.Hour), to, 0)
+		if err != nil {
+			t.Fatalf("SeriesQuery(): %v", err)
+		}
+		for series.Next() {
+			ends = append(ends, series.CurrentPosEndsOn())
+			values = append(values, series.CurrentValue())
+		}
+		series.Close()
+		return ends, values
+	}
+
+	// the worker processes the data point asynchronously
+	var (
+		ends   []time.Time
+		values []float64
+	)
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if ends, values = query(time.Now()); len(ends) == 3 {
+			break
+		}
+	}
+	if len(ends) != 3 || !ends[2].Equal(lu.Add(step)) || values[0] != 1 || values[1] != 2 || values[2] != 3 {
+		t.Fatalf("until=now: expected stored points followed by the fresh one, got %v %v", ends, values)
+	}
+
+	if ends, _ = query(lu); len(ends) != 2 {
+		t.Errorf("until before the fresh point: expected 2 stored points, got %v", ends)
+	}
+
+	// a range ending before the last flushed update asks no worker
+	requests := 0
+	dsCopies := tr.Rcache.dsCopies
+	tr.Rcache.dsCopies = func(ids []int64) map[int64]*rrd.DataSource {
+		requests++
+		return dsCopies(ids)
+	}
+	if query(lu.Add(-time.Second)); requests != 0 {
+		t.Errorf("until in the past: expected no copy requests, got %d", requests)
+	}
+	if query(lu); requests != 1 {
+		t.Errorf("until at the last update: expected 1 copy request, got %d", requests)
+	}
+
+	if n := serde.flushes[1]; n != 0 {
+		t.Errorf("expected no flushes, got %d", n)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	for _, interval := range []time.Duration{20 * time.Millisecond, 0} {
+		lu := time.Now().Truncate(10 * time.Second).Add(-time.Minute)
+		serde := &cacheCheckSerDe{
+			flushCheckSerDe: flushCheckSerDe{inFlight: make(map[int64]bool), flushes: make(map[int64]int)},
+			ds: &rrd.DataSource{Id: 1, Name: "foo.bar", StepMs: 10000, HeartbeatMs: 3600000,
+				LastUpdate: lu, LastFlushRT: time.Now(),
+				RRAs: []*rrd.RoundRobinArchive{&rrd.RoundRobinArchive{Id: 1, DsId: 1, Cf: "AVERAGE",
+					StepsPerRow: 1, Size: 360, Xff: 0.5, Width: 768, Latest: lu, DPs: make(map[int64]float64)}},
+			},
+		}
+		tr := New(nil, serde)
+		tr.NWorkers = 1
+		tr.MinCacheDuration, tr.MaxCacheDuration = time.Hour, 2*time.Hour // not due
+		tr.FlushInterval = interval
+		if err := tr.dss.Reload(serde); err != nil {
+			t.Fatalf("dss.Reload(): %v", err)
+		}
+		tr.startWorkers()
+		tr.startFlushers()
+		tr.startWg.Wait()
+
+		ds := tr.dss.GetById(1)
+		tr.workerChs[0] <- &rrd.DataPoint{DS: ds, Name: ds.Name, TimeStamp: lu.Add(10 * time.Second), Value: 1}
+		time.Sleep(100 * time.Millisecond)
+		serde.Lock()
+		n := serde.flushes[1]
+		serde.Unlock()
+		if interval > 0 && n != 1 {
+			t.Errorf("%v: expected the flush interval to flush the ds, got %d flushes", interval, n)
+		} else if interval == 0 && n != 0 {
+			t.Errorf("%v: expected no flushes before shutdown, got %d", interval, n)
+		}
+		if s := tr.Stats(); interval > 0 && s.SinceLastFlush > 0.1 {
+			t.Errorf("%v: expected a recent flush, got %v seconds ago", interval, s.SinceLastFlush)
+		}
+
+		// Shutting down flushes whatever is left
+		tr.workerChs[0] <- &rrd.DataPoint{DS: ds, Name: ds.Name, TimeStamp: lu.Add(20 * time.Second), Value: 2}
+		tr.stopWorkers()
+		tr.stopFlushers()
+		if expect := n + 1; serde.flushes[1] != expect {
+			t.Errorf("%v: expected %d flushes after shutdown, got %d", interval, expect, serde.flushes[1])
+		}
+	}
+}
+
+func TestDedupeSameTimestamp(t *testing.T) {
+	for _, dedupe := range []bool{true, false} {
+		serde := &failingSerDe{}
+		tr := New(nil, serde)
+		tr.NWorkers = 1
+		tr.MinCacheDuration, tr.MaxCacheDuration = time.Hour, 2*time.Hour // flushed on shutdown
+		tr.DedupeSameTimestamp = dedupe
+		tr.startWorkers()
+		tr.startFlushers()
+		tr.startWg.Wait()
+
+		start := time.Now().Truncate(10 * time.Second).Add(-time.Minute)
+		ds := &rrd.DataSource{Id: 1, Name: "foo.bar", StepMs: 10000, HeartbeatMs: 3600000,
+			LastUpdate: start, LastFlushRT: time.Now(),
+			RRAs: []*rrd.RoundRobinArchive{&rrd.RoundRobinArchive{Id: 1, DsId: 1, Cf: "AVERAGE",
+				StepsPerRow: 1, Size: 360, Xff: 0.5, Width: 768, Latest: start, DPs: make(map[int64]float64)}}}
+		if err := tr.dss.Reload(serde); err != nil {
+			t.Fatalf("dss.Reload(): %v", err)
+		}
+		tr.dss.Insert(ds)
+
+		for _, v := range []float64{1, 2, 3} { // resent, corrected
+			tr.workerChs[0] <- &rrd.DataPoint{DS: ds, Name: ds.Name, TimeStamp: start.Add(10 * time.Second), Value: v}
+		}
+		for len(tr.workerChs[0]) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if dedupe {
+			// A reader sees the held back point too
+			copy := tr.requestDsCopy(ds.Id)
+			if copy == nil || len(copy.RRAs[0].DPs) != 1 {
+				t.Fatalf("dedupe %v: expected the held back point in the copy, got %v", dedupe, copy)
+			}
+			for _, v := range copy.RRAs[0].DPs {
+				if v != 3 {
+					t.Errorf("dedupe %v: expected 3 in the copy, got %v", dedupe, v)
+				}
+			}
+		}
+		tr.stopWorkers()
+		tr.stopFlushers()
+
+		if len(serde.flushed) != 1 || len(serde.flushed[0].RRAs[0].DPs) != 1 {
+			t.Fatalf("dedupe %v: expected one flush of one point, got %v", dedupe, serde.flushed)
+		}
+		expect := 3.0 // the last one
+		if !dedupe {
+			expect = 1 // the first one, the others cover no time
+		}
+		for _, v := range serde.flushed[0].RRAs[0].DPs {
+			if v != expect {
+				t.Errorf("dedupe %v: expected %v stored, got %v", dedupe, expect, v)
+			}
+		}
+	}
+}
+
+// Queueing the lines of a (50 line) UDP datagram one at a time vs
+// all at once.
+const benchDatagramLines = 50
+
+func benchmarkQueue(b *testing.B, queue func(tr *Transceiver, dps []*rrd.DataPoint)) {
+	tr := New(nil, nil)
+	done := make(chan bool)
+	go func() { // stand-in for the dispatcher
+		for {
+			select {
+			case <-tr.dpCh:
+			case <-tr.dpsCh:
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dps := make([]*rrd.DataPoint, benchDatagramLines)
+		for n := range dps {
+			dps[n] = &rrd.DataPoint{Name: "foo.bar", TimeStamp: now, Value: float64(n)}
+		}
+		queue(tr, dps)
+	}
+}
+
+func BenchmarkQueuePerLine(b *testing.B) {
+	benchmarkQueue(b, func(tr *Transceiver, dps []*rrd.DataPoint) {
+		for _, dp := range dps {
+			tr.QueueDataPoint(dp.Name, dp.TimeStamp, dp.Value)
+		}
+	})
+}
+
+func BenchmarkQueuePerDatagram(b *testing.B) {
+	benchmarkQueue(b, func(tr *Transceiver, dps []*rrd.DataPoint) {
+		tr.QueueDataPoints(dps)
+	})
+}
+
+func TestTimestampSource(t *testing.T) {
+	embedded := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for _, c := range []struct {
+		source  string
+		ts      time.Time
+		arrival bool
+	}{
+		{"embedded", embedded, false},
+		{"embedded", time.Unix(0, 0), false},
+		{"arrival", embedded, true},
+		{"preferEmbedded", embedded, false},
+		{"preferEmbedded", time.Unix(0, 0), true},
+		{"preferEmbedded", time.Unix(-1, 0), true},
+	} {
+		tr := New(nil, nil)
+		if err := tr.TimestampSource.UnmarshalText([]byte(c.source)); err != nil {
+			t.Fatalf("UnmarshalText(%q): %v", c.source, err)
+		}
+
+		before := time.Now()
+		tr.QueueDataPoint("foo.bar", c.ts, 1)
+		tr.QueueDataPoints([]*rrd.DataPoint{&rrd.DataPoint{Name: "foo.bar", TimeStamp: c.ts, Value: 1}})
+
+		for _, dp := range []*rrd.DataPoint{<-tr.dpCh, (<-tr.dpsCh)[0]} {
+			arrived := !dp.TimeStamp.Before(before)
+			if arrived != c.arrival || (!arrived && !dp.TimeStamp.Equal(c.ts)) {
+				t.Errorf("%s with %v: expected arrival time %v, got time stamp %v", c.source, c.ts, c.arrival, dp.TimeStamp)
+			}
+		}
+	}
+
+	var s TimestampSource
+	if err := s.UnmarshalText([]byte("client")); err == nil {
+		t.Errorf("expected an error for an invalid timestamp source")
+	}
+}
+
+func TestDerivedMetrics(t *testing.T) {
+	total, err := ParseDerivedMetric("foo.total = foo.a + foo.b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseDerivedMetric("foo.bad = foo.a +"); err == nil {
+		t.Errorf("expected an error for an incomplete expression")
+	}
+	if dm, err := ParseDerivedMetric("foo.x = (foo.a - 1) * 2 / foo.b"); err != nil {
+		t.Errorf("ParseDerivedMetric(): %v", err)
+	} else if v := dm.expr.eval(map[string]float64{"foo.a": 4, "foo.b": 3}); v != 2 {
+		t.Errorf("(4 - 1) * 2 / 3: expected 2, got %v", v)
+	}
+
+	tr := New(nil, nil)
+	tr.derived = newDerivedState([]*DerivedMetric{total}, time.Minute)
+
+	latest := time.Unix(1000000, 0)
+	newDs := func(name string, values ...float64) *rrd.DataSource {
+		rra := &rrd.RoundRobinArchive{StepsPerRow: 1, Size: 10, Latest: latest, DPs: make(map[int64]float64)}
+		ds := &rrd.DataSource{Name: name, StepMs: 10000, RRAs: []*rrd.RoundRobinArchive{rra}}
+		for i, v := range values { // the last value is the latest slot
+			ms := latest.Add(time.Duration(i-len(values)+1)*10*time.Second).UnixNano() / 1000000
+			rra.DPs[(ms/10000)%10] = v
+		}
+		return ds
+	}
+
+	tr.deriveFromFlush(newDs("foo.a", 1, 2))
+	tr.deriveFromFlush(newDs("foo.unrelated", 5))
+	tr.deriveFromFlush(newDs("foo.b", 10, 20))
+
+	got := make(map[time.Time]float64)
+	for len(got) < 2 {
+		select {
+		case dps := <-tr.dpsCh:
+			for _, dp := range dps {
+				if dp.Name != "foo.total" {
+					t.Errorf("unexpected derived name %q", dp.Name)
+				}
+				got[dp.TimeStamp] = dp.Value
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for derived points, got %v", got)
+		}
+	}
+	if v := got[latest.Add(-10*time.Second)]; v != 11 {
+		t.Errorf("expected 1 + 10 = 11, got %v", v)
+	}
+	if v := got[latest]; v != 22 {
+		t.Errorf("expected 2 + 20 = 22, got %v", v)
+	}
+
+	// A late re-flush of an emitted slot doesn't reopen it
+	if dps := tr.derived.record(newDs("foo.a", 3), latest.Add(2*time.Minute)); len(dps) != 0 {
+		t.Errorf("expected nothing for an emitted slot, got %v", dps)
+	}
+
+	// A missing input makes the result NaN, once we give up on it
+	latest = latest.Add(10 * time.Second)
+	tr.derived.record(newDs("foo.a", 3), latest)
+	dps := tr.derived.record(newDs("foo.unrelated", 5), latest.Add(2*time.Minute))
+	if len(dps) != 1 || !math.IsNaN(dps[0].Value) {
+		t.Errorf("expected one NaN data point, got %v", dps)
+	}
+
+	// Once the dispatcher has exited, a derived point is dropped
+	// rather than leaving a goroutine blocked forever.
+	tr.dpsCh = make(chan []*rrd.DataPoint)
+	close(tr.dispatcherDone)
+	before := runtime.NumGoroutine()
+	latest = latest.Add(10 * time.Second)
+	tr.deriveFromFlush(newDs("foo.a", 1))
+	tr.deriveFromFlush(newDs("foo.b", 2))
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the derived points sender to exit")
+		}
+	}
+}
+
+func TestNameRewriter(t *testing.T) {
+	for _, c := range []struct {
+		script, name, expect string
+	}{
+		{"{{index .Segments 2}}.{{index .Segments 0}}", "a.b.c", "c.a"},
+		{`{{join (drop .Segments 1) "."}}`, "a.b.c", "a.c"},
+		{`{{if eq (index .Segments 0) "junk"}}{{else}}{{.Name}}{{end}}`, "junk.b", ""},
+	} {
+		r, err := NewNameRewriter(c.script)
+		if err != nil {
+			t.Fatalf("NewNameRewriter(%q): %v", c.script, err)
+		}
+		if name, err := r.Rewrite(c.name); err != nil || name != c.expect {
+			t.Errorf("%q: expected %q, got %q (%v)", c.script, c.expect, name, err)
+		}
+	}
+
+	tr := New(nil, nil)
+	tr.NameRewriter, _ = NewNameRewriter("{{index .Segments 2}}.{{index .Segments 0}}")
+	tr.QueueDataPoint("a.b.c", time.Now(), 1)
+	if dp := <-tr.dpCh; dp.Name != "c.a" {
+		t.Errorf("expected c.a, got %q", dp.Name)
+	}
+
+	// A failed rewrite (index out of range) keeps the name
+	tr.QueueDataPoints([]*rrd.DataPoint{&rrd.DataPoint{Name: "a.b", TimeStamp: time.Now()}})
+	if dps := <-tr.dpsCh; dps[0].Name != "a.b" {
+		t.Errorf("expected a.b, got %q", dps[0].Name)
+	}
+
+	// Output is bounded
+	r, _ := NewNameRewriter(`{{define "x"}}{{.Name}}{{template "x" .}}{{end}}{{template "x" .}}`)
+	if _, err := r.Rewrite("a.b.c"); err == nil {
+		t.Errorf("expected an error for a runaway template")
+	}
+}
+
+func TestNameReplaceRules(t *testing.T) {
+	var spaces, junk NameReplaceRule
+	if err := spaces.UnmarshalText([]byte(`\s+ _`)); err != nil {
+		t.Fatalf("UnmarshalText(): %v", err)
+	}
+	if err := junk.UnmarshalText([]byte(`^junk.*`)); err != nil {
+		t.Fatalf("UnmarshalText(): %v", err)
+	}
+	if err := (&NameReplaceRule{}).UnmarshalText([]byte("a b c")); err == nil {
+		t.Errorf("expected an error for a rule with too many fields")
+	}
+
+	tr := New(nil, nil)
+	tr.NameReplaceRules = []*NameReplaceRule{&spaces, &junk}
+	tr.SanitizeNames = true
+	for name, expect := range map[string]string{
+		"foo  bar.baz":     "foo_bar.baz",
+		".a..b...c.":       "a.b.c",
+		"a/b(c).d":         "a_b_c_.d",
+		"foo.bar;dc=east":  "foo.bar;dc=east",
+		"..foo..;dc=east":  "foo;dc=east",
+		"junk.anything":    "",
+		"...":              "",
+		"Foo-Bar.baz:quux": "Foo-Bar.baz:quux",
+	} {
+		if got := tr.rewriteName(name); got != expect {
+			t.Errorf("%q: expected %q, got %q", name, expect, got)
+		}
+	}
+
+	tr = New(nil, nil)
+	tr.NameReplaceRules = []*NameReplaceRule{&junk}
+	tr.QueueDataPoint("junk.a", time.Now(), 1)
+	tr.QueueDataPoint("ok.a", time.Now(), 1)
+	if dp := <-tr.dpCh; dp.Name != "ok.a" {
+		t.Errorf("expected junk.a to be dropped, got %q", dp.Name)
+	}
+	if st := <-tr.stCh; st.Name != "tgres.name_rewrite_drops" || st.Value != 1 {
+		t.Errorf("expected the drop to be counted, got %+v", st)
+	}
+}
+
+func TestNameFilter(t *testing.T) {
+	patterns := func(texts ...string) []*NamePattern {
+		var result []*NamePattern
+		for _, text := range texts {
+			p := &NamePattern{}
+			if err := p.UnmarshalText([]byte(text)); err != nil {
+				t.Fatalf("UnmarshalText(%q): %v", text, err)
+			}
+			result = append(result, p)
+		}
+		return result
+	}
+	if err := (&NamePattern{}).UnmarshalText([]byte("/(/")); err == nil {
+		t.Errorf("expected an error for a bad regexp")
+	}
+
+	for _, c := range []struct {
+		desc        string
+		allow, deny []*NamePattern
+		accepted    map[string]bool
+	}{
+		{"allow only", patterns("servers.*", `/^apps\.(web|db)\./`), nil, map[string]bool{
+			"servers.a.cpu": true, "apps.web.hits": true, "apps.cache.hits": false, "junk": false,
+		}},
+		{"deny only", nil, patterns("servers.?.runaway.*"), map[string]bool{
+			"servers.a.runaway.x": false, "servers.ab.runaway.x": true, "servers.a.cpu": true,
+		}},
+	} {
+		tr := New(nil, nil)
+		tr.AllowNames, tr.DenyNames = c.allow, c.deny
+		var rejected int64
+		for name, accept := range c.accepted {
+			tr.QueueDataPoints([]*rrd.DataPoint{&rrd.DataPoint{Name: name, TimeStamp: time.Now()}})
+			if accept {
+				if dps := <-tr.dpsCh; dps[0].Name != name {
+					t.Errorf("%s: expected %q, got %q", c.desc, name, dps[0].Name)
+				}
+			} else {
+				rejected++
+			}
+			if len(tr.dpsCh) > 0 {
+				t.Errorf("%s: expected %q to be filtered", c.desc, name)
+				<-tr.dpsCh
+			}
+		}
+		if n := tr.Stats().RejectedFiltered; n != rejected {
+			t.Errorf("%s: expected %d rejected, got %d", c.desc, rejected, n)
+		}
+	}
+}
+
+func TestMaxSeriesNameLength(t *testing.T) {
+	tr := New(nil, nil)
+	tr.MaxSeriesNameLength = 7
+	tr.QueueDataPoints([]*rrd.DataPoint{
+		&rrd.DataPoint{Name: "foo.bar", TimeStamp: time.Now()},
+		&rrd.DataPoint{Name: "foo.bar.baz", TimeStamp: time.Now()},
+	})
+	if dps := <-tr.dpsCh; len(dps) != 1 || dps[0].Name != "foo.bar" {
+		t.Errorf("expected only foo.bar, got %v", dps)
+	}
+	tr.QueueDataPoint("foo.bar.baz", time.Now(), 1)
+	if n := tr.Stats().RejectedNameLength; n != 2 || len(tr.dpCh) != 0 {
+		t.Errorf("expected 2 rejected for their length (and none queued), got %d (%d)", n, len(tr.dpCh))
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	tr := New(nil, nil)
+	if _, err := tr.Subscribe("/(/", 1); err == nil {
+		t.Errorf("expected an error for a bad regexp")
+	}
+	sub, err := tr.Subscribe("foo.*", 1)
+	if err != nil {
+		t.Fatalf("Subscribe(): %v", err)
+	}
+	tr.QueueDataPoint("bar.a", time.Now(), 1)
+	tr.QueueDataPoints([]*rrd.DataPoint{
+		&rrd.DataPoint{Name: "foo.a", TimeStamp: time.Now(), Value: 2},
+		&rrd.DataPoint{Name: "foo.b", TimeStamp: time.Now(), Value: 3},
+	})
+	if dp := <-sub.C; dp.Name != "foo.a" || dp.Value != 2 {
+		t.Errorf("expected foo.a, got %v", dp)
+	}
+	if n := sub.Dropped(); n != 1 {
+		t.Errorf("expected foo.b to be dropped (the buffer was full), got %d dropped", n)
+	}
+	tr.Unsubscribe(sub)
+	tr.QueueDataPoint("foo.c", time.Now(), 4)
+	if _, ok := <-sub.C; ok {
+		t.Errorf("expected C to be closed after Unsubscribe()")
+	}
+}
+
+func TestValidDataPoint(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		desc     string
+		keepNaN  bool
+		ts       time.Time
+		v        float64
+		accepted bool
+	}{
+		{"finite", false, now, 1, true},
+		{"NaN", false, now, math.NaN(), false},
+		{"+Inf", false, now, math.Inf(1), false},
+		{"-Inf", false, now, math.Inf(-1), false},
+		{"NaN kept", true, now, math.NaN(), true},
+		{"negative timestamp", false, time.Unix(-1, 0), 1, false},
+		{"slightly ahead", false, now.Add(time.Minute), 1, true},
+		{"too far ahead", false, now.Add(2 * time.Hour), 1, false},
+	} {
+		tr := New(nil, nil)
+		tr.DropNonFinite = !c.keepNaN
+		tr.MaxFutureSkew = time.Hour
+		tr.QueueDataPoint("foo.bar", c.ts, c.v)
+		tr.QueueDataPoints([]*rrd.DataPoint{&rrd.DataPoint{Name: "foo.bar", TimeStamp: c.ts, Value: c.v}})
+		if accepted := len(tr.dpCh) == 1 && len(tr.dpsCh) == 1; accepted != c.accepted {
+			t.Errorf("%s: expected accepted %v, got %v", c.desc, c.accepted, accepted)
+		}
+		var rejected int64
+		if !c.accepted {
+			rejected = 2
+		}
+		if n := tr.Stats().RejectedInvalid; n != rejected {
+			t.Errorf("%s: expected %d rejected, got %d", c.desc, rejected, n)
+		}
+	}
+}
+
+func TestSeriesAliasRules(t *testing.T) {
+	var r SeriesAliasRule
+	if err := r.UnmarshalText([]byte(`^(web\d+)\.example\.com\. $1.`)); err != nil {
+		t.Fatalf("UnmarshalText(): %v", err)
+	}
+	if err := (&SeriesAliasRule{}).UnmarshalText([]byte("^web1")); err == nil {
+		t.Errorf("expected an error for a rule without a canonical name")
+	}
+
+	tr := New(nil, nil)
+	tr.SeriesAliasRules = []*SeriesAliasRule{&r}
+	tr.QueueDataPoint("web1.example.com.cpu.idle", time.Now(), 1)
+	tr.QueueDataPoints([]*rrd.DataPoint{
+		&rrd.DataPoint{Name: "web1.cpu.idle", TimeStamp: time.Now()},
+		&rrd.DataPoint{Name: "db1.example.com.cpu.idle", TimeStamp: time.Now()},
+	})
+	if dp := <-tr.dpCh; dp.Name != "web1.cpu.idle" {
+		t.Errorf("expected web1.cpu.idle, got %q", dp.Name)
+	}
+	dps := <-tr.dpsCh
+	if dps[0].Name != "web1.cpu.idle" || dps[1].Name != "db1.example.com.cpu.idle" {
+		t.Errorf("expected web1.cpu.idle and an unchanged db1.example.com.cpu.idle, got %q and %q", dps[0].Name, dps[1].Name)
+	}
+}
+
+// failingSerDe fails the first failures flushes.
+type failingSerDe struct {
+	flushCheckSerDe
+	failures int
+	attempts int
+	flushed  []*rrd.DataSource
+}
+
+func (f *failingSerDe) FlushDataSource(ds *rrd.DataSource) error {
+	f.Lock()
+	defer f.Unlock()
+	f.attempts++
+	if f.attempts <= f.failures {
+		return fmt.Errorf("connection reset by peer")
+	}
+	f.flushed = append(f.flushed, ds)
+	return nil
+}
+
+func TestFlushRetry(t *testing.T) {
+	for _, c := range []struct {
+		failures, retries int
+		ok                bool
+	}{
+		{2, 3, true},  // transient, eventually flushed
+		{5, 2, false}, // dead-lettered
+	} {
+		serde := &failingSerDe{failures: c.failures}
+		tr := New(nil, serde)
+		tr.NWorkers = 1
+		tr.FlushMaxRetries = c.retries
+		tr.FlushRetryDelay = time.Millisecond
+		tr.dirty = []*dirtySet{newDirtySet()}
+		tr.startFlushers()
+		tr.startWg.Wait()
+
+		rra := &rrd.RoundRobinArchive{StepsPerRow: 1, Size: 10, DPs: map[int64]float64{1: 1, 2: 2}}
+		tr.flushDs(&rrd.DataSource{Id: 1, Name: "foo.bar", RRAs: []*rrd.RoundRobinArchive{rra}}, true)
+		tr.stopFlushers()
+
+		if c.ok {
+			if len(serde.flushed) != 1 || len(serde.flushed[0].RRAs[0].DPs) != 2 {
+				t.Errorf("%d failures, %d retries: expected the points to be flushed, got %v", c.failures, c.retries, serde.flushed)
+			}
+			if serde.attempts != c.failures+1 {
+				t.Errorf("%d failures, %d retries: expected %d attempts, got %d", c.failures, c.retries, c.failures+1, serde.attempts)
+			}
+		} else if serde.attempts != c.retries+1 {
+			t.Errorf("%d failures, %d retries: expected %d attempts, got %d", c.failures, c.retries, c.retries+1, serde.attempts)
+		}
+
+		s := tr.Stats()
+		if dead := !c.ok; dead != (s.DeadLetterSeries == 1 && s.DeadLetterPoints == 2 && s.DeadLetterTotal == 1) {
+			t.Errorf("%d failures, %d retries: unexpected dead-letter stats %+v", c.failures, c.retries, s)
+		}
+	}
+}
+
+// failingDsSerDe fails the first failures flushes of ds 1 only.
+type failingDsSerDe struct {
+	failingSerDe
+}
+
+func (f *failingDsSerDe) FlushDataSource(ds *rrd.DataSource) error {
+	f.Lock()
+	defer f.Unlock()
+	if ds.Id == 1 {
+		if f.attempts++; f.attempts <= f.failures {
+			return fmt.Errorf("connection reset by peer")
+		}
+	}
+	f.flushed = append(f.flushed, ds)
+	return nil
+}
+
+func TestFlushRetryDoesNotBlock(t *testing.T) {
+	serde := &failingDsSerDe{failingSerDe{failures: 2}}
+	tr := New(nil, serde)
+	tr.NWorkers = 1
+	tr.FlushMaxRetries = 3
+	tr.FlushRetryDelay = 50 * time.Millisecond
+	tr.dirty = []*dirtySet{newDirtySet()}
+	tr.startFlushers()
+	tr.startWg.Wait()
+
+	newDs := func(id int64, value float64) *rrd.DataSource {
+		rra := &rrd.RoundRobinArchive{StepsPerRow: 1, Size: 10, DPs: map[int64]float64{1: value}}
+		return &rrd.DataSource{Id: id, Name: fmt.Sprintf("foo.%d", id), RRAs: []*rrd.RoundRobinArchive{rra}}
+	}
+	tr.flushDs(newDs(1, 1), false)
+	tr.flushDs(newDs(1, 2), false) // queued behind the retries
+	start := time.Now()
+	tr.flushDs(newDs(2, 3), true)
+	if d := time.Now().Sub(start); d >= tr.FlushRetryDelay {
+		t.Errorf("expected ds 2 to be flushed while ds 1 is retried, it took %v", d)
+	}
+	tr.stopFlushers()
+
+	var got []float64
+	for _, ds := range serde.flushed {
+		got = append(got, ds.RRAs[0].DPs[1])
+	}
+	if len(got) != 3 || got[0] != 3 || got[1] != 1 || got[2] != 2 {
+		t.Errorf("expected ds 2, then the flushes of ds 1 in order, got %v", got)
+	}
+	if s := tr.Stats(); s.DeadLetterSeries != 0 || s.DeadLetterTotal != 0 {
+		t.Errorf("expected nothing dead-lettered, got %+v", s)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tgres-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := spoolReplayInterval
+	spoolReplayInterval = time.Millisecond
+	defer func() { spoolReplayInterval = saved }()
+
+	serde := &failingSerDe{failures: 3}
+	tr := New(nil, serde)
+	tr.NWorkers = 1
+	tr.SpoolDir, tr.SpoolMaxSize = dir, 1<<20
+	tr.dirty = []*dirtySet{newDirtySet()}
+	if err := tr.startSpool(); err != nil {
+		t.Fatal(err)
+	}
+	tr.startFlushers()
+	tr.startWg.Wait()
+
+	// The first flush fails and is spooled, and so are the ones
+	// after it, until the spool is replayed.
+	for i := int64(1); i <= 3; i++ {
+		rra := &rrd.RoundRobinArchive{StepsPerRow: 1, Size: 10, DPs: map[int64]float64{i: float64(i)}}
+		tr.flushDs(&rrd.DataSource{Id: i, Name: "foo.bar", RRAs: []*rrd.RoundRobinArchive{rra}}, true)
+	}
+	for i := 0; i < 1000; i++ {
+		serde.Lock()
+		n := len(serde.flushed)
+		serde.Unlock()
+		if n == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	tr.stopFlushers()
+	tr.stopSpool()
+
+	if len(serde.flushed) != 3 {
+		t.Fatalf("expected 3 data sources replayed, got %d", len(serde.flushed))
+	}
+	for i, ds := range serde.flushed {
+		if ds.Id != int64(i+1) || ds.RRAs[0].DPs[int64(i+1)] != float64(i+1) {
+			t.Errorf("replayed out of order or mangled: %d: %+v", i, ds)
+		}
+	}
+	if s := tr.Stats(); s.SpoolSeries != 0 || s.DeadLetterSeries != 0 {
+		t.Errorf("expected the spool drained and nothing dead-lettered, got %+v", s)
+	}
+	if tr.spool.active {
+		t.Errorf("expected the spool to be inactive once drained")
+	}
+
+	// A full spool drops its oldest segments, and a torn record
+	// ends a segment.
+	sp, err := openSpool(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.segMax = 1
+	for i := int64(1); i <= 3; i++ {
+		if _, err := sp.add(&rrd.DataSource{Id: i, Name: "foo.bar"}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, _, dropped := sp.size(); entries != 0 || dropped != 3 {
+		t.Errorf("expected all 3 dropped, got %d entries, %d dropped", entries, dropped)
+	}
+	sp.maxSize = 1 << 20
+	for i := int64(1); i <= 2; i++ {
+		sp.add(&rrd.DataSource{Id: i, Name: "foo.bar"}, false)
+	}
+	path := sp.segs[1].path
+	sp.close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	sp, err = openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, _, _ := sp.size(); !sp.active || entries != 2 {
+		t.Errorf("expected 2 data sources left over in an active spool, got %d (active: %v)", entries, sp.active)
+	}
+	var ids []int64
+	for seg := sp.next(); seg != nil; seg = sp.next() {
+		readSpoolSegment(seg.path, func(ds *rrd.DataSource) bool {
+			ids = append(ids, ds.Id)
+			return true
+		})
+		sp.done(seg)
+	}
+	if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+		t.Errorf("expected data sources 1 and 2, got %v", ids)
+	}
+}
+
+// batchSerDe is a BatchFlusher failing the first failures batches.
+type batchSerDe struct {
+	flushCheckSerDe
+	failures int
+	attempts int
+	batches  [][]*rrd.DataSource
+}
+
+func (f *batchSerDe) FlushDataSources(dss []*rrd.DataSource) error {
+	f.Lock()
+	defer f.Unlock()
+	f.attempts++
+	if f.attempts <= f.failures {
+		return fmt.Errorf("connection reset by peer")
+	}
+	f.batches = append(f.batches, dss)
+	return nil
+}
+
+func (f *batchSerDe) flushedBatches() [][]*rrd.DataSource {
+	f.Lock()
+	defer f.Unlock()
+	return f.batches
+}
+
+func TestFlushBatch(t *testing.T) {
+	for _, c := range []struct {
+		failures, maxRetries, attempts int
+		dead                           bool
+	}{
+		{0, 0, 1, false},
+		{1, 0, 1, true}, // not retried
+		{1, 1, 2, false},
+		{2, 1, 2, true}, // dead-lettered after the retries
+		{2, 2, 3, false},
+	} {
+		serde := &batchSerDe{failures: c.failures}
+		tr := New(nil, serde)
+		tr.NWorkers = 1
+		tr.FlushMaxRetries = c.maxRetries
+		tr.FlushBatchSize = 3
+		tr.FlushBatchInterval = 50 * time.Millisecond
+		tr.FlushRetryDelay = time.Millisecond
+		tr.dirty = []*dirtySet{newDirtySet()}
+		tr.startFlushers()
+		tr.startWg.Wait()
+
+		for id := int64(1); id <= 3; id++ {
+			rra := &rrd.RoundRobinArchive{StepsPerRow: 1, Size: 10, DPs: map[int64]float64{1: 1}}
+			tr.flushDs(&rrd.DataSource{Id: id, Name: "foo.bar", RRAs: []*rrd.RoundRobinArchive{rra}}, false)
+		}
+		time.Sleep(20 * time.Millisecond) // well within the interval
+		serde.Lock()
+		attempts := serde.attempts
+		serde.Unlock()
+		if attempts != c.attempts {
+			t.Errorf("%d failures, %d retries: expected a full batch to be flushed in %d attempts, got %d", c.failures, c.maxRetries, c.attempts, attempts)
+		}
+
+		// A partial batch waits for the interval
+		rra := &rrd.RoundRobinArchive{StepsPerRow: 1, Size: 10, DPs: map[int64]float64{1: 1}}
+		tr.flushDs(&rrd.DataSource{Id: 4, Name: "foo.baz", RRAs: []*rrd.RoundRobinArchive{rra}}, false)
+		time.Sleep(100 * time.Millisecond)
+		tr.stopFlushers()
+
+		batches := serde.flushedBatches()
+		if !c.dead && (len(batches) != 2 || len(batches[0]) != 3 || len(batches[1]) != 1) {
+			t.Errorf("%d failures, %d retries: expected a batch of 3 and one of 1, got %v", c.failures, c.maxRetries, batches)
+		}
+		if dead := tr.Stats().DeadLetterSeries == 3; dead != c.dead {
+			t.Errorf("%d failures, %d retries: expected dead-lettered %v, got %+v", c.failures, c.maxRetries, c.dead, tr.Stats())
+		}
+	}
+}
+
+// A flush of a ds in a batch being retried waits for the retry.
+func TestFlushBatchRetryOrder(t *testing.T) {
+	serde := &batchSerDe{failures: 1,
+		flushCheckSerDe: flushCheckSerDe{inFlight: make(map[int64]bool), flushes: make(map[int64]int)}}
+	tr := New(nil, serde)
+	tr.NWorkers = 1
+	tr.FlushMaxRetries = 1
+	tr.FlushBatchSize = 3
+	tr.FlushRetryDelay = 50 * time.Millisecond
+	tr.dirty = []*dirtySet{newDirtySet()}
+	tr.startFlushers()
+	tr.startWg.Wait()
+
+	newDs := func(id int64) *rrd.DataSource {
+		rra := &rrd.RoundRobinArchive{StepsPerRow: 1, Size: 10, DPs: map[int64]float64{1: 1}}
+		return &rrd.DataSource{Id: id, Name: "foo.bar", RRAs: []*rrd.RoundRobinArchive{rra}}
+	}
+	for id := int64(1); id <= 3; id++ {
+		tr.flushDs(newDs(id), false)
+	}
+	time.Sleep(10 * time.Millisecond) // the batch failed
+	tr.flushDs(newDs(1), false)
+	time.Sleep(10 * time.Millisecond)
+	serde.Lock()
+	flushes := serde.flushes[1]
+	serde.Unlock()
+	if flushes != 0 {
+		t.Errorf("expected ds 1 not to be flushed before the retry, got %d flushes", flushes)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	tr.stopFlushers()
+	if batches := serde.flushedBatches(); len(batches) != 1 || len(batches[0]) != 3 {
+		t.Errorf("expected the batch of 3 to be retried, got %v", batches)
+	}
+	if flushes := serde.flushes[1]; flushes != 1 {
+		t.Errorf("expected ds 1 to be flushed after the retry, got %d flushes", flushes)
+	}
+}
+
+// A second of a 1kHz series, inserted into the cache point by point
+// vs pre-aggregated.
+func benchmark1kHzSeries(b *testing.B, preAgg bool) {
+	ds := &rrd.DataSource{StepMs: 1000, HeartbeatMs: 3600 * 1000, LastUpdate: time.Unix(0, 0),
+		RRAs: []*rrd.RoundRobinArchive{
+			&rrd.RoundRobinArchive{Cf: "AVERAGE", StepsPerRow: 1, Size: 3600, Xff: 0.5, DPs: make(map[int64]float64)},
+		},
+	}
+	buf := newPreAggBuffer(func(string) time.Duration { return time.Second })
+	start := time.Unix(1000, 0)
+	inserts := 0
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var dps []*rrd.DataPoint
+		for n := 0; n < 1000; n++ {
+			ts := start.Add(time.Duration(i*1000+n+1) * time.Millisecond)
+			if preAgg {
+				buf.add("foo.bar", ts, float64(n))
+			} else {
+				dps = append(dps, &rrd.DataPoint{Name: "foo.bar", TimeStamp: ts, Value: float64(n)})
+			}
+		}
+		if preAgg {
+			dps = buf.drain()
+		}
+		for _, dp := range dps {
+			dp.DS = ds
+			dp.Process()
+			inserts++
+		}
+	}
+	b.StopTimer()
+	if i := inserts / b.N; preAgg && i != 1 || !preAgg && i != 1000 {
+		b.Errorf("unexpected %d cache inserts per second", i)
+	}
+}
+
+func BenchmarkCacheInserts1kHz(b *testing.B)         { benchmark1kHzSeries(b, false) }
+func BenchmarkCacheInserts1kHzPreAgg1s(b *testing.B) { benchmark1kHzSeries(b, true) }
+
+func TestPreAggregation(t *testing.T) {
+	tr := New(nil, nil)
+	tr.PreAggWindow = time.Hour // drained by stopPreAggregator() only
+	tr.startPreAggregator()
+
+	// Within one 10s step (that of the default DS spec), and one
+	// in the next
+	now := time.Now().Truncate(10 * time.Second).Add(-5 * time.Second)
+	tr.QueueDataPoint("foo.bar", now.Add(-time.Second), 1)
+	tr.QueueDataPoints([]*rrd.DataPoint{
+		&rrd.DataPoint{Name: "foo.bar", TimeStamp: now, Value: 3},
+		&rrd.DataPoint{Name: "foo.baz", TimeStamp: now, Value: 7},
+		&rrd.DataPoint{Name: "foo.bar", TimeStamp: now.Add(6 * time.Second), Value: 10},
+	})
+	if len(tr.dpCh) != 0 || len(tr.dpsCh) != 0 {
+		t.Fatalf("expected points to be held back")
+	}
+	tr.stopPreAggregator()
+
+	got := make(map[string][]*rrd.DataPoint)
+	for _, dp := range <-tr.dpsCh {
+		got[dp.Name] = append(got[dp.Name], dp)
+	}
+	bar := got["foo.bar"]
+	if len(bar) == 2 && bar[0].TimeStamp.After(bar[1].TimeStamp) {
+		bar[0], bar[1] = bar[1], bar[0]
+	}
+	if len(bar) != 2 || bar[0].Value != 2 || !bar[0].TimeStamp.Equal(now) {
+		t.Errorf("foo.bar: expected the average 2 as of the last point of the step, got %v", bar)
+	} else if bar[1].Value != 10 || !bar[1].TimeStamp.Equal(now.Add(6*time.Second)) {
+		t.Errorf("foo.bar: expected the point of the next step on its own, got %v", bar[1])
+	}
+	if dp := got["foo.baz"]; len(dp) != 1 || dp[0].Value != 7 {
+		t.Errorf("foo.baz: expected 7, got %v", dp)
+	}
+}
+
+func TestParseAggregationRule(t *testing.T) {
+	r, err := ParseAggregationRule("<env>.applications.<app>.all.requests (60) = sum <env>.applications.<app>.*.requests")
+	if err != nil {
+		t.Fatalf("ParseAggregationRule(): %v", err)
+	}
+	for name, expect := range map[string]string{
+		"prod.applications.web.host1.requests":  "prod.applications.web.all.requests",
+		"stage.applications.api.host2.requests": "stage.applications.api.all.requests",
+		"prod.applications.web.host1.errors":    "",
+		"prod.applications.web.a.b.requests":    "",
+	} {
+		if got := r.outputName(name); got != expect {
+			t.Errorf("%q: expected %q, got %q", name, expect, got)
+		}
+	}
+	if r, err = ParseAggregationRule("foo.total = avg foo.*"); err != nil || r.Frequency != time.Minute || r.Method != "avg" {
+		t.Errorf("expected the default frequency, got %+v (%v)", r, err)
+	}
+	for _, bad := range []string{
+		"foo.total",
+		"foo.total (60) = median foo.*",
+		"foo.total (0) = sum foo.*",
+		"foo.total (x) = sum foo.*",
+		"<host>.total = sum foo.*",
+		"foo.total = sum <a>.<a>",
+	} {
+		if _, err := ParseAggregationRule(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	tr := New(nil, nil)
+	sum, _ := ParseAggregationRule("<env>.all.requests (10) = sum <env>.*.requests")
+	avg, _ := ParseAggregationRule("<env>.avg.requests (10) = avg <env>.*.requests")
+	tr.AggregationRules = []*AggregationRule{sum, avg}
+	tr.aggregation = newAggregationBuffer()
+
+	start := time.Unix(1000, 0)
+	tr.QueueDataPoint("prod.a.requests", start.Add(time.Second), 1)
+	tr.QueueDataPoints([]*rrd.DataPoint{
+		&rrd.DataPoint{Name: "prod.b.requests", TimeStamp: start.Add(5 * time.Second), Value: 3},
+		&rrd.DataPoint{Name: "prod.b.requests", TimeStamp: start.Add(10 * time.Second), Value: 10}, // the next interval
+	})
+	if dps := tr.aggregation.drain(start.Add(15 * time.Second)); len(dps) != 0 {
+		t.Errorf("expected nothing before the interval and the wait are over, got %v", dps)
+	}
+	got := make(map[string]float64)
+	for _, dp := range tr.aggregation.drain(start.Add(20 * time.Second)) {
+		if !dp.TimeStamp.Equal(start) {
+			t.Errorf("%s: expected the beginning of the interval, got %v", dp.Name, dp.TimeStamp)
+		}
+		got[dp.Name] = dp.Value
+	}
+	if len(got) != 2 || got["prod.all.requests"] != 4 || got["prod.avg.requests"] != 2 {
+		t.Errorf("expected a sum of 4 and an average of 2, got %v", got)
+	}
+	if dps := tr.aggregation.drain(time.Time{}); len(dps) != 2 || dps[0].Value != 10 {
+		t.Errorf("expected the next interval on a final drain, got %v", dps)
+	}
+}
+
+// storeSerDe records the flushed data sources, creating them
+// according to the spec.
+type storeSerDe struct {
+	flushCheckSerDe
+	specs   map[string]*rrd.DSSpec
+	flushed []*rrd.DataSource
+}
+
+func (f *storeSerDe) CreateOrReturnDataSource(name string, dsSpec *rrd.DSSpec) (*rrd.DataSource, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.specs[name] = dsSpec
+	ds := &rrd.DataSource{Id: 42, Name: name, StepMs: dsSpec.Step.Nanoseconds() / 1000000}
+	for _, r := range dsSpec.RRAs {
+		ds.RRAs = append(ds.RRAs, &rrd.RoundRobinArchive{Id: 43, Cf: r.Function,
+			StepsPerRow: int32(r.Step / dsSpec.Step), Size: int32(r.Size / r.Step), Width: 10})
+	}
+	return ds, nil
+}
+
+func (f *storeSerDe) FlushDataSource(ds *rrd.DataSource) error {
+	f.Lock()
+	defer f.Unlock()
+	f.flushed = append(f.flushed, ds)
+	return nil
+}
+
+func TestSecondaryStore(t *testing.T) {
+	primary := &storeSerDe{specs: make(map[string]*rrd.DSSpec)}
+	secondary := &storeSerDe{specs: make(map[string]*rrd.DSSpec)}
+
+	tr := New(nil, primary)
+	tr.NWorkers = 1
+	tr.SecondaryStore = secondary
+	tr.SecondaryRetention = 100 * time.Minute
+	tr.dirty = []*dirtySet{newDirtySet()}
+	tr.startSecondaryFlusher()
+	tr.startFlushers()
+	tr.startWg.Wait()
+
+	// 10s fine and 1m coarse (10 slots, i.e. 10m)
+	latest := time.Unix(6000, 0)
+	fine := &rrd.RoundRobinArchive{Id: 1, Cf: "AVERAGE", StepsPerRow: 1, Size: 10, Latest: latest, DPs: map[int64]float64{0: 1, 9: 2}}
+	coarse := &rrd.RoundRobinArchive{Id: 2, Cf: "MAX", StepsPerRow: 6, Size: 10, Latest: latest, DPs: map[int64]float64{
+		0: 10, // 6000s, the latest
+		9: 20, // 5940s
+	}}
+	ds := &rrd.DataSource{Id: 1, Name: "foo.bar", StepMs: 10000, HeartbeatMs: 60000, LastUpdate: latest,
+		Secondary: true, RRAs: []*rrd.RoundRobinArchive{fine, coarse}}
+	tr.flushDs(ds, true)
+	tr.flushDs(&rrd.DataSource{Id: 2, Name: "foo.primary.only", StepMs: 10000, RRAs: []*rrd.RoundRobinArchive{
+		&rrd.RoundRobinArchive{Id: 3, StepsPerRow: 6, Size: 10, Latest: latest, DPs: map[int64]float64{0: 1}}}}, true)
+
+	tr.stopFlushers()
+	tr.stopSecondaryFlusher()
+
+	if len(primary.flushed) != 2 || len(primary.flushed[0].RRAs) != 2 || len(primary.flushed[0].RRAs[0].DPs) != 2 {
+		t.Errorf("expected both data sources with all archives in the primary, got %v", primary.flushed)
+	}
+
+	if len(secondary.flushed) != 1 {
+		t.Fatalf("expected only foo.bar in the secondary store, got %v", secondary.flushed)
+	}
+	spec := secondary.specs["foo.bar"]
+	if len(spec.RRAs) != 1 || spec.RRAs[0].Function != "MAX" || spec.RRAs[0].Step != time.Minute || spec.RRAs[0].Size != 100*time.Minute {
+		t.Errorf("expected a 1m:100m MAX archive in the secondary store, got %v", spec.RRAs[0])
+	}
+	srra := secondary.flushed[0].RRAs[0]
+	// 100 slots of a minute: 6000s is slot 0, 5940s is slot 99
+	if len(srra.DPs) != 2 || srra.DPs[0] != 10 || srra.DPs[99] != 20 {
+		t.Errorf("expected the coarse values in slots 99 and 0, got %v", srra.DPs)
+	}
+	if srra.Start != 99 || srra.End != 0 || !srra.Latest.Equal(latest) {
+		t.Errorf("unexpected secondary range %d - %d, latest %v", srra.Start, srra.End, srra.Latest)
+	}
+}
+
+type rraCountFinder int
+
+func (n rraCountFinder) FindMatchingDSSpec(name string) *rrd.DSSpec {
+	spec := &rrd.DSSpec{Step: 10 * time.Second, Heartbeat: time.Hour}
+	for i := 0; i < int(n); i++ {
+		spec.RRAs = append(spec.RRAs, &rrd.RRASpec{Function: "AVERAGE", Step: 10 * time.Second, Size: time.Hour})
+	}
+	return spec
+}
+
+func TestMaxRrasPerDs(t *testing.T) {
+	serde := &storeSerDe{specs: make(map[string]*rrd.DSSpec)}
+	tr := New(nil, serde)
+	tr.MaxRrasPerDs = 8
+	tr.DSSpecs = rraCountFinder(9)
+
+	if err := tr.createOrLoadDS(&rrd.DataPoint{Name: "foo.bar"}); err == nil || !strings.Contains(err.Error(), "max-rras-per-ds") {
+		t.Errorf("expected the 9th RRA to be rejected, got %v", err)
+	}
+	if len(serde.specs) != 0 {
+		t.Errorf("expected no ds to be created, got %v", serde.specs)
+	}
+}
+
+func TestFlushPriority(t *testing.T) {
+	serde := &storeSerDe{specs: make(map[string]*rrd.DSSpec)}
+	tr := New(nil, serde)
+	tr.NWorkers = 1
+	tr.MinCacheDuration = time.Second
+	tr.MaxCacheDuration = time.Minute
+	for _, rule := range []string{"high ^slo\\.", "low ^debug\\."} {
+		r, err := ParseFlushPriorityRule(rule)
+		if err != nil {
+			t.Fatalf("ParseFlushPriorityRule(%q): %v", rule, err)
+		}
+		tr.FlushPriorityRules = append(tr.FlushPriorityRules, r)
+	}
+	if _, err := ParseFlushPriorityRule("urgent ^foo"); err == nil {
+		t.Errorf("expected an error for an invalid priority")
+	}
+	tr.dirty = []*dirtySet{newDirtySet()}
+	if err := tr.dss.Reload(serde); err != nil {
+		t.Fatalf("dss.Reload(): %v", err)
+	}
+
+	// All due, except debug.recent which is low priority and was
+	// flushed 2 minutes ago.
+	recent := make(map[int64]bool)
+	for i, c := range []struct {
+		name    string
+		flushed time.Duration
+	}{
+		{"debug.old", time.Hour},
+		{"foo.old", time.Hour},
+		{"debug.recent", 2 * time.Minute},
+		{"slo.recent", 2 * time.Second},
+		{"foo.recent", 2 * time.Minute},
+	} {
+		rra := &rrd.RoundRobinArchive{StepsPerRow: 1, Size: 10, DPs: map[int64]float64{1: 1}}
+		ds := &rrd.DataSource{Id: int64(i + 1), Name: c.name, LastFlushRT: time.Now().Add(-c.flushed),
+			RRAs: []*rrd.RoundRobinArchive{rra}}
+		tr.dss.Insert(ds)
+		recent[ds.Id] = true
+		tr.dirty[0].add(ds.Id, time.Now().Add(-c.flushed))
+	}
+
+	s := tr.Stats()
+	if s.FlushLagHigh < 1 || s.FlushLagHigh > 3 || s.FlushLagLow < 3599 || s.FlushLagNormal < 3599 {
+		t.Errorf("unexpected flush lag stats %+v", s)
+	}
+
+	// All of them are due in the same periodic check.
+	tr.startFlushers()
+	tr.startWg.Wait()
+	tr.flushRecent(0, recent, make(map[int64]FlushPriority))
+	tr.stopFlushers()
+
+	var names []string
+	for _, ds := range serde.flushed {
+		names = append(names, ds.Name)
+	}
+	if len(names) != 4 || names[0] != "slo.recent" || names[3] != "debug.old" {
+		t.Errorf("expected slo.recent first, debug.old last and no debug.recent, got %v", names)
+	}
+	if !recent[3] || len(recent) != 1 {
+		t.Errorf("expected only debug.recent to remain in recent, got %v", recent)
+	}
+}
+
+// tagSerDe records the tags stored.
+type tagSerDe struct {
+	flushCheckSerDe
+	tags map[int64]map[string]string
+}
+
+func (f *tagSerDe) StoreTags(dsId int64, tags map[string]string) error {
+	f.tags[dsId] = tags
+	return nil
+}
+
+func (f *tagSerDe) FetchTaggedDataSourceNames(tags map[string]string) (map[string]int64, error) {
+	return nil, nil
+}
+
+func TestTaggedName(t *testing.T) {
+	tags := map[string]string{"host": "web01", "dc": "us-east", "path": `a;b=c\d`}
+	name := TaggedName("disk.used", tags)
+	if name != `disk.used;dc=us-east;host=web01;path=a\;b\=c\\d` {
+		t.Errorf("expected tags sorted by key and escaped, got %q", name)
+	}
+	base, parsed, err := ParseTaggedName(name)
+	if err != nil || base != "disk.used" || len(parsed) != 3 || parsed["path"] != tags["path"] {
+		t.Errorf("expected the tags back, got %q %v (%v)", base, parsed, err)
+	}
+	if base, parsed, err := ParseTaggedName("disk.used"); err != nil || base != "disk.used" || parsed != nil {
+		t.Errorf("expected an untagged name with nil tags, got %q %v (%v)", base, parsed, err)
+	}
+	for _, bad := range []string{"disk.used;host", "disk.used;=web01", "disk.used;host="} {
+		if _, _, err := ParseTaggedName(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+
+	sd := &tagSerDe{tags: make(map[int64]map[string]string)}
+	tr := New(nil, sd)
+	tr.storeTags(7, name)
+	tr.storeTags(8, "disk.used")
+	if len(sd.tags) != 1 || sd.tags[7]["host"] != "web01" {
+		t.Errorf("expected the tags of ds 7 only to be stored, got %v", sd.tags)
+	}
+
+	tr.QueueDataPointTagged("disk.used", map[string]string{"host": "web01", "dc": "us-east"}, time.Now(), 1)
+	if dp := <-tr.dpCh; dp.Name != "disk.used;dc=us-east;host=web01" {
+		t.Errorf("expected disk.used;dc=us-east;host=web01, got %q", dp.Name)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	tr := New(nil, nil)
+	if tr.QueueFull() {
+		t.Errorf("expected an empty queue not to be full")
+	}
+	tr.QueueHighWater = 0.5
+	for i := 0; i < cap(tr.dpsCh)/2; i++ {
+		tr.dpsCh <- nil
+	}
+	if !tr.QueueFull() {
+		t.Errorf("expected the queue to be full with half the batches queued")
+	}
+	tr.QueueHighWater = 0
+	if tr.QueueFull() {
+		t.Errorf("expected a QueueHighWater of 0 to never be full")
+	}
+}